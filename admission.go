@@ -0,0 +1,81 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+// Admission decides whether a new key is let into a full cache, see
+// Config.Admission.
+type Admission interface {
+	// Admit reports whether the key, with the given cost, is worth evicting
+	// victims, the items chosen to make room for it. The keys are hashes, as
+	// passed to OnEvict. Admit is called with the lock of the policy held, so
+	// it must be fast and must not call the cache. The partitions of a
+	// PartitionedCache may call it concurrently.
+	Admit(key uint64, cost int64, victims []Victim) bool
+}
+
+// Victim is an item which would be evicted to admit a new key, see Admission.
+type Victim struct {
+	Key  uint64
+	Cost int64
+}
+
+// AdmissionFunc is an Admission implemented by a function.
+type AdmissionFunc func(key uint64, cost int64, victims []Victim) bool
+
+// Admit calls f.
+func (f AdmissionFunc) Admit(key uint64, cost int64, victims []Victim) bool {
+	return f(key, cost, victims)
+}
+
+// admitWith is the add of defaultPolicy with a custom Admission, for a key
+// which doesn't fit in the room left. The victims are chosen as by the
+// default admission, the items of the fewest hits in samples of the cache,
+// until there's room for key, and are only evicted if admission admits it.
+func (p *defaultPolicy[V]) admitWith(admission Admission, key uint64, cost,
+	room int64) ([]*Item[V], bool) {
+	var victims []Victim
+	chosen := make(map[uint64]struct{})
+	sample := make([]*policyPair, 0, lfuSample)
+	for room < 0 {
+		sample = sample[:0]
+		for k, c := range p.evict.keyCosts {
+			if _, ok := chosen[k]; ok {
+				continue
+			}
+			if sample = append(sample, &policyPair{k, c}); len(sample) >= lfuSample {
+				break
+			}
+		}
+		if len(sample) == 0 {
+			break
+		}
+		victim := sample[0]
+		minWeight := p.weigh(victim.key, p.admit.Estimate(victim.key))
+		for _, pair := range sample[1:] {
+			if weight := p.weigh(pair.key, p.admit.Estimate(pair.key)); weight < minWeight {
+				victim, minWeight = pair, weight
+			}
+		}
+		chosen[victim.key] = struct{}{}
+		victims = append(victims, Victim{Key: victim.key, Cost: victim.cost})
+		room += victim.cost
+	}
+
+	if !admission.Admit(key, cost, victims) {
+		p.metrics.add(rejectSets, 1)
+		delete(p.penalties, key)
+		return nil, false
+	}
+	items := make([]*Item[V], 0, len(victims))
+	for _, victim := range victims {
+		p.evictVictim(victim.Key)
+		items = append(items, &Item[V]{Key: victim.Key, Cost: victim.Cost})
+	}
+	p.evict.add(key, cost)
+	p.ghost.del(key)
+	p.metrics.trackAdd(key, cost)
+	return items, true
+}
@@ -0,0 +1,91 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyAdmission(t *testing.T) {
+	p := newDefaultPolicy[int](100, 4)
+	p.CollectMetrics(newMetrics())
+	var admit bool
+	var got []Victim
+	p.admission = AdmissionFunc(func(key uint64, cost int64, victims []Victim) bool {
+		got = victims
+		return admit
+	})
+	for key := uint64(1); key <= 4; key++ {
+		_, added := p.Add(key, 1)
+		require.True(t, added)
+	}
+	for n := 0; n < 5; n++ {
+		p.admit.Increment(1)
+		p.admit.Increment(2)
+		p.admit.Increment(3)
+	}
+	require.Nil(t, got)
+
+	// The victims are chosen, but not evicted, when the key is rejected.
+	victims, added := p.Add(5, 2)
+	require.False(t, added)
+	require.Empty(t, victims)
+	require.Len(t, got, 2)
+	require.Equal(t, int64(4), p.evict.used)
+	require.Equal(t, uint64(1), p.metrics.SetsRejected())
+
+	// A new key is admitted over more frequent ones.
+	admit = true
+	victims, added = p.Add(5, 2)
+	require.True(t, added)
+	require.Len(t, victims, 2)
+	require.Equal(t, int64(2), victims[0].Cost+victims[1].Cost)
+	require.Equal(t, []Victim{{Key: 4, Cost: 1}}, got[:1])
+	require.Equal(t, got[0].Key, victims[0].Key)
+	require.Equal(t, got[1].Key, victims[1].Key)
+	require.True(t, p.Has(5))
+	require.False(t, p.Has(victims[0].Key))
+	require.False(t, p.Has(victims[1].Key))
+	require.Equal(t, int64(4), p.evict.used)
+}
+
+func TestCacheAdmission(t *testing.T) {
+	_, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Policy:      PolicyLIRS,
+		Admission:   AdmissionFunc(func(uint64, int64, []Victim) bool { return true }),
+	})
+	require.Error(t, err)
+
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Admission:          AdmissionFunc(func(uint64, int64, []Victim) bool { return true }),
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	for key := 0; key < 10; key++ {
+		require.True(t, c.Set(key, key, 1))
+	}
+	c.Wait()
+	for n := 0; n < 10; n++ {
+		c.Get(0)
+	}
+	// Every new key is admitted, whatever the hits of the others.
+	for key := 10; key < 20; key++ {
+		require.True(t, c.Set(key, key, 1))
+		c.Wait()
+		val, ok := c.Get(key)
+		require.True(t, ok)
+		require.Equal(t, key, val)
+	}
+}
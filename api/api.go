@@ -0,0 +1,72 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package api defines the interfaces of ristretto caches, for the libraries
+// which accept a cache without depending on the concrete ristretto types,
+// e.g. to be given a *ristretto.Cache, a *ristretto.PartitionedCache or a
+// Noop. These interfaces are kept stable: methods are only added to them in
+// new interfaces.
+package api
+
+import "time"
+
+// Getter reads the values of a cache.
+type Getter[K any, V any] interface {
+	// Get returns the value of key, and whether it was found.
+	Get(key K) (V, bool)
+}
+
+// Setter writes the values of a cache.
+type Setter[K any, V any] interface {
+	// Set adds the value of key with the given cost, or replaces it, and
+	// returns whether it was accepted. Accepted values can still be dropped
+	// by the cache later on.
+	Set(key K, value V, cost int64) bool
+	// Del removes key from the cache.
+	Del(key K)
+}
+
+// Cache is a cache read and written to.
+type Cache[K any, V any] interface {
+	Getter[K, V]
+	Setter[K, V]
+}
+
+// TTLCache is a Cache whose values can expire.
+type TTLCache[K any, V any] interface {
+	Cache[K, V]
+	// SetWithTTL works like Set, with the value expiring after ttl, or never
+	// if ttl is zero.
+	SetWithTTL(key K, value V, cost int64, ttl time.Duration) bool
+	// GetTTL returns the time left before the value of key expires, zero if
+	// it doesn't, and whether it was found.
+	GetTTL(key K) (time.Duration, bool)
+}
+
+// Metrics are the statistics of a cache, like ristretto.Metrics.
+type Metrics interface {
+	// Hits and Misses are the numbers of Gets which found their key or not.
+	Hits() uint64
+	Misses() uint64
+	// Ratio is the ratio of Hits to all the Gets.
+	Ratio() float64
+	// KeysAdded and KeysEvicted are the numbers of keys added and evicted,
+	// CostAdded and CostEvicted the sums of their costs.
+	KeysAdded() uint64
+	KeysEvicted() uint64
+	CostAdded() uint64
+	CostEvicted() uint64
+	// SetsDropped and SetsRejected are the numbers of Sets dropped, and
+	// rejected by the admission policy.
+	SetsDropped() uint64
+	SetsRejected() uint64
+}
+
+// MetricsProvider is a cache which keeps Metrics.
+type MetricsProvider interface {
+	// CacheMetrics returns the Metrics of the cache, which are all zero if
+	// it doesn't collect them.
+	CacheMetrics() Metrics
+}
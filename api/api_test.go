@@ -0,0 +1,84 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package api_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/dgraph-io/ristretto/v2/api"
+	"github.com/stretchr/testify/require"
+)
+
+// The caches which implement the interfaces.
+var (
+	_ api.TTLCache[int, int]  = (*ristretto.Cache[int, int])(nil)
+	_ api.MetricsProvider     = (*ristretto.Cache[int, int])(nil)
+	_ api.TTLCache[int, int]  = (*ristretto.PartitionedCache[int, int])(nil)
+	_ api.MetricsProvider     = (*ristretto.PartitionedCache[int, int])(nil)
+	_ api.TTLCache[int, int]  = api.Noop[int, int]{}
+	_ api.MetricsProvider     = api.Noop[int, int]{}
+	_ api.Metrics             = (*ristretto.Metrics)(nil)
+	_ api.Getter[string, int] = (*ristretto.Cache[string, int])(nil)
+)
+
+func TestCache(t *testing.T) {
+	c, err := ristretto.NewCache(&ristretto.Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	var cache api.TTLCache[int, int] = c
+	require.True(t, cache.SetWithTTL(1, 1, 1, time.Hour))
+	c.Wait()
+	val, ok := cache.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	ttl, ok := cache.GetTTL(1)
+	require.True(t, ok)
+	require.Greater(t, ttl, time.Minute)
+	cache.Del(1)
+	_, ok = cache.Get(1)
+	require.False(t, ok)
+
+	var provider api.MetricsProvider = c
+	require.Equal(t, uint64(1), provider.CacheMetrics().Hits())
+	require.Equal(t, uint64(1), provider.CacheMetrics().Misses())
+	require.Equal(t, uint64(1), provider.CacheMetrics().KeysAdded())
+
+	// The metrics of caches without Metrics are zero.
+	c, err = ristretto.NewCache(&ristretto.Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	c.Get(1)
+	require.Zero(t, c.CacheMetrics().Misses())
+}
+
+func TestNoop(t *testing.T) {
+	var cache api.TTLCache[string, []byte] = api.Noop[string, []byte]{}
+	require.False(t, cache.Set("key", []byte("value"), 1))
+	require.False(t, cache.SetWithTTL("key", []byte("value"), 1, time.Hour))
+	val, ok := cache.Get("key")
+	require.False(t, ok)
+	require.Nil(t, val)
+	_, ok = cache.GetTTL("key")
+	require.False(t, ok)
+	cache.Del("key")
+
+	m := api.Noop[string, []byte]{}.CacheMetrics()
+	require.Zero(t, m.Hits())
+	require.Zero(t, m.Ratio())
+}
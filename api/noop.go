@@ -0,0 +1,41 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package api
+
+import "time"
+
+// Noop is a TTLCache and a MetricsProvider which keeps nothing: its Gets
+// always miss, and its Sets are always dropped. It serves to disable caching
+// where a cache is expected. The zero value is ready to use.
+type Noop[K any, V any] struct{}
+
+func (Noop[K, V]) Get(K) (V, bool) {
+	var zero V
+	return zero, false
+}
+
+func (Noop[K, V]) Set(K, V, int64) bool { return false }
+
+func (Noop[K, V]) Del(K) {}
+
+func (Noop[K, V]) SetWithTTL(K, V, int64, time.Duration) bool { return false }
+
+func (Noop[K, V]) GetTTL(K) (time.Duration, bool) { return 0, false }
+
+func (Noop[K, V]) CacheMetrics() Metrics { return noopMetrics{} }
+
+// noopMetrics are the Metrics of Noop, all zero.
+type noopMetrics struct{}
+
+func (noopMetrics) Hits() uint64         { return 0 }
+func (noopMetrics) Misses() uint64       { return 0 }
+func (noopMetrics) Ratio() float64       { return 0 }
+func (noopMetrics) KeysAdded() uint64    { return 0 }
+func (noopMetrics) KeysEvicted() uint64  { return 0 }
+func (noopMetrics) CostAdded() uint64    { return 0 }
+func (noopMetrics) CostEvicted() uint64  { return 0 }
+func (noopMetrics) SetsDropped() uint64  { return 0 }
+func (noopMetrics) SetsRejected() uint64 { return 0 }
@@ -0,0 +1,272 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"container/list"
+	"sync/atomic"
+)
+
+// arcList identifies the lists of arcPolicy: T1 and T2 hold the entries in the
+// cache, B1 and B2 the ghosts of those evicted from T1 and T2.
+type arcList int
+
+const (
+	arcT1 arcList = iota
+	arcT2
+	arcB1
+	arcB2
+)
+
+type arcEntry struct {
+	key  uint64
+	cost int64
+	list arcList
+	elem *list.Element
+}
+
+func (e *arcEntry) resident() bool {
+	return e.list == arcT1 || e.list == arcT2
+}
+
+// arcPolicy implements the Adaptive Replacement Cache policy [1], weighing
+// entries by cost. New items go to T1, and move to T2 once accessed again, so
+// T1 holds the items seen recently and T2 those seen frequently, both in LRU
+// order. The keys evicted from them are remembered in the ghost lists B1 and
+// B2: a new key found in B1 means T1 should have been larger, and one found in
+// B2 that T2 should have been, so the target cost of T1 is adapted on every
+// ghost hit, balancing recency and frequency for the workload.
+//
+// [1]: https://www.usenix.org/conference/fast-03/arc-self-tuning-low-overhead-replacement-cache
+type arcPolicy[V any] struct {
+	policyBase
+	// NOTE: align maxCost to 64-bit boundary for use with atomic.
+	maxCost int64
+	// target is the cost T1 aims for.
+	target  int64
+	entries map[uint64]*arcEntry
+	// Front is the most recently used entry for all the lists.
+	lists [4]*list.List
+	costs [4]int64
+}
+
+func newARCPolicy[V any](maxCost int64) *arcPolicy[V] {
+	p := &arcPolicy[V]{
+		policyBase: newPolicyBase(),
+		maxCost:    maxCost,
+	}
+	p.clear()
+	go p.processItems(p.access)
+	return p
+}
+
+func (p *arcPolicy[V]) CollectMetrics(metrics *Metrics) {
+	p.metrics = metrics
+}
+
+func (p *arcPolicy[V]) clear() {
+	p.target = 0
+	p.entries = make(map[uint64]*arcEntry)
+	for i := range p.lists {
+		p.lists[i] = list.New()
+		p.costs[i] = 0
+	}
+}
+
+func (p *arcPolicy[V]) used() int64 {
+	return p.costs[arcT1] + p.costs[arcT2]
+}
+
+func (p *arcPolicy[V]) access(keys []uint64) {
+	for _, key := range keys {
+		if e, ok := p.entries[key]; ok && e.resident() {
+			p.move(e, arcT2)
+		}
+	}
+}
+
+// move moves e to the front of to.
+func (p *arcPolicy[V]) move(e *arcEntry, to arcList) {
+	p.remove(e)
+	p.push(e, to)
+}
+
+func (p *arcPolicy[V]) push(e *arcEntry, to arcList) {
+	e.list = to
+	e.elem = p.lists[to].PushFront(e)
+	p.costs[to] += e.cost
+}
+
+func (p *arcPolicy[V]) remove(e *arcEntry) {
+	p.lists[e.list].Remove(e.elem)
+	p.costs[e.list] -= e.cost
+}
+
+// evictOne moves the least recently used entry of T1 to B1 if T1 uses more
+// than its target, or the one of T2 to B2 otherwise. ghostB2 is set when
+// making room for a key found in B2.
+func (p *arcPolicy[V]) evictOne(ghostB2 bool) *Item[V] {
+	t1 := p.lists[arcT1]
+	from, to := arcT2, arcB2
+	if t1.Len() > 0 && (p.costs[arcT1] > p.target ||
+		(ghostB2 && p.costs[arcT1] == p.target) || p.lists[arcT2].Len() == 0) {
+		from, to = arcT1, arcB1
+	}
+	e := p.lists[from].Back().Value.(*arcEntry)
+	p.move(e, to)
+	p.metrics.trackEvict(e.key, e.cost)
+	return &Item[V]{Key: e.key, Cost: e.cost}
+}
+
+// trimGhosts forgets the oldest ghosts, keeping T1 and B1 within MaxCost, and
+// all the lists within twice MaxCost.
+func (p *arcPolicy[V]) trimGhosts() {
+	maxCost := p.MaxCost()
+	for p.costs[arcT1]+p.costs[arcB1] > maxCost && p.lists[arcB1].Len() > 0 {
+		p.forget(p.lists[arcB1].Back().Value.(*arcEntry))
+	}
+	for p.used()+p.costs[arcB1]+p.costs[arcB2] > 2*maxCost && p.lists[arcB2].Len() > 0 {
+		p.forget(p.lists[arcB2].Back().Value.(*arcEntry))
+	}
+}
+
+func (p *arcPolicy[V]) forget(e *arcEntry) {
+	p.remove(e)
+	delete(p.entries, e.key)
+}
+
+func (p *arcPolicy[V]) Add(key uint64, cost int64) ([]*Item[V], bool) {
+	p.Lock()
+	defer p.Unlock()
+	return p.add(key, cost)
+}
+
+func (p *arcPolicy[V]) AddBatch(pairs []policyPair) []addResult[V] {
+	p.Lock()
+	defer p.Unlock()
+	return addBatch(pairs, p.add)
+}
+
+// add is Add, with the lock held.
+func (p *arcPolicy[V]) add(key uint64, cost int64) ([]*Item[V], bool) {
+	maxCost := p.MaxCost()
+	// Cannot add an item bigger than entire cache.
+	if cost > maxCost {
+		return nil, false
+	}
+	// No need to go any further if the item is already in the cache.
+	if p.updateIfHas(key, cost) {
+		return nil, false
+	}
+
+	to := arcT1
+	ghost, ok := p.entries[key]
+	if ok {
+		// The key was evicted too early, grow the list it was evicted from.
+		p.metrics.add(ghostHit, 1)
+		b1, b2 := p.costs[arcB1], p.costs[arcB2]
+		if ghost.list == arcB1 {
+			p.target = min(maxCost, p.target+int64(float64(cost)*arcRatio(b2, b1)))
+		} else {
+			p.target = max(0, p.target-int64(float64(cost)*arcRatio(b1, b2)))
+		}
+		p.forget(ghost)
+		to = arcT2
+	}
+	var victims []*Item[V]
+	for p.used()+cost > maxCost {
+		victims = append(victims, p.evictOne(ok && ghost.list == arcB2))
+	}
+	e := &arcEntry{key: key, cost: cost}
+	p.push(e, to)
+	p.entries[key] = e
+	p.trimGhosts()
+	p.metrics.trackAdd(key, cost)
+	return victims, true
+}
+
+// arcRatio returns how much larger a is than b, at least 1.
+func arcRatio(a, b int64) float64 {
+	if b <= 0 {
+		return 1
+	}
+	return max(1, float64(a)/float64(b))
+}
+
+func (p *arcPolicy[V]) AddIfRoom(key uint64, cost int64) bool {
+	p.Lock()
+	if e, ok := p.entries[key]; (ok && e.resident()) || p.used()+cost > p.MaxCost() {
+		p.Unlock()
+		return false
+	}
+	p.Unlock()
+	_, added := p.Add(key, cost)
+	return added
+}
+
+func (p *arcPolicy[V]) updateIfHas(key uint64, cost int64) bool {
+	e, ok := p.entries[key]
+	if !ok || !e.resident() {
+		return false
+	}
+	p.metrics.trackUpdate(key, e.cost, cost)
+	p.costs[e.list] += cost - e.cost
+	e.cost = cost
+	return true
+}
+
+func (p *arcPolicy[V]) Has(key uint64) bool {
+	p.Lock()
+	defer p.Unlock()
+	e, ok := p.entries[key]
+	return ok && e.resident()
+}
+
+func (p *arcPolicy[V]) Del(key uint64) {
+	p.Lock()
+	defer p.Unlock()
+	e, ok := p.entries[key]
+	if !ok || !e.resident() {
+		return
+	}
+	p.forget(e)
+	p.metrics.trackEvict(key, e.cost)
+}
+
+func (p *arcPolicy[V]) Cap() int64 {
+	p.Lock()
+	defer p.Unlock()
+	return p.MaxCost() - p.used()
+}
+
+func (p *arcPolicy[V]) Update(key uint64, cost int64) {
+	p.Lock()
+	p.updateIfHas(key, cost)
+	p.Unlock()
+}
+
+func (p *arcPolicy[V]) Cost(key uint64) int64 {
+	p.Lock()
+	defer p.Unlock()
+	if e, ok := p.entries[key]; ok && e.resident() {
+		return e.cost
+	}
+	return -1
+}
+
+func (p *arcPolicy[V]) Clear() {
+	p.Lock()
+	p.clear()
+	p.Unlock()
+}
+
+func (p *arcPolicy[V]) MaxCost() int64 {
+	return atomic.LoadInt64(&p.maxCost)
+}
+
+func (p *arcPolicy[V]) UpdateMaxCost(maxCost int64) {
+	atomic.StoreInt64(&p.maxCost, maxCost)
+}
@@ -0,0 +1,122 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestARCPolicy(t *testing.T) {
+	p := newARCPolicy[int](10)
+	defer p.Close()
+	p.CollectMetrics(newMetrics())
+
+	victims, added := p.Add(1, 11)
+	require.Nil(t, victims)
+	require.False(t, added)
+	for i := uint64(1); i <= 10; i++ {
+		victims, added = p.Add(i, 1)
+		require.Nil(t, victims)
+		require.True(t, added)
+	}
+	victims, added = p.Add(1, 1)
+	require.Nil(t, victims)
+	require.False(t, added)
+
+	// 1 and 2 are accessed again, so they move to T2, and 3 is evicted from
+	// T1 into B1.
+	p.itemsCh <- []uint64{1, 2}
+	time.Sleep(wait)
+	victims, added = p.Add(11, 1)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(3), victims[0].Key)
+	require.False(t, p.Has(3))
+	require.Equal(t, int64(-1), p.Cost(3))
+	p.Lock()
+	require.Equal(t, arcT2, p.entries[1].list)
+	require.Equal(t, arcB1, p.entries[3].list)
+	require.Equal(t, int64(0), p.target)
+	p.Unlock()
+
+	// 3 comes back, which grows the target of T1, and goes to T2.
+	_, added = p.Add(3, 1)
+	require.True(t, added)
+	require.Equal(t, uint64(1), p.metrics.GhostHits())
+	p.Lock()
+	require.Equal(t, arcT2, p.entries[3].list)
+	require.Equal(t, int64(1), p.target)
+	require.Equal(t, arcB1, p.entries[4].list)
+	p.Unlock()
+
+	// With a large target for T1, the items are evicted from T2 into B2, and
+	// a hit in B2 shrinks the target.
+	p.Lock()
+	p.target = 10
+	p.Unlock()
+	victims, _ = p.Add(12, 1)
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(1), victims[0].Key)
+	p.Lock()
+	require.Equal(t, arcB2, p.entries[1].list)
+	p.target = 5
+	p.Unlock()
+	victims, _ = p.Add(1, 1)
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(5), victims[0].Key)
+	p.Lock()
+	require.Equal(t, int64(4), p.target)
+	require.Equal(t, arcT2, p.entries[1].list)
+	p.Unlock()
+
+	// The ghosts are forgotten once they'd use more than MaxCost with T1.
+	for i := uint64(13); i <= 20; i++ {
+		p.Add(i, 1)
+	}
+	p.Lock()
+	require.LessOrEqual(t, p.costs[arcT1]+p.costs[arcB1], int64(10))
+	require.LessOrEqual(t, p.costs[arcB1]+p.costs[arcB2]+p.used(), int64(20))
+	require.NotContains(t, p.entries, uint64(4))
+	p.Unlock()
+
+	require.Equal(t, int64(0), p.Cap())
+	require.False(t, p.AddIfRoom(22, 1))
+	p.Del(20)
+	require.True(t, p.AddIfRoom(22, 1))
+	p.Update(22, 2)
+	require.Equal(t, int64(2), p.Cost(22))
+	p.Clear()
+	require.Equal(t, int64(10), p.Cap())
+	require.False(t, p.Has(22))
+}
+
+func TestCacheARCPolicy(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		Metrics:            true,
+		IgnoreInternalCost: true,
+		Policy:             PolicyARC,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 20; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	require.Equal(t, uint64(20), c.Metrics.KeysAdded())
+	require.Equal(t, uint64(10), c.Metrics.KeysEvicted())
+	val, ok := c.Get(19)
+	require.True(t, ok)
+	require.Equal(t, 19, val)
+	_, ok = c.Get(9)
+	require.False(t, ok)
+}
@@ -0,0 +1,195 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package harness
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// curveBatch is the number of keys SizeCurve reads before replaying them
+// against all the caches.
+const curveBatch = 4096
+
+// CurveSpec describes a cache size sensitivity analysis: the same key stream
+// replayed against caches of several sizes, like Spec for a single cache.
+type CurveSpec[K any, V any] struct {
+	// Name identifies the workload in reports.
+	Name string
+	// Keys generates the key stream, e.g. a sim.Simulator reading a recorded
+	// trace. It's read once, in batches fed to all the caches, so the stream
+	// doesn't have to fit in memory. Reading stops early if Keys returns an
+	// error.
+	Keys func() (K, error)
+	// Ops is the number of keys to draw from Keys. If zero, they are drawn
+	// until Keys returns an error.
+	Ops int
+	// Value and Cost work like in Spec.
+	Value func(key K) V
+	Cost  func(value V) int64
+	// MaxCosts are the sizes of the caches, see SizeRange.
+	MaxCosts []int64
+}
+
+// CurvePoint is the result of the cache of one size of a CurveSpec.
+type CurvePoint struct {
+	MaxCost int64 `json:"max_cost"`
+	Result
+}
+
+// SizeCurve replays the key stream of spec against a cache of every size of
+// spec.MaxCosts, made by newCache, and returns their results, by increasing
+// size. This gives the hit ratio as a function of the size of the cache, to
+// tell how much memory buys how many hits. The caches replay the keys
+// concurrently, each from its own goroutine, like a Spec with a Concurrency
+// of 1. Caches which apply their Sets asynchronously, like *ristretto.Cache,
+// should wait for them in Set, else their hit ratios depend on how fast they
+// are replayed. The caches with a Close method, like *ristretto.Cache or an
+// io.Closer, are closed once replayed, or if SizeCurve fails.
+func SizeCurve[K any, V any](newCache func(maxCost int64) (Cache[K, V], error),
+	spec CurveSpec[K, V]) ([]CurvePoint, error) {
+	if newCache == nil {
+		return nil, errors.New("harness: nil newCache")
+	}
+	if spec.Keys == nil {
+		return nil, errors.New("harness: CurveSpec.Keys can't be nil")
+	}
+	if len(spec.MaxCosts) == 0 {
+		return nil, errors.New("harness: CurveSpec.MaxCosts can't be empty")
+	}
+	maxCosts := append([]int64(nil), spec.MaxCosts...)
+	sort.Slice(maxCosts, func(i, j int) bool { return maxCosts[i] < maxCosts[j] })
+	points := make([]CurvePoint, len(maxCosts))
+	caches := make([]Cache[K, V], len(maxCosts))
+	defer func() {
+		for _, cache := range caches {
+			closeCache(cache)
+		}
+	}()
+	for i, maxCost := range maxCosts {
+		cache, err := newCache(maxCost)
+		if err != nil {
+			return nil, fmt.Errorf("harness: creating the cache of size %d: %w", maxCost, err)
+		}
+		if cache == nil {
+			return nil, errors.New("harness: nil cache")
+		}
+		caches[i] = cache
+		points[i] = CurvePoint{
+			MaxCost: maxCost,
+			Result:  Result{Name: fmt.Sprintf("%s/%d", spec.Name, maxCost)},
+		}
+	}
+
+	replay := func(cache Cache[K, V], res *Result, keys []K) {
+		start := time.Now()
+		for _, key := range keys {
+			if _, ok := cache.Get(key); ok {
+				res.Hits++
+				continue
+			}
+			res.Misses++
+			var value V
+			if spec.Value != nil {
+				value = spec.Value(key)
+			}
+			cost := int64(1)
+			if spec.Cost != nil {
+				cost = spec.Cost(value)
+			}
+			if !cache.Set(key, value, cost) {
+				res.SetsDropped++
+			}
+		}
+		res.Ops += int64(len(keys))
+		res.Duration += time.Since(start)
+	}
+
+	var ops int
+	batch := make([]K, 0, curveBatch)
+	for done := false; !done; {
+		batch = batch[:0]
+		for len(batch) < curveBatch && (spec.Ops == 0 || ops < spec.Ops) {
+			key, err := spec.Keys()
+			if err != nil {
+				done = true
+				break
+			}
+			batch = append(batch, key)
+			ops++
+		}
+		if spec.Ops > 0 && ops == spec.Ops {
+			done = true
+		}
+		var wg sync.WaitGroup
+		for i := range caches {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				replay(caches[i], &points[i].Result, batch)
+			}(i)
+		}
+		wg.Wait()
+	}
+	return points, nil
+}
+
+// closeCache closes cache if it has a Close method, ignoring the error of an
+// io.Closer, as the results don't depend on it.
+func closeCache(cache any) {
+	switch c := cache.(type) {
+	case interface{ Close() }:
+		c.Close()
+	case io.Closer:
+		c.Close()
+	}
+}
+
+// SizeRange returns n sizes from lo to hi, included, spaced geometrically, so
+// that the small sizes, where the hit ratio usually changes the most, are
+// sampled more densely. The sizes are rounded, and the duplicates removed.
+func SizeRange(lo, hi int64, n int) []int64 {
+	if lo <= 0 || hi < lo || n <= 0 {
+		return nil
+	}
+	if n == 1 || lo == hi {
+		return []int64{lo}
+	}
+	ratio := math.Pow(float64(hi)/float64(lo), 1/float64(n-1))
+	sizes := make([]int64, 0, n)
+	for i := 0; i < n; i++ {
+		size := int64(math.Round(float64(lo) * math.Pow(ratio, float64(i))))
+		if i == n-1 {
+			size = hi
+		}
+		if len(sizes) == 0 || size > sizes[len(sizes)-1] {
+			sizes = append(sizes, size)
+		}
+	}
+	return sizes
+}
+
+// WriteCurve writes points to w as an aligned table, with the share of the
+// hits gained over the previous size, the marginal benefit of growing the
+// cache.
+func WriteCurve(w io.Writer, points []CurvePoint) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "max-cost\tops\thit-ratio\tgain\tsets-dropped")
+	prev := 0.0
+	for _, p := range points {
+		ratio := p.HitRatio()
+		fmt.Fprintf(tw, "%d\t%d\t%.4f\t%+.4f\t%d\n",
+			p.MaxCost, p.Ops, ratio, ratio-prev, p.SetsDropped)
+		prev = ratio
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,163 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package harness
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/dgraph-io/ristretto/v2/sim"
+	"github.com/stretchr/testify/require"
+)
+
+// fifoCache holds up to size keys, evicting the oldest ones.
+type fifoCache struct {
+	size  int
+	order []int
+	m     map[int]bool
+}
+
+func (c *fifoCache) Get(key int) (int, bool) {
+	return key, c.m[key]
+}
+
+func (c *fifoCache) Set(key, value int, cost int64) bool {
+	if len(c.order) == c.size {
+		delete(c.m, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.order = append(c.order, key)
+	c.m[key] = true
+	return true
+}
+
+func TestSizeCurve(t *testing.T) {
+	// Loops over 10 keys, which only hit once they all fit.
+	i := 0
+	points, err := SizeCurve(func(maxCost int64) (Cache[int, int], error) {
+		return &fifoCache{size: int(maxCost), m: make(map[int]bool)}, nil
+	}, CurveSpec[int, int]{
+		Name: "loop",
+		Keys: func() (int, error) {
+			i++
+			return i % 10, nil
+		},
+		Ops:      10000,
+		MaxCosts: []int64{20, 5, 10, 9},
+	})
+	require.NoError(t, err)
+	require.Len(t, points, 4)
+	for n, maxCost := range []int64{5, 9, 10, 20} {
+		require.Equal(t, maxCost, points[n].MaxCost)
+		require.Equal(t, int64(10000), points[n].Ops)
+	}
+	require.Zero(t, points[1].Hits)
+	require.Equal(t, int64(9990), points[2].Hits)
+	require.Equal(t, points[2].Hits, points[3].Hits)
+	require.Equal(t, "loop/10", points[2].Name)
+	require.Equal(t, 10000, i, "the keys are read once")
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteCurve(&buf, points))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 5)
+	require.Contains(t, lines[3], "+0.9990")
+}
+
+// closingCache is a fifoCache which counts the calls to Close.
+type closingCache struct {
+	fifoCache
+	closes *int
+}
+
+func (c *closingCache) Close() error {
+	*c.closes++
+	return nil
+}
+
+func TestSizeCurveClose(t *testing.T) {
+	closes := 0
+	errCache := errors.New("no cache")
+	newCache := func(fail int64) func(int64) (Cache[int, int], error) {
+		return func(maxCost int64) (Cache[int, int], error) {
+			if maxCost == fail {
+				return nil, errCache
+			}
+			return &closingCache{fifoCache{size: int(maxCost), m: make(map[int]bool)}, &closes}, nil
+		}
+	}
+	keys := func() (int, error) { return 1, nil }
+
+	_, err := SizeCurve(newCache(3), CurveSpec[int, int]{Keys: keys, Ops: 10,
+		MaxCosts: []int64{1, 2, 3, 4}})
+	require.ErrorIs(t, err, errCache)
+	require.Equal(t, 2, closes, "the caches built before the error are closed")
+
+	closes = 0
+	_, err = SizeCurve(newCache(0), CurveSpec[int, int]{Keys: keys, Ops: 10,
+		MaxCosts: []int64{1, 2, 3, 4}})
+	require.NoError(t, err)
+	require.Equal(t, 4, closes, "the caches are closed once replayed")
+}
+
+func TestSizeCurveRistretto(t *testing.T) {
+	sizes := SizeRange(100, 10000, 5)
+	points, err := SizeCurve(func(maxCost int64) (Cache[uint64, uint64], error) {
+		c, err := ristretto.NewCache(&ristretto.Config[uint64, uint64]{
+			NumCounters:        maxCost * 10,
+			MaxCost:            maxCost,
+			BufferItems:        64,
+			IgnoreInternalCost: true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return syncCache{c}, nil
+	}, CurveSpec[uint64, uint64]{
+		Name:     "zipf",
+		Keys:     sim.NewZipfian(1.0001, 1, 1e5),
+		Ops:      1e5,
+		MaxCosts: sizes,
+	})
+	require.NoError(t, err)
+	require.Len(t, points, len(sizes))
+	for n := 1; n < len(points); n++ {
+		require.Greater(t, points[n].HitRatio(), points[n-1].HitRatio())
+	}
+}
+
+func TestSizeCurveInvalid(t *testing.T) {
+	newCache := func(maxCost int64) (Cache[string, int], error) {
+		return &mapCache{m: make(map[string]int)}, nil
+	}
+	keys := func() (string, error) { return "", errors.New("done") }
+	_, err := SizeCurve(nil, CurveSpec[string, int]{Keys: keys, MaxCosts: []int64{1}})
+	require.Error(t, err)
+	_, err = SizeCurve(newCache, CurveSpec[string, int]{MaxCosts: []int64{1}})
+	require.Error(t, err)
+	_, err = SizeCurve(newCache, CurveSpec[string, int]{Keys: keys})
+	require.Error(t, err)
+	errCache := errors.New("no cache")
+	_, err = SizeCurve(func(int64) (Cache[string, int], error) { return nil, errCache },
+		CurveSpec[string, int]{Keys: keys, MaxCosts: []int64{1}})
+	require.ErrorIs(t, err, errCache)
+
+	// Without Ops, the keys are read until Keys fails.
+	points, err := SizeCurve(newCache, CurveSpec[string, int]{Keys: keys, MaxCosts: []int64{1}})
+	require.NoError(t, err)
+	require.Zero(t, points[0].Ops)
+}
+
+func TestSizeRange(t *testing.T) {
+	require.Equal(t, []int64{1, 10, 100, 1000}, SizeRange(1, 1000, 4))
+	require.Equal(t, []int64{1, 2, 3}, SizeRange(1, 3, 10))
+	require.Equal(t, []int64{5}, SizeRange(5, 100, 1))
+	require.Nil(t, SizeRange(0, 10, 3))
+	require.Nil(t, SizeRange(10, 5, 3))
+}
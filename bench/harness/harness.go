@@ -0,0 +1,167 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package harness runs cache workloads and reports hit ratios and throughput.
+// It only depends on a small Cache interface, so downstream projects can
+// benchmark their own cache wrappers (with their codecs and key types) using
+// the same machinery used for Ristretto.
+package harness
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// Cache is the subset of a cache API exercised by RunWorkload. *ristretto.Cache
+// satisfies it.
+type Cache[K any, V any] interface {
+	Get(key K) (V, bool)
+	Set(key K, value V, cost int64) bool
+}
+
+// Spec describes a read-through workload: every key is looked up with Get and,
+// on a miss, inserted with Set.
+type Spec[K any, V any] struct {
+	// Name identifies the workload in reports.
+	Name string
+	// Keys generates the key stream, e.g. a sim.Simulator for uint64 keys. The
+	// stream is fully generated before the run starts, so its cost isn't part
+	// of the measurements. Generation stops early if Keys returns an error.
+	Keys func() (K, error)
+	// Ops is the number of keys to draw from Keys.
+	Ops int
+	// Value returns the value to Set for a key that missed. If nil, the zero
+	// value is used.
+	Value func(key K) V
+	// Cost returns the cost to Set for a value. If nil, every value costs 1.
+	Cost func(value V) int64
+	// Concurrency is the number of goroutines issuing operations. The key
+	// stream is split evenly between them. If zero, 1 is used.
+	Concurrency int
+}
+
+// Result holds the outcome of a run of a workload.
+type Result struct {
+	Name        string        `json:"name"`
+	Ops         int64         `json:"ops"`
+	Hits        int64         `json:"hits"`
+	Misses      int64         `json:"misses"`
+	SetsDropped int64         `json:"sets_dropped"`
+	Duration    time.Duration `json:"duration_ns"`
+	// Expired and Refreshes are the numbers of keys expired and refreshed by
+	// ReplayTrace.
+	Expired   int64 `json:"expired,omitempty"`
+	Refreshes int64 `json:"refreshes,omitempty"`
+}
+
+// HitRatio is the number of hits over all Gets.
+func (r Result) HitRatio() float64 {
+	if r.Hits+r.Misses == 0 {
+		return 0
+	}
+	return float64(r.Hits) / float64(r.Hits+r.Misses)
+}
+
+// OpsPerSec is the number of Gets issued per second.
+func (r Result) OpsPerSec() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Ops) / r.Duration.Seconds()
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("%s: ops: %d hit-ratio: %.4f ops/sec: %.0f sets-dropped: %d",
+		r.Name, r.Ops, r.HitRatio(), r.OpsPerSec(), r.SetsDropped)
+}
+
+// RunWorkload generates the key stream of spec and replays it against cache.
+func RunWorkload[K any, V any](cache Cache[K, V], spec Spec[K, V]) (Result, error) {
+	if cache == nil {
+		return Result{}, errors.New("harness: nil cache")
+	}
+	if spec.Keys == nil {
+		return Result{}, errors.New("harness: Spec.Keys can't be nil")
+	}
+	workers := spec.Concurrency
+	if workers <= 0 {
+		workers = 1
+	}
+	keys := make([]K, 0, spec.Ops)
+	for len(keys) < spec.Ops {
+		key, err := spec.Keys()
+		if err != nil {
+			break
+		}
+		keys = append(keys, key)
+	}
+
+	var hits, misses, dropped int64
+	run := func(keys []K) {
+		var h, m, d int64
+		for _, key := range keys {
+			if _, ok := cache.Get(key); ok {
+				h++
+				continue
+			}
+			m++
+			var value V
+			if spec.Value != nil {
+				value = spec.Value(key)
+			}
+			cost := int64(1)
+			if spec.Cost != nil {
+				cost = spec.Cost(value)
+			}
+			if !cache.Set(key, value, cost) {
+				d++
+			}
+		}
+		atomic.AddInt64(&hits, h)
+		atomic.AddInt64(&misses, m)
+		atomic.AddInt64(&dropped, d)
+	}
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	chunk := (len(keys) + workers - 1) / workers
+	for lo := 0; lo < len(keys); lo += chunk {
+		hi := lo + chunk
+		if hi > len(keys) {
+			hi = len(keys)
+		}
+		wg.Add(1)
+		go func(keys []K) {
+			defer wg.Done()
+			run(keys)
+		}(keys[lo:hi])
+	}
+	wg.Wait()
+
+	return Result{
+		Name:        spec.Name,
+		Ops:         int64(len(keys)),
+		Hits:        hits,
+		Misses:      misses,
+		SetsDropped: dropped,
+		Duration:    time.Since(start),
+	}, nil
+}
+
+// WriteReport writes results to w as an aligned table.
+func WriteReport(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "name\tops\thit-ratio\tops/sec\tsets-dropped")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%.4f\t%.0f\t%d\n",
+			r.Name, r.Ops, r.HitRatio(), r.OpsPerSec(), r.SetsDropped)
+	}
+	return tw.Flush()
+}
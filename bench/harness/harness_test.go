@@ -0,0 +1,168 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package harness
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/dgraph-io/ristretto/v2/sim"
+	"github.com/stretchr/testify/require"
+)
+
+// mapCache is an unbounded cache, so every key only misses once.
+type mapCache struct {
+	sync.Mutex
+	m map[string]int
+}
+
+func (c *mapCache) Get(key string) (int, bool) {
+	c.Lock()
+	defer c.Unlock()
+	v, ok := c.m[key]
+	return v, ok
+}
+
+func (c *mapCache) Set(key string, value int, cost int64) bool {
+	c.Lock()
+	defer c.Unlock()
+	c.m[key] = value
+	return true
+}
+
+func TestRunWorkload(t *testing.T) {
+	keys := []string{"a", "b", "a", "c", "a", "b"}
+	i := 0
+	res, err := RunWorkload[string, int](&mapCache{m: make(map[string]int)}, Spec[string, int]{
+		Name: "map",
+		Keys: func() (string, error) {
+			if i == len(keys) {
+				return "", errors.New("done")
+			}
+			i++
+			return keys[i-1], nil
+		},
+		Ops: 100,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "map", res.Name)
+	require.Equal(t, int64(6), res.Ops)
+	require.Equal(t, int64(3), res.Hits)
+	require.Equal(t, int64(3), res.Misses)
+	require.Equal(t, 0.5, res.HitRatio())
+	require.True(t, strings.HasPrefix(res.String(), "map: ops: 6 hit-ratio: 0.5000"))
+}
+
+func TestRunWorkloadRistretto(t *testing.T) {
+	c, err := ristretto.NewCache(&ristretto.Config[uint64, uint64]{
+		NumCounters: 1e4,
+		MaxCost:     1e3,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	res, err := RunWorkload[uint64, uint64](c, Spec[uint64, uint64]{
+		Name:        "zipf",
+		Keys:        sim.NewZipfian(1.0001, 1, 1e5),
+		Ops:         1e5,
+		Value:       func(key uint64) uint64 { return key },
+		Concurrency: 4,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(1e5), res.Ops)
+	require.Equal(t, res.Ops, res.Hits+res.Misses)
+	require.Greater(t, res.HitRatio(), 0.0)
+	require.Greater(t, res.OpsPerSec(), 0.0)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteReport(&buf, []Result{res}))
+	require.Contains(t, buf.String(), "zipf")
+}
+
+func TestRunWorkloadInvalid(t *testing.T) {
+	_, err := RunWorkload[string, int](nil, Spec[string, int]{})
+	require.Error(t, err)
+	_, err = RunWorkload[string, int](&mapCache{}, Spec[string, int]{})
+	require.Error(t, err)
+}
+
+// syncCache waits for every Set to be applied, so that hit ratios only depend
+// on the policy and not on how fast the Sets are processed.
+type syncCache struct {
+	*ristretto.Cache[uint64, uint64]
+}
+
+func (c syncCache) Set(key, value uint64, cost int64) bool {
+	ok := c.Cache.Set(key, value, cost)
+	c.Wait()
+	return ok
+}
+
+// TestComparePolicies runs the same workloads against every policy and logs the
+// results, run it with -v to see them.
+func TestComparePolicies(t *testing.T) {
+	f, err := os.Open("../../sim/gli.lirs.gz")
+	require.NoError(t, err)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	trace := sim.Collection(sim.NewReader(sim.ParseLIRS, r), 1e5)
+
+	workloads := []struct {
+		name    string
+		maxCost int64
+		keys    func() sim.Simulator
+	}{
+		{"zipf", 1e3, func() sim.Simulator { return sim.NewZipfian(1.0001, 1, 1e5) }},
+		{"gli", 1e3, func() sim.Simulator {
+			i := 0
+			return func() (uint64, error) {
+				if i == len(trace) {
+					return 0, errors.New("done")
+				}
+				i++
+				return trace[i-1], nil
+			}
+		}},
+	}
+	var results []Result
+	for _, w := range workloads {
+		for _, policy := range []string{
+			ristretto.PolicyTinyLFU, ristretto.PolicyLIRS, ristretto.PolicyS3FIFO,
+			ristretto.PolicyLRU, ristretto.PolicySLRU, ristretto.PolicyARC,
+			ristretto.PolicyWTinyLFU,
+		} {
+			c, err := ristretto.NewCache(&ristretto.Config[uint64, uint64]{
+				NumCounters:        w.maxCost * 10,
+				MaxCost:            w.maxCost,
+				BufferItems:        64,
+				IgnoreInternalCost: true,
+				Policy:             policy,
+			})
+			require.NoError(t, err)
+			res, err := RunWorkload[uint64, uint64](syncCache{c}, Spec[uint64, uint64]{
+				Name: w.name + "/" + policy,
+				Keys: w.keys(),
+				Ops:  1e5,
+			})
+			c.Close()
+			require.NoError(t, err)
+			require.Greater(t, res.HitRatio(), 0.0)
+			results = append(results, res)
+		}
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteReport(&buf, results))
+	t.Log("\n" + buf.String())
+}
@@ -0,0 +1,145 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package harness
+
+import (
+	"container/heap"
+	"errors"
+	"time"
+)
+
+// Deleter is implemented by the caches which can delete keys, like
+// *ristretto.Cache. ReplayTrace needs it to expire the keys.
+type Deleter[K any] interface {
+	Del(key K)
+}
+
+// TimedSpec describes a read-through workload replayed with a simulated
+// clock, which follows the times of the events of a trace instead of the wall
+// clock. Time-dependent behaviors like expiration are applied by the harness on
+// that clock, so every cache sees them at the same point of the trace, however
+// fast it replays it.
+type TimedSpec[K comparable, V any] struct {
+	// Name identifies the workload in reports.
+	Name string
+	// Events returns the keys of the trace, along with their times relative to
+	// the start of the trace, which can't decrease. The events are all read
+	// before the run starts. Reading stops early if Events returns an error.
+	Events func() (K, time.Duration, error)
+	// Ops is the number of events to read from Events.
+	Ops int
+	// Value and Cost work like in Spec.
+	Value func(key K) V
+	Cost  func(value V) int64
+	// TTL, if positive, makes the keys expire TTL after they were Set: they
+	// are deleted from the cache as soon as the clock passes their expiration,
+	// which requires the cache to implement Deleter.
+	TTL time.Duration
+	// RefreshAfter, if positive, makes the hits on keys Set at least
+	// RefreshAfter ago Set them again, like a refresh-after-write loader would.
+	// This also restarts their TTL.
+	RefreshAfter time.Duration
+}
+
+// expiration is a key to delete at some time of the trace.
+type expiration[K comparable] struct {
+	at  time.Duration
+	key K
+}
+
+// expirationHeap orders the expirations by time.
+type expirationHeap[K comparable] []expiration[K]
+
+func (h expirationHeap[K]) Len() int           { return len(h) }
+func (h expirationHeap[K]) Less(i, j int) bool { return h[i].at < h[j].at }
+func (h expirationHeap[K]) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expirationHeap[K]) Push(x any)        { *h = append(*h, x.(expiration[K])) }
+func (h *expirationHeap[K]) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// ReplayTrace reads the events of spec and replays them against cache, in
+// order and from a single goroutine, advancing the simulated clock to the time
+// of every event before issuing it. Result.Duration is the wall time of the
+// replay, not the simulated one.
+func ReplayTrace[K comparable, V any](cache Cache[K, V], spec TimedSpec[K, V]) (Result, error) {
+	if cache == nil {
+		return Result{}, errors.New("harness: nil cache")
+	}
+	if spec.Events == nil {
+		return Result{}, errors.New("harness: TimedSpec.Events can't be nil")
+	}
+	deleter, ok := cache.(Deleter[K])
+	if spec.TTL > 0 && !ok {
+		return Result{}, errors.New("harness: TimedSpec.TTL needs a cache implementing Deleter")
+	}
+	type event struct {
+		key K
+		at  time.Duration
+	}
+	events := make([]event, 0, spec.Ops)
+	for len(events) < spec.Ops {
+		key, at, err := spec.Events()
+		if err != nil {
+			break
+		}
+		if len(events) > 0 && at < events[len(events)-1].at {
+			return Result{}, errors.New("harness: the times of the events can't decrease")
+		}
+		events = append(events, event{key: key, at: at})
+	}
+
+	res := Result{Name: spec.Name, Ops: int64(len(events))}
+	// written holds when the keys were last Set, to tell the expirations of the
+	// keys Set again since from the current ones.
+	written := make(map[K]time.Duration)
+	var expirations expirationHeap[K]
+	set := func(key K, now time.Duration) {
+		var value V
+		if spec.Value != nil {
+			value = spec.Value(key)
+		}
+		cost := int64(1)
+		if spec.Cost != nil {
+			cost = spec.Cost(value)
+		}
+		if !cache.Set(key, value, cost) {
+			res.SetsDropped++
+			return
+		}
+		written[key] = now
+		if spec.TTL > 0 {
+			heap.Push(&expirations, expiration[K]{at: now + spec.TTL, key: key})
+		}
+	}
+
+	start := time.Now()
+	for _, e := range events {
+		for len(expirations) > 0 && expirations[0].at <= e.at {
+			exp := heap.Pop(&expirations).(expiration[K])
+			if at, ok := written[exp.key]; ok && at+spec.TTL == exp.at {
+				deleter.Del(exp.key)
+				delete(written, exp.key)
+				res.Expired++
+			}
+		}
+		if _, ok := cache.Get(e.key); !ok {
+			res.Misses++
+			set(e.key, e.at)
+			continue
+		}
+		res.Hits++
+		if at, ok := written[e.key]; ok && spec.RefreshAfter > 0 && e.at-at >= spec.RefreshAfter {
+			res.Refreshes++
+			set(e.key, e.at)
+		}
+	}
+	res.Duration = time.Since(start)
+	return res, nil
+}
@@ -0,0 +1,125 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package harness
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/dgraph-io/ristretto/v2/sim"
+	"github.com/stretchr/testify/require"
+)
+
+// delMapCache is a mapCache which can delete keys.
+type delMapCache struct {
+	mapCache
+}
+
+func (c *delMapCache) Del(key string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.m, key)
+}
+
+// events returns a TimedSpec.Events function for the events, each one being a
+// key and a time in seconds.
+func events(evs ...any) func() (string, time.Duration, error) {
+	i := 0
+	return func() (string, time.Duration, error) {
+		if i == len(evs) {
+			return "", 0, errors.New("done")
+		}
+		i += 2
+		return evs[i-2].(string), time.Duration(evs[i-1].(int)) * time.Second, nil
+	}
+}
+
+func TestReplayTraceTTL(t *testing.T) {
+	c := &delMapCache{mapCache{m: make(map[string]int)}}
+	res, err := ReplayTrace[string, int](c, TimedSpec[string, int]{
+		Name:   "ttl",
+		Events: events("a", 0, "a", 5, "a", 10, "b", 11, "a", 15, "a", 30),
+		Ops:    100,
+		TTL:    10 * time.Second,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(6), res.Ops)
+	require.Equal(t, int64(2), res.Hits)
+	require.Equal(t, int64(4), res.Misses)
+	require.Equal(t, int64(3), res.Expired)
+	require.Zero(t, res.Refreshes)
+	require.Len(t, c.m, 1)
+}
+
+func TestReplayTraceRefreshAfter(t *testing.T) {
+	c := &delMapCache{mapCache{m: make(map[string]int)}}
+	res, err := ReplayTrace[string, int](c, TimedSpec[string, int]{
+		Events:       events("a", 0, "a", 6, "a", 12, "a", 40),
+		Ops:          100,
+		TTL:          10 * time.Second,
+		RefreshAfter: 5 * time.Second,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), res.Hits)
+	require.Equal(t, int64(2), res.Misses)
+	// The refreshes restart the TTL, so a only expires after the last one.
+	require.Equal(t, int64(2), res.Refreshes)
+	require.Equal(t, int64(1), res.Expired)
+}
+
+func TestReplayTraceInvalid(t *testing.T) {
+	_, err := ReplayTrace[string, int](nil, TimedSpec[string, int]{})
+	require.Error(t, err)
+	_, err = ReplayTrace[string, int](&mapCache{}, TimedSpec[string, int]{})
+	require.Error(t, err)
+	_, err = ReplayTrace[string, int](&mapCache{}, TimedSpec[string, int]{
+		Events: events("a", 0),
+		Ops:    1,
+		TTL:    time.Second,
+	})
+	require.EqualError(t, err, "harness: TimedSpec.TTL needs a cache implementing Deleter")
+	_, err = ReplayTrace[string, int](&mapCache{m: make(map[string]int)}, TimedSpec[string, int]{
+		Events: events("a", 1, "b", 0),
+		Ops:    2,
+	})
+	require.EqualError(t, err, "harness: the times of the events can't decrease")
+}
+
+func TestReplayTraceRistretto(t *testing.T) {
+	c, err := ristretto.NewCache(&ristretto.Config[uint64, uint64]{
+		NumCounters:        1e3,
+		MaxCost:            1e2,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	var trace strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&trace, "%d %d\n", i, i%10)
+	}
+	r := sim.NewTimedReader(strings.NewReader(trace.String()))
+	res, err := ReplayTrace[uint64, uint64](syncCache{c}, TimedSpec[uint64, uint64]{
+		Name: "timed",
+		Events: func() (uint64, time.Duration, error) {
+			e, err := r()
+			return e.Key, e.Time, err
+		},
+		Ops: 1000,
+		TTL: 30 * time.Second,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), res.Ops)
+	// Every key is accessed every 10s, and expires every 30s after it's Set,
+	// so one access out of 3 misses. The last expirations aren't reached.
+	require.Equal(t, int64(340), res.Misses)
+	require.Equal(t, int64(330), res.Expired)
+}
@@ -10,13 +10,17 @@ package ristretto
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"maps"
 	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
 
+	"github.com/dgraph-io/ristretto/v2/api"
 	"github.com/dgraph-io/ristretto/v2/z"
 )
 
@@ -27,6 +31,16 @@ var (
 
 const itemSize = int64(unsafe.Sizeof(storeItem[any]{}))
 
+const (
+	// setBatchSize is the max number of items processItems takes from setBuf
+	// at once. The new items of a batch are admitted by the policy with a
+	// single acquisition of its lock.
+	setBatchSize = 256
+	// setBatchWait bounds the time spent by processItems filling a batch, so
+	// that the first items of a batch aren't held back for long.
+	setBatchWait = 100 * time.Microsecond
+)
+
 func zeroValue[T any]() T {
 	var zero T
 	return zero
@@ -39,22 +53,62 @@ type Key = z.Key
 // policy and a Sampled LFU eviction policy. You can use the same Cache instance
 // from as many goroutines as you want.
 type Cache[K Key, V any] struct {
+	// name is Config.Name, used to label the internal goroutines.
+	name string
 	// storedItems is the central concurrent hashmap where key-value items are stored.
 	storedItems store[V]
 	// cachePolicy determines what gets let in to the cache and what gets kicked out.
-	cachePolicy *defaultPolicy[V]
+	cachePolicy policy[V]
+	// idle tracks the last access time of the items if Config.TrackIdleTime is
+	// set, it's nil otherwise.
+	idle *idleTracker
+	// topKeys tracks the keys read the most if Config.TopKeys is set, it's
+	// nil otherwise.
+	topKeys *topKeys[K]
+	// maxIdleTime is Config.MaxIdleTime.
+	maxIdleTime time.Duration
+	// defaultTTL and maxTTL are Config.DefaultTTL and Config.MaxTTL.
+	defaultTTL, maxTTL time.Duration
+	// ttlGroup is Config.TTLGroup, ttlPolicies a copy of Config.TTLPolicies.
+	ttlGroup    func(key K, value V) string
+	ttlPolicies map[string]TTLPolicy
+	// slidingTTL is Config.SlidingTTL. sliding is set once there may be
+	// sliding items, for Get to extend their expirations.
+	slidingTTL bool
+	sliding    atomic.Bool
+	// fetchCosts is set once there may be items with a fetch cost, for Get to
+	// count the fetch time saved. fetchTotal and fetchCount sum up the fetch
+	// costs Set, see fetchPenalty.
+	fetchCosts             atomic.Bool
+	fetchTotal, fetchCount atomic.Int64
 	// getBuf is a custom ring buffer implementation that gets pushed to when
 	// keys are read.
 	getBuf *ringBuffer
 	// setBuf is a buffer allowing us to batch/drop Sets during times of high
 	// contention.
 	setBuf chan *Item[V]
+	// spill holds the items which found setBuf full if Config.SpillLimit is
+	// set, it's nil otherwise.
+	spill *spillQueue[V]
+	// computes coalesces the concurrent misses of GetOrCompute.
+	computes z.Flight[computed[V]]
+	// keyLocks serializes the writes of Compute and GetOrCompute by key hash.
+	keyLocks *z.KeyedMutex
+	// expiry sends the expirations to the channels of ExpiryNotifications.
+	expiry *expiryNotifier[V]
 	// onEvict is called for item evictions.
 	onEvict func(*Item[V])
 	// onReject is called when an item is rejected via admission policy.
 	onReject func(*Item[V])
+	// onRemoval is Config.OnRemoval.
+	onRemoval func(*Item[V])
 	// onExit is called whenever a value goes out of scope from the cache.
 	onExit (func(V))
+	// inspectValue is Config.InspectValue.
+	inspectValue func(value V) bool
+	// ordered queues the callbacks if Config.OrderedCallbacks is set, it's nil
+	// otherwise.
+	ordered *orderedCallbacks
 	// KeyToHash function is used to customize the key hashing algorithm.
 	// Each key will be hashed using the provided function. If keyToHash value
 	// is not set, the default keyToHash function is used.
@@ -64,13 +118,36 @@ type Cache[K Key, V any] struct {
 	done chan struct{}
 	// indicates whether cache is closed.
 	isClosed atomic.Bool
+	// readOnly is set by SetReadOnly.
+	readOnly atomic.Bool
+	// faults is set by InjectFaults, see FaultInjector.
+	faults atomic.Pointer[faultInjector]
 	// cost calculates cost from a value.
 	cost func(value V) int64
+	// recalculateCosts is Config.RecalculateCosts.
+	recalculateCosts bool
 	// ignoreInternalCost dictates whether to ignore the cost of internally storing
 	// the item in the cost calculation.
 	ignoreInternalCost bool
 	// cleanupTicker is used to periodically check for entries whose TTL has passed.
 	cleanupTicker *time.Ticker
+	// auditTicker schedules the audits of the expiration buckets if
+	// Config.TTLAuditInterval is set, it's nil otherwise.
+	auditTicker *time.Ticker
+	// purge wakes processItems up to purge the items invalidated by
+	// Invalidate, one shard of the store at a time.
+	purge chan struct{}
+	// thrashThreshold is the admission denial rate above which a full cache is
+	// considered to be thrashing.
+	thrashThreshold float64
+	// thrashing is refreshed on every cleanupTicker tick, see IsThrashing.
+	thrashing atomic.Bool
+	// onTrace is called for 1 in traceRate operations.
+	onTrace   func(op TraceOp, keyHash uint64, durNs int64, hit bool)
+	traceRate uint32
+	// detailedMetrics is set if Config.DetailedMetrics and Config.Metrics
+	// are, for the operations to be timed.
+	detailedMetrics bool
 	// Metrics contains a running log of important statistics like hits, misses,
 	// and dropped items.
 	Metrics *Metrics
@@ -121,22 +198,62 @@ type Config[K Key, V any] struct {
 	// This is a fine-tuning mechanism and you probably won't have to touch this.
 	BufferItems int64
 
+	// MaxBufferItems, when above BufferItems, lets the size of the Get buffers
+	// adapt at runtime between BufferItems and MaxBufferItems. The buffers are
+	// grown while the policy drops the batches of Gets they send it, for being
+	// busy, and shrunk back once it keeps up, so that the size doesn't need to
+	// be tuned for the busiest time of the day. The current size is reported
+	// by Metrics.BufferItems.
+	MaxBufferItems int64
+
 	// Metrics is true when you want variety of stats about the cache.
 	// There is some overhead to keeping statistics, so you should only set this
 	// flag to true when testing or throughput performance isn't a major factor.
 	Metrics bool
 
-	// OnEvict is called for every eviction with the evicted item.
+	// OnEvict is called for every eviction with the evicted item. Its Reason
+	// tells the evictions by the policy from the expirations.
 	OnEvict func(item *Item[V])
 
-	// OnReject is called for every rejection done via the policy.
+	// OnEvictRateLimit caps the number of OnEvict calls to OnEvictRateLimit
+	// per second on average, in bursts of up to OnEvictRateLimit calls, so
+	// that mass evictions (e.g. after UpdateMaxCost lowers MaxCost) don't
+	// flood the callback. Evictions over the limit aren't reported to OnEvict,
+	// but OnExit is still called for them. If zero, OnEvict is always called.
+	OnEvictRateLimit float64
+
+	// OnReject is called for every rejection done via the policy: when it
+	// declines to admit a new item, or has no room for a prefetched one. The
+	// item holds the hashes of the key, the value and its cost, with the
+	// internal cost unless IgnoreInternalCost is set, so that e.g. a tiered
+	// cache can push the rejected values to its next level rather than drop
+	// them. It isn't called for the Sets dropped before reaching the policy,
+	// see SetWithResult. Like OnEvict, it's called from the goroutine which
+	// applies the Sets, which it holds up.
 	OnReject func(item *Item[V])
 
 	// OnExit is called whenever a value is removed from cache. This can be
 	// used to do manual memory deallocation. Would also be called on eviction
 	// as well as on rejection of the value.
+	//
+	// It's called exactly once for every value a Set returned true for, as it
+	// leaves the cache for any reason: eviction, expiry, rejection, Del,
+	// replacement by another Set, Clear or Close. So the values holding
+	// resources, like mmaps, pooled buffers or file handles, can be released
+	// in OnExit. The values a Set returned false for never entered the cache,
+	// and remain the caller's: OnExit isn't called for them.
 	OnExit func(val V)
 
+	// OnRemoval is called for every item leaving the cache, with the reason
+	// in its Reason: as it's evicted or expires like with OnEvict, but also
+	// as it's deleted, rejected, or replaced by an update, with the previous
+	// value. This serves the metrics and write-behind logic which need to
+	// tell them apart. It's called before OnExit, and unlike OnEvict it isn't
+	// subject to OnEvictRateLimit. The cost of the items deleted or replaced
+	// is the one accounted by the policy at the time, 0 if they weren't
+	// admitted yet.
+	OnRemoval func(item *Item[V])
+
 	// ShouldUpdate is called when a value already exists in cache and is being updated.
 	// If ShouldUpdate returns true, the cache continues with the update (Set). If the
 	// function returns false, no changes are made in the cache. If the value doesn't
@@ -159,6 +276,15 @@ type Config[K Key, V any] struct {
 	// just return the first uint64 and return 0 for the second uint64.
 	KeyToHash func(key K) (uint64, uint64)
 
+	// ScrambleKeys mixes a seed, picked at random when the cache is created,
+	// into the hashes of the keys (see z.SeededKeyToHash). This stops
+	// adversarial keys, e.g. user-controlled strings, from being chosen to
+	// collide or to fall into the same internal shard. KeyHashSeed, if set,
+	// is used as the seed instead, to make the hashes reproducible. Ignored if
+	// KeyToHash is set.
+	ScrambleKeys bool
+	KeyHashSeed  uint64
+
 	// Cost evaluates a value and outputs a corresponding cost. This function is ran
 	// after Set is called for a new item or an item is updated with a cost param of 0.
 	//
@@ -169,7 +295,8 @@ type Config[K Key, V any] struct {
 	//
 	// To signal to Ristretto that you'd like to use this Cost function:
 	//   1. Set the Cost field to a non-nil function.
-	//   2. When calling Set for new items or item updates, use a `cost` of 0.
+	//   2. When calling Set for new items or item updates, use a `cost` of 0, or
+	//      call Put, which never takes a cost.
 	Cost func(value V) int64
 
 	// IgnoreInternalCost set to true indicates to the cache that the cost of
@@ -180,6 +307,221 @@ type Config[K Key, V any] struct {
 
 	// TtlTickerDurationInSec sets the value of time ticker for cleanup keys on TTL expiry.
 	TtlTickerDurationInSec int64
+
+	// TTLAuditInterval makes the cache audit its expiration metadata every
+	// TTLAuditInterval, to guard long-running processes against its slow
+	// drift. Every audit checks the keys of a few expiration buckets against
+	// the store, removing those of the items gone or expiring in another
+	// bucket, and one shard of the store against the buckets, evicting the
+	// expired items the TTL cleanup would never reach. The repairs are counted
+	// by Metrics.TTLOrphansRepaired and Metrics.TTLExpiredRepaired. If zero,
+	// there are no audits.
+	TTLAuditInterval time.Duration
+
+	// DefaultTTL is the TTL of the items Set without one, i.e. by Set,
+	// SetWithVersion, Prefetch, or with a zero TTL. If zero, they never expire.
+	DefaultTTL time.Duration
+
+	// MaxTTL caps the TTLs of all the items, including those Set without
+	// one, which expire after MaxTTL too. This lets the owners of a cache
+	// enforce a freshness policy centrally, instead of auditing the TTLs of
+	// every call site. If zero, TTLs aren't capped.
+	MaxTTL time.Duration
+
+	// TTLGroup, if set, returns the group of the items Set, e.g. their class
+	// of data, to apply the TTLPolicy of their group in TTLPolicies instead of
+	// DefaultTTL and MaxTTL. This gives the different kinds of data sharing a
+	// cache their own freshness, without logic at every call site. The items
+	// of the groups not in TTLPolicies get DefaultTTL and MaxTTL.
+	TTLGroup    func(key K, value V) string
+	TTLPolicies map[string]TTLPolicy
+
+	// ThrashThreshold is the admission denial rate (see
+	// Metrics.AdmissionDenialRate) above which IsThrashing reports true, as
+	// long as the cache is also evicting at least one key per admitted key.
+	// It is evaluated over the most recent cleanup interval rather than the
+	// lifetime of the cache. If zero, 0.5 is used. Requires Metrics.
+	ThrashThreshold float64
+
+	// OnTrace, if set, is called after a sample of Get, Set and Del operations
+	// complete, with the operation, the hashed key, the time it took in
+	// nanoseconds and whether it hit: for Get, hit is true if the key was
+	// found; for Set, if the item was accepted into the buffers. This can be
+	// used to attach tracing spans or custom profilers to cache operations.
+	OnTrace func(op TraceOp, keyHash uint64, durNs int64, hit bool)
+
+	// TraceSampleRate makes OnTrace be called for 1 in TraceSampleRate
+	// operations, chosen at random. If zero, every operation is traced.
+	TraceSampleRate uint32
+
+	// GhostListSize is the number of recently evicted keys to remember. When
+	// a remembered key is Set again, its access frequency is boosted when
+	// competing with eviction candidates, which helps items that were evicted
+	// by mistake get back in (similar to the ghost lists of ARC). The number
+	// of such re-requests is reported by Metrics.GhostHits. If zero, no
+	// evicted keys are remembered. Only used by PolicyTinyLFU.
+	GhostListSize int
+
+	// RetryAdmitWindow makes a key rejected by the admission policy be
+	// admitted unconditionally if it's Set again within RetryAdmitWindow. This
+	// lets new items that are requested in bursts get in on their second Set,
+	// instead of being rejected until their access frequency catches up with
+	// the resident items. The number of such admissions is reported by
+	// Metrics.RetriesAdmitted. If zero, rejected keys aren't remembered. Only
+	// used by PolicyTinyLFU.
+	RetryAdmitWindow time.Duration
+
+	// SampleHotGets makes Get record in the policy only 1 in 16 accesses to
+	// hot items, i.e. items whose estimated access frequency is close to the
+	// maximum the sketch can count. Their frequency stays high either way, so
+	// this saves the ring buffer work on most Gets of read-mostly workloads
+	// without changing the admission and eviction decisions much. Only used by
+	// PolicyTinyLFU.
+	SampleHotGets bool
+
+	// ReplicateHotKeys makes the store keep copies of the items of the hot
+	// keys (see SampleHotGets), up to 256 of them, which Get reads without
+	// locking their shard, so that the Gets of a few very hot keys don't
+	// contend on the lock of their shards. The copies are replaced along with
+	// the items, so that Get never returns a stale value. This costs a copy of
+	// the replicas every time a hot key is written to, or becomes hot or
+	// cold, so it suits read-mostly workloads. Setting it implies
+	// SampleHotGets. Only used by PolicyTinyLFU.
+	ReplicateHotKeys bool
+
+	// RecalculateCosts is a debug mode to recover from a buggy Cost function
+	// without flushing the cache: every time Get or GetWithInfo finds an
+	// item, its cost is computed again with Cost, and corrected in the policy
+	// if it differs from the stored one. The corrections are counted by
+	// Metrics.CostsCorrected. It's slow: it takes the policy lock on every
+	// hit. Ignored if Cost isn't set.
+	RecalculateCosts bool
+
+	// Name identifies the cache in profiles: the internal goroutines of the
+	// cache (processing Sets and TTL cleanups, and the policy's) carry the
+	// pprof labels "ristretto.cache" set to Name and "ristretto.goroutine" set
+	// to the name of the goroutine.
+	Name string
+
+	// TrackIdleTime enables tracking the approximate time of the last access
+	// of every item, with a 1 second resolution. The distribution of idle
+	// times is reported by Metrics.IdleTimeSeconds and Metrics.IdleCost.
+	TrackIdleTime bool
+
+	// DetailedMetrics makes the Metrics record the latencies of every Get,
+	// Set and Del, reported by Metrics.GetLatency, SetLatency and DelLatency,
+	// and Metrics.LatencyDistribution. Timing the operations adds some
+	// overhead to each of them. Ignored unless Metrics is set.
+	DetailedMetrics bool
+
+	// TopKeys makes the cache track the keys read the most, the heavy hitters,
+	// up to TopKeys of them, reported with their approximate numbers of Gets
+	// by Cache.TopKeys, e.g. to tell which keys dominate the traffic when
+	// debugging skew or stampedes. Unlike the policy, which only knows the
+	// hashes of the keys, it keeps a copy of the keys themselves. Every Get
+	// takes one of a few locks. If zero, the keys aren't tracked.
+	TopKeys int
+
+	// MaxIdleTime makes the cache evict the items that haven't been accessed
+	// for at least MaxIdleTime, even if the cache isn't full, returning their
+	// cost to the budget. This suits session-like data that has no explicit
+	// TTL. Idle items are looked for on the same schedule as expired items
+	// (see TtlTickerDurationInSec), so they can stay for up to that much
+	// longer. Setting it implies TrackIdleTime. If zero, idle items are only
+	// evicted by the policy.
+	MaxIdleTime time.Duration
+
+	// Policy selects the admission and eviction policy, one of the Policy*
+	// constants. If empty, PolicyTinyLFU is used.
+	Policy string
+
+	// Admission replaces the admission of PolicyTinyLFU, if set. When a new
+	// key doesn't fit in the cache, the policy still picks the items of the
+	// fewest hits as victims, but then asks Admission whether to evict them
+	// for the new key, instead of comparing their hits. This allows e.g.
+	// always admitting the new keys, as LRU caches do, or admitting them by
+	// size. GhostListSize and RetryAdmitWindow have no effect with it, since
+	// they only boost the default admission. It can't be used with the other
+	// policies, which admit keys their own way.
+	Admission Admission
+
+	// OrderedCallbacks guarantees that OnEvict, OnReject and OnExit are called
+	// in the order of the operations that caused them for any given key, e.g.
+	// that the OnExit of the value replaced by a Set comes before the OnEvict
+	// of the new value, even if the Set and the eviction happen concurrently in
+	// different goroutines. This suits integrations replaying the callbacks
+	// into a log, like write-behind stores. The callbacks of different keys can
+	// still come in any order, and concurrently.
+	//
+	// The callbacks are queued and delivered after the operation, by the
+	// goroutine of the operation or of a concurrent one of a key sharing the
+	// same queue, instead of being called inline. Without OrderedCallbacks,
+	// the callbacks of an update or deletion are called by the goroutine of the
+	// operation, and those of evictions by the internal goroutines of the cache,
+	// so they can race.
+	OrderedCallbacks bool
+
+	// InspectValue, if set, is called with the value of every Set and
+	// Prefetch, and makes the cache skip the values for which it returns
+	// false: Set returns false, SetWithResult returns SetRejected, and the value
+	// stored for the key, if any, is left as is, like when ShouldUpdate returns
+	// false. The skipped values are counted by Metrics.InspectorRejections.
+	// This is meant to keep out the values that aren't worth their cost, e.g.
+	// already compressed or encrypted blobs in a cache of compressed values,
+	// which z.Entropy detects cheaply:
+	//
+	//	InspectValue: func(v []byte) bool { return z.Entropy(v) < 7.5 },
+	//
+	// It's called by the goroutine of the Set, so it should be fast.
+	InspectValue func(value V) bool
+
+	// SpillLimit, if positive, makes the Sets which find the internal buffer
+	// of the cache full wait in a spill queue, of up to SpillLimit items,
+	// instead of being dropped. This suits the users who prefer delayed writes
+	// over lost writes, at the cost of the memory of the queue, which holds up
+	// to SpillLimit values. The spilled items are applied in order as soon as
+	// the buffer has room again. While items are spilled, the Dels and Waits
+	// are queued after them rather than blocking, even past SpillLimit.
+	//
+	// The spilled Sets are counted by Metrics.SetsSpilled, and the depth of
+	// the queue and the age of its oldest item are in QueueDepths.
+	SpillLimit int
+
+	// KeepValues makes the notifications of ExpiryNotifications hold the
+	// expired values. Without it, their values are zero, so that a lagging
+	// consumer doesn't keep the expired values in memory.
+	KeepValues bool
+
+	// MmapStorePath, if set, makes the cache keep its items in a
+	// memory-mapped file at MmapStorePath too, so that a cache created again
+	// with the same path, e.g. after a crash of its process, recovers them:
+	// the items are admitted back as long as they fit in MaxCost, with their
+	// cost and expiration. This works without snapshots, as every change of
+	// the cache is mirrored to the file as it's made, but the file is only
+	// synced to disk by Close, so a crash of the machine can lose the latest
+	// changes. It needs []byte values, and the file can't be shared by caches:
+	// NewPartitionedCache gives every partition its own.
+	//
+	// This is experimental. The reads are still served from memory, so the
+	// values are held both in memory and in the file.
+	MmapStorePath string
+
+	// SlidingTTL makes every Get of an item with a TTL extend its expiration
+	// by its TTL, like Caffeine's expireAfterAccess: the items expire once
+	// they haven't been read for their TTL, rather than their TTL after they
+	// were Set. SetOptions.Sliding does it for single items. The extensions
+	// are only made once they move the expiration by at least 1/64 of the
+	// TTL, so that the Gets of hot keys rarely write to the store. They
+	// aren't mirrored to the file of MmapStorePath, and the items recovered
+	// from it don't slide.
+	SlidingTTL bool
+}
+
+// TTLPolicy is the TTL policy of a group of items, see Config.TTLGroup.
+type TTLPolicy struct {
+	// Default and Max work like Config.DefaultTTL and Config.MaxTTL, for the
+	// items of the group. If zero, Config.DefaultTTL and Config.MaxTTL apply.
+	Default, Max time.Duration
 }
 
 type itemFlag byte
@@ -188,6 +530,7 @@ const (
 	itemNew itemFlag = iota
 	itemDelete
 	itemUpdate
+	itemPrefetch
 )
 
 // Item is a full representation of what's stored in the cache for each key-value pair.
@@ -198,81 +541,317 @@ type Item[V any] struct {
 	Value      V
 	Cost       int64
 	Expiration time.Time
-	wg         *sync.WaitGroup
+	// Reason is why the item left the cache, for the items passed to
+	// Config.OnEvict and Config.OnRemoval.
+	Reason EvictionReason
+	wg     *sync.WaitGroup
+	// result receives the outcome of the Set, for SetWithResult.
+	result chan SetResult
+	// version is the version of the value if versioned is set, see
+	// SetWithVersion.
+	version   uint64
+	versioned bool
+	// stale is set by the store when it rejects the item for having an older
+	// version than the stored one, or for its cond.
+	stale bool
+	// cond, if set, is checked by the store with the stored value, if found,
+	// under the lock of its shard: the item is rejected if it returns false,
+	// see SetIfAbsent and CompareAndSwap.
+	cond func(stored V, found bool) bool
+	// generation is the generation of the store when the item was created,
+	// see Invalidate.
+	generation uint64
+	// penalty is the miss penalty of the item if set, see
+	// SetOptions.MissPenalty.
+	penalty float64
+	// slide is the TTL of the item if it's sliding, see Config.SlidingTTL.
+	slide time.Duration
+	// fetchCost is the fetch cost of the item if set, see
+	// SetOptions.FetchCost.
+	fetchCost time.Duration
+	// metadata is the metadata of the item if set, see SetOptions.Metadata.
+	metadata *itemMetadata
+}
+
+// itemMetadata is the metadata of an item, with its cost, see
+// SetOptions.Metadata.
+type itemMetadata struct {
+	value any
+	cost  int64
+}
+
+// isStale returns true, and marks i as stale, if i is versioned and older than
+// the stored version.
+func (i *Item[V]) isStale(stored uint64) bool {
+	if i.versioned && i.version < stored {
+		i.stale = true
+	}
+	return i.stale
+}
+
+// report sends r to the channel waiting for the outcome of the Set, if any.
+func (i *Item[V]) report(r SetResult) {
+	if i.result != nil {
+		i.result <- r
+	}
 }
 
 // NewCache returns a new Cache instance and any configuration errors, if any.
 func NewCache[K Key, V any](config *Config[K, V]) (*Cache[K, V], error) {
+	return newCache(config, nil)
+}
+
+// validateConfig returns the error of NewCache for config, if it's invalid.
+func validateConfig[K Key, V any](config *Config[K, V]) error {
 	switch {
 	case config.NumCounters == 0:
-		return nil, errors.New("NumCounters can't be zero")
+		return errors.New("NumCounters can't be zero")
 	case config.NumCounters < 0:
-		return nil, errors.New("NumCounters can't be negative number")
+		return errors.New("NumCounters can't be negative number")
 	case config.MaxCost == 0:
-		return nil, errors.New("MaxCost can't be zero")
+		return errors.New("MaxCost can't be zero")
 	case config.MaxCost < 0:
-		return nil, errors.New("MaxCost can't be be negative number")
+		return errors.New("MaxCost can't be be negative number")
 	case config.BufferItems == 0:
-		return nil, errors.New("BufferItems can't be zero")
+		return errors.New("BufferItems can't be zero")
 	case config.BufferItems < 0:
-		return nil, errors.New("BufferItems can't be be negative number")
-	case config.TtlTickerDurationInSec == 0:
+		return errors.New("BufferItems can't be be negative number")
+	case config.MaxBufferItems < 0:
+		return errors.New("MaxBufferItems can't be negative number")
+	case config.ThrashThreshold < 0:
+		return errors.New("ThrashThreshold can't be negative number")
+	case config.GhostListSize < 0:
+		return errors.New("GhostListSize can't be negative number")
+	case config.OnEvictRateLimit < 0:
+		return errors.New("OnEvictRateLimit can't be negative number")
+	case config.RetryAdmitWindow < 0:
+		return errors.New("RetryAdmitWindow can't be negative number")
+	case config.MaxIdleTime < 0:
+		return errors.New("MaxIdleTime can't be negative number")
+	case config.TopKeys < 0:
+		return errors.New("TopKeys can't be negative number")
+	case config.TTLAuditInterval < 0:
+		return errors.New("TTLAuditInterval can't be negative number")
+	case config.DefaultTTL < 0:
+		return errors.New("DefaultTTL can't be negative number")
+	case config.MaxTTL < 0:
+		return errors.New("MaxTTL can't be negative number")
+	case config.SpillLimit < 0:
+		return errors.New("SpillLimit can't be negative number")
+	}
+	for group, p := range config.TTLPolicies {
+		if p.Default < 0 || p.Max < 0 {
+			return fmt.Errorf("TTLPolicies[%q] can't have negative TTLs", group)
+		}
+	}
+	if config.Admission != nil && config.Policy != "" && config.Policy != PolicyTinyLFU {
+		return fmt.Errorf("Admission can't be used with Policy %q", config.Policy)
+	}
+	return nil
+}
+
+// newCache works like NewCache, but if Config.Metrics is set and metrics isn't
+// nil, the cache records its metrics in metrics instead of its own instance.
+func newCache[K Key, V any](config *Config[K, V], metrics *Metrics) (*Cache[K, V], error) {
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	if config.TtlTickerDurationInSec == 0 {
 		config.TtlTickerDurationInSec = bucketDurationSecs
 	}
-	policy := newPolicy[V](config.NumCounters, config.MaxCost)
+	if config.ThrashThreshold == 0 {
+		config.ThrashThreshold = defaultThrashThreshold
+	}
+	var policy policy[V]
+	var err error
+	withLabels(config.Name, "policy", func() {
+		policy, err = newPolicyOfKind[V](config.Policy, config.NumCounters, config.MaxCost)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if config.Admission != nil {
+		// validateConfig checked that the policy is PolicyTinyLFU.
+		policy.(*defaultPolicy[V]).admission = config.Admission
+	}
+	if p, ok := policy.(*defaultPolicy[V]); ok {
+		if config.GhostListSize > 0 {
+			p.ghost = newGhostList(config.GhostListSize)
+		}
+		if config.RetryAdmitWindow > 0 {
+			p.pending = newPendingSet(config.RetryAdmitWindow)
+		}
+	}
+	var storedItems store[V] = newStore[V]()
+	var mmapped *mmapStore[V]
+	var recovered []mmapRecord
+	if config.MmapStorePath != "" {
+		if mmapped, recovered, err = openMmapStore[V](config.MmapStorePath); err != nil {
+			policy.Close()
+			return nil, err
+		}
+		storedItems = mmapped
+	}
+	var idle *idleTracker
+	if config.TrackIdleTime || config.MaxIdleTime > 0 {
+		idle = newIdleTracker()
+	}
+	var top *topKeys[K]
+	if config.TopKeys > 0 {
+		top = newTopKeys[K](config.TopKeys)
+	}
+	getBuf := newRingBuffer(idle.consumer(policy), config.BufferItems)
+	if config.MaxBufferItems > config.BufferItems {
+		getBuf = newAdaptiveRingBuffer(idle.consumer(policy), config.BufferItems,
+			config.MaxBufferItems)
+	}
 	cache := &Cache[K, V]{
-		storedItems:        newStore[V](),
+		name:               config.Name,
+		storedItems:        storedItems,
 		cachePolicy:        policy,
-		getBuf:             newRingBuffer(policy, config.BufferItems),
+		idle:               idle,
+		topKeys:            top,
+		maxIdleTime:        config.MaxIdleTime,
+		defaultTTL:         config.DefaultTTL,
+		maxTTL:             config.MaxTTL,
+		ttlGroup:           config.TTLGroup,
+		ttlPolicies:        maps.Clone(config.TTLPolicies),
+		slidingTTL:         config.SlidingTTL,
+		getBuf:             getBuf,
 		setBuf:             make(chan *Item[V], setBufSize),
+		keyLocks:           z.NewKeyedMutex(0),
+		expiry:             newExpiryNotifier[V](config.KeepValues),
 		keyToHash:          config.KeyToHash,
 		stop:               make(chan struct{}),
 		done:               make(chan struct{}),
 		cost:               config.Cost,
+		recalculateCosts:   config.RecalculateCosts && config.Cost != nil,
 		ignoreInternalCost: config.IgnoreInternalCost,
 		cleanupTicker:      time.NewTicker(time.Duration(config.TtlTickerDurationInSec) * time.Second / 2),
+		purge:              make(chan struct{}, 1),
+		thrashThreshold:    config.ThrashThreshold,
+		onTrace:            config.OnTrace,
+		traceRate:          config.TraceSampleRate,
+		inspectValue:       config.InspectValue,
 	}
 	cache.storedItems.SetShouldUpdateFn(config.ShouldUpdate)
+	cache.sliding.Store(config.SlidingTTL)
+	if config.TTLAuditInterval > 0 {
+		cache.auditTicker = time.NewTicker(config.TTLAuditInterval)
+	}
 	cache.onExit = func(val V) {
 		if config.OnExit != nil {
 			config.OnExit(val)
 		}
 	}
+	var evictLimiter *z.RateLimiter
+	if config.OnEvictRateLimit > 0 {
+		evictLimiter = z.NewRateLimiter(config.OnEvictRateLimit,
+			max(1, int(config.OnEvictRateLimit)))
+	}
+	cache.onRemoval = config.OnRemoval
 	cache.onEvict = func(item *Item[V]) {
-		if config.OnEvict != nil {
+		if config.OnEvict != nil && evictLimiter.Allow() {
 			config.OnEvict(item)
 		}
+		if config.OnRemoval != nil {
+			config.OnRemoval(item)
+		}
 		cache.onExit(item.Value)
 	}
 	cache.onReject = func(item *Item[V]) {
 		if config.OnReject != nil {
 			config.OnReject(item)
 		}
+		if config.OnRemoval != nil {
+			item.Reason = Rejected
+			config.OnRemoval(item)
+		}
 		cache.onExit(item.Value)
 	}
+	if config.SpillLimit > 0 {
+		cache.spill = newSpillQueue[V](config.SpillLimit)
+	}
+	if config.OrderedCallbacks {
+		cache.ordered = newOrderedCallbacks()
+		onEvict, onReject := cache.onEvict, cache.onReject
+		// The items passed to the callbacks can be reused once they return,
+		// queue copies.
+		cache.onEvict = func(item *Item[V]) {
+			i := *item
+			cache.ordered.call(i.Key, func() { onEvict(&i) })
+		}
+		cache.onReject = func(item *Item[V]) {
+			i := *item
+			cache.ordered.call(i.Key, func() { onReject(&i) })
+		}
+	}
 	if cache.keyToHash == nil {
-		cache.keyToHash = z.KeyToHash[K]
+		cache.keyToHash = defaultKeyToHash(config)
 	}
 
+	if p, ok := policy.(*defaultPolicy[V]); ok && (config.SampleHotGets || config.ReplicateHotKeys) {
+		if r, ok := cache.storedItems.(hotReplicator); ok && config.ReplicateHotKeys {
+			r.replicateHot()
+		}
+		p.Lock()
+		p.hot = make(map[uint64]struct{})
+		p.onHot = cache.storedItems.SetHot
+		p.Unlock()
+	}
+
+	if mmapped != nil {
+		cache.recoverItems(mmapped, recovered)
+	}
 	if config.Metrics {
-		cache.collectMetrics()
+		cache.collectMetrics(metrics)
+		if config.DetailedMetrics {
+			cache.Metrics.enableLatencies()
+			cache.detailedMetrics = true
+		}
 	}
 	// NOTE: benchmarks seem to show that performance decreases the more
 	//       goroutines we have running cache.processItems(), so 1 should
 	//       usually be sufficient
-	go cache.processItems()
+	withLabels(cache.name, "processItems", func() { go cache.processItems() })
 	return cache, nil
 }
 
+// defaultKeyToHash returns the KeyToHash used when config doesn't set one.
+func defaultKeyToHash[K Key, V any](config *Config[K, V]) func(K) (uint64, uint64) {
+	if !config.ScrambleKeys {
+		return z.KeyToHash[K]
+	}
+	seed := config.KeyHashSeed
+	if seed == 0 {
+		var b [8]byte
+		// crypto/rand never fails on the supported platforms.
+		_, _ = rand.Read(b[:])
+		seed = binary.LittleEndian.Uint64(b[:])
+	}
+	return z.SeededKeyToHash[K](seed)
+}
+
 // Wait blocks until all buffered writes have been applied. This ensures a call to Set()
-// will be visible to future calls to Get().
+// will be visible to future calls to Get(). It also applies the accesses recorded by
+// the Gets so far, which are otherwise buffered until enough of them are made, and
+// may be dropped, so that the tests and the Set-then-Get flows built on the
+// frequencies of the keys are deterministic, without sleeps.
 func (c *Cache[K, V]) Wait() {
 	if c == nil || c.isClosed.Load() {
 		return
 	}
+	c.waitSets()
+	c.getBuf.Flush(c.cachePolicy.PushSync)
+	c.cachePolicy.Sync()
+}
+
+// waitSets works like Wait, but doesn't apply the buffered accesses of the
+// Gets, which is all GetOrCompute and Compute need.
+func (c *Cache[K, V]) waitSets() {
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
-	c.setBuf <- &Item[V]{wg: wg}
+	c.send(&Item[V]{wg: wg}, true)
 	wg.Wait()
 }
 
@@ -283,18 +862,238 @@ func (c *Cache[K, V]) Get(key K) (V, bool) {
 	if c == nil || c.isClosed.Load() {
 		return zeroValue[V](), false
 	}
+	start := c.traceStart()
 	keyHash, conflictHash := c.keyToHash(key)
+	c.topKeys.add(key, keyHash)
 
-	c.getBuf.Push(keyHash)
-	value, ok := c.storedItems.Get(keyHash, conflictHash)
+	failed := c.storeFault(TraceGet, keyHash)
+	value, ok, hot := c.storedItems.GetHot(keyHash, conflictHash)
+	if failed {
+		value, ok = zeroValue[V](), false
+	}
+	if ok && c.sliding.Load() {
+		c.storedItems.Touch(keyHash, conflictHash)
+	}
+	if (!hot || z.FastRand()%hotGetSample == 0) && !c.dropAccess(keyHash) {
+		c.getBuf.Push(keyHash)
+	}
 	if ok {
-		c.Metrics.add(hit, keyHash, 1)
+		c.Metrics.add(hit, 1)
+		c.trackFetchSaved(keyHash, conflictHash)
+		if c.recalculateCosts {
+			c.recalculateCost(keyHash, conflictHash, value, c.cachePolicy.Cost(keyHash))
+		}
 	} else {
-		c.Metrics.add(miss, keyHash, 1)
+		c.Metrics.add(miss, 1)
 	}
+	c.traceEnd(TraceGet, keyHash, start, ok)
 	return value, ok
 }
 
+// GetQuiet works like Get, but leaves no trace: the access isn't recorded by
+// the policy, nor in the idle time of the item, and isn't counted in the
+// Metrics or traced. This is meant for administrative reads, e.g. by
+// dashboards or exporters, which shouldn't change what the cache admits and
+// evicts, nor its statistics.
+func (c *Cache[K, V]) GetQuiet(key K) (V, bool) {
+	if c == nil || c.isClosed.Load() {
+		return zeroValue[V](), false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	if c.storeFault(TraceGet, keyHash) {
+		return zeroValue[V](), false
+	}
+	return c.storedItems.Get(keyHash, conflictHash)
+}
+
+// computed is the result of a compute function of GetOrCompute, along with the
+// conflict hash of its key, as the calls are coalesced by key hash only.
+type computed[V any] struct {
+	value    V
+	conflict uint64
+}
+
+// GetOrCompute returns the value of key, like Get. On a miss, it calls compute
+// to get the value and its cost, Sets it and returns it. The concurrent misses
+// for the same key are coalesced: only one of them calls compute, and the
+// others wait for its results. They also wait for the value to be applied to
+// the cache, so that the GetOrComputes that follow hit it rather than
+// computing it again, unless it wasn't admitted.
+//
+// The errors returned by compute are returned to all the waiting callers, and
+// nothing is Set. If compute panics, the panic is propagated to its caller,
+// and the waiting callers get an error. On a nil or closed cache, compute is
+// always called.
+func (c *Cache[K, V]) GetOrCompute(key K, compute func() (V, int64, error)) (V, error) {
+	if c == nil || c.isClosed.Load() {
+		value, _, err := compute()
+		return value, err
+	}
+	if value, ok := c.Get(key); ok {
+		return value, nil
+	}
+	return c.computeMiss(key, compute, func(value V, cost int64) bool {
+		return c.Set(key, value, cost)
+	})
+}
+
+// computeMiss is the miss path of GetOrCompute, with the computed value written
+// to the cache by set.
+func (c *Cache[K, V]) computeMiss(key K, compute func() (V, int64, error),
+	set func(value V, cost int64) bool) (V, error) {
+	keyHash, conflictHash := c.keyToHash(key)
+	fn := func() (computed[V], error) {
+		// Another call may have Set the value since the Get.
+		if value, ok := c.GetQuiet(key); ok {
+			return computed[V]{value: value, conflict: conflictHash}, nil
+		}
+		value, cost, err := compute()
+		if err != nil {
+			return computed[V]{}, err
+		}
+		c.keyLocks.Lock(keyHash)
+		defer c.keyLocks.Unlock(keyHash)
+		// A Compute may have Set the value while it was computed.
+		if value, ok := c.GetQuiet(key); ok {
+			return computed[V]{value: value, conflict: conflictHash}, nil
+		}
+		if set(value, cost) {
+			c.waitSets()
+		}
+		return computed[V]{value: value, conflict: conflictHash}, nil
+	}
+	res, err, shared := c.computes.Do(keyHash, fn)
+	if shared && err == nil && res.conflict != conflictHash {
+		// The call was for another key with the same hash.
+		res, err = fn()
+	}
+	if err != nil {
+		return zeroValue[V](), err
+	}
+	return res.value, nil
+}
+
+// Compute updates the value of key atomically with respect to the other
+// Computes and GetOrComputes of key: it calls fn with the current value of key,
+// and whether it was found, then Sets the value returned by fn with its cost,
+// or Deletes key if fn returns false. Like GetOrCompute, it waits for the value
+// to be applied to the cache, so that the next Compute of key sees it. It
+// returns the value returned by fn, and whether it was Set: the Set may be
+// dropped or rejected, like any other.
+//
+// fn is called with the lock of key held, see z.KeyedMutex, so it mustn't call
+// Compute or GetOrCompute itself. Set and Del aren't serialized with Compute.
+// On a nil or closed cache, fn is called with no value, and nothing is Set.
+func (c *Cache[K, V]) Compute(key K, fn func(value V, found bool) (V, int64, bool)) (V, bool) {
+	if c == nil || c.isClosed.Load() {
+		value, _, _ := fn(zeroValue[V](), false)
+		return value, false
+	}
+	keyHash, _ := c.keyToHash(key)
+	c.keyLocks.Lock(keyHash)
+	defer c.keyLocks.Unlock(keyHash)
+	old, found := c.GetQuiet(key)
+	value, cost, keep := fn(old, found)
+	if !keep {
+		if found {
+			c.Del(key)
+		}
+		return value, false
+	}
+	if !c.Set(key, value, cost) {
+		return value, false
+	}
+	c.waitSets()
+	return value, true
+}
+
+// ItemInfo describes an item of the cache, see GetWithInfo.
+type ItemInfo struct {
+	// Cost is the cost of the item accounted by the policy, including the
+	// internal cost unless Config.IgnoreInternalCost is set.
+	Cost int64
+	// Expiration is when the item expires, or zero if it doesn't.
+	Expiration time.Time
+}
+
+// GetWithInfo works like Get, and also returns the cost and expiration of the
+// item, e.g. to check the costs accounted for the items against the memory
+// they actually use. It's slower than Get: it takes the policy lock. The
+// cost is -1 if the item has been found, but hasn't been admitted by the
+// policy yet.
+func (c *Cache[K, V]) GetWithInfo(key K) (V, ItemInfo, bool) {
+	value, ok := c.Get(key)
+	if !ok {
+		return value, ItemInfo{}, false
+	}
+	keyHash, _ := c.keyToHash(key)
+	return value, ItemInfo{
+		Cost:       c.cachePolicy.Cost(keyHash),
+		Expiration: c.storedItems.Expiration(keyHash),
+	}, true
+}
+
+// CacheEntry is an item returned by GetEntry.
+type CacheEntry[V any] struct {
+	Value V
+	// Metadata is the SetOptions.Metadata of the value, or nil if it was Set
+	// without.
+	Metadata any
+}
+
+// GetEntry works like Get, and also returns the metadata of the value, see
+// SetOptions.Metadata. The value and its metadata are read together, so they
+// are always those of the same Set.
+func (c *Cache[K, V]) GetEntry(key K) (CacheEntry[V], bool) {
+	if _, ok := c.Get(key); !ok {
+		return CacheEntry[V]{}, false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	value, meta, ok := c.storedItems.GetMetadata(keyHash, conflictHash)
+	if !ok {
+		// Deleted or expired since the Get.
+		return CacheEntry[V]{}, false
+	}
+	e := CacheEntry[V]{Value: value}
+	if meta != nil {
+		e.Metadata = meta.value
+	}
+	return e, true
+}
+
+// recalculateCost corrects the cost of the item of keyHash in the policy, if
+// computing it again from value doesn't give the stored cost.
+func (c *Cache[K, V]) recalculateCost(keyHash, conflictHash uint64, value V, stored int64) {
+	cost := c.cost(value)
+	if _, meta, ok := c.storedItems.GetMetadata(keyHash, conflictHash); ok && meta != nil {
+		cost += meta.cost
+	}
+	internal := cost
+	if !c.ignoreInternalCost {
+		internal += itemSize
+	}
+	if stored < 0 || internal == stored {
+		return
+	}
+	// The update is dropped if setBuf is full: the next Get tries again.
+	if c.updateCost(keyHash, conflictHash, value, cost) {
+		c.Metrics.add(costFix, 1)
+	}
+}
+
+// updateCost sends an update of the cost of the item of keyHash, whose value
+// is value, to the policy through setBuf, like the cost updates of Set. It
+// returns false if setBuf is full.
+func (c *Cache[K, V]) updateCost(keyHash, conflictHash uint64, value V, cost int64) bool {
+	return c.send(&Item[V]{
+		flag:     itemUpdate,
+		Key:      keyHash,
+		Conflict: conflictHash,
+		Value:    value,
+		Cost:     cost,
+	}, false)
+}
+
 // Set attempts to add the key-value item to the cache. If it returns false,
 // then the Set was dropped and the key-value item isn't added to the cache. If
 // it returns true, there's still a chance it could be dropped by the policy if
@@ -314,28 +1113,286 @@ func (c *Cache[K, V]) Set(key K, value V, cost int64) bool {
 	return c.SetWithTTL(key, value, cost, 0*time.Second)
 }
 
+// Put works like Set, but the cost of the item is always computed from value by
+// Config.Cost, so that callers don't have to pass a cost that matches the size
+// of the value. Put returns false, and doesn't add the item, if Config.Cost is
+// nil.
+func (c *Cache[K, V]) Put(key K, value V) bool {
+	if c == nil || c.cost == nil {
+		return false
+	}
+	return c.SetWithTTL(key, value, 0, 0*time.Second)
+}
+
 // SetWithTTL works like Set but adds a key-value pair to the cache that will expire
 // after the specified TTL (time to live) has passed. A zero value means the value never
 // expires, which is identical to calling Set. A negative value is a no-op and the value
-// is discarded.
+// is discarded. Config.DefaultTTL and Config.MaxTTL, if set, apply to ttl.
 //
 // See Set for more information.
 func (c *Cache[K, V]) SetWithTTL(key K, value V, cost int64, ttl time.Duration) bool {
+	return c.SetWithOptions(key, value, cost, SetOptions{TTL: ttl})
+}
+
+// SetOptions are the options of SetWithOptions.
+type SetOptions struct {
+	// TTL is the time to live of the item, like with SetWithTTL.
+	TTL time.Duration
+	// MissPenalty weighs the access frequency of the item against those of
+	// the eviction candidates when it's admitted, e.g. 10 for an item ten
+	// times as expensive to recompute as the average: such an item gets in,
+	// and stays, with a tenth of the accesses. Values of 0 or less mean 1.
+	// Only PolicyTinyLFU uses it, and the penalty of a key already in the
+	// cache is kept when its value is replaced.
+	MissPenalty float64
+	// Sliding makes the Gets of the item extend its expiration by its TTL,
+	// like Config.SlidingTTL does for all the items.
+	Sliding bool
+	// FetchCost is the time it takes to fetch the value of the item again on
+	// a miss, e.g. the latency of the query it's the result of. Unlike the
+	// cost, which is charged against MaxCost, it's the value of the item: the
+	// hits on the item add it to Metrics.FetchTimeSaved. Unless MissPenalty
+	// is set, it also sets the miss penalty of the item to its ratio to the
+	// average FetchCost of the items Set so far, so that the items slow to
+	// fetch are evicted last. The fetch cost of a key already in the cache is
+	// kept when its value is replaced without one.
+	FetchCost time.Duration
+	// Metadata is an opaque value attached to the item, e.g. the etag or the
+	// version of the source of the value, returned along with it by GetEntry,
+	// so that the values don't have to be wrapped to carry such bookkeeping.
+	// It's replaced along with the value: Setting the key again without
+	// Metadata leaves it without. It isn't persisted by Config.MmapStorePath.
+	Metadata any
+	// MetadataCost is added to the cost of the item for its Metadata, after
+	// Config.Cost computes the cost of the value if it's zero. By default the
+	// Metadata costs nothing. Ignored without Metadata.
+	MetadataCost int64
+}
+
+// fetchPenalty returns the miss penalty of an item of the given fetch cost, its
+// ratio to the average fetch cost of the items Set so far, including it.
+func (c *Cache[K, V]) fetchPenalty(fetchCost time.Duration) float64 {
+	total := c.fetchTotal.Add(int64(fetchCost))
+	count := c.fetchCount.Add(1)
+	return float64(fetchCost) * float64(count) / float64(total)
+}
+
+// trackFetchSaved adds the fetch cost of the item of keyHash, if it has one, to
+// the fetch time saved, for a hit on it.
+func (c *Cache[K, V]) trackFetchSaved(keyHash, conflictHash uint64) {
+	if c.Metrics == nil || !c.fetchCosts.Load() {
+		return
+	}
+	if fetchCost, ok := c.storedItems.GetFetchCost(keyHash, conflictHash); ok && fetchCost > 0 {
+		c.Metrics.add(fetchSaved, uint64(fetchCost))
+	}
+}
+
+// SetWithOptions works like SetWithTTL, with the options in opts.
+func (c *Cache[K, V]) SetWithOptions(key K, value V, cost int64, opts SetOptions) bool {
 	if c == nil || c.isClosed.Load() {
 		return false
 	}
+	if !c.writable() {
+		return false
+	}
+	start := c.traceStart()
 
-	var expiration time.Time
-	switch {
-	case ttl == 0:
-		// No expiration.
-		break
-	case ttl < 0:
-		// Treat this a no-op.
+	i, ok := c.newItem(key, value, cost, opts.TTL)
+	if !ok || !c.inspect(value) {
+		return false
+	}
+	if opts.FetchCost > 0 {
+		i.fetchCost = opts.FetchCost
+		i.penalty = c.fetchPenalty(opts.FetchCost)
+		c.fetchCosts.Store(true)
+	}
+	if opts.MissPenalty > 0 {
+		i.penalty = opts.MissPenalty
+	}
+	if opts.Sliding && !i.Expiration.IsZero() {
+		i.slide = c.ttl(key, value, opts.TTL)
+		c.sliding.Store(true)
+	}
+	if opts.Metadata != nil {
+		i.metadata = &itemMetadata{value: opts.Metadata, cost: max(opts.MetadataCost, 0)}
+	}
+	added := c.setItem(i)
+	c.traceEnd(TraceSet, i.Key, start, added)
+	return added
+}
+
+// SetWithVersion works like Set, but only replaces the value of key if version
+// is at least the version of the stored value. This keeps out-of-order writes,
+// e.g. from concurrent asynchronous loaders, from overwriting fresher data. It
+// returns false if the write was rejected as stale, or dropped like with Set.
+// Values written by Set and SetWithTTL have version 0, and are always written.
+func (c *Cache[K, V]) SetWithVersion(key K, value V, cost int64, version uint64) bool {
+	if c == nil || c.isClosed.Load() {
+		return false
+	}
+	if !c.writable() || !c.inspect(value) {
 		return false
+	}
+	start := c.traceStart()
+	i, _ := c.newItem(key, value, cost, 0)
+	i.version, i.versioned = version, true
+	added := c.setItem(i)
+	c.traceEnd(TraceSet, i.Key, start, added)
+	return added
+}
+
+// EvictionReason is why an item left the cache, see Config.OnRemoval.
+type EvictionReason int
+
+const (
+	// EvictedByPolicy means that the item was evicted by the policy, to make
+	// room for other items.
+	EvictedByPolicy EvictionReason = iota
+	// Expired means that the TTL of the item expired, or that it was idle for
+	// Config.MaxIdleTime.
+	Expired
+	// Deleted means that the item was deleted by Del, or by Clear or
+	// Invalidate.
+	Deleted
+	// Rejected means that the policy didn't admit the item.
+	Rejected
+	// Updated means that the value of the item was replaced by a Set.
+	Updated
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictedByPolicy:
+		return "evicted"
+	case Expired:
+		return "expired"
+	case Deleted:
+		return "deleted"
+	case Rejected:
+		return "rejected"
+	case Updated:
+		return "updated"
 	default:
-		expiration = time.Now().Add(ttl)
+		return "unknown"
+	}
+}
+
+// SetIfAbsent works like Set, but only adds the item if key isn't in the cache,
+// or has expired, and never replaces its value. The check is made by the store
+// under the lock of the shard of key, both when SetIfAbsent is called and when
+// the item is admitted, so that of concurrent SetIfAbsent calls for the same
+// key, at most one value gets in. It returns false if key was found, or if the
+// item was dropped like with Set. Like with Set, the item can still be
+// rejected by the policy after SetIfAbsent returns true.
+func (c *Cache[K, V]) SetIfAbsent(key K, value V, cost int64) bool {
+	if c == nil || c.isClosed.Load() {
+		return false
 	}
+	if !c.writable() || !c.inspect(value) {
+		return false
+	}
+	start := c.traceStart()
+	i, _ := c.newItem(key, value, cost, 0)
+	i.cond = func(_ V, found bool) bool { return !found }
+	added := c.setItem(i)
+	c.traceEnd(TraceSet, i.Key, start, added)
+	return added
+}
+
+// CompareAndSwap replaces the value of key with new if it's old, and returns
+// whether it did. The comparison and the swap are made under the lock of the
+// shard of key, so that they can't race with the other writes of key. Keys not
+// found, or expired, are never swapped. Like for sync.Map.CompareAndSwap, the
+// values must be of a comparable type, or CompareAndSwap panics.
+func (c *Cache[K, V]) CompareAndSwap(key K, old, new V, cost int64) bool {
+	if c == nil || c.isClosed.Load() {
+		return false
+	}
+	if !c.writable() || !c.inspect(new) {
+		return false
+	}
+	start := c.traceStart()
+	i, _ := c.newItem(key, new, cost, 0)
+	i.cond = func(stored V, found bool) bool { return found && any(stored) == any(old) }
+	swapped := c.setItem(i)
+	c.traceEnd(TraceSet, i.Key, start, swapped)
+	return swapped
+}
+
+// SetResult is the outcome of SetWithResult.
+type SetResult int
+
+const (
+	// SetAdmitted means that the item was added to the cache.
+	SetAdmitted SetResult = iota
+	// SetReplaced means that the key was in the cache already, and that its
+	// value was replaced.
+	SetReplaced
+	// SetDropped means that the item was dropped before reaching the policy,
+	// because the internal buffers were full or the cache was closed or
+	// read-only, or that the TTL was negative.
+	SetDropped
+	// SetRejected means that the policy decided not to admit the item.
+	SetRejected
+)
+
+func (r SetResult) String() string {
+	switch r {
+	case SetAdmitted:
+		return "admitted"
+	case SetReplaced:
+		return "replaced"
+	case SetDropped:
+		return "dropped"
+	case SetRejected:
+		return "rejected"
+	default:
+		return "unknown"
+	}
+}
+
+// SetWithResult works like SetWithTTL, but returns what happened to the item,
+// which tells buffer drops apart from admission rejections. Unlike SetWithTTL,
+// it waits for the policy to decide on the admission of new items, so it's
+// slower, and blocks while the Sets buffered before it are applied.
+func (c *Cache[K, V]) SetWithResult(key K, value V, cost int64, ttl time.Duration) SetResult {
+	if c == nil || c.isClosed.Load() {
+		return SetDropped
+	}
+	if !c.writable() {
+		return SetDropped
+	}
+	start := c.traceStart()
+	i, ok := c.newItem(key, value, cost, ttl)
+	if !ok {
+		return SetDropped
+	}
+	if !c.inspect(value) {
+		return SetRejected
+	}
+	i.result = make(chan SetResult, 1)
+	var result SetResult
+	switch {
+	case !c.setItem(i):
+		result = SetDropped
+	case i.flag == itemUpdate:
+		result = SetReplaced
+	default:
+		result = <-i.result
+	}
+	c.traceEnd(TraceSet, i.Key, start, result == SetAdmitted || result == SetReplaced)
+	return result
+}
+
+// newItem returns the item to Set for key. It returns false if ttl is
+// negative, which makes the Set a no-op.
+func (c *Cache[K, V]) newItem(key K, value V, cost int64, ttl time.Duration) (*Item[V], bool) {
+	if ttl < 0 {
+		// Treat this a no-op.
+		return nil, false
+	}
+	ttl = c.ttl(key, value, ttl)
 
 	keyHash, conflictHash := c.keyToHash(key)
 	i := &Item[V]{
@@ -344,75 +1401,369 @@ func (c *Cache[K, V]) SetWithTTL(key K, value V, cost int64, ttl time.Duration)
 		Conflict:   conflictHash,
 		Value:      value,
 		Cost:       cost,
-		Expiration: expiration,
+		generation: c.storedItems.Generation(),
+	}
+	if ttl > 0 {
+		i.Expiration = ttlNow().Add(ttl)
+		if c.slidingTTL {
+			i.slide = ttl
+		}
+	}
+	return i, true
+}
+
+// expiration returns the expiration of the item of key and value Set now with
+// ttl, see Cache.ttl. It's zero if the item doesn't expire.
+func (c *Cache[K, V]) expiration(key K, value V, ttl time.Duration) time.Time {
+	if ttl = c.ttl(key, value, ttl); ttl == 0 {
+		return time.Time{}
+	}
+	return ttlNow().Add(ttl)
+}
+
+// ttl returns the TTL of the item of key and value Set with ttl, which can't
+// be negative, once Config.DefaultTTL and Config.MaxTTL, or the TTLPolicy of
+// its group, are applied. It's zero if the item doesn't expire.
+func (c *Cache[K, V]) ttl(key K, value V, ttl time.Duration) time.Duration {
+	defaultTTL, maxTTL := c.defaultTTL, c.maxTTL
+	if c.ttlGroup != nil {
+		if p, ok := c.ttlPolicies[c.ttlGroup(key, value)]; ok {
+			if p.Default > 0 {
+				defaultTTL = p.Default
+			}
+			if p.Max > 0 {
+				maxTTL = p.Max
+			}
+		}
+	}
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
+	if maxTTL > 0 && (ttl == 0 || ttl > maxTTL) {
+		ttl = maxTTL
+	}
+	return ttl
+}
+
+// inspect returns false, and counts the rejection, if Config.InspectValue
+// rejects value.
+func (c *Cache[K, V]) inspect(value V) bool {
+	if c.inspectValue == nil || c.inspectValue(value) {
+		return true
+	}
+	c.Metrics.add(rejectInspect, 1)
+	return false
+}
+
+// setItem applies i to the store if it's an update of an existing key and
+// sends it to the setBuf to be processed by the policy. It returns false if the
+// Set was dropped.
+func (c *Cache[K, V]) setItem(i *Item[V]) bool {
+	if c.storeFault(TraceSet, i.Key) {
+		c.Metrics.add(dropSets, 1)
+		return false
 	}
 	// cost is eventually updated. The expiration must also be immediately updated
 	// to prevent items from being prematurely removed from the map.
-	if prev, ok := c.storedItems.Update(i); ok {
-		c.onExit(prev)
+	c.ordered.lock(i.Key)
+	prev, ok := c.storedItems.Update(i)
+	if ok {
+		c.removed(Item[V]{
+			Key:      i.Key,
+			Conflict: i.Conflict,
+			Value:    prev,
+			Cost:     c.removalCost(i.Key),
+		}, Updated)
+	}
+	c.ordered.unlock(i.Key)
+	return c.sendItem(i, ok)
+}
+
+// sendItem sends i to the setBuf, once the store has been updated with i. ok
+// is the result of store.Update.
+func (c *Cache[K, V]) sendItem(i *Item[V], ok bool) bool {
+	if ok {
 		i.flag = itemUpdate
+	} else if i.stale {
+		return false
 	}
 	// Attempt to send item to cachePolicy.
-	select {
-	case c.setBuf <- i:
+	if c.send(i, false) {
 		return true
-	default:
-		if i.flag == itemUpdate {
-			// Return true if this was an update operation since we've already
-			// updated the storedItems. For all the other operations (set/delete), we
-			// return false which means the item was not inserted.
-			return true
+	}
+	if i.flag == itemUpdate {
+		// Return true if this was an update operation since we've already
+		// updated the storedItems. For all the other operations (set/delete), we
+		// return false which means the item was not inserted.
+		return true
+	}
+	c.Metrics.add(dropSets, 1)
+	return false
+}
+
+// Prefetch loads the value for key using loader and offers it to the cache at
+// a reduced admission priority: the item is only admitted if it fits in the
+// remaining room, so it never evicts other items. This makes Prefetch suitable
+// for background warming, which should not push out organically hot data.
+//
+// The loader is not called if the key is already present. Prefetched items are
+// counted separately in Metrics (see KeysPrefetched and PrefetchesRejected).
+// Any error returned by loader is returned as is.
+//
+// Like for a Set returning false, OnExit isn't called for a loaded value
+// dropped before reaching the policy, which never entered the cache, see
+// Metrics.SetsDropped.
+func (c *Cache[K, V]) Prefetch(key K, loader func() (V, int64, error)) error {
+	if c == nil || c.isClosed.Load() || !c.writable() {
+		return nil
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	if _, ok := c.storedItems.Get(keyHash, conflictHash); ok {
+		return nil
+	}
+	value, cost, err := loader()
+	if err != nil {
+		return err
+	}
+	if !c.inspect(value) {
+		return nil
+	}
+	i := &Item[V]{
+		flag:       itemPrefetch,
+		Key:        keyHash,
+		Conflict:   conflictHash,
+		Value:      value,
+		Cost:       cost,
+		Expiration: c.expiration(key, value, 0),
+		generation: c.storedItems.Generation(),
+	}
+	if !c.send(i, false) {
+		c.Metrics.add(dropSets, 1)
+	}
+	return nil
+}
+
+// exit calls onExit for val, a value of keyHash leaving the cache. If
+// Config.OrderedCallbacks is set, the call is queued instead, and the stripe of
+// keyHash must be locked.
+func (c *Cache[K, V]) exit(keyHash uint64, val V) {
+	if c.ordered == nil {
+		c.onExit(val)
+		return
+	}
+	c.ordered.push(keyHash, func() { c.onExit(val) })
+}
+
+// removed calls exit for the value of i, which left the cache for reason, and
+// Config.OnRemoval before it, if set. Like exit, it queues the calls if
+// Config.OrderedCallbacks is set, and the stripe of i.Key must be locked.
+func (c *Cache[K, V]) removed(i Item[V], reason EvictionReason) {
+	if c.onRemoval != nil {
+		i.Reason = reason
+		if c.ordered == nil {
+			c.onRemoval(&i)
+		} else {
+			c.ordered.push(i.Key, func() { c.onRemoval(&i) })
 		}
-		c.Metrics.add(dropSets, keyHash, 1)
-		return false
+	}
+	c.exit(i.Key, i.Value)
+}
+
+// removalCost returns the cost of keyHash in the policy, if Config.OnRemoval
+// is set. Otherwise it's not needed, and the policy lock isn't taken.
+func (c *Cache[K, V]) removalCost(keyHash uint64) int64 {
+	if c.onRemoval == nil {
+		return 0
+	}
+	return max(c.cachePolicy.Cost(keyHash), 0)
+}
+
+// Scan returns a batch of the items of the cache, and the cursor to pass to
+// the next call to Scan to get the next batch, like the SCAN command of
+// Redis. A full iteration starts with cursor 0, and ends when the returned
+// cursor is 0. The items have their Key, Conflict, Value and Expiration set.
+//
+// The batches are made of whole shards of the store, so count is only a hint:
+// a batch holds at least count items, unless the iteration ends, but may hold
+// more. Only one shard is locked at a time, and only while its items are
+// copied. Every item present during the whole iteration is returned exactly
+// once; the items Set or deleted meanwhile may or may not be.
+func (c *Cache[K, V]) Scan(cursor uint64, count int) ([]*Item[V], uint64) {
+	if c == nil || c.isClosed.Load() {
+		return nil, 0
+	}
+	var items []*Item[V]
+	for ; cursor < numShards; cursor++ {
+		if len(items) >= max(count, 1) {
+			return items, cursor
+		}
+		items = append(items, c.storedItems.Items(int(cursor))...)
+	}
+	return items, 0
+}
+
+// Range calls fn for every item of the cache, with the hashes of its key and
+// its value, until fn returns false. Like with Scan, the iteration is weakly
+// consistent, and safe with concurrent Sets and Dels: every item present during
+// the whole iteration is passed once, while the items Set or deleted meanwhile
+// may or may not be. The shards of the store are copied one at a time, and fn
+// is called without any lock held, so it can use the cache. Iterator works
+// the same way, with the items pulled by the caller.
+func (c *Cache[K, V]) Range(fn func(key, conflict uint64, value V) bool) {
+	if c == nil || c.isClosed.Load() {
+		return
+	}
+	for shard := 0; shard < int(numShards); shard++ {
+		for _, item := range c.storedItems.Items(shard) {
+			if !fn(item.Key, item.Conflict, item.Value) {
+				return
+			}
+		}
+	}
+}
+
+// Invalidate makes all the items in the cache unreachable at once, in O(1):
+// Gets miss them right away, while they're removed in the background, calling
+// OnEvict for each of them. Items Set after Invalidate returns aren't
+// affected. This is much cheaper than deleting all the keys one by one for
+// caches of derived objects that all become stale at once, e.g. when the data
+// they're derived from changes. Unlike Clear, the access frequencies
+// collected by the policy are kept.
+func (c *Cache[K, V]) Invalidate() {
+	if c == nil || c.isClosed.Load() {
+		return
+	}
+	c.storedItems.Invalidate()
+	select {
+	case c.purge <- struct{}{}:
+	default:
 	}
 }
 
 // Del deletes the key-value item from the cache if it exists.
 func (c *Cache[K, V]) Del(key K) {
-	if c == nil || c.isClosed.Load() {
+	if c == nil || c.isClosed.Load() || !c.writable() {
 		return
 	}
+	start := c.traceStart()
 	keyHash, conflictHash := c.keyToHash(key)
+	if c.storeFault(TraceDel, keyHash) {
+		return
+	}
 	// Delete immediately.
-	_, prev := c.storedItems.Del(keyHash, conflictHash)
-	c.onExit(prev)
+	c.ordered.lock(keyHash)
+	conflict, prev, found := c.storedItems.Del(keyHash, conflictHash)
+	if found {
+		c.removed(Item[V]{
+			Key:      keyHash,
+			Conflict: conflict,
+			Value:    prev,
+			Cost:     c.removalCost(keyHash),
+		}, Deleted)
+	}
+	c.ordered.unlock(keyHash)
 	// If we've set an item, it would be applied slightly later.
 	// So we must push the same item to `setBuf` with the deletion flag.
 	// This ensures that if a set is followed by a delete, it will be
 	// applied in the correct order.
-	c.setBuf <- &Item[V]{
+	c.send(&Item[V]{
 		flag:     itemDelete,
 		Key:      keyHash,
 		Conflict: conflictHash,
-	}
+	}, true)
+	c.traceEnd(TraceDel, keyHash, start, false)
 }
 
 // GetTTL returns the TTL for the specified key and a bool that is true if the
-// item was found and is not expired.
+// item was found and is not expired. The TTL is the time left before the item
+// expires, e.g. to refresh it ahead of its expiration, and zero if it doesn't
+// expire. The expiration is read along with the item, so it's never the one of
+// another value Set concurrently, or of an item removed by the TTL cleanup.
 func (c *Cache[K, V]) GetTTL(key K) (time.Duration, bool) {
-	if c == nil {
+	if c == nil || c.isClosed.Load() {
 		return 0, false
 	}
 
 	keyHash, conflictHash := c.keyToHash(key)
-	if _, ok := c.storedItems.Get(keyHash, conflictHash); !ok {
-		// not found
+	expiration, ok := c.storedItems.GetExpiration(keyHash, conflictHash)
+	if !ok {
+		// not found, or expired
 		return 0, false
 	}
-
-	expiration := c.storedItems.Expiration(keyHash)
 	if expiration.IsZero() {
 		// found but no expiration
 		return 0, true
 	}
 
-	if time.Now().After(expiration) {
-		// found but expired
+	ttl := expiration.Sub(ttlNow())
+	if ttl < 0 {
+		// expired since
 		return 0, false
 	}
+	return ttl, true
+}
+
+// TopKeys returns up to n of the keys read the most since the cache was
+// created or last cleared, by decreasing number of Gets, if Config.TopKeys is
+// set, or nil otherwise. The counts are approximate, see KeyFrequency, and n
+// can't usefully exceed Config.TopKeys.
+func (c *Cache[K, V]) TopKeys(n int) []KeyFrequency[K] {
+	if c == nil {
+		return nil
+	}
+	return c.topKeys.top(n)
+}
+
+// CacheMetrics returns c.Metrics as an api.Metrics, for c to be an
+// api.MetricsProvider. They're all zero if Config.Metrics isn't set.
+func (c *Cache[K, V]) CacheMetrics() api.Metrics {
+	if c == nil {
+		return (*Metrics)(nil)
+	}
+	return c.Metrics
+}
+
+// IsThrashing returns true if, during the last cleanup interval, the cache was
+// evicting at least as many keys as it admitted while the policy rejected more
+// than Config.ThrashThreshold of the incoming Sets. Upstream systems can use
+// this as a backpressure signal, e.g. to stop optimistic prefetching while the
+// cache is churning. It always returns false if Metrics are disabled.
+func (c *Cache[K, V]) IsThrashing() bool {
+	if c == nil || c.Metrics == nil {
+		return false
+	}
+	return c.thrashing.Load()
+}
+
+// SetReadOnly makes the cache read-only if readOnly is true, until it's called
+// again with false. A read-only cache keeps serving Gets, while it ignores the
+// Sets, Prefetches and Dels, which are counted by
+// Metrics.ReadOnlyRejections. This freezes the content of the cache, e.g.
+// during a backup or a failover, except for the expirations and the
+// evictions of idle items, which go on, and for Clear and Invalidate.
+func (c *Cache[K, V]) SetReadOnly(readOnly bool) {
+	if c == nil {
+		return
+	}
+	c.readOnly.Store(readOnly)
+}
+
+// ReadOnly returns whether the cache is read-only, see SetReadOnly.
+func (c *Cache[K, V]) ReadOnly() bool {
+	if c == nil {
+		return false
+	}
+	return c.readOnly.Load()
+}
 
-	return time.Until(expiration), true
+// writable returns false, and counts the rejection, if the cache is
+// read-only.
+func (c *Cache[K, V]) writable() bool {
+	if !c.readOnly.Load() {
+		return true
+	}
+	c.Metrics.add(rejectReadOnly, 1)
+	return false
 }
 
 // Close stops all goroutines and closes all channels.
@@ -420,6 +1771,11 @@ func (c *Cache[K, V]) Close() {
 	if c == nil || c.isClosed.Load() {
 		return
 	}
+	// The items are kept in the store file for the next cache, see
+	// Config.MmapStorePath.
+	if s, ok := c.storedItems.(*mmapStore[V]); ok {
+		_ = s.close()
+	}
 	c.Clear()
 
 	// Block until processItems goroutine is returned.
@@ -428,8 +1784,12 @@ func (c *Cache[K, V]) Close() {
 	close(c.stop)
 	close(c.done)
 	close(c.setBuf)
+	c.expiry.close()
 	c.cachePolicy.Close()
 	c.cleanupTicker.Stop()
+	if c.auditTicker != nil {
+		c.auditTicker.Stop()
+	}
 	c.isClosed.Store(true)
 }
 
@@ -444,34 +1804,48 @@ func (c *Cache[K, V]) Clear() {
 	c.stop <- struct{}{}
 	<-c.done
 
-	// Clear out the setBuf channel.
+	// Clear out the setBuf channel, then the spilled items, which were sent
+	// after it.
+	drop := func(i *Item[V]) {
+		if i.wg != nil {
+			i.wg.Done()
+			return
+		}
+		if i.flag != itemUpdate && i.flag != itemDelete {
+			// In itemUpdate, the value is already set in the storedItems.  So, no need to call
+			// onEvict here. In itemDelete, the value already left, in Del.
+			i.Reason = Deleted
+			c.onEvict(i)
+		}
+		i.report(SetDropped)
+	}
 loop:
 	for {
 		select {
 		case i := <-c.setBuf:
-			if i.wg != nil {
-				i.wg.Done()
-				continue
-			}
-			if i.flag != itemUpdate {
-				// In itemUpdate, the value is already set in the storedItems.  So, no need to call
-				// onEvict here.
-				c.onEvict(i)
-			}
+			drop(i)
 		default:
 			break loop
 		}
 	}
+	for _, i := range c.spill.drain() {
+		drop(i)
+	}
 
 	// Clear value hashmap and cachePolicy data.
 	c.cachePolicy.Clear()
-	c.storedItems.Clear(c.onEvict)
+	c.idle.clear()
+	c.topKeys.clear()
+	c.storedItems.Clear(func(i *Item[V]) {
+		i.Reason = Deleted
+		c.onEvict(i)
+	})
 	// Only reset metrics if they're enabled.
 	if c.Metrics != nil {
 		c.Metrics.Clear()
 	}
 	// Restart processItems goroutine.
-	go c.processItems()
+	withLabels(c.name, "processItems", func() { go c.processItems() })
 }
 
 // MaxCost returns the max cost of the cache.
@@ -490,6 +1864,16 @@ func (c *Cache[K, V]) UpdateMaxCost(maxCost int64) {
 	c.cachePolicy.UpdateMaxCost(maxCost)
 }
 
+// UpdateTtlTickerDuration changes how often expired items are cleaned up, like
+// Config.TtlTickerDurationInSec does at creation. It's a no-op if secs isn't
+// positive.
+func (c *Cache[K, V]) UpdateTtlTickerDuration(secs int64) {
+	if c == nil || c.isClosed.Load() || secs <= 0 {
+		return
+	}
+	c.cleanupTicker.Reset(time.Duration(secs) * time.Second / 2)
+}
+
 // processItems is ran by goroutines processing the Set buffer.
 func (c *Cache[K, V]) processItems() {
 	startTs := make(map[uint64]time.Time)
@@ -510,6 +1894,7 @@ func (c *Cache[K, V]) processItems() {
 		}
 	}
 	onEvict := func(i *Item[V]) {
+		c.idle.del(i.Key)
 		if ts, has := startTs[i.Key]; has {
 			c.Metrics.trackEviction(int64(time.Since(ts) / time.Second))
 			delete(startTs, i.Key)
@@ -518,48 +1903,176 @@ func (c *Cache[K, V]) processItems() {
 			c.onEvict(i)
 		}
 	}
-
-	for {
-		select {
-		case i := <-c.setBuf:
-			if i.wg != nil {
-				i.wg.Done()
-				continue
+	onExpire := func(i *Item[V]) {
+		i.Reason = Expired
+		// The keys deleted since they were set to expire have no expiration.
+		if !i.Expiration.IsZero() {
+			if dropped := c.expiry.notify(i); dropped > 0 {
+				c.Metrics.add(dropExpiry, uint64(dropped))
 			}
-			// Calculate item cost value if new or update.
-			if i.Cost == 0 && c.cost != nil && i.flag != itemDelete {
-				i.Cost = c.cost(i.Value)
+		}
+		onEvict(i)
+	}
+
+	var window thrashWindow
+	// The purge of the invalidated items goes through the shards of the store
+	// one by one, starting over if the cache is invalidated again meanwhile.
+	var purgeShard int
+	var purgeGeneration uint64
+	// The audits go through the shards of the store one by one.
+	var audit <-chan time.Time
+	if c.auditTicker != nil {
+		audit = c.auditTicker.C
+	}
+	var auditShard int
+
+	// batch holds the new items waiting for the policy, see setBatchSize.
+	batch := make([]*Item[V], 0, setBatchSize)
+	pairs := make([]policyPair, 0, setBatchSize)
+	admitBatch := func() {
+		if len(batch) == 0 {
+			return
+		}
+		for _, i := range batch {
+			if pp, ok := c.cachePolicy.(penaltyPolicy); ok && i.penalty != 0 {
+				pp.setPenalty(i.Key, i.penalty)
 			}
-			if !c.ignoreInternalCost {
-				// Add the cost of internally storing the object.
-				i.Cost += itemSize
+			pairs = append(pairs, policyPair{key: i.Key, cost: i.Cost})
+		}
+		for j, res := range c.cachePolicy.AddBatch(pairs) {
+			i := batch[j]
+			if res.added {
+				c.storedItems.Set(i)
+				c.idle.add(i.Key, i.Cost)
+				c.Metrics.add(keyAdd, 1)
+				c.Metrics.add(fetchAdd, uint64(i.fetchCost))
+				trackAdmission(i.Key)
+				i.report(SetAdmitted)
+			} else {
+				c.onReject(i)
+				i.report(SetRejected)
 			}
-
-			switch i.flag {
-			case itemNew:
-				victims, added := c.cachePolicy.Add(i.Key, i.Cost)
-				if added {
-					c.storedItems.Set(i)
-					c.Metrics.add(keyAdd, i.Key, 1)
-					trackAdmission(i.Key)
-				} else {
-					c.onReject(i)
-				}
-				for _, victim := range victims {
-					victim.Conflict, victim.Value = c.storedItems.Del(victim.Key, 0)
+			for _, victim := range res.victims {
+				var found bool
+				victim.Conflict, victim.Value, found = c.storedItems.Del(victim.Key, 0)
+				// The victims deleted from the store since, e.g. by Del,
+				// already left the cache.
+				if found {
 					onEvict(victim)
 				}
+			}
+		}
+		clear(batch)
+		batch, pairs = batch[:0], pairs[:0]
+	}
 
-			case itemUpdate:
-				c.cachePolicy.Update(i.Key, i.Cost)
+	process := func(i *Item[V]) {
+		if i.wg != nil {
+			admitBatch()
+			i.wg.Done()
+			return
+		}
+		// Calculate item cost value if new or update.
+		if i.Cost == 0 && c.cost != nil && i.flag != itemDelete {
+			i.Cost = c.cost(i.Value)
+		}
+		if i.metadata != nil {
+			i.Cost += i.metadata.cost
+		}
+		if !c.ignoreInternalCost {
+			// Add the cost of internally storing the object.
+			i.Cost += itemSize
+		}
 
-			case itemDelete:
+		if i.flag == itemNew {
+			batch = append(batch, i)
+			return
+		}
+		// The items are applied in order: admit the previous new items
+		// first.
+		admitBatch()
+
+		switch i.flag {
+		case itemPrefetch:
+			if c.cachePolicy.AddIfRoom(i.Key, i.Cost) {
+				c.storedItems.Set(i)
+				c.idle.add(i.Key, i.Cost)
+				c.Metrics.add(keyPrefetch, 1)
+				trackAdmission(i.Key)
+			} else {
+				c.Metrics.add(rejectPrefetch, 1)
+				c.onReject(i)
+			}
+
+		case itemUpdate:
+			c.cachePolicy.Update(i.Key, i.Cost)
+			c.idle.update(i.Key, i.Cost)
+			c.Metrics.add(fetchAdd, uint64(i.fetchCost))
+
+		case itemDelete:
+			cost := c.removalCost(i.Key)
+			c.cachePolicy.Del(i.Key) // Deals with metrics updates.
+			c.idle.del(i.Key)
+			// Deleted keys aren't evicted, forget them so that they don't
+			// take the place of resident keys in startTs.
+			delete(startTs, i.Key)
+			c.ordered.lock(i.Key)
+			conflict, val, found := c.storedItems.Del(i.Key, i.Conflict)
+			if found {
+				c.removed(Item[V]{Key: i.Key, Conflict: conflict, Value: val, Cost: cost}, Deleted)
+			}
+			c.ordered.unlock(i.Key)
+		}
+	}
+
+	for {
+		select {
+		case i := <-c.setBuf:
+			c.stallPolicy()
+			// Take the items available in setBuf, up to setBatchSize of them
+			// and for up to setBatchWait.
+			deadline := z.NanoTime() + int64(setBatchWait)
+			for n := 1; i != nil; n++ {
+				process(i)
+				i = nil
+				if n < setBatchSize && z.NanoTime() < deadline {
+					select {
+					case i = <-c.setBuf:
+					default:
+					}
+				}
+			}
+			admitBatch()
+			c.spill.pump(c.setBuf)
+		case <-c.purge:
+			if g := c.storedItems.Generation(); g != purgeGeneration {
+				purgeShard, purgeGeneration = 0, g
+			}
+			if purgeShard >= int(numShards) {
+				continue
+			}
+			for _, i := range c.storedItems.Purge(purgeShard) {
+				i.Cost = c.cachePolicy.Cost(i.Key)
+				i.Reason = Deleted
 				c.cachePolicy.Del(i.Key) // Deals with metrics updates.
-				_, val := c.storedItems.Del(i.Key, i.Conflict)
-				c.onExit(val)
+				onEvict(i)
+			}
+			if purgeShard++; purgeShard < int(numShards) {
+				select {
+				case c.purge <- struct{}{}:
+				default:
+				}
 			}
 		case <-c.cleanupTicker.C:
-			c.storedItems.Cleanup(c.cachePolicy, onEvict)
+			c.spill.pump(c.setBuf)
+			c.storedItems.Cleanup(c.cachePolicy, onExpire)
+			c.evictIdle(onEvict)
+			c.updateThrashing(&window)
+		case <-audit:
+			orphans, expired := c.storedItems.Audit(c.cachePolicy, onExpire, auditShard)
+			c.Metrics.add(ttlOrphan, uint64(orphans))
+			c.Metrics.add(ttlExpired, uint64(expired))
+			auditShard = (auditShard + 1) % int(numShards)
 		case <-c.stop:
 			c.done <- struct{}{}
 			return
@@ -567,11 +2080,76 @@ func (c *Cache[K, V]) processItems() {
 	}
 }
 
-// collectMetrics just creates a new *Metrics instance and adds the pointers
-// to the cache and policy instances.
-func (c *Cache[K, V]) collectMetrics() {
-	c.Metrics = newMetrics()
-	c.cachePolicy.CollectMetrics(c.Metrics)
+// evictIdle evicts the items that have been idle for at least maxIdleTime, if
+// set.
+func (c *Cache[K, V]) evictIdle(onEvict func(*Item[V])) {
+	if c.maxIdleTime <= 0 {
+		return
+	}
+	for _, key := range c.idle.idleKeys(c.maxIdleTime) {
+		cost := c.cachePolicy.Cost(key)
+		c.cachePolicy.Del(key) // Deals with metrics updates.
+		conflict, value, found := c.storedItems.Del(key, 0)
+		// Like the victims, the keys deleted from the store since, e.g. by
+		// Del, already left the cache.
+		if !found {
+			continue
+		}
+		c.Metrics.add(keyIdleEvict, 1)
+		onEvict(&Item[V]{
+			Key:      key,
+			Conflict: conflict,
+			Value:    value,
+			Cost:     cost,
+			Reason:   Expired,
+		})
+	}
+}
+
+// defaultThrashThreshold is used when Config.ThrashThreshold is not set.
+const defaultThrashThreshold = 0.5
+
+// thrashWindow holds the counters seen at the end of the previous cleanup
+// interval, so that thrashing is judged on recent activity only.
+type thrashWindow struct {
+	added, evicted, rejected uint64
+}
+
+// updateThrashing recomputes the thrashing state from the metrics collected
+// since the previous call.
+func (c *Cache[K, V]) updateThrashing(prev *thrashWindow) {
+	if c.Metrics == nil {
+		return
+	}
+	cur := thrashWindow{
+		added:    c.Metrics.KeysAdded(),
+		evicted:  c.Metrics.KeysEvicted(),
+		rejected: c.Metrics.SetsRejected(),
+	}
+	added, evicted, rejected := cur.added-prev.added, cur.evicted-prev.evicted,
+		cur.rejected-prev.rejected
+	*prev = cur
+	c.thrashing.Store(added > 0 && thrashIndex(added, evicted) >= 1 &&
+		denialRate(added, rejected) > c.thrashThreshold)
+}
+
+// collectMetrics adds the pointers to m, or to a new *Metrics instance if m is
+// nil, to the cache and policy instances.
+func (c *Cache[K, V]) collectMetrics(m *Metrics) {
+	if m == nil {
+		m = newMetrics()
+	}
+	c.Metrics = m
+	if c.idle != nil {
+		m.mu.Lock()
+		m.idle = append(m.idle, c.idle)
+		m.mu.Unlock()
+	}
+	m.mu.Lock()
+	m.queues = append(m.queues, c.queueDepths)
+	m.bufferItems = append(m.bufferItems, c.getBuf.Capacity)
+	m.mu.Unlock()
+	c.cachePolicy.CollectMetrics(m)
 }
 
 type metricType int
@@ -594,6 +2172,42 @@ const (
 	// floor.
 	dropGets
 	keepGets
+	// The following 2 keep track of how many prefetched keys were added and
+	// rejected.
+	keyPrefetch
+	rejectPrefetch
+	// The following keeps track of how many new keys were found in the ghost
+	// list of recently evicted keys.
+	ghostHit
+	// The following keeps track of how many keys were evicted for being idle
+	// for longer than Config.MaxIdleTime.
+	keyIdleEvict
+	// The following keeps track of how many keys were admitted for being Set
+	// again shortly after being rejected.
+	retryAdmit
+	// The following keeps track of how many item costs were corrected by
+	// Config.RecalculateCosts.
+	costFix
+	// The following keeps track of how many values were rejected by
+	// Config.InspectValue.
+	rejectInspect
+	// The following keeps track of how many writes were rejected for the
+	// cache being read-only, see SetReadOnly.
+	rejectReadOnly
+	// The following keeps track of how many Sets, Dels and Waits were spilled,
+	// see Config.SpillLimit.
+	spillSets
+	// The following keeps track of how many notifications of
+	// ExpiryNotifications were dropped for their channels being full.
+	dropExpiry
+	// The following 2 keep track of the fetch costs, in nanoseconds, of the
+	// items Set and of the hits, see SetOptions.FetchCost.
+	fetchAdd
+	fetchSaved
+	// The following 2 keep track of the repairs of the expiration metadata by
+	// the audits of Config.TTLAuditInterval.
+	ttlOrphan
+	ttlExpired
 	// This should be the final enum. Other enums should be set before this.
 	doNotUse
 )
@@ -622,6 +2236,34 @@ func stringFor(t metricType) string {
 		return "gets-dropped"
 	case keepGets:
 		return "gets-kept"
+	case keyPrefetch:
+		return "keys-prefetched"
+	case rejectPrefetch:
+		return "prefetches-rejected"
+	case ghostHit:
+		return "ghost-hits"
+	case keyIdleEvict:
+		return "keys-idle-evicted"
+	case retryAdmit:
+		return "retries-admitted"
+	case costFix:
+		return "costs-corrected"
+	case rejectInspect:
+		return "inspector-rejections"
+	case rejectReadOnly:
+		return "read-only-rejections"
+	case spillSets:
+		return "sets-spilled"
+	case dropExpiry:
+		return "expiry-notifications-dropped"
+	case fetchAdd:
+		return "fetch-ns-added"
+	case fetchSaved:
+		return "fetch-ns-saved"
+	case ttlOrphan:
+		return "ttl-orphans-repaired"
+	case ttlExpired:
+		return "ttl-expired-repaired"
 	default:
 		return "unidentified"
 	}
@@ -629,47 +2271,80 @@ func stringFor(t metricType) string {
 
 // Metrics is a snapshot of performance statistics for the lifetime of a cache instance.
 type Metrics struct {
-	all [doNotUse][]*uint64
+	counters *counterSet
+	// epoch is the number of times the metrics were restored, see Restore.
+	epoch atomic.Uint64
+
+	// costs counts the resident keys by cost.
+	costs costHistogram
 
 	mu   sync.RWMutex
 	life *z.HistogramData // Tracks the life expectancy of a key.
+	idle []*idleTracker   // Track the idle time of keys, if enabled.
+	// queues report the depths of the internal queues of the caches, and
+	// bufferItems the sizes of their Get buffers.
+	queues      []func() QueueDepths
+	bufferItems []func() int64
+	// latencies is set if Config.DetailedMetrics is.
+	latencies atomic.Pointer[latencies]
 }
 
 func newMetrics() *Metrics {
-	s := &Metrics{
-		life: z.NewHistogramData(z.HistogramBounds(1, 16)),
+	return &Metrics{
+		counters: newCounterSet(doNotUse),
+		costs:    newCostHistogram(),
+		life:     z.NewHistogramData(z.HistogramBounds(1, 16)),
 	}
-	for i := 0; i < doNotUse; i++ {
-		s.all[i] = make([]*uint64, 256)
-		slice := s.all[i]
-		for j := range slice {
-			slice[j] = new(uint64)
-		}
+}
+
+// trackAdd records the admission of key with the given cost.
+func (p *Metrics) trackAdd(key uint64, cost int64) {
+	if p == nil {
+		return
+	}
+	p.add(costAdd, uint64(cost))
+	p.costs.add(cost, 1)
+}
+
+// trackUpdate records the update of the cost of key from prev to cost.
+func (p *Metrics) trackUpdate(key uint64, prev, cost int64) {
+	if p == nil {
+		return
 	}
-	return s
+	p.costs.add(prev, -1)
+	p.costs.add(cost, 1)
+	p.add(keyUpdate, 1)
+	if prev > cost {
+		diff := prev - cost
+		p.add(costAdd, ^(uint64(diff) - 1))
+	} else if cost > prev {
+		diff := cost - prev
+		p.add(costAdd, uint64(diff))
+	}
+}
+
+// trackEvict records the eviction of key, which had the given cost.
+func (p *Metrics) trackEvict(key uint64, cost int64) {
+	if p == nil {
+		return
+	}
+	p.costs.add(cost, -1)
+	p.add(costEvict, uint64(cost))
+	p.add(keyEvict, 1)
 }
 
-func (p *Metrics) add(t metricType, hash, delta uint64) {
+func (p *Metrics) add(t metricType, delta uint64) {
 	if p == nil {
 		return
 	}
-	valp := p.all[t]
-	// Avoid false sharing by padding at least 64 bytes of space between two
-	// atomic counters which would be incremented.
-	idx := (hash % 25) * 10
-	atomic.AddUint64(valp[idx], delta)
+	p.counters.add(int(t), delta)
 }
 
 func (p *Metrics) get(t metricType) uint64 {
 	if p == nil {
 		return 0
 	}
-	valp := p.all[t]
-	var total uint64
-	for i := range valp {
-		total += atomic.LoadUint64(valp[i])
-	}
-	return total
+	return p.counters.load(int(t))
 }
 
 // Hits is the number of Get calls where a value was found for the corresponding key.
@@ -729,6 +2404,99 @@ func (p *Metrics) GetsKept() uint64 {
 	return p.get(keepGets)
 }
 
+// KeysPrefetched is the number of Prefetch calls where a new key-value item was
+// added.
+func (p *Metrics) KeysPrefetched() uint64 {
+	return p.get(keyPrefetch)
+}
+
+// PrefetchesRejected is the number of Prefetch calls whose item didn't fit in
+// the remaining room of the cache.
+func (p *Metrics) PrefetchesRejected() uint64 {
+	return p.get(rejectPrefetch)
+}
+
+// GhostHits is the number of new items that had been evicted recently, as
+// remembered by the ghost list (see Config.GhostListSize), the ghost queue
+// of PolicyS3FIFO or the ghost lists of PolicyARC. A high number of ghost hits
+// means that eviction decisions are often wrong.
+func (p *Metrics) GhostHits() uint64 {
+	return p.get(ghostHit)
+}
+
+// KeysIdleEvicted is the number of keys evicted for not being accessed for
+// Config.MaxIdleTime. They're also counted by KeysEvicted.
+func (p *Metrics) KeysIdleEvicted() uint64 {
+	return p.get(keyIdleEvict)
+}
+
+// RetriesAdmitted is the number of items admitted unconditionally because they
+// had been rejected less than Config.RetryAdmitWindow ago.
+func (p *Metrics) RetriesAdmitted() uint64 {
+	return p.get(retryAdmit)
+}
+
+// CostsCorrected is the number of item costs corrected in the policy because
+// they differed from the cost computed again by Config.RecalculateCosts.
+func (p *Metrics) CostsCorrected() uint64 {
+	return p.get(costFix)
+}
+
+// InspectorRejections is the number of values skipped by Set and Prefetch
+// because Config.InspectValue rejected them.
+func (p *Metrics) InspectorRejections() uint64 {
+	return p.get(rejectInspect)
+}
+
+// ReadOnlyRejections is the number of Sets, Prefetches and Dels ignored
+// because the cache was read-only, see Cache.SetReadOnly.
+func (p *Metrics) ReadOnlyRejections() uint64 {
+	return p.get(rejectReadOnly)
+}
+
+// SetsSpilled is the number of Sets, Dels and Waits which found the internal
+// buffer of the cache full and waited in the spill queue instead of being
+// dropped or blocking, see Config.SpillLimit.
+func (p *Metrics) SetsSpilled() uint64 {
+	return p.get(spillSets)
+}
+
+// ExpiryNotificationsDropped is the number of notifications of
+// Cache.ExpiryNotifications dropped because their consumers lagged behind.
+func (p *Metrics) ExpiryNotificationsDropped() uint64 {
+	return p.get(dropExpiry)
+}
+
+// FetchTimeAdded is the sum of the fetch costs of the values admitted to the
+// cache or replacing others with one, see SetOptions.FetchCost: the time spent
+// fetching the values put in the cache. The Sets dropped or rejected aren't
+// counted.
+func (p *Metrics) FetchTimeAdded() time.Duration {
+	return time.Duration(p.get(fetchAdd))
+}
+
+// FetchTimeSaved estimates the time the cache saved, the sum of the fetch costs
+// of the items hit, see SetOptions.FetchCost. It's cumulative, like the other
+// counters: the time saved per interval is the difference between two
+// readings, and its ratio to FetchTimeAdded over the same interval tells how
+// much the cache gives back for the fetches it takes.
+func (p *Metrics) FetchTimeSaved() time.Duration {
+	return time.Duration(p.get(fetchSaved))
+}
+
+// TTLOrphansRepaired is the number of keys the audits removed from the
+// expiration buckets for their items being gone, or expiring in another
+// bucket, see Config.TTLAuditInterval.
+func (p *Metrics) TTLOrphansRepaired() uint64 {
+	return p.get(ttlOrphan)
+}
+
+// TTLExpiredRepaired is the number of expired items the audits evicted for
+// being missing from the expiration buckets, see Config.TTLAuditInterval.
+func (p *Metrics) TTLExpiredRepaired() uint64 {
+	return p.get(ttlExpired)
+}
+
 // Ratio is the number of Hits over all accesses (Hits + Misses). This is the
 // percentage of successful Get calls.
 func (p *Metrics) Ratio() float64 {
@@ -742,6 +2510,38 @@ func (p *Metrics) Ratio() float64 {
 	return float64(hits) / float64(hits+misses)
 }
 
+// ThrashIndex is the number of keys evicted per key added. A value close to or
+// above 1 means that every admission is paid for with an eviction.
+func (p *Metrics) ThrashIndex() float64 {
+	if p == nil {
+		return 0.0
+	}
+	return thrashIndex(p.get(keyAdd), p.get(keyEvict))
+}
+
+// AdmissionDenialRate is the number of Sets rejected by the policy over all
+// Sets that reached the policy (KeysAdded + SetsRejected).
+func (p *Metrics) AdmissionDenialRate() float64 {
+	if p == nil {
+		return 0.0
+	}
+	return denialRate(p.get(keyAdd), p.get(rejectSets))
+}
+
+func thrashIndex(added, evicted uint64) float64 {
+	if added == 0 {
+		return 0.0
+	}
+	return float64(evicted) / float64(added)
+}
+
+func denialRate(added, rejected uint64) float64 {
+	if added == 0 && rejected == 0 {
+		return 0.0
+	}
+	return float64(rejected) / float64(added+rejected)
+}
+
 func (p *Metrics) trackEviction(numSeconds int64) {
 	if p == nil {
 		return
@@ -751,6 +2551,11 @@ func (p *Metrics) trackEviction(numSeconds int64) {
 	p.life.Update(numSeconds)
 }
 
+// LifeExpectancySeconds returns the distribution of the age of the items when
+// they were evicted or expired, in seconds since they were admitted. Mostly
+// young victims mean that the cache is too small for its working set, while
+// old ones mean that evictions hit stale items, as intended. Only the ages of
+// up to 100000 items admitted last are known at any time.
 func (p *Metrics) LifeExpectancySeconds() *z.HistogramData {
 	if p == nil {
 		return nil
@@ -760,14 +2565,124 @@ func (p *Metrics) LifeExpectancySeconds() *z.HistogramData {
 	return p.life.Copy()
 }
 
+// IdleTimeSeconds returns the distribution of the time since the last access of
+// the items in the cache, in seconds. It's nil if Config.TrackIdleTime isn't
+// set. Computing it goes through all the items.
+func (p *Metrics) IdleTimeSeconds() *z.HistogramData {
+	if p == nil {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.idle) == 0 {
+		return nil
+	}
+	h := z.NewHistogramData(z.HistogramBounds(1, 16))
+	for _, t := range p.idle {
+		t.updateHistogram(h)
+	}
+	return h
+}
+
+// IdleCost returns the total cost of the items that haven't been accessed for
+// at least d, which shows how much of MaxCost is used by items that aren't
+// needed anymore. It's 0 if Config.TrackIdleTime isn't set. Computing it goes
+// through all the items.
+func (p *Metrics) IdleCost(d time.Duration) uint64 {
+	if p == nil {
+		return 0
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var cost uint64
+	for _, t := range p.idle {
+		cost += t.idleCost(d)
+	}
+	return cost
+}
+
+// QueueDepths holds the depths of the internal queues of a cache at one point
+// in time. Writes are dropped when SetBuf reaches SetBufCap, unless they can be
+// spilled (see Config.SpillLimit), and delayed while the backlogs grow.
+type QueueDepths struct {
+	// SetBuf is the number of Sets, Dels and Waits waiting to be applied.
+	SetBuf int
+	// SetBufCap is the capacity of the buffer of SetBuf.
+	SetBufCap int
+	// EvictionBacklog is the cost of the items in the cache beyond MaxCost,
+	// e.g. after MaxCost was lowered with UpdateMaxCost. It's evicted as new
+	// items are admitted.
+	EvictionBacklog int64
+	// CleanupBacklog is the number of expired items waiting for the next TTL
+	// cleanup.
+	CleanupBacklog int
+	// Spill is the number of items waiting in the spill queue, see
+	// Config.SpillLimit, and SpillAge is how long the oldest one has waited.
+	Spill    int
+	SpillAge time.Duration
+}
+
+// queueDepths returns the current depths of the internal queues of c.
+func (c *Cache[K, V]) queueDepths() QueueDepths {
+	spill, spillAge := c.spill.stats()
+	return QueueDepths{
+		SetBuf:          len(c.setBuf),
+		SetBufCap:       cap(c.setBuf),
+		EvictionBacklog: max(0, -c.cachePolicy.Cap()),
+		CleanupBacklog:  c.storedItems.CleanupBacklog(),
+		Spill:           spill,
+		SpillAge:        spillAge,
+	}
+}
+
+// QueueDepths returns the current depths of the internal queues of the cache,
+// summed over all the partitions of a PartitionedCache, except for SpillAge,
+// which is the oldest of the partitions.
+func (p *Metrics) QueueDepths() QueueDepths {
+	var d QueueDepths
+	if p == nil {
+		return d
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, queues := range p.queues {
+		q := queues()
+		d.SetBuf += q.SetBuf
+		d.SetBufCap += q.SetBufCap
+		d.EvictionBacklog += q.EvictionBacklog
+		d.CleanupBacklog += q.CleanupBacklog
+		d.Spill += q.Spill
+		d.SpillAge = max(d.SpillAge, q.SpillAge)
+	}
+	return d
+}
+
+// BufferItems returns the current size of the Get buffers, which is
+// Config.BufferItems unless Config.MaxBufferItems lets it adapt. For a
+// PartitionedCache, it's the largest of the partitions.
+func (p *Metrics) BufferItems() int64 {
+	if p == nil {
+		return 0
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var size int64
+	for _, bufferItems := range p.bufferItems {
+		size = max(size, bufferItems())
+	}
+	return size
+}
+
 // Clear resets all the metrics.
 func (p *Metrics) Clear() {
 	if p == nil {
 		return
 	}
-	for i := 0; i < doNotUse; i++ {
-		for j := range p.all[i] {
-			atomic.StoreUint64(p.all[i][j], 0)
+	p.counters.reset()
+	p.costs.clear()
+	if l := p.latencies.Load(); l != nil {
+		for i := range l {
+			l[i].clear()
 		}
 	}
 	p.mu.Lock()
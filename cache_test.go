@@ -6,12 +6,14 @@
 package ristretto
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -121,6 +123,29 @@ func TestUpdateMaxCost(t *testing.T) {
 	c.Del(1)
 }
 
+func TestUpdateTtlTickerDuration(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:            100,
+		MaxCost:                10,
+		BufferItems:            64,
+		TtlTickerDurationInSec: 3600,
+	})
+	require.NoError(t, err)
+	c.UpdateTtlTickerDuration(1)
+	c.UpdateTtlTickerDuration(0)
+	c.Close()
+	// A closed cache doesn't restart its ticker.
+	c.UpdateTtlTickerDuration(1)
+	select {
+	case <-c.cleanupTicker.C:
+		t.Fatal("the ticker of a closed cache ticked")
+	case <-time.After(time.Second):
+	}
+
+	c = nil
+	c.UpdateTtlTickerDuration(1)
+}
+
 func TestNewCache(t *testing.T) {
 	_, err := NewCache(&Config[int, int]{
 		NumCounters: 0,
@@ -321,94 +346,1196 @@ func TestCacheProcessItems(t *testing.T) {
 	c.setBuf <- &Item[int]{flag: itemNew}
 }
 
-func TestCacheGet(t *testing.T) {
+func TestCacheOnReject(t *testing.T) {
+	var mu sync.Mutex
+	rejected := make(map[uint64]int)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		OnReject: func(item *Item[int]) {
+			mu.Lock()
+			defer mu.Unlock()
+			require.Equal(t, int64(11), item.Cost)
+			rejected[item.Key] = item.Value
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, 1, 1))
+	require.True(t, c.Set(2, 2, 11), "the policy rejects it asynchronously")
+	c.Wait()
+	key, _ := z.KeyToHash(2)
+	mu.Lock()
+	require.Equal(t, map[uint64]int{key: 2}, rejected)
+	mu.Unlock()
+	_, ok := c.Get(2)
+	require.False(t, ok)
+}
+
+func TestCacheOnEvictRateLimit(t *testing.T) {
+	var evicted, exited int
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		OnEvictRateLimit:   1,
+		OnEvict: func(item *Item[int]) {
+			evicted++
+		},
+		OnExit: func(val int) {
+			exited++
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	// Each new item evicts an old one.
+	for i := 10; i < 20; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	require.Equal(t, 10, exited)
+	require.Equal(t, 1, evicted)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters:      100,
+		MaxCost:          10,
+		BufferItems:      64,
+		OnEvictRateLimit: -1,
+	})
+	require.EqualError(t, err, "OnEvictRateLimit can't be negative number")
+}
+
+func TestCacheOnRemoval(t *testing.T) {
+	type removal struct {
+		reason EvictionReason
+		key    int
+		value  int
+		cost   int64
+	}
+	var mu sync.Mutex
+	var removals []removal
+	var evicted []EvictionReason
+	// take returns the removals since the previous call.
+	take := func() []removal {
+		mu.Lock()
+		defer mu.Unlock()
+		taken := removals
+		removals = nil
+		return taken
+	}
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:            100,
+		MaxCost:                1,
+		BufferItems:            64,
+		IgnoreInternalCost:     true,
+		TtlTickerDurationInSec: 1,
+		OnEvict: func(item *Item[int]) {
+			mu.Lock()
+			defer mu.Unlock()
+			evicted = append(evicted, item.Reason)
+		},
+		OnRemoval: func(item *Item[int]) {
+			mu.Lock()
+			defer mu.Unlock()
+			// The keys are ints, hashed to themselves.
+			removals = append(removals, removal{item.Reason, int(item.Key), item.Value, item.Cost})
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, 10, 1))
+	c.Wait()
+	require.Empty(t, take())
+	require.True(t, c.Set(1, 11, 1))
+	c.Wait()
+	require.Equal(t, []removal{{Updated, 1, 10, 1}}, take())
+	c.Del(1)
+	c.Wait()
+	require.Equal(t, []removal{{Deleted, 1, 11, 1}}, take())
+	c.Del(1)
+	c.Wait()
+	require.Empty(t, take())
+
+	// The pipelines report the updates and deletions too.
+	require.True(t, c.Set(2, 20, 1))
+	c.Wait()
+	p := c.Pipeline()
+	p.Set(2, 21, 1)
+	p.Del(2)
+	p.Exec()
+	c.Wait()
+	require.Equal(t, []removal{{Updated, 2, 20, 1}, {Deleted, 2, 21, 1}}, take())
+
+	// 3 evicts 2, but 4 is rejected for being less frequent than 3.
+	require.True(t, c.Set(2, 20, 1))
+	c.Wait()
+	require.True(t, c.Set(3, 30, 1))
+	c.Wait()
+	require.Equal(t, []removal{{EvictedByPolicy, 2, 20, 1}}, take())
+	p2 := c.cachePolicy.(*defaultPolicy[int])
+	keyHash, _ := z.KeyToHash(3)
+	p2.Lock()
+	p2.admit.Increment(keyHash)
+	p2.Unlock()
+	require.True(t, c.Set(4, 40, 1))
+	c.Wait()
+	require.Equal(t, []removal{{Rejected, 4, 40, 1}}, take())
+
+	// Expired items are reported as such to OnEvict too.
+	sm := c.storedItems.(*shardedMap[int])
+	expired := time.Now().Add(-10 * time.Second)
+	sm.Set(&Item[int]{Key: keyHash, Value: 30, Expiration: expired})
+	sm.expiryMap.Lock()
+	sm.expiryMap.lastCleanedBucketNum = storageBucket(expired) - 1
+	sm.expiryMap.Unlock()
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(removals) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []removal{{Expired, 3, 30, 1}}, take())
+	mu.Lock()
+	require.Equal(t, []EvictionReason{EvictedByPolicy, Expired}, evicted)
+	mu.Unlock()
+
+	require.Equal(t, "evicted", EvictedByPolicy.String())
+	require.Equal(t, "expired", Expired.String())
+	require.Equal(t, "deleted", Deleted.String())
+	require.Equal(t, "rejected", Rejected.String())
+	require.Equal(t, "updated", Updated.String())
+	require.Equal(t, "unknown", EvictionReason(-1).String())
+}
+
+func TestCacheGet(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+
+	key, conflict := z.KeyToHash(1)
+	i := Item[int]{
+		Key:      key,
+		Conflict: conflict,
+		Value:    1,
+	}
+	c.storedItems.Set(&i)
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.NotNil(t, val)
+
+	val, ok = c.Get(2)
+	require.False(t, ok)
+	require.Zero(t, val)
+
+	// 0.5 and not 1.0 because we tried Getting each item twice
+	require.Equal(t, 0.5, c.Metrics.Ratio())
+
+	c = nil
+	val, ok = c.Get(0)
+	require.False(t, ok)
+	require.Zero(t, val)
+}
+
+func TestCacheGetQuiet(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		TrackIdleTime:      true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+
+	for i := 0; i < 1000; i++ {
+		val, ok := c.GetQuiet(1)
+		require.True(t, ok)
+		require.Equal(t, 1, val)
+		_, ok = c.GetQuiet(2)
+		require.False(t, ok)
+	}
+	time.Sleep(wait)
+	require.Zero(t, c.Metrics.Hits())
+	require.Zero(t, c.Metrics.Misses())
+	require.Zero(t, c.Metrics.GetsKept()+c.Metrics.GetsDropped())
+	keyHash, _ := c.keyToHash(1)
+	p := c.cachePolicy.(*defaultPolicy[int])
+	p.Lock()
+	require.Zero(t, p.admit.Estimate(keyHash))
+	p.Unlock()
+
+	c = nil
+	_, ok := c.GetQuiet(1)
+	require.False(t, ok)
+}
+
+func TestCacheGetOrCompute(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		// Keys 1 and 3 share their key hash, not their conflict hash.
+		KeyToHash: func(key int) (uint64, uint64) { return uint64(key % 2), uint64(key) },
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	var computes atomic.Int64
+	release := make(chan struct{})
+	compute := func(val int) func() (int, int64, error) {
+		return func() (int, int64, error) {
+			computes.Add(1)
+			<-release
+			return val, 1, nil
+		}
+	}
+	const callers = 10
+	var wg sync.WaitGroup
+	vals := make([]int, callers)
+	for n := 0; n < callers; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			val, err := c.GetOrCompute(1, compute(1))
+			require.NoError(t, err)
+			vals[n] = val
+		}(n)
+	}
+	for computes.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int64(1), computes.Load())
+	for _, val := range vals {
+		require.Equal(t, 1, val)
+	}
+	// The value is applied by the time GetOrCompute returns.
+	val, err := c.GetOrCompute(1, compute(2))
+	require.NoError(t, err)
+	require.Equal(t, 1, val)
+	require.Equal(t, int64(1), computes.Load())
+
+	val, err = c.GetOrCompute(3, compute(3))
+	require.NoError(t, err)
+	require.Equal(t, 3, val)
+
+	errCompute := errors.New("compute failed")
+	_, err = c.GetOrCompute(4, func() (int, int64, error) { return 0, 0, errCompute })
+	require.ErrorIs(t, err, errCompute)
+	_, ok := c.Get(4)
+	require.False(t, ok)
+	val, err = c.GetOrCompute(4, compute(4))
+	require.NoError(t, err)
+	require.Equal(t, 4, val)
+
+	c = nil
+	val, err = c.GetOrCompute(1, compute(5))
+	require.NoError(t, err)
+	require.Equal(t, 5, val)
+}
+
+// retrySet calls SetWithTTL until the item is accepted by the cache.
+func retrySet(t *testing.T, c *Cache[int, int], key, value int, cost int64, ttl time.Duration) {
+	for {
+		if set := c.SetWithTTL(key, value, cost, ttl); !set {
+			time.Sleep(wait)
+			continue
+		}
+
+		time.Sleep(wait)
+		val, ok := c.Get(key)
+		require.True(t, ok)
+		require.NotNil(t, val)
+		require.Equal(t, value, val)
+		return
+	}
+}
+
+func TestCacheCompute(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	incr := func(value int, found bool) (int, int64, bool) {
+		return value + 1, 1, true
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 10; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 10; n++ {
+				_, ok := c.Compute(1, incr)
+				require.True(t, ok)
+			}
+		}()
+	}
+	wg.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 100, val)
+
+	// A GetOrCompute hits the value of the Compute.
+	val, err = c.GetOrCompute(1, func() (int, int64, error) { return 0, 1, nil })
+	require.NoError(t, err)
+	require.Equal(t, 100, val)
+
+	val, ok = c.Compute(1, func(value int, found bool) (int, int64, bool) {
+		require.True(t, found)
+		return value, 0, false
+	})
+	require.False(t, ok)
+	require.Equal(t, 100, val)
+	_, ok = c.Get(1)
+	require.False(t, ok)
+
+	var nilCache *Cache[int, int]
+	val, ok = nilCache.Compute(1, incr)
+	require.False(t, ok)
+	require.Equal(t, 1, val)
+}
+
+func TestCachePut(t *testing.T) {
+	c, err := NewCache(&Config[int, []byte]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Cost: func(value []byte) int64 {
+			return int64(len(value))
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Put(1, []byte("abc")))
+	c.Wait()
+	_, info, ok := c.GetWithInfo(1)
+	require.True(t, ok)
+	require.Equal(t, int64(3), info.Cost)
+	require.True(t, c.Put(1, []byte("abcde")))
+	c.Wait()
+	_, info, _ = c.GetWithInfo(1)
+	require.Equal(t, int64(5), info.Cost)
+
+	c, err = NewCache(&Config[int, []byte]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.False(t, c.Put(1, []byte("abc")), "there's no Cost to compute it")
+
+	var nilCache *Cache[int, []byte]
+	require.False(t, nilCache.Put(1, nil))
+}
+
+func TestCacheSet(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+
+	retrySet(t, c, 1, 1, 1, 0)
+
+	c.Set(1, 2, 2)
+	val, ok := c.storedItems.Get(z.KeyToHash(1))
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+
+	c.stop <- struct{}{}
+	<-c.done
+	for i := 0; i < setBufSize; i++ {
+		key, conflict := z.KeyToHash(1)
+		c.setBuf <- &Item[int]{
+			flag:     itemUpdate,
+			Key:      key,
+			Conflict: conflict,
+			Value:    1,
+			Cost:     1,
+		}
+	}
+	require.False(t, c.Set(2, 2, 1))
+	require.Equal(t, uint64(1), c.Metrics.SetsDropped())
+	close(c.setBuf)
+	close(c.stop)
+	close(c.done)
+
+	c = nil
+	require.False(t, c.Set(1, 1, 1))
+}
+
+func TestCacheSetWithResult(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, SetAdmitted, c.SetWithResult(1, 1, 1, 0))
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.Equal(t, SetReplaced, c.SetWithResult(1, 2, 1, 0))
+	require.Equal(t, SetRejected, c.SetWithResult(2, 2, 11, 0))
+	require.Equal(t, SetDropped, c.SetWithResult(3, 3, 1, -time.Second))
+	require.Equal(t, SetAdmitted, c.SetWithResult(3, 3, 1, time.Hour))
+	_, ok = c.GetTTL(3)
+	require.True(t, ok)
+
+	c.Close()
+	require.Equal(t, SetDropped, c.SetWithResult(5, 5, 1, 0))
+
+	require.Equal(t, "admitted", SetAdmitted.String())
+	require.Equal(t, "replaced", SetReplaced.String())
+	require.Equal(t, "dropped", SetDropped.String())
+	require.Equal(t, "rejected", SetRejected.String())
+	require.Equal(t, "unknown", SetResult(-1).String())
+}
+
+func TestCacheSetWithVersion(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithVersion(1, 10, 1, 10))
+	c.Wait()
+	require.False(t, c.SetWithVersion(1, 9, 1, 9))
+	require.True(t, c.SetWithVersion(1, 11, 1, 11))
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 11, val)
+
+	require.True(t, c.Set(1, 0, 1))
+	require.True(t, c.SetWithVersion(1, 1, 1, 1))
+	c.Wait()
+	val, _ = c.Get(1)
+	require.Equal(t, 1, val)
+
+	var nilCache *Cache[int, int]
+	require.False(t, nilCache.SetWithVersion(1, 1, 1, 1))
+}
+
+func TestCacheSetIfAbsent(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Of concurrent SetIfAbsent calls, only one value gets in.
+	var wg sync.WaitGroup
+	for n := 1; n <= 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.SetIfAbsent(1, n, 1)
+		}()
+	}
+	wg.Wait()
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.False(t, c.SetIfAbsent(1, 0, 1))
+	c.Wait()
+	got, _ := c.Get(1)
+	require.Equal(t, val, got)
+
+	// Expired keys are absent.
+	require.True(t, c.SetWithTTL(2, 2, 1, time.Millisecond))
+	c.Wait()
+	time.Sleep(5 * time.Millisecond)
+	require.True(t, c.SetIfAbsent(2, 3, 1))
+	c.Wait()
+	val, ok = c.Get(2)
+	require.True(t, ok)
+	require.Equal(t, 3, val)
+
+	var nilCache *Cache[int, int]
+	require.False(t, nilCache.SetIfAbsent(1, 1, 1))
+}
+
+func TestCacheCompareAndSwap(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.False(t, c.CompareAndSwap(1, 0, 1, 1))
+	require.True(t, c.Set(1, 0, 1))
+	c.Wait()
+	require.False(t, c.CompareAndSwap(1, 1, 2, 1))
+
+	// The swaps of concurrent increments are never lost.
+	const workers, increments = 4, 50
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := 0; m < increments; {
+				val, _ := c.Get(1)
+				if c.CompareAndSwap(1, val, val+1, 1) {
+					m++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, workers*increments, val)
+
+	var nilCache *Cache[int, int]
+	require.False(t, nilCache.CompareAndSwap(1, 0, 1, 1))
+}
+
+func TestCacheSetWithOptions(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            1,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	p := c.cachePolicy.(*defaultPolicy[int])
+	increment := func(key, n int) {
+		keyHash, _ := z.KeyToHash(key)
+		p.Lock()
+		defer p.Unlock()
+		for ; n > 0; n-- {
+			p.admit.Increment(keyHash)
+		}
+	}
+
+	require.True(t, c.SetWithOptions(1, 1, 1, SetOptions{TTL: time.Hour, MissPenalty: 10}))
+	c.Wait()
+	ttl, ok := c.GetTTL(1)
+	require.True(t, ok)
+	require.InDelta(t, time.Hour, ttl, float64(time.Minute))
+
+	// 2 is more frequent than 1, but not enough for its miss penalty.
+	increment(1, 1)
+	increment(2, 5)
+	c.SetWithOptions(2, 2, 1, SetOptions{MissPenalty: -1})
+	c.Wait()
+	_, ok = c.Get(2)
+	require.False(t, ok)
+	increment(2, 10)
+	c.Set(2, 2, 1)
+	c.Wait()
+	_, ok = c.Get(2)
+	require.True(t, ok)
+	_, ok = c.Get(1)
+	require.False(t, ok)
+
+	var nilCache *Cache[int, int]
+	require.False(t, nilCache.SetWithOptions(1, 1, 1, SetOptions{}))
+}
+
+func TestCacheWaitGets(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	for n := 0; n < 5; n++ {
+		_, ok := c.Get(1)
+		require.True(t, ok)
+	}
+	c.Wait()
+	// The accesses are applied, though fewer than BufferItems.
+	require.Equal(t, uint64(5), c.Metrics.GetsKept())
+	keyHash, _ := z.KeyToHash(1)
+	p := c.cachePolicy.(*defaultPolicy[int])
+	p.Lock()
+	require.Equal(t, int64(5), p.admit.Estimate(keyHash))
+	p.Unlock()
+}
+
+func TestCacheGetEntry(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Cost:               func(value int) int64 { return int64(value) },
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithOptions(1, 3, 0, SetOptions{Metadata: "etag-1", MetadataCost: 2}))
+	c.Wait()
+	e, ok := c.GetEntry(1)
+	require.True(t, ok)
+	require.Equal(t, CacheEntry[int]{Value: 3, Metadata: "etag-1"}, e)
+	_, info, ok := c.GetWithInfo(1)
+	require.True(t, ok)
+	require.Equal(t, int64(5), info.Cost, "the cost of the value and of its metadata")
+
+	require.True(t, c.Set(1, 4, 0))
+	c.Wait()
+	e, ok = c.GetEntry(1)
+	require.True(t, ok)
+	require.Equal(t, CacheEntry[int]{Value: 4}, e, "the metadata is replaced with the value")
+	_, info, _ = c.GetWithInfo(1)
+	require.Equal(t, int64(4), info.Cost)
+
+	_, ok = c.GetEntry(2)
+	require.False(t, ok)
+	var nilCache *Cache[int, int]
+	_, ok = nilCache.GetEntry(1)
+	require.False(t, ok)
+}
+
+func TestCacheFetchCost(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithOptions(1, 1, 1, SetOptions{FetchCost: time.Millisecond}))
+	require.True(t, c.SetWithOptions(2, 2, 1, SetOptions{FetchCost: 3 * time.Millisecond}))
+	require.True(t, c.Set(3, 3, 1))
+	c.Wait()
+	// The miss penalty of 2 is its ratio to the average of 1 and 2.
+	p := c.cachePolicy.(*defaultPolicy[int])
+	keyHash, _ := z.KeyToHash(2)
+	p.Lock()
+	require.InDelta(t, 1.5, p.penalties[keyHash], 1e-9)
+	p.Unlock()
+
+	for n := 0; n < 2; n++ {
+		c.Get(1)
+		c.Get(2)
+		c.Get(3)
+	}
+	require.Equal(t, 4*time.Millisecond, c.Metrics.FetchTimeAdded())
+	require.Equal(t, 8*time.Millisecond, c.Metrics.FetchTimeSaved())
+
+	// The fetch cost is kept by an update without one.
+	require.True(t, c.Set(1, 10, 1))
+	c.Wait()
+	c.Get(1)
+	require.Equal(t, 9*time.Millisecond, c.Metrics.FetchTimeSaved())
+	c.Del(1)
+	c.Get(1)
+	require.Equal(t, 9*time.Millisecond, c.Metrics.FetchTimeSaved())
+
+	// The fetch costs of the values rejected aren't added, those of updates
+	// are.
+	require.True(t, c.SetWithOptions(4, 4, 100, SetOptions{FetchCost: time.Second}))
+	c.Wait()
+	_, ok := c.Get(4)
+	require.False(t, ok)
+	require.Equal(t, 4*time.Millisecond, c.Metrics.FetchTimeAdded())
+	require.True(t, c.SetWithOptions(2, 20, 1, SetOptions{FetchCost: 2 * time.Millisecond}))
+	c.Wait()
+	require.Equal(t, 6*time.Millisecond, c.Metrics.FetchTimeAdded())
+}
+
+func TestCacheSlidingTTL(t *testing.T) {
+	for _, perEntry := range []bool{false, true} {
+		c, err := NewCache(&Config[int, int]{
+			NumCounters:        100,
+			MaxCost:            10,
+			BufferItems:        64,
+			IgnoreInternalCost: true,
+			SlidingTTL:         !perEntry,
+		})
+		require.NoError(t, err)
+		const ttl = 500 * time.Millisecond
+		if perEntry {
+			require.True(t, c.SetWithOptions(1, 1, 1, SetOptions{TTL: ttl, Sliding: true}))
+			require.True(t, c.SetWithTTL(2, 2, 1, ttl))
+		} else {
+			require.True(t, c.SetWithTTL(1, 1, 1, ttl))
+			require.True(t, c.SetWithTTL(2, 2, 1, ttl))
+		}
+		require.True(t, c.SetWithOptions(3, 3, 1, SetOptions{Sliding: true}))
+		c.Wait()
+
+		// The items stay as long as they're read, but for 2 in the per-entry
+		// mode.
+		deadline := time.Now().Add(2 * ttl)
+		for time.Now().Before(deadline) {
+			_, ok := c.Get(1)
+			require.True(t, ok)
+			c.Get(2)
+			p := c.Pipeline()
+			p.Get(1)
+			require.True(t, p.Exec()[0].OK)
+			time.Sleep(ttl / 10)
+		}
+		remaining, ok := c.GetTTL(1)
+		require.True(t, ok)
+		require.Greater(t, remaining, ttl/2)
+		_, ok = c.GetQuiet(2)
+		require.Equal(t, !perEntry, ok)
+		time.Sleep(ttl + ttl/5)
+		_, ok = c.Get(1)
+		require.False(t, ok)
+		// Items without a TTL don't get one.
+		_, ok = c.GetTTL(3)
+		require.True(t, ok)
+		require.True(t, c.storedItems.Expiration(3).IsZero())
+		c.Close()
+	}
+}
+
+func TestCacheSampleHotGets(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        1,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		SampleHotGets:      true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	keyHash, conflict := z.KeyToHash(1)
+	require.Eventually(t, func() bool {
+		c.Get(1)
+		_, _, hot := c.storedItems.GetHot(keyHash, conflict)
+		return hot
+	}, time.Second, time.Millisecond)
+
+	// Most of the Gets of the hot key aren't recorded in the policy.
+	kept := c.Metrics.GetsKept()
+	for i := 0; i < 1600; i++ {
+		val, ok := c.Get(1)
+		require.True(t, ok)
+		require.Equal(t, 1, val)
+	}
+	time.Sleep(10 * time.Millisecond)
+	require.Less(t, c.Metrics.GetsKept()-kept, uint64(400))
+}
+
+func TestMetricsQueueDepths(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	require.Equal(t, QueueDepths{SetBufCap: setBufSize}, c.Metrics.QueueDepths())
+
+	c.UpdateMaxCost(4)
+	require.Equal(t, int64(6), c.Metrics.QueueDepths().EvictionBacklog)
+
+	var nilMetrics *Metrics
+	require.Equal(t, QueueDepths{}, nilMetrics.QueueDepths())
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	var evicted atomic.Int64
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		OnEvict: func(item *Item[int]) {
+			evicted.Add(1)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 50; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	c.Invalidate()
+	for i := 0; i < 50; i++ {
+		_, ok := c.Get(i)
+		require.False(t, ok)
+	}
+
+	// New items are visible right away.
+	require.True(t, c.Set(100, 100, 1))
+	c.Wait()
+	val, ok := c.Get(100)
+	require.True(t, ok)
+	require.Equal(t, 100, val)
+
+	// The invalidated items are purged in the background.
+	require.Eventually(t, func() bool {
+		return evicted.Load() == 50
+	}, time.Second, time.Millisecond)
+	require.Equal(t, int64(99), c.cachePolicy.Cap())
+	_, ok = c.Get(100)
+	require.True(t, ok)
+
+	var nilCache *Cache[int, int]
+	nilCache.Invalidate()
+}
+
+func TestCacheScrambleKeys(t *testing.T) {
+	newCache := func(seed uint64) *Cache[string, int] {
+		c, err := NewCache(&Config[string, int]{
+			NumCounters:        100,
+			MaxCost:            10,
+			BufferItems:        64,
+			IgnoreInternalCost: true,
+			ScrambleKeys:       true,
+			KeyHashSeed:        seed,
+		})
+		require.NoError(t, err)
+		t.Cleanup(c.Close)
+		return c
+	}
+
+	c := newCache(42)
+	key, conflict := z.SeededKeyToHash[string](42)("foo")
+	gotKey, gotConflict := c.keyToHash("foo")
+	require.Equal(t, key, gotKey)
+	require.Equal(t, conflict, gotConflict)
+	require.True(t, c.Set("foo", 1, 1))
+	c.Wait()
+	val, ok := c.Get("foo")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+
+	// Without KeyHashSeed, every cache gets its own seed.
+	key1, _ := newCache(0).keyToHash("foo")
+	key2, _ := newCache(0).keyToHash("foo")
+	require.NotEqual(t, key1, key2)
+
+	p, err := NewPartitionedCache(&Config[string, int]{
+		NumCounters:  100,
+		MaxCost:      10,
+		BufferItems:  64,
+		ScrambleKeys: true,
+	}, 2)
+	require.NoError(t, err)
+	defer p.Close()
+	key1, _ = p.parts[0].keyToHash("foo")
+	key2, _ = p.parts[1].keyToHash("foo")
+	require.Equal(t, key1, key2)
+}
+
+func TestCacheGetWithInfo(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithTTL(1, 10, 3, time.Hour))
+	c.Wait()
+	val, info, ok := c.GetWithInfo(1)
+	require.True(t, ok)
+	require.Equal(t, 10, val)
+	require.Equal(t, int64(3), info.Cost)
+	require.WithinDuration(t, time.Now().Add(time.Hour), info.Expiration, time.Minute)
+
+	_, info, ok = c.GetWithInfo(2)
+	require.False(t, ok)
+	require.Equal(t, ItemInfo{}, info)
+}
+
+func TestCacheRecalculateCosts(t *testing.T) {
+	var factor atomic.Int64
+	factor.Store(1)
 	c, err := NewCache(&Config[int, int]{
 		NumCounters:        100,
-		MaxCost:            10,
+		MaxCost:            100,
 		BufferItems:        64,
 		IgnoreInternalCost: true,
 		Metrics:            true,
+		RecalculateCosts:   true,
+		Cost: func(value int) int64 {
+			return int64(value) * factor.Load()
+		},
 	})
 	require.NoError(t, err)
+	defer c.Close()
 
-	key, conflict := z.KeyToHash(1)
-	i := Item[int]{
-		Key:      key,
-		Conflict: conflict,
-		Value:    1,
-	}
-	c.storedItems.Set(&i)
-	val, ok := c.Get(1)
-	require.True(t, ok)
-	require.NotNil(t, val)
-
-	val, ok = c.Get(2)
-	require.False(t, ok)
-	require.Zero(t, val)
-
-	// 0.5 and not 1.0 because we tried Getting each item twice
-	require.Equal(t, 0.5, c.Metrics.Ratio())
-
-	c = nil
-	val, ok = c.Get(0)
-	require.False(t, ok)
-	require.Zero(t, val)
+	require.True(t, c.Set(1, 2, 0))
+	c.Wait()
+	_, info, _ := c.GetWithInfo(1)
+	require.Equal(t, int64(2), info.Cost)
+	require.Zero(t, c.Metrics.CostsCorrected())
+
+	// Fix the "buggy" cost function.
+	factor.Store(5)
+	c.Get(1)
+	c.Wait()
+	_, info, _ = c.GetWithInfo(1)
+	require.Equal(t, int64(10), info.Cost)
+	require.Equal(t, uint64(1), c.Metrics.CostsCorrected())
+	require.Equal(t, int64(90), c.cachePolicy.Cap())
 }
 
-// retrySet calls SetWithTTL until the item is accepted by the cache.
-func retrySet(t *testing.T, c *Cache[int, int], key, value int, cost int64, ttl time.Duration) {
-	for {
-		if set := c.SetWithTTL(key, value, cost, ttl); !set {
-			time.Sleep(wait)
-			continue
-		}
+func TestCacheInspectValue(t *testing.T) {
+	c, err := NewCache(&Config[int, []byte]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		InspectValue: func(v []byte) bool {
+			return z.Entropy(v) < 7.5
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
 
-		time.Sleep(wait)
-		val, ok := c.Get(key)
-		require.True(t, ok)
-		require.NotNil(t, val)
-		require.Equal(t, value, val)
-		return
+	random := make([]byte, 1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := []byte("aaaabbbbccccdddd")
+
+	require.True(t, c.Set(1, text, 1))
+	require.False(t, c.Set(2, random, 1))
+	require.False(t, c.SetWithTTL(3, random, 1, time.Hour))
+	require.False(t, c.SetWithVersion(4, random, 1, 1))
+	require.Equal(t, SetRejected, c.SetWithResult(5, random, 1, 0))
+	require.NoError(t, c.Prefetch(6, func() ([]byte, int64, error) {
+		return random, 1, nil
+	}))
+	p := c.Pipeline()
+	p.Set(7, random, 1)
+	require.False(t, p.Exec()[0].OK)
+	// The value of a key is left as is.
+	require.False(t, c.Set(1, random, 1))
+	c.Wait()
+
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, text, val)
+	for key := 2; key <= 7; key++ {
+		_, ok := c.Get(key)
+		require.False(t, ok)
 	}
+	require.Equal(t, uint64(7), c.Metrics.InspectorRejections())
+	require.Equal(t, uint64(1), c.Metrics.KeysAdded())
 }
 
-func TestCacheSet(t *testing.T) {
+func TestCacheSetReadOnly(t *testing.T) {
 	c, err := NewCache(&Config[int, int]{
 		NumCounters:        100,
-		MaxCost:            10,
-		IgnoreInternalCost: true,
+		MaxCost:            100,
 		BufferItems:        64,
+		IgnoreInternalCost: true,
 		Metrics:            true,
 	})
 	require.NoError(t, err)
+	defer c.Close()
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+
+	require.False(t, c.ReadOnly())
+	c.SetReadOnly(true)
+	require.True(t, c.ReadOnly())
+	require.False(t, c.Set(1, 2, 1))
+	require.False(t, c.SetWithTTL(2, 2, 1, time.Hour))
+	require.False(t, c.SetWithVersion(3, 3, 1, 1))
+	require.Equal(t, SetDropped, c.SetWithResult(4, 4, 1, 0))
+	require.NoError(t, c.Prefetch(5, func() (int, int64, error) {
+		t.Fatal("Prefetch called the loader of a read-only cache")
+		return 0, 0, nil
+	}))
+	c.Del(1)
+	p := c.Pipeline()
+	p.Get(1)
+	p.Set(6, 6, 1)
+	p.Del(1)
+	require.Equal(t, []PipelineResult[int]{{Value: 1, OK: true}, {}, {}}, p.Exec())
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	for key := 2; key <= 6; key++ {
+		_, ok := c.Get(key)
+		require.False(t, ok)
+	}
+	require.Equal(t, uint64(8), c.Metrics.ReadOnlyRejections())
 
-	retrySet(t, c, 1, 1, 1, 0)
-
-	c.Set(1, 2, 2)
-	val, ok := c.storedItems.Get(z.KeyToHash(1))
+	c.SetReadOnly(false)
+	require.True(t, c.Set(1, 2, 1))
+	c.Wait()
+	val, ok = c.Get(1)
 	require.True(t, ok)
 	require.Equal(t, 2, val)
+	c.Del(1)
+	_, ok = c.Get(1)
+	require.False(t, ok)
+	require.Equal(t, uint64(8), c.Metrics.ReadOnlyRejections())
 
-	c.stop <- struct{}{}
-	<-c.done
-	for i := 0; i < setBufSize; i++ {
-		key, conflict := z.KeyToHash(1)
-		c.setBuf <- &Item[int]{
-			flag:     itemUpdate,
-			Key:      key,
-			Conflict: conflict,
-			Value:    1,
-			Cost:     1,
+	var nilCache *Cache[int, int]
+	nilCache.SetReadOnly(true)
+	require.False(t, nilCache.ReadOnly())
+}
+
+func TestCacheScan(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        10000,
+		MaxCost:            1000,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 500; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	require.True(t, c.SetWithTTL(1000, 1000, 1, time.Hour))
+	c.Wait()
+
+	seen := make(map[uint64]int)
+	var cursor uint64
+	var batches int
+	for {
+		var items []*Item[int]
+		items, cursor = c.Scan(cursor, 50)
+		batches++
+		if cursor != 0 {
+			require.GreaterOrEqual(t, len(items), 50)
+		}
+		for _, item := range items {
+			seen[item.Key]++
+			require.Equal(t, int(item.Key), item.Value)
+			if item.Value == 1000 {
+				require.False(t, item.Expiration.IsZero())
+			}
+		}
+		if cursor == 0 {
+			break
 		}
+		// Concurrent changes don't break the iteration.
+		c.Del(batches)
 	}
-	require.False(t, c.Set(2, 2, 1))
-	require.Equal(t, uint64(1), c.Metrics.SetsDropped())
-	close(c.setBuf)
-	close(c.stop)
-	close(c.done)
+	require.Greater(t, batches, 5)
+	// The keys present during the whole iteration are all returned once.
+	for _, n := range seen {
+		require.Equal(t, 1, n)
+	}
+	for i := batches; i < 500; i++ {
+		require.Contains(t, seen, uint64(i))
+	}
+	require.Contains(t, seen, uint64(1000))
 
-	c = nil
-	require.False(t, c.Set(1, 1, 1))
+	var nilCache *Cache[int, int]
+	items, cursor := nilCache.Scan(0, 10)
+	require.Empty(t, items)
+	require.Zero(t, cursor)
+}
+
+func TestCacheRange(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        10000,
+		MaxCost:            1000,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 500; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+
+	seen := make(map[uint64]int)
+	c.Range(func(key, conflict uint64, value int) bool {
+		seen[key]++
+		require.Equal(t, int(key), value)
+		// The callbacks can use the cache.
+		c.Del(value + 1)
+		return true
+	})
+	for _, n := range seen {
+		require.Equal(t, 1, n)
+	}
+	require.Contains(t, seen, uint64(0))
+
+	var calls int
+	c.Range(func(key, conflict uint64, value int) bool {
+		calls++
+		return calls < 3
+	})
+	require.Equal(t, 3, calls)
+
+	var nilCache *Cache[int, int]
+	nilCache.Range(func(key, conflict uint64, value int) bool {
+		t.Fatal("Range called fn on a nil cache")
+		return false
+	})
 }
 
 func TestCacheInternalCost(t *testing.T) {
@@ -627,6 +1754,213 @@ func TestCacheGetTTL(t *testing.T) {
 		require.False(t, ok)
 		require.Equal(t, ttl, time.Duration(0))
 	}
+	// try expiration on a closed cache
+	{
+		c.Close()
+		_, ok := c.GetTTL(2)
+		require.False(t, ok)
+	}
+}
+
+func TestCacheDefaultAndMaxTTL(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		DefaultTTL:         time.Minute,
+		MaxTTL:             time.Hour,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, 1, 1))
+	require.True(t, c.SetWithTTL(2, 2, 1, time.Second))
+	require.True(t, c.SetWithTTL(3, 3, 1, 24*time.Hour))
+	require.True(t, c.SetWithVersion(4, 4, 1, 1))
+	require.NoError(t, c.Prefetch(5, func() (int, int64, error) { return 5, 1, nil }))
+	require.False(t, c.SetWithTTL(6, 6, 1, -1))
+	c.Wait()
+	for key, want := range map[int]time.Duration{
+		1: time.Minute,
+		2: time.Second,
+		3: time.Hour,
+		4: time.Minute,
+		5: time.Minute,
+	} {
+		ttl, ok := c.GetTTL(key)
+		require.True(t, ok)
+		require.InDelta(t, want, ttl, float64(time.Second), "key %d", key)
+	}
+
+	// Without DefaultTTL, MaxTTL applies to the items Set without a TTL too.
+	c, err = NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		MaxTTL:             time.Hour,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	ttl, ok := c.GetTTL(1)
+	require.True(t, ok)
+	require.InDelta(t, time.Hour, ttl, float64(time.Second))
+
+	for _, cfg := range []struct {
+		defaultTTL, maxTTL time.Duration
+		policies           map[string]TTLPolicy
+		err                string
+	}{
+		{defaultTTL: -1, err: "DefaultTTL can't be negative number"},
+		{maxTTL: -1, err: "MaxTTL can't be negative number"},
+		{
+			policies: map[string]TTLPolicy{"a": {Max: -1}},
+			err:      `TTLPolicies["a"] can't have negative TTLs`,
+		},
+	} {
+		_, err := NewCache(&Config[int, int]{
+			NumCounters: 100,
+			MaxCost:     10,
+			BufferItems: 64,
+			DefaultTTL:  cfg.defaultTTL,
+			MaxTTL:      cfg.maxTTL,
+			TTLPolicies: cfg.policies,
+		})
+		require.EqualError(t, err, cfg.err)
+	}
+}
+
+func TestCacheTTLPolicies(t *testing.T) {
+	policies := map[string]TTLPolicy{
+		"session": {Default: time.Minute, Max: 10 * time.Minute},
+		"static":  {Default: 24 * time.Hour},
+	}
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		DefaultTTL:         time.Second,
+		MaxTTL:             48 * time.Hour,
+		TTLGroup: func(key, value int) string {
+			switch key % 3 {
+			case 0:
+				return "session"
+			case 1:
+				return "static"
+			default:
+				return "other"
+			}
+		},
+		TTLPolicies: policies,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	// The policies are copied.
+	policies["other"] = TTLPolicy{Default: time.Hour}
+
+	for key, ttl := range map[int]time.Duration{
+		0: 0,
+		3: time.Hour,
+		1: 0,
+		4: 72 * time.Hour,
+		2: 0,
+		5: 72 * time.Hour,
+	} {
+		require.True(t, c.SetWithTTL(key, key, 1, ttl))
+	}
+	c.Wait()
+	for key, want := range map[int]time.Duration{
+		0: time.Minute,
+		3: 10 * time.Minute,
+		1: 24 * time.Hour,
+		4: 48 * time.Hour,
+		2: time.Second,
+		5: 48 * time.Hour,
+	} {
+		ttl, ok := c.GetTTL(key)
+		require.True(t, ok)
+		require.InDelta(t, want, ttl, float64(time.Second), "key %d", key)
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		retrySet(t, c, i, i, 1, 0)
+	}
+
+	loads := 0
+	loader := func(v int) func() (int, int64, error) {
+		return func() (int, int64, error) {
+			loads++
+			return v, 1, nil
+		}
+	}
+
+	// The loader isn't called for keys that are already present.
+	require.NoError(t, c.Prefetch(1, loader(100)))
+	require.Equal(t, 0, loads)
+
+	// A full cache doesn't evict anything for a prefetched item.
+	require.NoError(t, c.Prefetch(10, loader(10)))
+	c.Wait()
+	require.Equal(t, 1, loads)
+	_, ok := c.Get(10)
+	require.False(t, ok)
+	require.Equal(t, uint64(1), c.Metrics.PrefetchesRejected())
+	require.Equal(t, uint64(0), c.Metrics.KeysEvicted())
+
+	c.Del(0)
+	require.NoError(t, c.Prefetch(10, loader(10)))
+	c.Wait()
+	val, ok := c.Get(10)
+	require.True(t, ok)
+	require.Equal(t, 10, val)
+	require.Equal(t, uint64(1), c.Metrics.KeysPrefetched())
+	require.Equal(t, uint64(10), c.Metrics.KeysAdded())
+
+	errLoad := errors.New("load failed")
+	err = c.Prefetch(11, func() (int, int64, error) { return 0, 0, errLoad })
+	require.ErrorIs(t, err, errLoad)
+}
+
+func TestCachePrefetchDropped(t *testing.T) {
+	exits := 0
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		OnExit:             func(int) { exits++ },
+	})
+	require.NoError(t, err)
+
+	// Stop applying the Sets, and fill the buffer so that the next is dropped.
+	c.stop <- struct{}{}
+	<-c.done
+	for i := 0; i < setBufSize; i++ {
+		c.setBuf <- &Item[int]{flag: itemUpdate}
+	}
+	require.NoError(t, c.Prefetch(1, func() (int, int64, error) { return 1, 1, nil }))
+	require.Equal(t, uint64(1), c.Metrics.SetsDropped())
+	require.Zero(t, exits, "the dropped value never entered the cache")
+	close(c.setBuf)
+	close(c.stop)
+	close(c.done)
 }
 
 func TestCacheClear(t *testing.T) {
@@ -689,6 +2023,17 @@ func TestNilMetrics(t *testing.T) {
 		m.SetsRejected,
 		m.GetsDropped,
 		m.GetsKept,
+		m.KeysPrefetched,
+		m.PrefetchesRejected,
+		m.GhostHits,
+		m.KeysIdleEvicted,
+		m.RetriesAdmitted,
+		m.CostsCorrected,
+		m.InspectorRejections,
+		m.ReadOnlyRejections,
+		m.SetsSpilled,
+		m.ExpiryNotificationsDropped,
+		m.Epoch,
 	} {
 		require.Equal(t, uint64(0), f())
 	}
@@ -696,13 +2041,13 @@ func TestNilMetrics(t *testing.T) {
 
 func TestMetricsAddGet(t *testing.T) {
 	m := newMetrics()
-	m.add(hit, 1, 1)
-	m.add(hit, 2, 2)
-	m.add(hit, 3, 3)
+	m.add(hit, 1)
+	m.add(hit, 2)
+	m.add(hit, 3)
 	require.Equal(t, uint64(6), m.Hits())
 
 	m = nil
-	m.add(hit, 1, 1)
+	m.add(hit, 1)
 	require.Equal(t, uint64(0), m.Hits())
 }
 
@@ -710,10 +2055,10 @@ func TestMetricsRatio(t *testing.T) {
 	m := newMetrics()
 	require.Equal(t, float64(0), m.Ratio())
 
-	m.add(hit, 1, 1)
-	m.add(hit, 2, 2)
-	m.add(miss, 1, 1)
-	m.add(miss, 2, 2)
+	m.add(hit, 1)
+	m.add(hit, 2)
+	m.add(miss, 1)
+	m.add(miss, 2)
 	require.Equal(t, 0.5, m.Ratio())
 
 	m = nil
@@ -722,17 +2067,26 @@ func TestMetricsRatio(t *testing.T) {
 
 func TestMetricsString(t *testing.T) {
 	m := newMetrics()
-	m.add(hit, 1, 1)
-	m.add(miss, 1, 1)
-	m.add(keyAdd, 1, 1)
-	m.add(keyUpdate, 1, 1)
-	m.add(keyEvict, 1, 1)
-	m.add(costAdd, 1, 1)
-	m.add(costEvict, 1, 1)
-	m.add(dropSets, 1, 1)
-	m.add(rejectSets, 1, 1)
-	m.add(dropGets, 1, 1)
-	m.add(keepGets, 1, 1)
+	m.add(hit, 1)
+	m.add(miss, 1)
+	m.add(keyAdd, 1)
+	m.add(keyUpdate, 1)
+	m.add(keyEvict, 1)
+	m.add(costAdd, 1)
+	m.add(costEvict, 1)
+	m.add(dropSets, 1)
+	m.add(rejectSets, 1)
+	m.add(dropGets, 1)
+	m.add(keepGets, 1)
+	m.add(keyPrefetch, 1)
+	m.add(rejectPrefetch, 1)
+	m.add(keyIdleEvict, 1)
+	m.add(retryAdmit, 1)
+	m.add(costFix, 1)
+	m.add(rejectInspect, 1)
+	m.add(rejectReadOnly, 1)
+	m.add(spillSets, 1)
+	m.add(dropExpiry, 1)
 	require.Equal(t, uint64(1), m.Hits())
 	require.Equal(t, uint64(1), m.Misses())
 	require.Equal(t, 0.5, m.Ratio())
@@ -745,6 +2099,15 @@ func TestMetricsString(t *testing.T) {
 	require.Equal(t, uint64(1), m.SetsRejected())
 	require.Equal(t, uint64(1), m.GetsDropped())
 	require.Equal(t, uint64(1), m.GetsKept())
+	require.Equal(t, uint64(1), m.KeysPrefetched())
+	require.Equal(t, uint64(1), m.PrefetchesRejected())
+	require.Equal(t, uint64(1), m.KeysIdleEvicted())
+	require.Equal(t, uint64(1), m.RetriesAdmitted())
+	require.Equal(t, uint64(1), m.CostsCorrected())
+	require.Equal(t, uint64(1), m.InspectorRejections())
+	require.Equal(t, uint64(1), m.ReadOnlyRejections())
+	require.Equal(t, uint64(1), m.SetsSpilled())
+	require.Equal(t, uint64(1), m.ExpiryNotificationsDropped())
 
 	require.NotEqual(t, 0, len(m.String()))
 
@@ -754,6 +2117,31 @@ func TestMetricsString(t *testing.T) {
 	require.Equal(t, "unidentified", stringFor(doNotUse))
 }
 
+func TestCacheLifeExpectancy(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	c.Del(0)
+	require.True(t, c.Set(100, 100, 10))
+	c.Wait()
+
+	// Deleted keys aren't evictions.
+	life := c.Metrics.LifeExpectancySeconds()
+	require.Equal(t, int64(9), life.Count)
+	require.Equal(t, int64(0), life.Max)
+}
+
 func TestCacheMetricsClear(t *testing.T) {
 	c, err := NewCache(&Config[int, int]{
 		NumCounters: 100,
@@ -967,6 +2355,14 @@ func TestRistrettoCallocTTL(t *testing.T) {
 	require.Zero(t, z.NumAllocBytes())
 }
 
+// newCacheT returns a new cache of config, closed at the end of the test.
+func newCacheT[K Key, V any](t *testing.T, config *Config[K, V]) *Cache[K, V] {
+	c, err := NewCache(config)
+	require.NoError(t, err)
+	t.Cleanup(c.Close)
+	return c
+}
+
 func newTestCache() (*Cache[int, int], error) {
 	return NewCache(&Config[int, int]{
 		NumCounters: 100,
@@ -1011,3 +2407,53 @@ func TestCacheWithTTL(t *testing.T) {
 		})
 	}
 }
+
+func TestMetricsThrashIndex(t *testing.T) {
+	m := newMetrics()
+	require.Zero(t, m.ThrashIndex())
+	require.Zero(t, m.AdmissionDenialRate())
+
+	m.add(keyAdd, 4)
+	m.add(keyEvict, 2)
+	m.add(rejectSets, 4)
+	require.Equal(t, 0.5, m.ThrashIndex())
+	require.Equal(t, 0.5, m.AdmissionDenialRate())
+
+	m = nil
+	require.Zero(t, m.ThrashIndex())
+	require.Zero(t, m.AdmissionDenialRate())
+}
+
+func TestCacheIsThrashing(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		// Keep the cleanup ticker from updating the state during the test.
+		TtlTickerDurationInSec: 3600,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.False(t, c.IsThrashing())
+
+	var window thrashWindow
+	c.Metrics.add(keyAdd, 10)
+	c.Metrics.add(keyEvict, 10)
+	c.updateThrashing(&window)
+	require.False(t, c.IsThrashing())
+
+	c.Metrics.add(keyAdd, 10)
+	c.Metrics.add(keyEvict, 10)
+	c.Metrics.add(rejectSets, 30)
+	c.updateThrashing(&window)
+	require.True(t, c.IsThrashing())
+
+	// Only the activity since the last interval is taken into account.
+	c.updateThrashing(&window)
+	require.False(t, c.IsThrashing())
+
+	var nilCache *Cache[int, int]
+	require.False(t, nilCache.IsThrashing())
+}
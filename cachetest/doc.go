@@ -0,0 +1,12 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package cachetest helps testing the systems using ristretto caches. Faults
+// degrades a cache on purpose, by delaying or failing its operations,
+// dropping its accesses or stalling its policy, to check how they behave when
+// the cache does. It needs the ristretto_faults build tag, e.g.:
+//
+//	go test -tags ristretto_faults ./...
+package cachetest
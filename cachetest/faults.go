@@ -0,0 +1,107 @@
+//go:build ristretto_faults
+
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package cachetest
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+)
+
+// Faults is a ristretto.FaultInjector whose faults can be changed at any
+// time, while the cache is used. The zero value injects no fault.
+type Faults struct {
+	// storeDelay is in nanoseconds, the rates are math.Float64bits.
+	storeDelay    atomic.Int64
+	storeFailRate atomic.Uint64
+	dropRate      atomic.Uint64
+
+	// stall is locked for writing while the policy is stalled.
+	stall sync.RWMutex
+	// stalled is set when stall is locked.
+	stalled atomic.Bool
+	mu      sync.Mutex
+}
+
+// Inject makes c use f, until the returned function is called.
+func Inject[K ristretto.Key, V any](c *ristretto.Cache[K, V], f *Faults) (remove func()) {
+	ristretto.InjectFaults[K, V](c, f)
+	return func() { ristretto.InjectFaults[K, V](c, nil) }
+}
+
+// SetStoreDelay delays every store operation by d, or stops delaying them if
+// d is zero.
+func (f *Faults) SetStoreDelay(d time.Duration) {
+	f.storeDelay.Store(int64(d))
+}
+
+// SetStoreFailRate makes the given fraction of the store operations fail,
+// between 0 and 1.
+func (f *Faults) SetStoreFailRate(rate float64) {
+	f.storeFailRate.Store(math.Float64bits(rate))
+}
+
+// SetDropRate makes the given fraction of the accesses of the Gets be dropped
+// before reaching the policy, between 0 and 1.
+func (f *Faults) SetDropRate(rate float64) {
+	f.dropRate.Store(math.Float64bits(rate))
+}
+
+// Stall stalls the goroutine applying the Sets to the policy, after
+// the batch it's applying, if any, until the returned function is called. The
+// Sets pile up in the Set buffer meanwhile, and are dropped once it's full.
+// It's a no-op if the policy is already stalled.
+func (f *Faults) Stall() (resume func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stalled.Load() {
+		return func() {}
+	}
+	f.stall.Lock()
+	f.stalled.Store(true)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.stalled.Store(false)
+			f.stall.Unlock()
+		})
+	}
+}
+
+// StoreOp implements ristretto.FaultInjector.
+func (f *Faults) StoreOp(op ristretto.TraceOp, keyHash uint64) bool {
+	if d := f.storeDelay.Load(); d > 0 {
+		time.Sleep(time.Duration(d))
+	}
+	return chance(&f.storeFailRate)
+}
+
+// DropAccess implements ristretto.FaultInjector.
+func (f *Faults) DropAccess(keyHash uint64) bool {
+	return chance(&f.dropRate)
+}
+
+// StallPolicy implements ristretto.FaultInjector.
+func (f *Faults) StallPolicy() {
+	if f.stalled.Load() {
+		f.stall.RLock()
+		f.stall.RUnlock()
+	}
+}
+
+// chance returns true with the probability stored in rate.
+func chance(rate *atomic.Uint64) bool {
+	p := math.Float64frombits(rate.Load())
+	return p > 0 && rand.Float64() < p
+}
@@ -0,0 +1,97 @@
+//go:build ristretto_faults
+
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package cachetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCache(t *testing.T) *ristretto.Cache[int, int] {
+	c, err := ristretto.NewCache(&ristretto.Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestFaultsStore(t *testing.T) {
+	c := newTestCache(t)
+	f := &Faults{}
+	remove := Inject(c, f)
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+
+	f.SetStoreFailRate(1)
+	_, ok := c.Get(1)
+	require.False(t, ok)
+	require.False(t, c.Set(2, 2, 1))
+	c.Del(1)
+	p := c.Pipeline()
+	p.Get(1)
+	p.Set(3, 3, 1)
+	p.Del(1)
+	require.Equal(t, []ristretto.PipelineResult[int]{{}, {}, {}}, p.Exec())
+	require.Equal(t, uint64(2), c.Metrics.SetsDropped())
+
+	f.SetStoreFailRate(0)
+	f.SetStoreDelay(20 * time.Millisecond)
+	start := time.Now()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+	f.SetStoreFailRate(1)
+	remove()
+	_, ok = c.Get(1)
+	require.True(t, ok)
+}
+
+func TestFaultsDropAccess(t *testing.T) {
+	c := newTestCache(t)
+	f := &Faults{}
+	defer Inject(c, f)()
+	f.SetDropRate(1)
+	for i := 0; i < 10; i++ {
+		c.Get(1)
+	}
+	require.Equal(t, uint64(10), c.Metrics.GetsDropped())
+	require.Equal(t, uint64(10), c.Metrics.Misses())
+}
+
+func TestFaultsStall(t *testing.T) {
+	c := newTestCache(t)
+	f := &Faults{}
+	defer Inject(c, f)()
+	resume := f.Stall()
+	require.NotNil(t, f.Stall())
+	// The first Set may be taken by the policy goroutine before it stalls,
+	// the next ones wait in the Set buffer.
+	require.True(t, c.Set(1, 1, 1))
+	time.Sleep(10 * time.Millisecond)
+	require.True(t, c.Set(2, 2, 1))
+	time.Sleep(10 * time.Millisecond)
+	_, ok := c.Get(2)
+	require.False(t, ok)
+
+	resume()
+	resume()
+	c.Wait()
+	val, ok := c.Get(2)
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+}
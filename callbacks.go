@@ -0,0 +1,141 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import "sync"
+
+// callbackStripes is the number of queues of orderedCallbacks. It fits the
+// stripe masks of lockStripes.
+const callbackStripes = 64
+
+// orderedCallbacks delivers the callbacks of a cache in the order of the
+// operations that caused them, for every key, see Config.OrderedCallbacks.
+//
+// The keys are spread over callbackStripes stripes, each with a FIFO queue of
+// callbacks. The operations changing the store and calling back, like Set and
+// Del, hold the lock of the stripe of their key from the change to the
+// queueing of their callbacks: as the changes of a key are serialized by the
+// store, so are their callbacks. There are no delivery goroutines: whoever
+// releases the lock of a stripe delivers its queue, unless somebody else is
+// already doing so, in which case the callbacks are left for them. Callbacks
+// are called without any lock held, so they can use the cache.
+//
+// A nil *orderedCallbacks is valid, and makes lock and unlock no-ops.
+type orderedCallbacks struct {
+	stripes [callbackStripes]callbackStripe
+}
+
+type callbackStripe struct {
+	// op is held while the store is changed and the callbacks queued.
+	op sync.Mutex
+	// mu protects queue and delivering.
+	mu         sync.Mutex
+	queue      []func()
+	delivering bool
+}
+
+func newOrderedCallbacks() *orderedCallbacks {
+	return &orderedCallbacks{}
+}
+
+func (o *orderedCallbacks) stripe(keyHash uint64) *callbackStripe {
+	return &o.stripes[keyHash%callbackStripes]
+}
+
+// lock locks the stripe of keyHash, until unlock.
+func (o *orderedCallbacks) lock(keyHash uint64) {
+	if o == nil {
+		return
+	}
+	o.stripe(keyHash).op.Lock()
+}
+
+// unlock unlocks the stripe of keyHash and delivers its queued callbacks.
+func (o *orderedCallbacks) unlock(keyHash uint64) {
+	if o == nil {
+		return
+	}
+	s := o.stripe(keyHash)
+	s.op.Unlock()
+	s.deliver()
+}
+
+// lockStripes locks the stripes of bit set in mask, in order. It's what lock
+// does for batches of keys, see stripeMask.
+func (o *orderedCallbacks) lockStripes(mask uint64) {
+	if o == nil {
+		return
+	}
+	for i := range o.stripes {
+		if mask&(1<<i) != 0 {
+			o.stripes[i].op.Lock()
+		}
+	}
+}
+
+// unlockStripes unlocks the stripes locked by lockStripes, and delivers their
+// queued callbacks.
+func (o *orderedCallbacks) unlockStripes(mask uint64) {
+	if o == nil {
+		return
+	}
+	for i := range o.stripes {
+		if mask&(1<<i) != 0 {
+			o.stripes[i].op.Unlock()
+		}
+	}
+	for i := range o.stripes {
+		if mask&(1<<i) != 0 {
+			o.stripes[i].deliver()
+		}
+	}
+}
+
+// stripeMask returns the bit of the stripe of keyHash, for lockStripes.
+func stripeMask(keyHash uint64) uint64 {
+	return 1 << (keyHash % callbackStripes)
+}
+
+// push queues fn in the stripe of keyHash, which must be locked.
+func (o *orderedCallbacks) push(keyHash uint64, fn func()) {
+	s := o.stripe(keyHash)
+	s.mu.Lock()
+	s.queue = append(s.queue, fn)
+	s.mu.Unlock()
+}
+
+// call calls fn in order with the other callbacks of keyHash, whose stripe
+// must not be locked by the caller. It's used for the callbacks of the changes
+// of the store made without the lock, like evictions, which only remove keys:
+// the changes made under the lock are then either done already, and their
+// callbacks queued before the lock is released, or impossible until the key is
+// added again, which only processItems does.
+func (o *orderedCallbacks) call(keyHash uint64, fn func()) {
+	o.lock(keyHash)
+	o.push(keyHash, fn)
+	o.unlock(keyHash)
+}
+
+// deliver calls the queued callbacks of s, until the queue is empty.
+func (s *callbackStripe) deliver() {
+	s.mu.Lock()
+	if s.delivering {
+		s.mu.Unlock()
+		return
+	}
+	s.delivering = true
+	for len(s.queue) > 0 {
+		queue := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+		for _, fn := range queue {
+			fn()
+		}
+		s.mu.Lock()
+	}
+	s.delivering = false
+	s.mu.Unlock()
+}
@@ -0,0 +1,214 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrderedCallbacksQueue(t *testing.T) {
+	var nilQueue *orderedCallbacks
+	nilQueue.lock(1)
+	nilQueue.unlock(1)
+	nilQueue.lockStripes(^uint64(0))
+	nilQueue.unlockStripes(^uint64(0))
+
+	o := newOrderedCallbacks()
+	var got []int
+	o.lock(1)
+	o.push(1, func() { got = append(got, 1) })
+	// Callbacks queued while delivering are delivered in turn.
+	o.push(1, func() {
+		o.call(1, func() { got = append(got, 3) })
+		got = append(got, 2)
+	})
+	require.Empty(t, got)
+	o.unlock(1)
+	require.Equal(t, []int{1, 2, 3}, got)
+
+	mask := stripeMask(1) | stripeMask(2) | stripeMask(1+callbackStripes)
+	require.Equal(t, stripeMask(1)|stripeMask(2), mask)
+	o.lockStripes(mask)
+	o.push(2, func() { got = append(got, 4) })
+	o.unlockStripes(mask)
+	require.Equal(t, []int{1, 2, 3, 4}, got)
+}
+
+func TestOrderedCallbacks(t *testing.T) {
+	const keys, writes = 8, 2000
+	var (
+		mu sync.Mutex
+		// replaced maps the values replaced in the store to the values that
+		// replaced them, exits the values to the order of their OnExit.
+		replaced = make(map[int]int)
+		exits    = make(map[int]int)
+	)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            4,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		OrderedCallbacks:   true,
+		ShouldUpdate: func(cur, prev int) bool {
+			mu.Lock()
+			replaced[prev] = cur
+			mu.Unlock()
+			return true
+		},
+		OnExit: func(val int) {
+			mu.Lock()
+			exits[val] = len(exits)
+			mu.Unlock()
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// The small MaxCost makes the cache evict the values concurrently with
+	// their updates.
+	var wg sync.WaitGroup
+	for key := 0; key < keys; key++ {
+		wg.Add(1)
+		go func(key int) {
+			defer wg.Done()
+			for n := 1; n <= writes; n++ {
+				val := n*keys + key
+				switch n % 10 {
+				case 0:
+					c.Del(key)
+				case 5:
+					p := c.Pipeline()
+					p.Set(key, val, 1)
+					p.Del(key)
+					p.Exec()
+				case 2:
+					c.Set(key, val, 1)
+					// Let processItems add the keys, for the next Sets to
+					// update them.
+					c.Wait()
+				default:
+					c.Set(key, val, 1)
+				}
+			}
+		}(key)
+	}
+	wg.Wait()
+	c.Wait()
+	c.Clear()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, replaced)
+	for prev, cur := range replaced {
+		prevExit, ok := exits[prev]
+		require.True(t, ok, "value %d replaced by %d never exited", prev, cur)
+		if curExit, ok := exits[cur]; ok {
+			require.Less(t, prevExit, curExit, "value %d exited after %d", prev, cur)
+		}
+	}
+}
+
+func TestOnExitExactlyOnce(t *testing.T) {
+	for _, ordered := range []bool{false, true} {
+		const keys, writes = 8, 2000
+		var (
+			mu sync.Mutex
+			// exits counts the OnExits of every value, set the values Set.
+			exits = make(map[int]int)
+			set   = make(map[int]bool)
+		)
+		c, err := NewCache(&Config[int, int]{
+			NumCounters:        100,
+			MaxCost:            4,
+			BufferItems:        64,
+			IgnoreInternalCost: true,
+			OrderedCallbacks:   ordered,
+			OnExit: func(val int) {
+				mu.Lock()
+				exits[val]++
+				mu.Unlock()
+			},
+		})
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for key := 0; key < keys; key++ {
+			wg.Add(1)
+			go func(key int) {
+				defer wg.Done()
+				for n := 1; n <= writes; n++ {
+					val := n*keys + key
+					var ok bool
+					switch n % 5 {
+					case 0:
+						c.Del(key)
+						continue
+					case 1:
+						ok = c.SetWithTTL(key, val, 1, time.Millisecond)
+					case 2:
+						p := c.Pipeline()
+						p.Set(key, val, 1)
+						p.Del(key + keys)
+						ok = p.Exec()[0].OK
+					default:
+						ok = c.Set(key, val, 1)
+					}
+					mu.Lock()
+					set[val] = ok
+					mu.Unlock()
+				}
+			}(key)
+		}
+		wg.Wait()
+		c.Close()
+
+		mu.Lock()
+		for val, ok := range set {
+			if ok {
+				require.Equal(t, 1, exits[val], "value %d Set exits once", val)
+			} else {
+				require.Zero(t, exits[val], "value %d dropped by Set doesn't exit", val)
+			}
+		}
+		require.Zero(t, exits[0], "the zero value never exits")
+		mu.Unlock()
+	}
+}
+
+func TestOrderedCallbacksReentrant(t *testing.T) {
+	var c *Cache[int, int]
+	var exits []int
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		OrderedCallbacks:   true,
+		OnExit: func(val int) {
+			exits = append(exits, val)
+			// The callbacks can use the cache, even for the same key.
+			if val == 1 {
+				c.Get(1)
+				c.Set(1, 3, 1)
+			}
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	require.True(t, c.Set(1, 2, 1))
+	c.Wait()
+	require.Equal(t, []int{1, 2}, exits)
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 3, val)
+}
@@ -0,0 +1,95 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+const (
+	// clockAnchorInterval is how often ttlClock is anchored back to the wall
+	// clock.
+	clockAnchorInterval = time.Minute
+	// clockMaxSlew is the largest rate, relative to the monotonic clock, at
+	// which ttlClock catches up with the wall clock: 1%, or 36s an hour.
+	clockMaxSlew = 0.01
+)
+
+// ttlClock is the clock of the expirations. It reads the wall clock once, at
+// its creation, and advances by the monotonic clock since, so that the TTLs
+// are immune to the steps of the wall clock, like those of NTP or of a VM
+// resumed from a pause: a step forward would otherwise expire the items en
+// masse, and a step backward keep them from expiring until the wall clock
+// catches up. It's anchored back to the wall clock every clockAnchorInterval,
+// running up to clockMaxSlew faster or slower until the next anchor to catch
+// up with it, so that it never goes backward nor jumps, and the expirations
+// still read as wall clock times, e.g. once persisted by Config.MmapStorePath.
+type ttlClock struct {
+	// wall and mono read the wall and monotonic clocks, the latter in
+	// nanoseconds. The tests replace them.
+	wall   func() time.Time
+	mono   func() int64
+	anchor atomic.Pointer[clockAnchor]
+}
+
+// clockAnchor maps the monotonic clock to the time of a ttlClock.
+type clockAnchor struct {
+	// wall is the time of the ttlClock at mono, in nanoseconds since the epoch.
+	wall int64
+	mono int64
+	// rate is how much faster than the monotonic clock the ttlClock runs.
+	rate float64
+}
+
+func newTTLClock(wall func() time.Time, mono func() int64) *ttlClock {
+	c := &ttlClock{wall: wall, mono: mono}
+	c.anchor.Store(&clockAnchor{wall: wall().UnixNano(), mono: mono()})
+	return c
+}
+
+// at returns the time of the ttlClock at mono, in nanoseconds since the epoch.
+func (a *clockAnchor) at(mono int64) int64 {
+	elapsed := mono - a.mono
+	return a.wall + elapsed + int64(float64(elapsed)*a.rate)
+}
+
+// now returns the current time of c. It has no monotonic reading, so that it
+// compares to the expirations by their wall clock readings.
+func (c *ttlClock) now() time.Time {
+	mono := c.mono()
+	a := c.anchor.Load()
+	if mono-a.mono >= int64(clockAnchorInterval) {
+		a = c.reanchor(a, mono)
+	}
+	return time.Unix(0, a.at(mono))
+}
+
+// reanchor replaces a by an anchor at mono, whose rate catches up with the
+// wall clock over the next clockAnchorInterval, and returns the new anchor.
+func (c *ttlClock) reanchor(a *clockAnchor, mono int64) *clockAnchor {
+	next := &clockAnchor{wall: a.at(mono), mono: mono}
+	drift := float64(c.wall().UnixNano() - next.wall)
+	next.rate = max(-clockMaxSlew, min(clockMaxSlew, drift/float64(clockAnchorInterval)))
+	if c.anchor.CompareAndSwap(a, next) {
+		return next
+	}
+	return c.anchor.Load()
+}
+
+// expirationClock is the ttlClock of all the caches. The tests replace it.
+var expirationClock atomic.Pointer[ttlClock]
+
+func init() {
+	expirationClock.Store(newTTLClock(time.Now, z.NanoTime))
+}
+
+// ttlNow returns the current time of the expirations, see ttlClock.
+func ttlNow() time.Time {
+	return expirationClock.Load().now()
+}
@@ -0,0 +1,151 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a wall and a monotonic clock which only move when told to.
+type fakeClock struct {
+	wall atomic.Int64
+	mono atomic.Int64
+}
+
+func newFakeClock() *fakeClock {
+	f := &fakeClock{}
+	f.wall.Store(time.Now().UnixNano())
+	return f
+}
+
+func (f *fakeClock) newTTLClock() *ttlClock {
+	return newTTLClock(func() time.Time { return time.Unix(0, f.wall.Load()) }, f.mono.Load)
+}
+
+// install makes f the clock of the expirations until the end of the test.
+func (f *fakeClock) install(t *testing.T) {
+	prev := expirationClock.Swap(f.newTTLClock())
+	t.Cleanup(func() { expirationClock.Store(prev) })
+}
+
+// advance moves both clocks by d.
+func (f *fakeClock) advance(d time.Duration) {
+	f.wall.Add(int64(d))
+	f.mono.Add(int64(d))
+}
+
+// step moves the wall clock alone by d.
+func (f *fakeClock) step(d time.Duration) {
+	f.wall.Add(int64(d))
+}
+
+func TestTTLClockSteps(t *testing.T) {
+	f := newFakeClock()
+	c := f.newTTLClock()
+	start := c.now()
+
+	f.step(time.Hour)
+	require.Equal(t, start, c.now(), "a step of the wall clock doesn't move it")
+	f.advance(time.Second)
+	require.Equal(t, start.Add(time.Second), c.now())
+
+	f.advance(clockAnchorInterval)
+	anchored := c.now()
+	f.advance(clockAnchorInterval)
+	require.Equal(t, time.Duration(float64(clockAnchorInterval)*(1+clockMaxSlew)),
+		c.now().Sub(anchored), "it catches up at clockMaxSlew")
+
+	f.step(-3 * time.Hour)
+	last := c.now()
+	for i := 0; i < 10; i++ {
+		f.advance(clockAnchorInterval / 2)
+		now := c.now()
+		require.Greater(t, now.Sub(last), time.Duration(0), "it never goes backward")
+		last = now
+	}
+}
+
+func TestTTLClockCatchesUp(t *testing.T) {
+	f := newFakeClock()
+	c := f.newTTLClock()
+
+	f.step(300 * time.Millisecond)
+	f.advance(clockAnchorInterval)
+	require.Equal(t, 300*time.Millisecond, time.Unix(0, f.wall.Load()).Sub(c.now()))
+	f.advance(clockAnchorInterval)
+	require.InDelta(t, f.wall.Load(), c.now().UnixNano(), float64(time.Microsecond))
+}
+
+// cleanup runs the TTL cleanup of c and returns the keys it evicted.
+func cleanup(c *Cache[int, int]) []uint64 {
+	var keys []uint64
+	c.storedItems.Cleanup(c.cachePolicy, func(i *Item[int]) {
+		keys = append(keys, i.Key)
+	})
+	return keys
+}
+
+func TestCacheTTLForwardClockStep(t *testing.T) {
+	f := newFakeClock()
+	f.install(t)
+	c := newCacheT(t, &Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		// The test runs the cleanups itself.
+		TtlTickerDurationInSec: 3600,
+	})
+
+	require.True(t, c.SetWithTTL(1, 1, 1, 10*time.Second))
+	c.Wait()
+	f.step(time.Hour)
+	require.Empty(t, cleanup(c), "the items don't expire en masse")
+	_, ok := c.Get(1)
+	require.True(t, ok)
+	ttl, ok := c.GetTTL(1)
+	require.True(t, ok)
+	require.Equal(t, 10*time.Second, ttl)
+
+	f.advance(12 * time.Second)
+	_, ok = c.Get(1)
+	require.False(t, ok)
+	key, _ := z.KeyToHash(1)
+	require.Equal(t, []uint64{key}, cleanup(c))
+}
+
+func TestCacheTTLBackwardClockStep(t *testing.T) {
+	f := newFakeClock()
+	f.install(t)
+	c := newCacheT(t, &Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		// The test runs the cleanups itself.
+		TtlTickerDurationInSec: 3600,
+	})
+
+	require.True(t, c.SetWithTTL(1, 1, 1, 10*time.Second))
+	c.Wait()
+	f.step(-time.Hour)
+	f.advance(12 * time.Second)
+	_, ok := c.Get(1)
+	require.False(t, ok, "the items still expire")
+	key, _ := z.KeyToHash(1)
+	require.Equal(t, []uint64{key}, cleanup(c), "and are cleaned up")
+
+	require.True(t, c.SetWithTTL(2, 2, 1, 10*time.Second))
+	c.Wait()
+	f.advance(12 * time.Second)
+	key, _ = z.KeyToHash(2)
+	require.Equal(t, []uint64{key}, cleanup(c))
+}
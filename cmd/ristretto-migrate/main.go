@@ -0,0 +1,72 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// ristretto-migrate rewrites a policy state saved by Cache.ExportPolicy for a
+// cache with another NumCounters, so that the access frequencies learned by a
+// cache survive a config change. For example:
+//
+//	ristretto-migrate -in policy.state -out policy.new -num-counters 1000000
+//
+// The counters are re-bucketed approximately, see PolicyState.Resize. The
+// key hashes can't be recomputed without the keys, so the state can't be
+// carried over a change of KeyToHash, ScrambleKeys or KeyHashSeed.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+func main() {
+	in := flag.String("in", "", "path of the policy state to read")
+	out := flag.String("out", "", "path of the policy state to write, -in if empty")
+	numCounters := flag.Int64("num-counters", 0, "NumCounters of the new config")
+	info := flag.Bool("info", false, "only print a summary of the state read")
+	flag.Parse()
+
+	if *in == "" {
+		log.Fatal("-in is required")
+	}
+	if *out == "" {
+		*out = *in
+	}
+	if err := run(*in, *out, *numCounters, *info); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(in, out string, numCounters int64, info bool) error {
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	state, err := ristretto.ReadPolicyState(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("while reading %s: %w", in, err)
+	}
+	if info {
+		fmt.Printf("counters: %d x %d, increments: %d/%d, doorkeeper: %d bits, keys: %d\n",
+			len(state.Rows), state.Counters, state.Increments, state.ResetAt,
+			len(state.Door)*64, len(state.Costs))
+		return nil
+	}
+
+	resized, err := state.Resize(numCounters)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if _, err := resized.WriteTo(&buf); err != nil {
+		return err
+	}
+	return z.WriteFileAtomic(out, buf.Bytes(), 0o644)
+}
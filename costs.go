@@ -0,0 +1,91 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+// costBuckets is the number of buckets of costHistogram. Bucket 0 holds the
+// costs below 1, bucket i the costs in [2^(i-1), 2^i), and the last bucket all
+// the costs above.
+const costBuckets = 64
+
+// costHistogram counts items by cost, in power of 2 buckets. Unlike
+// z.HistogramData, items can be removed from it, and it's safe for concurrent
+// use.
+type costHistogram struct {
+	buckets [costBuckets]atomic.Int64
+	// sum is updated for every item, by all the partitions of a
+	// PartitionedCache.
+	sum *counterSet
+}
+
+func newCostHistogram() costHistogram {
+	return costHistogram{sum: newCounterSet(1)}
+}
+
+func costBucket(cost int64) int {
+	if cost < 1 {
+		return 0
+	}
+	return min(bits.Len64(uint64(cost)), costBuckets-1)
+}
+
+// add adds n items of the given cost, or removes them if n is negative.
+func (h *costHistogram) add(cost, n int64) {
+	h.buckets[costBucket(cost)].Add(n)
+	h.sum.add(0, uint64(cost*n))
+}
+
+func (h *costHistogram) clear() {
+	for i := range h.buckets {
+		h.buckets[i].Store(0)
+	}
+	h.sum.reset()
+}
+
+// snapshot returns the histogram as a z.HistogramData. As the exact costs
+// aren't kept, Min and Max are the bounds of the lowest and highest non-empty
+// buckets.
+func (h *costHistogram) snapshot() *z.HistogramData {
+	data := z.NewHistogramData(z.HistogramBounds(0, costBuckets-2))
+	for i := range h.buckets {
+		n := h.buckets[i].Load()
+		if n <= 0 {
+			continue
+		}
+		data.CountPerBucket[i] = n
+		data.Count += n
+		if data.Count == n {
+			data.Min = 0
+			if i > 0 {
+				data.Min = int64(data.Bounds[i-1])
+			}
+		}
+		data.Max = math.MaxInt64
+		if i < len(data.Bounds) {
+			data.Max = int64(data.Bounds[i]) - 1
+		}
+	}
+	data.Sum = int64(h.sum.load(0))
+	return data
+}
+
+// CostDistribution returns the distribution of the costs of the items in the
+// cache, internal cost included unless Config.IgnoreInternalCost is set. It's
+// based on the actual costs of the items, so it can be used to plan capacity.
+// The buckets are powers of 2, so Min and Max are only approximations.
+func (p *Metrics) CostDistribution() *z.HistogramData {
+	if p == nil {
+		return nil
+	}
+	return p.costs.snapshot()
+}
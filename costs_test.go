@@ -0,0 +1,86 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCostHistogram(t *testing.T) {
+	h := newCostHistogram()
+	h.add(0, 1)
+	h.add(1, 1)
+	h.add(3, 2)
+	h.add(1000, 1)
+	h.add(math.MaxInt64, 1)
+	h.add(3, -1)
+
+	data := h.snapshot()
+	require.Equal(t, int64(5), data.Count)
+	require.Equal(t, []int64{1, 1, 1}, data.CountPerBucket[:3])
+	require.Equal(t, int64(1), data.CountPerBucket[10])
+	require.Equal(t, int64(1), data.CountPerBucket[costBuckets-1])
+	require.Equal(t, int64(0), data.Min)
+	require.Equal(t, int64(math.MaxInt64), data.Max)
+
+	h.clear()
+	h.add(3, 1)
+	h.add(5, 1)
+	data = h.snapshot()
+	require.Equal(t, int64(2), data.Count)
+	require.Equal(t, int64(8), data.Sum)
+	require.Equal(t, int64(2), data.Min)
+	require.Equal(t, int64(7), data.Max)
+}
+
+func TestCacheCostDistribution(t *testing.T) {
+	for _, policy := range []string{
+		PolicyTinyLFU, PolicyLIRS, PolicyS3FIFO, PolicyLRU, PolicySLRU, PolicyARC,
+		PolicyWTinyLFU,
+	} {
+		t.Run(policy, func(t *testing.T) {
+			c, err := NewCache(&Config[int, int]{
+				NumCounters:        100,
+				MaxCost:            100,
+				BufferItems:        64,
+				IgnoreInternalCost: true,
+				Metrics:            true,
+				Policy:             policy,
+			})
+			require.NoError(t, err)
+			defer c.Close()
+
+			for i := 0; i < 10; i++ {
+				require.True(t, c.Set(i, i, 4))
+			}
+			c.Wait()
+			require.True(t, c.Set(0, 0, 16))
+			c.Del(1)
+			c.Wait()
+
+			data := c.Metrics.CostDistribution()
+			require.Equal(t, int64(9), data.Count)
+			require.Equal(t, int64(8*4+16), data.Sum)
+			require.Equal(t, int64(8), data.CountPerBucket[costBucket(4)])
+			require.Equal(t, int64(1), data.CountPerBucket[costBucket(16)])
+			require.Equal(t, int64(c.Metrics.CostAdded()-c.Metrics.CostEvicted()), data.Sum)
+
+			c.Clear()
+			require.Zero(t, c.Metrics.CostDistribution().Count)
+		})
+	}
+}
+
+func TestCostDistributionNil(t *testing.T) {
+	var m *Metrics
+	require.Nil(t, m.CostDistribution())
+	m.trackAdd(1, 1)
+	m.trackUpdate(1, 1, 2)
+	m.trackEvict(1, 2)
+}
@@ -0,0 +1,129 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// counterSet is a set of counters for the hot paths, that many goroutines
+// update concurrently, like the Metrics. A single atomic counter bounces its
+// cache line between the cores on every add, and even counters picked at
+// random still take an atomic read-modify-write per add, which on arm64 and
+// ppc64 retries in a loop while the line is contended.
+//
+// Instead, the adds go to a local copy of the counters per P: each add takes
+// a local from a sync.Pool, which hands every local to a single goroutine at
+// a time, updates it with a plain load and store, and puts it back. So the
+// adds never write to a shared cache line, nor retry. The readers sum the
+// locals on read, so that the counters are exact once the adds returned,
+// without a goroutine aggregating them periodically. The locals the pool
+// drops, e.g. on GC, are folded into the retired counts by the finalizer of
+// their token, once no goroutine can update them anymore.
+type counterSet struct {
+	pool  sync.Pool // Of *counterToken.
+	state *counterState
+}
+
+// counterLocal is the local copy of the counters of a P. Only the goroutine
+// holding its token updates it, but the counters are read concurrently.
+type counterLocal struct {
+	counts []atomic.Uint64
+}
+
+// counterToken is what the pool of a counterSet holds: its local is only
+// updated through it, so the local is retired once the token is collected.
+type counterToken struct {
+	local *counterLocal
+	state *counterState
+}
+
+// counterState holds the locals of a counterSet, without any reference to its
+// pool, so that the tokens the pool drops can be collected.
+type counterState struct {
+	mu     sync.RWMutex
+	locals map[*counterLocal]struct{}
+	// retired are the counts of the retired locals, and offset the counts at
+	// the last reset.
+	retired []uint64
+	offset  []uint64
+}
+
+// newCounterSet returns a set of n counters, all zero.
+func newCounterSet(n int) *counterSet {
+	return &counterSet{state: &counterState{
+		locals:  make(map[*counterLocal]struct{}),
+		retired: make([]uint64, n),
+		offset:  make([]uint64, n),
+	}}
+}
+
+// add adds delta to counter i. Like with atomic.AddUint64, a value can be
+// subtracted by adding its two's complement.
+func (s *counterSet) add(i int, delta uint64) {
+	t, _ := s.pool.Get().(*counterToken)
+	if t == nil {
+		t = s.state.newToken()
+	}
+	c := &t.local.counts[i]
+	// The holder of the token is the only writer of its local.
+	c.Store(c.Load() + delta)
+	s.pool.Put(t)
+}
+
+// newToken registers a new local and returns its token.
+func (s *counterState) newToken() *counterToken {
+	// The size is rounded up to 128 bytes, so that the locals of different Ps
+	// don't share cache lines, with adjacent line prefetching.
+	n := (len(s.retired) + 15) &^ 15
+	l := &counterLocal{counts: make([]atomic.Uint64, n)[:len(s.retired)]}
+	s.mu.Lock()
+	s.locals[l] = struct{}{}
+	s.mu.Unlock()
+	t := &counterToken{local: l, state: s}
+	runtime.SetFinalizer(t, (*counterToken).retire)
+	return t
+}
+
+// retire folds the counts of the local of t into the retired ones.
+func (t *counterToken) retire() {
+	s := t.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.retired {
+		s.retired[i] += t.local.counts[i].Load()
+	}
+	delete(s.locals, t.local)
+}
+
+// load returns the value of counter i. It's not an atomic snapshot: the adds
+// made concurrently may only be partly counted.
+func (s *counterSet) load(i int) uint64 {
+	s.state.mu.RLock()
+	defer s.state.mu.RUnlock()
+	return s.state.sum(i) - s.state.offset[i]
+}
+
+// sum returns the total of the adds to counter i, with the lock held.
+func (s *counterState) sum(i int) uint64 {
+	total := s.retired[i]
+	for l := range s.locals {
+		total += l.counts[i].Load()
+	}
+	return total
+}
+
+// reset sets all the counters to zero. The locals aren't written to, as their
+// holders may be updating them: the current counts are subtracted instead.
+func (s *counterSet) reset() {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	for i := range s.state.offset {
+		s.state.offset[i] = s.state.sum(i)
+	}
+}
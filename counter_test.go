@@ -0,0 +1,125 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounterSet(t *testing.T) {
+	s := newCounterSet(2)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				s.add(0, 3)
+				s.add(1, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, uint64(8*3000), s.load(0))
+	require.Equal(t, uint64(8*1000), s.load(1))
+
+	// Subtracting works like with atomic.AddUint64.
+	s.add(0, ^uint64(4000-1))
+	require.Equal(t, uint64(20000), s.load(0))
+
+	s.reset()
+	require.Zero(t, s.load(0))
+	require.Zero(t, s.load(1))
+	s.add(1, 2)
+	require.Equal(t, uint64(2), s.load(1))
+}
+
+func TestCounterSetRetire(t *testing.T) {
+	s := newCounterSet(1)
+	s.add(0, 5)
+	s.reset()
+	s.add(0, 2)
+	// The locals dropped by the pool keep their counts once retired.
+	tok := s.state.newToken()
+	tok.local.counts[0].Store(10)
+	require.Equal(t, uint64(12), s.load(0))
+	tok.retire()
+	require.Equal(t, uint64(12), s.load(0))
+	require.NotContains(t, s.state.locals, tok.local)
+}
+
+// The benchmarks below compare the counters updated by all the goroutines,
+// like Metrics.Hits: the counterSet, a single atomic counter, and the 256
+// counters indexed by key hash which Metrics used before, for a hot key and
+// for many keys. The difference is largest on many-core arm64 and ppc64
+// machines, run them there with -cpu to see how it grows with the cores.
+
+func BenchmarkCounterSet(b *testing.B) {
+	s := newCounterSet(1)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.add(0, 1)
+		}
+	})
+}
+
+func BenchmarkAtomicCounter(b *testing.B) {
+	var c atomic.Uint64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Add(1)
+		}
+	})
+}
+
+func BenchmarkMetricsHit(b *testing.B) {
+	m := newMetrics()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			m.add(hit, 1)
+		}
+	})
+}
+
+// keyHashCounter is the counter Metrics used before counterSet: 256
+// separately allocated counters, of which the adds use 25 picked by key hash.
+type keyHashCounter []*uint64
+
+func newKeyHashCounter() keyHashCounter {
+	c := make(keyHashCounter, 256)
+	for i := range c {
+		c[i] = new(uint64)
+	}
+	return c
+}
+
+func (c keyHashCounter) add(hash, delta uint64) {
+	atomic.AddUint64(c[(hash%25)*10], delta)
+}
+
+func BenchmarkKeyHashCounter(b *testing.B) {
+	b.Run("hot", func(b *testing.B) {
+		c := newKeyHashCounter()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				c.add(1, 1)
+			}
+		})
+	})
+	b.Run("spread", func(b *testing.B) {
+		c := newKeyHashCounter()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				c.add(uint64(z.FastRand()), 1)
+			}
+		})
+	})
+}
@@ -0,0 +1,116 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"time"
+)
+
+// ExpiredEntry describes an item removed from the cache for its TTL, see
+// Cache.ExpiryNotifications.
+type ExpiredEntry[V any] struct {
+	// KeyHash and Conflict are the hashes of the key of the item. The cache
+	// doesn't keep the keys themselves.
+	KeyHash  uint64
+	Conflict uint64
+	// Value is the expired value if Config.KeepValues is set, and the zero
+	// value otherwise.
+	Value V
+	// Expiration is when the item expired.
+	Expiration time.Time
+	// Dropped is the number of notifications dropped on the channel before
+	// this one, for the consumer lagging behind.
+	Dropped uint64
+}
+
+// expiryNotifier sends the TTL expirations of a cache to the channels returned
+// by ExpiryNotifications.
+type expiryNotifier[V any] struct {
+	mu         sync.Mutex
+	subs       []*expirySub[V]
+	keepValues bool
+	closed     bool
+}
+
+type expirySub[V any] struct {
+	ch chan ExpiredEntry[V]
+	// dropped is the number of notifications dropped since the last one sent.
+	dropped uint64
+}
+
+func newExpiryNotifier[V any](keepValues bool) *expiryNotifier[V] {
+	return &expiryNotifier[V]{keepValues: keepValues}
+}
+
+// subscribe returns a new channel, buffering up to buffer notifications.
+func (n *expiryNotifier[V]) subscribe(buffer int) <-chan ExpiredEntry[V] {
+	ch := make(chan ExpiredEntry[V], max(buffer, 1))
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		close(ch)
+		return ch
+	}
+	n.subs = append(n.subs, &expirySub[V]{ch: ch})
+	return ch
+}
+
+// notify sends the expiration of i to all the channels, without blocking, and
+// returns the number of notifications dropped for the channels being full.
+func (n *expiryNotifier[V]) notify(i *Item[V]) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.subs) == 0 {
+		return 0
+	}
+	e := ExpiredEntry[V]{KeyHash: i.Key, Conflict: i.Conflict, Expiration: i.Expiration}
+	if n.keepValues {
+		e.Value = i.Value
+	}
+	dropped := 0
+	for _, sub := range n.subs {
+		e.Dropped = sub.dropped
+		select {
+		case sub.ch <- e:
+			sub.dropped = 0
+		default:
+			sub.dropped++
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// close closes the channels, and those subscribed later.
+func (n *expiryNotifier[V]) close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, sub := range n.subs {
+		close(sub.ch)
+	}
+	n.subs, n.closed = nil, true
+}
+
+// ExpiryNotifications returns a channel receiving an ExpiredEntry for every
+// item removed from the cache for its TTL, e.g. to invalidate the copies of
+// the items in other caches. Every call returns a new channel, buffering up to
+// buffer notifications (at least 1), which all receive the notifications.
+//
+// The notifications are sent without blocking the cache: when a channel is
+// full, they are dropped, and counted in the Dropped field of the next
+// notification sent to the channel and in Metrics.ExpiryNotificationsDropped.
+// The expirations are found on the schedule of Config.TtlTickerDurationInSec,
+// so they can be notified up to that much time after the items expired. The
+// channels are closed by Close.
+func (c *Cache[K, V]) ExpiryNotifications(buffer int) <-chan ExpiredEntry[V] {
+	if c == nil {
+		ch := make(chan ExpiredEntry[V])
+		close(ch)
+		return ch
+	}
+	return c.expiry.subscribe(buffer)
+}
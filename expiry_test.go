@@ -0,0 +1,110 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiryNotifier(t *testing.T) {
+	expired := time.Now()
+	item := func(key uint64) *Item[int] {
+		return &Item[int]{Key: key, Conflict: key + 1, Value: int(key), Expiration: expired}
+	}
+
+	n := newExpiryNotifier[int](true)
+	require.Zero(t, n.notify(item(1)))
+	ch := n.subscribe(0)
+	require.Equal(t, 1, cap(ch))
+	require.Zero(t, n.notify(item(2)))
+	require.Equal(t, 1, n.notify(item(3)))
+	require.Equal(t, 1, n.notify(item(4)))
+	require.Equal(t, ExpiredEntry[int]{KeyHash: 2, Conflict: 3, Value: 2, Expiration: expired}, <-ch)
+	require.Zero(t, n.notify(item(5)))
+	require.Equal(t, ExpiredEntry[int]{
+		KeyHash:    5,
+		Conflict:   6,
+		Value:      5,
+		Expiration: expired,
+		Dropped:    2,
+	}, <-ch)
+
+	n.close()
+	_, ok := <-ch
+	require.False(t, ok)
+	_, ok = <-n.subscribe(1)
+	require.False(t, ok)
+
+	n = newExpiryNotifier[int](false)
+	ch = n.subscribe(1)
+	n.notify(item(1))
+	require.Zero(t, (<-ch).Value)
+}
+
+func TestCacheExpiryNotifications(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:            100,
+		MaxCost:                10,
+		BufferItems:            64,
+		IgnoreInternalCost:     true,
+		Metrics:                true,
+		TtlTickerDurationInSec: 1,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	first, second := c.ExpiryNotifications(1), c.ExpiryNotifications(1)
+
+	// Store the items as already expired, then make their bucket the next to
+	// be cleaned up, rather than waiting for their TTL.
+	expired := time.Now().Add(-10 * time.Second)
+	sm := c.storedItems.(*shardedMap[int])
+	expire := func(keys ...uint64) {
+		for _, key := range keys {
+			sm.Set(&Item[int]{Key: key, Conflict: key, Value: int(key), Expiration: expired})
+		}
+		sm.expiryMap.Lock()
+		sm.expiryMap.lastCleanedBucketNum = storageBucket(expired) - 1
+		sm.expiryMap.Unlock()
+	}
+	receive := func(ch <-chan ExpiredEntry[int]) ExpiredEntry[int] {
+		select {
+		case e := <-ch:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no expiry notification")
+			return ExpiredEntry[int]{}
+		}
+	}
+	expire(1, 2)
+	// The second expiration is dropped, the channels being full.
+	require.Eventually(t, func() bool {
+		return c.Metrics.ExpiryNotificationsDropped() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	e := receive(first)
+	require.Contains(t, []uint64{1, 2}, e.KeyHash)
+	require.Zero(t, e.Value)
+	require.Equal(t, e.KeyHash, receive(second).KeyHash)
+
+	expire(3)
+	e = receive(first)
+	require.Equal(t, uint64(3), e.KeyHash)
+	require.Equal(t, uint64(1), e.Dropped)
+	_, ok := c.Get(3)
+	require.False(t, ok)
+
+	c.Close()
+	_, ok = <-first
+	require.False(t, ok)
+	_, ok = <-c.ExpiryNotifications(1)
+	require.False(t, ok)
+
+	c = nil
+	_, ok = <-c.ExpiryNotifications(1)
+	require.False(t, ok)
+}
@@ -0,0 +1,69 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+// FaultInjector degrades a cache on purpose, to test how the systems using it
+// behave when it's slow or failing. The cache calls it at fixed points, but
+// only in the builds with the ristretto_faults build tag, e.g. with
+// go test -tags ristretto_faults: InjectFaults only exists in those builds,
+// and the other builds skip the calls at compile time. The cachetest package
+// has a ready to use implementation.
+//
+// The methods are called concurrently, by the goroutines of the operations.
+type FaultInjector interface {
+	// StoreOp is called before the store is accessed by Get, Set (and its
+	// variants) and Del of a single key, and by the pipelines for each of
+	// their operations. It can sleep to delay the operation. If it returns
+	// true, the operation fails: Get misses, Set is dropped and Del is a
+	// no-op.
+	StoreOp(op TraceOp, keyHash uint64) (fail bool)
+	// DropAccess is called before the accesses of Get are pushed to the ring
+	// buffer for the policy. If it returns true, the access is dropped, as
+	// when the buffer is contended, and counted by Metrics.GetsDropped.
+	DropAccess(keyHash uint64) bool
+	// StallPolicy is called by the goroutine applying the Sets to the policy
+	// before every batch. It can block to stall it, which fills the Set
+	// buffer until the Sets are dropped.
+	StallPolicy()
+}
+
+// faultInjector holds the FaultInjector of a cache, which is an interface, so
+// that it can be swapped atomically.
+type faultInjector struct {
+	FaultInjector
+}
+
+// storeFault calls FaultInjector.StoreOp, if any.
+func (c *Cache[K, V]) storeFault(op TraceOp, keyHash uint64) bool {
+	if !faultsEnabled {
+		return false
+	}
+	f := c.faults.Load()
+	return f != nil && f.StoreOp(op, keyHash)
+}
+
+// dropAccess calls FaultInjector.DropAccess, if any.
+func (c *Cache[K, V]) dropAccess(keyHash uint64) bool {
+	if !faultsEnabled {
+		return false
+	}
+	f := c.faults.Load()
+	if f == nil || !f.DropAccess(keyHash) {
+		return false
+	}
+	c.Metrics.add(dropGets, 1)
+	return true
+}
+
+// stallPolicy calls FaultInjector.StallPolicy, if any.
+func (c *Cache[K, V]) stallPolicy() {
+	if !faultsEnabled {
+		return
+	}
+	if f := c.faults.Load(); f != nil {
+		f.StallPolicy()
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !ristretto_faults
+
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+// faultsEnabled is set by the ristretto_faults build tag, see FaultInjector.
+const faultsEnabled = false
@@ -0,0 +1,24 @@
+//go:build ristretto_faults
+
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+// faultsEnabled is set by the ristretto_faults build tag, see FaultInjector.
+const faultsEnabled = true
+
+// InjectFaults makes c call f, or stop calling its FaultInjector if f is nil.
+// It's only available with the ristretto_faults build tag.
+func InjectFaults[K Key, V any](c *Cache[K, V], f FaultInjector) {
+	if c == nil {
+		return
+	}
+	if f == nil {
+		c.faults.Store(nil)
+		return
+	}
+	c.faults.Store(&faultInjector{f})
+}
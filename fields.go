@@ -0,0 +1,160 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"sync"
+)
+
+// Fields is the small map of fields stored for a key by a FieldCache.
+type Fields[F comparable, V any] struct {
+	mu     sync.RWMutex
+	values map[F]fieldValue[V]
+	cost   int64
+}
+
+type fieldValue[V any] struct {
+	value V
+	cost  int64
+}
+
+// Get returns the value of field, if it's set.
+func (f *Fields[F, V]) Get(field F) (V, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	fv, ok := f.values[field]
+	return fv.value, ok
+}
+
+// Len returns the number of fields set.
+func (f *Fields[F, V]) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.values)
+}
+
+// Cost returns the sum of the costs of the fields.
+func (f *Fields[F, V]) Cost() int64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.cost
+}
+
+// Range calls fn for every field, in no particular order, until fn returns
+// false. The fields can't be changed by fn.
+func (f *Fields[F, V]) Range(fn func(field F, value V) bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for field, fv := range f.values {
+		if !fn(field, fv.value) {
+			return
+		}
+	}
+}
+
+// set sets field, and returns the new cost of the fields.
+func (f *Fields[F, V]) set(field F, value V, cost int64) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cost += cost - f.values[field].cost
+	f.values[field] = fieldValue[V]{value: value, cost: cost}
+	return f.cost
+}
+
+// del deletes field, and returns the new cost and number of the fields.
+func (f *Fields[F, V]) del(field F) (int64, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cost -= f.values[field].cost
+	delete(f.values, field)
+	return f.cost, len(f.values)
+}
+
+// FieldCache is a Cache storing a small map of fields per key, e.g. the
+// attributes of a user, instead of one key per field. All the fields of a key
+// are admitted and evicted together, for the sum of their costs: this keeps
+// the policy from being flooded with tiny keys, and the fields of a key from
+// being evicted independently.
+type FieldCache[K Key, F comparable, V any] struct {
+	// Cache holds the fields of every key. Its methods can be used to get,
+	// delete or expire all the fields of a key at once.
+	*Cache[K, *Fields[F, V]]
+	// locks serialize the changes to the fields of the keys, by key hash.
+	locks [256]sync.Mutex
+}
+
+// NewFieldCache returns a new FieldCache, see NewCache. The cost of the items
+// of config is the sum of the costs passed to SetField, and Cost is only
+// called for the keys whose fields all have a zero cost.
+func NewFieldCache[K Key, F comparable, V any](config *Config[K, *Fields[F, V]]) (
+	*FieldCache[K, F, V], error) {
+	c, err := NewCache(config)
+	if err != nil {
+		return nil, err
+	}
+	return &FieldCache[K, F, V]{Cache: c}, nil
+}
+
+// lock locks the changes to the fields of the key of keyHash.
+func (c *FieldCache[K, F, V]) lock(keyHash uint64) func() {
+	mu := &c.locks[keyHash%uint64(len(c.locks))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// SetField sets field of key to value, with the given cost. The first field of
+// a key goes through the admission policy like Set, but waits for its outcome
+// so that concurrent SetFields of the key don't lose each other's fields. It
+// returns false if the fields of key have been dropped or rejected. The next
+// fields of the key only update its cost.
+func (c *FieldCache[K, F, V]) SetField(key K, field F, value V, cost int64) bool {
+	if c == nil || c.Cache == nil || c.isClosed.Load() {
+		return false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	defer c.lock(keyHash)()
+	// Unlike Get, this doesn't count as an access.
+	if fields, ok := c.storedItems.Get(keyHash, conflictHash); ok {
+		c.updateCost(keyHash, conflictHash, fields, fields.set(field, value, cost))
+		return true
+	}
+	fields := &Fields[F, V]{values: make(map[F]fieldValue[V])}
+	fields.set(field, value, cost)
+	r := c.SetWithResult(key, fields, cost, 0)
+	return r == SetAdmitted || r == SetReplaced
+}
+
+// GetField returns the value of field of key, if it's in the cache. It counts
+// as an access to key, like Get.
+func (c *FieldCache[K, F, V]) GetField(key K, field F) (V, bool) {
+	if c == nil || c.Cache == nil {
+		return zeroValue[V](), false
+	}
+	fields, ok := c.Get(key)
+	if !ok {
+		return zeroValue[V](), false
+	}
+	return fields.Get(field)
+}
+
+// DelField deletes field of key. If it was the last field of key, key is
+// deleted.
+func (c *FieldCache[K, F, V]) DelField(key K, field F) {
+	if c == nil || c.Cache == nil || c.isClosed.Load() {
+		return
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	defer c.lock(keyHash)()
+	fields, ok := c.storedItems.Get(keyHash, conflictHash)
+	if !ok {
+		return
+	}
+	if cost, n := fields.del(field); n > 0 {
+		c.updateCost(keyHash, conflictHash, fields, cost)
+		return
+	}
+	c.Del(key)
+}
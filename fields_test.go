@@ -0,0 +1,105 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFieldCache(t *testing.T) {
+	c, err := NewFieldCache(&Config[int, *Fields[string, int]]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.True(t, c.SetField(1, "a", 10, 2))
+	require.True(t, c.SetField(1, "b", 20, 3))
+	require.True(t, c.SetField(1, "a", 11, 4))
+	c.Wait()
+
+	val, ok := c.GetField(1, "a")
+	require.True(t, ok)
+	require.Equal(t, 11, val)
+	val, ok = c.GetField(1, "b")
+	require.True(t, ok)
+	require.Equal(t, 20, val)
+	_, ok = c.GetField(1, "c")
+	require.False(t, ok)
+	_, ok = c.GetField(2, "a")
+	require.False(t, ok)
+
+	// The key is accounted for the sum of the costs of its fields.
+	fields, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 2, fields.Len())
+	require.Equal(t, int64(7), fields.Cost())
+	require.Equal(t, int64(93), c.cachePolicy.Cap())
+
+	c.DelField(1, "a")
+	c.Wait()
+	_, ok = c.GetField(1, "a")
+	require.False(t, ok)
+	require.Equal(t, int64(97), c.cachePolicy.Cap())
+
+	c.DelField(1, "b")
+	c.Wait()
+	_, ok = c.Get(1)
+	require.False(t, ok)
+	require.Equal(t, int64(100), c.cachePolicy.Cap())
+}
+
+func TestFieldCacheConcurrent(t *testing.T) {
+	c, err := NewFieldCache(&Config[int, *Fields[string, int]]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				c.SetField(i, strconv.Itoa(g), g, 1)
+			}
+		}(g)
+	}
+	wg.Wait()
+	c.Wait()
+
+	// No field is lost to a concurrent SetField of the same key.
+	for i := 0; i < 5; i++ {
+		fields, ok := c.Get(i)
+		require.True(t, ok)
+		require.Equal(t, 8, fields.Len())
+		n := 0
+		fields.Range(func(field string, value int) bool {
+			require.Equal(t, strconv.Itoa(value), field)
+			n++
+			return true
+		})
+		require.Equal(t, 8, n)
+	}
+	require.Equal(t, int64(60), c.cachePolicy.Cap())
+}
+
+func TestFieldCacheNil(t *testing.T) {
+	var c *FieldCache[int, string, int]
+	require.False(t, c.SetField(1, "a", 1, 1))
+	_, ok := c.GetField(1, "a")
+	require.False(t, ok)
+	c.DelField(1, "a")
+}
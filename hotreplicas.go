@@ -0,0 +1,105 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"maps"
+	"sync"
+	"sync/atomic"
+)
+
+// hotReplicaLimit is the maximum number of items replicated, see
+// Config.ReplicateHotKeys.
+const hotReplicaLimit = 256
+
+// hotReplicas holds copies of the items of the hot keys of a store, which are
+// read without locking their shards, see Config.ReplicateHotKeys. The copies
+// are in a map replaced on every change, so that the reads don't write to any
+// memory shared with the other readers, unlike a read lock.
+//
+// The copies are changed by the shards, with their lock held, so that they are
+// always those of the items in the shards once the shards are unlocked.
+type hotReplicas[V any] struct {
+	mu    sync.Mutex
+	items atomic.Pointer[map[uint64]storeItem[V]]
+}
+
+func newHotReplicas[V any]() *hotReplicas[V] {
+	r := &hotReplicas[V]{}
+	r.items.Store(&map[uint64]storeItem[V]{})
+	return r
+}
+
+// get returns the copy of the item of key, if it's replicated.
+func (r *hotReplicas[V]) get(key uint64) (storeItem[V], bool) {
+	if r == nil {
+		return storeItem[V]{}, false
+	}
+	item, ok := (*r.items.Load())[key]
+	return item, ok
+}
+
+// set replicates item if it's hot and there's room for it, and forgets its key
+// otherwise.
+func (r *hotReplicas[V]) set(item storeItem[V]) {
+	if r == nil {
+		return
+	}
+	if !item.extra().hot {
+		r.del(item.key)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	items := *r.items.Load()
+	if _, ok := items[item.key]; !ok && len(items) >= hotReplicaLimit {
+		return
+	}
+	r.store(items, func(m map[uint64]storeItem[V]) { m[item.key] = item })
+}
+
+// del forgets key, if it's replicated.
+func (r *hotReplicas[V]) del(key uint64) {
+	if r == nil {
+		return
+	}
+	if _, ok := r.get(key); !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.store(*r.items.Load(), func(m map[uint64]storeItem[V]) { delete(m, key) })
+}
+
+// store replaces items with a copy changed by change, with mu held.
+func (r *hotReplicas[V]) store(items map[uint64]storeItem[V], change func(map[uint64]storeItem[V])) {
+	m := maps.Clone(items)
+	change(m)
+	r.items.Store(&m)
+}
+
+// len returns the number of items replicated.
+func (r *hotReplicas[V]) len() int {
+	if r == nil {
+		return 0
+	}
+	return len(*r.items.Load())
+}
+
+// hotReplicator is implemented by the stores which can replicate the items of
+// the hot keys, see Config.ReplicateHotKeys.
+type hotReplicator interface {
+	replicateHot()
+}
+
+// replicateHot makes the shards of sm replicate the items of the hot keys, see
+// Config.ReplicateHotKeys. It must be called before sm is used.
+func (sm *shardedMap[V]) replicateHot() {
+	sm.replicas = newHotReplicas[V]()
+	for _, m := range sm.shards {
+		m.replicas = sm.replicas
+	}
+}
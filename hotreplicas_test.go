@@ -0,0 +1,122 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHotReplicas(t *testing.T) {
+	s := newShardedMap[int]()
+	s.replicateHot()
+	replica := func(key uint64) (int, bool) {
+		item, ok := s.replicas.get(key)
+		return item.value, ok
+	}
+
+	s.Set(&Item[int]{Key: 1, Conflict: 1, Value: 1})
+	s.Set(&Item[int]{Key: 2, Conflict: 2, Value: 2})
+	s.SetHot(1, true)
+	s.SetHot(3, true)
+	require.Equal(t, 1, s.replicas.len())
+	val, ok := replica(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	val, ok, hot := s.GetHot(1, 1)
+	require.True(t, ok)
+	require.True(t, hot)
+	require.Equal(t, 1, val)
+	_, ok = s.Get(1, 2)
+	require.False(t, ok)
+
+	// The replicas follow the items.
+	_, ok = s.Update(&Item[int]{Key: 1, Conflict: 1, Value: 10})
+	require.True(t, ok)
+	val, _ = replica(1)
+	require.Equal(t, 10, val)
+	s.Set(&Item[int]{Key: 1, Conflict: 1, Value: 11})
+	_, ok = replica(1)
+	require.False(t, ok)
+	val, _ = s.Get(1, 1)
+	require.Equal(t, 11, val)
+
+	s.SetHot(1, true)
+	s.SetHot(2, true)
+	require.Equal(t, 2, s.replicas.len())
+	s.SetHot(2, false)
+	_, ok = replica(2)
+	require.False(t, ok)
+	s.Del(1, 1)
+	require.Zero(t, s.replicas.len())
+	_, ok = s.Get(1, 1)
+	require.False(t, ok)
+
+	// The replicas of items invalidated or expired aren't returned.
+	s.SetHot(2, true)
+	s.Invalidate()
+	_, ok = s.Get(2, 2)
+	require.False(t, ok)
+	require.Len(t, s.Purge(int(2%numShards)), 1)
+	require.Zero(t, s.replicas.len())
+	s.Set(&Item[int]{Key: 2, Conflict: 2, Value: 2, Expiration: time.Now().Add(-time.Second),
+		generation: s.Generation()})
+	s.SetHot(2, true)
+	_, ok = s.Get(2, 2)
+	require.False(t, ok)
+	s.Clear(nil)
+	require.Zero(t, s.replicas.len())
+
+	// Only up to hotReplicaLimit items are replicated.
+	for key := uint64(1); key <= hotReplicaLimit+1; key++ {
+		s.Set(&Item[int]{Key: key, Conflict: key, Value: int(key), generation: s.Generation()})
+		s.SetHot(key, true)
+	}
+	require.Equal(t, hotReplicaLimit, s.replicas.len())
+	val, ok = s.Get(hotReplicaLimit+1, hotReplicaLimit+1)
+	require.True(t, ok)
+	require.Equal(t, hotReplicaLimit+1, val)
+
+	var r *hotReplicas[int]
+	r.set(storeItem[int]{key: 1, extras: &itemExtras{hot: true}})
+	_, ok = r.get(1)
+	require.False(t, ok)
+}
+
+func TestCacheReplicateHotKeys(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        1,
+		IgnoreInternalCost: true,
+		ReplicateHotKeys:   true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	replicas := c.storedItems.(*shardedMap[int]).replicas
+
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	keyHash, _ := z.KeyToHash(1)
+	require.Eventually(t, func() bool {
+		c.Get(1)
+		_, ok := replicas.get(keyHash)
+		return ok
+	}, time.Second, time.Millisecond)
+
+	require.True(t, c.Set(1, 2, 1))
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+	c.Del(1)
+	c.Wait()
+	_, ok = c.Get(1)
+	require.False(t, ok)
+}
@@ -0,0 +1,172 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+// idleTracker keeps the approximate time of the last access of every resident
+// key, with a 1 second resolution. Accesses are recorded from the batches of
+// Gets sent to the policy, so, like the policy, it may miss some of them. All
+// the methods are no-ops on a nil *idleTracker.
+type idleTracker struct {
+	sync.Mutex
+	start   time.Time
+	entries map[uint64]idleEntry
+}
+
+type idleEntry struct {
+	// last is the time of the last access, in seconds since start.
+	last uint32
+	cost int64
+}
+
+func newIdleTracker() *idleTracker {
+	return &idleTracker{
+		start:   time.Now(),
+		entries: make(map[uint64]idleEntry),
+	}
+}
+
+func (t *idleTracker) now() uint32 {
+	return uint32(time.Since(t.start) / time.Second)
+}
+
+// consumer returns a ringConsumer recording the accesses in the batches before
+// passing them on to next.
+func (t *idleTracker) consumer(next ringConsumer) ringConsumer {
+	if t == nil {
+		return next
+	}
+	return &idleConsumer{idle: t, next: next}
+}
+
+type idleConsumer struct {
+	idle *idleTracker
+	next ringConsumer
+}
+
+func (c *idleConsumer) Push(keys []uint64) bool {
+	c.idle.touch(keys)
+	return c.next.Push(keys)
+}
+
+// add starts tracking a newly admitted key.
+func (t *idleTracker) add(key uint64, cost int64) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	t.entries[key] = idleEntry{last: t.now(), cost: cost}
+	t.Unlock()
+}
+
+// update records a Set of a resident key.
+func (t *idleTracker) update(key uint64, cost int64) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	if _, ok := t.entries[key]; ok {
+		t.entries[key] = idleEntry{last: t.now(), cost: cost}
+	}
+	t.Unlock()
+}
+
+func (t *idleTracker) touch(keys []uint64) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	now := t.now()
+	for _, key := range keys {
+		if e, ok := t.entries[key]; ok {
+			e.last = now
+			t.entries[key] = e
+		}
+	}
+	t.Unlock()
+}
+
+func (t *idleTracker) del(key uint64) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	delete(t.entries, key)
+	t.Unlock()
+}
+
+func (t *idleTracker) clear() {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	t.entries = make(map[uint64]idleEntry)
+	t.Unlock()
+}
+
+// histogram returns the distribution of the idle times of the resident keys,
+// in seconds.
+func (t *idleTracker) histogram() *z.HistogramData {
+	if t == nil {
+		return nil
+	}
+	h := z.NewHistogramData(z.HistogramBounds(1, 16))
+	t.updateHistogram(h)
+	return h
+}
+
+// updateHistogram adds the idle times of the resident keys to h.
+func (t *idleTracker) updateHistogram(h *z.HistogramData) {
+	t.Lock()
+	now := t.now()
+	for _, e := range t.entries {
+		h.Update(int64(now - e.last))
+	}
+	t.Unlock()
+}
+
+// idleCost returns the total cost of the keys that haven't been accessed for
+// at least d.
+func (t *idleTracker) idleCost(d time.Duration) uint64 {
+	if t == nil {
+		return 0
+	}
+	secs := uint32(d / time.Second)
+	var cost uint64
+	t.Lock()
+	now := t.now()
+	for _, e := range t.entries {
+		if now-e.last >= secs {
+			cost += uint64(e.cost)
+		}
+	}
+	t.Unlock()
+	return cost
+}
+
+// idleKeys returns the keys that haven't been accessed for at least d.
+func (t *idleTracker) idleKeys(d time.Duration) []uint64 {
+	if t == nil {
+		return nil
+	}
+	secs := uint32(d / time.Second)
+	var keys []uint64
+	t.Lock()
+	now := t.now()
+	for key, e := range t.entries {
+		if now-e.last >= secs {
+			keys = append(keys, key)
+		}
+	}
+	t.Unlock()
+	return keys
+}
@@ -0,0 +1,192 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+	"github.com/stretchr/testify/require"
+)
+
+// elapse moves the clock of t forward by d.
+func (t *idleTracker) elapse(d time.Duration) {
+	t.Lock()
+	t.start = t.start.Add(-d)
+	t.Unlock()
+}
+
+func TestIdleTracker(t *testing.T) {
+	idle := newIdleTracker()
+	idle.add(1, 10)
+	idle.add(2, 20)
+	idle.elapse(time.Minute)
+	idle.touch([]uint64{2, 3})
+
+	require.Equal(t, uint64(10), idle.idleCost(time.Minute))
+	require.Equal(t, uint64(30), idle.idleCost(0))
+	h := idle.histogram()
+	require.Equal(t, int64(2), h.Count)
+	require.Equal(t, int64(60), h.Max)
+
+	idle.update(1, 15)
+	idle.update(3, 15)
+	require.Zero(t, idle.idleCost(time.Second))
+	require.Equal(t, uint64(35), idle.idleCost(0))
+	require.ElementsMatch(t, []uint64{1, 2}, idle.idleKeys(0))
+	require.Empty(t, idle.idleKeys(time.Second))
+
+	idle.del(1)
+	require.Equal(t, uint64(20), idle.idleCost(0))
+	idle.clear()
+	require.Zero(t, idle.idleCost(0))
+}
+
+func TestIdleTrackerNil(t *testing.T) {
+	var idle *idleTracker
+	idle.add(1, 1)
+	idle.update(1, 1)
+	idle.touch([]uint64{1})
+	idle.del(1)
+	idle.clear()
+	require.Zero(t, idle.idleCost(0))
+	require.Nil(t, idle.histogram())
+	require.Nil(t, idle.idleKeys(0))
+
+	cons := &testConsumer{save: true}
+	require.Equal(t, cons, idle.consumer(cons))
+}
+
+func TestCacheTrackIdleTime(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        1,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		TrackIdleTime:      true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	require.Equal(t, uint64(10), c.Metrics.IdleCost(0))
+	require.Zero(t, c.Metrics.IdleCost(time.Minute))
+
+	c.idle.elapse(time.Minute)
+	for i := 0; i < 5; i++ {
+		_, ok := c.Get(i)
+		require.True(t, ok)
+	}
+	require.Equal(t, uint64(5), c.Metrics.IdleCost(time.Minute))
+	require.Equal(t, int64(10), c.Metrics.IdleTimeSeconds().Count)
+
+	c.Del(9)
+	c.Wait()
+	require.Equal(t, uint64(4), c.Metrics.IdleCost(time.Minute))
+}
+
+func TestCacheNoIdleTime(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     100,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.Nil(t, c.Metrics.IdleTimeSeconds())
+	require.Zero(t, c.Metrics.IdleCost(0))
+}
+
+func TestCacheMaxIdleTime(t *testing.T) {
+	var evicted []uint64
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:            100,
+		MaxCost:                100,
+		BufferItems:            1,
+		IgnoreInternalCost:     true,
+		Metrics:                true,
+		MaxIdleTime:            time.Minute,
+		TtlTickerDurationInSec: 1,
+		OnEvict: func(item *Item[int]) {
+			evicted = append(evicted, item.Key)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.NotNil(t, c.idle)
+
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	c.idle.elapse(time.Minute)
+	for i := 0; i < 5; i++ {
+		_, ok := c.Get(i)
+		require.True(t, ok)
+	}
+
+	require.Eventually(t, func() bool {
+		return c.Metrics.KeysIdleEvicted() == 5
+	}, 5*time.Second, 10*time.Millisecond)
+	c.Wait()
+	require.Len(t, evicted, 5)
+	require.Equal(t, uint64(5), c.Metrics.KeysEvicted())
+	require.Equal(t, int64(95), c.cachePolicy.Cap())
+	for i := 0; i < 10; i++ {
+		_, ok := c.Get(i)
+		require.Equal(t, i < 5, ok)
+	}
+}
+
+func TestCacheMaxIdleTimeDeleted(t *testing.T) {
+	var exits []int
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		MaxIdleTime:        time.Minute,
+		// The test reaps the idle items itself.
+		TtlTickerDurationInSec: 3600,
+		OnExit: func(val int) {
+			exits = append(exits, val)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, 1, 1))
+	require.True(t, c.Set(2, 2, 1))
+	c.Wait()
+	c.idle.elapse(time.Minute)
+	// A Del racing with the reap: the key is gone from the store, but still
+	// idle for the idle tracker.
+	key, conflict := z.KeyToHash(1)
+	_, _, found := c.storedItems.Del(key, conflict)
+	require.True(t, found)
+
+	c.evictIdle(c.onEvict)
+	require.Equal(t, []int{2}, exits)
+	require.Equal(t, uint64(1), c.Metrics.KeysIdleEvicted())
+}
+
+func TestCacheMaxIdleTimeNegative(t *testing.T) {
+	_, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     100,
+		BufferItems: 64,
+		MaxIdleTime: -time.Second,
+	})
+	require.EqualError(t, err, "MaxIdleTime can't be negative number")
+}
@@ -0,0 +1,89 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import "time"
+
+// Iterator goes through the items of a cache one shard of its store at a time,
+// see Cache.Iterator. It isn't safe for concurrent use, but the cache can be
+// used concurrently, from the loop or elsewhere.
+type Iterator[K Key, V any] struct {
+	caches []*Cache[K, V]
+	// shard is the index of the next shard to copy, counting the shards of all
+	// the caches.
+	shard int
+	// items is the copy of the current shard, taken at copied, and item the
+	// current item.
+	items  []*Item[V]
+	pos    int
+	copied time.Time
+	item   *Item[V]
+}
+
+// Iterator returns an Iterator over the items of the cache, like Range but
+// pulled by the caller, e.g. to export the items of a very large cache at the
+// pace of the writer. The items have their Key, Conflict, Value and
+// Expiration set.
+//
+// The Iterator copies the items of a single shard at a time, of the 256 of the
+// store, under the read lock of the shard, so that it holds no lock between
+// the calls to Next and takes about 1/256 of the memory of the cache. The
+// items of a shard are a consistent snapshot of the shard when it's copied,
+// see Iterator.Copied, but they can be Set, deleted or expire once copied,
+// and the shards are copied at different times: an item present during the
+// whole iteration is returned exactly once, while the items Set or deleted
+// meanwhile may or may not be, and the values returned can be as old as the
+// iteration.
+func (c *Cache[K, V]) Iterator() *Iterator[K, V] {
+	if c == nil {
+		return &Iterator[K, V]{}
+	}
+	return &Iterator[K, V]{caches: []*Cache[K, V]{c}}
+}
+
+// Next moves to the next item, copying the next shard with items if the
+// current one is exhausted, and returns false at the end of the iteration, or
+// if the cache is closed.
+func (it *Iterator[K, V]) Next() bool {
+	for it.pos >= len(it.items) {
+		if it.shard >= len(it.caches)*int(numShards) {
+			it.item, it.items = nil, nil
+			return false
+		}
+		c := it.caches[it.shard/int(numShards)]
+		if c.isClosed.Load() {
+			it.shard = len(it.caches) * int(numShards)
+			continue
+		}
+		it.items = c.storedItems.Items(it.shard % int(numShards))
+		it.copied = time.Now()
+		it.pos = 0
+		it.shard++
+	}
+	it.item = it.items[it.pos]
+	// Let the items already returned be collected.
+	it.items[it.pos] = nil
+	it.pos++
+	return true
+}
+
+// Item returns the current item, or nil if Next hasn't been called or has
+// returned false.
+func (it *Iterator[K, V]) Item() *Item[V] {
+	return it.item
+}
+
+// Shard returns the index of the shard of the current item. The items of the
+// same shard are returned in a row, and are consistent with each other.
+func (it *Iterator[K, V]) Shard() int {
+	return it.shard - 1
+}
+
+// Copied returns when the shard of the current item was copied: the current
+// item was in the cache, with its value, at that time.
+func (it *Iterator[K, V]) Copied() time.Time {
+	return it.copied
+}
@@ -0,0 +1,62 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheIterator(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            1000,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 100; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+
+	it := c.Iterator()
+	require.Nil(t, it.Item())
+	seen := make(map[int]bool)
+	lastShard := -1
+	for it.Next() {
+		item := it.Item()
+		require.False(t, seen[item.Value])
+		seen[item.Value] = true
+		require.Equal(t, int(item.Key%numShards), it.Shard())
+		require.GreaterOrEqual(t, it.Shard(), lastShard, "the shards are returned in a row")
+		lastShard = it.Shard()
+		require.False(t, it.Copied().IsZero())
+		// The cache can be used while iterating.
+		c.Del(item.Value)
+	}
+	require.Len(t, seen, 100)
+	require.Nil(t, it.Item())
+	require.False(t, it.Next())
+}
+
+func TestCacheIteratorClosed(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	c.Close()
+	require.False(t, c.Iterator().Next())
+
+	var nilCache *Cache[int, int]
+	require.False(t, nilCache.Iterator().Next())
+}
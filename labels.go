@@ -0,0 +1,26 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"context"
+	"runtime/pprof"
+)
+
+const (
+	// labelCache is the pprof label holding Config.Name.
+	labelCache = "ristretto.cache"
+	// labelGoroutine is the pprof label identifying the internal goroutine.
+	labelGoroutine = "ristretto.goroutine"
+)
+
+// withLabels runs f with the pprof labels of the cache called name and the
+// given internal goroutine. The goroutines started by f inherit the labels, so
+// the CPU they use is attributed to the cache in profiles.
+func withLabels(name, goroutine string, f func()) {
+	labels := pprof.Labels(labelCache, name, labelGoroutine, goroutine)
+	pprof.Do(context.Background(), labels, func(context.Context) { f() })
+}
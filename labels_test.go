@@ -0,0 +1,34 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"bytes"
+	"runtime/pprof"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheGoroutineLabels(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Name:        "labeled",
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	var buf bytes.Buffer
+	require.NoError(t, pprof.Lookup("goroutine").WriteTo(&buf, 1))
+	profile := buf.String()
+	require.Contains(t, profile,
+		`"ristretto.cache":"labeled", "ristretto.goroutine":"processItems"`)
+	require.Contains(t, profile,
+		`"ristretto.cache":"labeled", "ristretto.goroutine":"policy"`)
+
+}
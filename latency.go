@@ -0,0 +1,144 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"math"
+	"math/bits"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+// latencyBuckets is the number of buckets of latencyHistogram. Bucket 0 holds
+// the latencies below 1ns, bucket i those in [2^(i-1), 2^i) nanoseconds, and
+// the last bucket all those above, from about 9 minutes.
+const latencyBuckets = 40
+
+// latencyHistogram counts the operations of a kind by latency, in power of 2
+// buckets of nanoseconds, see Config.DetailedMetrics. Its counters are a
+// counterSet, as every operation updates them: the buckets, then the sum of
+// the latencies.
+type latencyHistogram struct {
+	counts *counterSet
+}
+
+func newLatencyHistogram() latencyHistogram {
+	return latencyHistogram{counts: newCounterSet(latencyBuckets + 1)}
+}
+
+// add records an operation which took ns nanoseconds.
+func (h *latencyHistogram) add(ns int64) {
+	bucket := 0
+	if ns > 0 {
+		bucket = min(bits.Len64(uint64(ns)), latencyBuckets-1)
+	}
+	h.counts.add(bucket, 1)
+	h.counts.add(latencyBuckets, uint64(ns))
+}
+
+func (h *latencyHistogram) clear() {
+	h.counts.reset()
+}
+
+// snapshot returns the histogram as a z.HistogramData, in nanoseconds. Like
+// for costHistogram, Min and Max are the bounds of the lowest and highest
+// non-empty buckets.
+func (h *latencyHistogram) snapshot() *z.HistogramData {
+	data := z.NewHistogramData(z.HistogramBounds(0, latencyBuckets-2))
+	for i := range data.CountPerBucket {
+		data.CountPerBucket[i] = int64(h.counts.load(i))
+	}
+	data.Sum = int64(h.counts.load(latencyBuckets))
+	for i, n := range data.CountPerBucket {
+		if n == 0 {
+			continue
+		}
+		if data.Count == 0 {
+			data.Min = 0
+			if i > 0 {
+				data.Min = int64(data.Bounds[i-1])
+			}
+		}
+		data.Count += n
+		data.Max = math.MaxInt64
+		if i < len(data.Bounds) {
+			data.Max = int64(data.Bounds[i]) - 1
+		}
+	}
+	return data
+}
+
+// latencies holds the latency histograms of the operations, by TraceOp.
+type latencies [TraceDel + 1]latencyHistogram
+
+// enableLatencies makes p record the latencies of the operations, see
+// Config.DetailedMetrics.
+func (p *Metrics) enableLatencies() {
+	if p == nil {
+		return
+	}
+	l := new(latencies)
+	for i := range l {
+		l[i] = newLatencyHistogram()
+	}
+	p.latencies.CompareAndSwap(nil, l)
+}
+
+// trackLatency records an operation of the given kind which took ns
+// nanoseconds, if the latencies are recorded.
+func (p *Metrics) trackLatency(op TraceOp, ns int64) {
+	if p == nil {
+		return
+	}
+	if l := p.latencies.Load(); l != nil {
+		l[op].add(ns)
+	}
+}
+
+// LatencyDistribution returns the distribution of the latencies of the
+// operations of the given kind, in nanoseconds. It's nil unless
+// Config.DetailedMetrics is set. The buckets are powers of 2, so Min and Max
+// are only approximations.
+func (p *Metrics) LatencyDistribution(op TraceOp) *z.HistogramData {
+	if p == nil || op < TraceGet || op > TraceDel {
+		return nil
+	}
+	l := p.latencies.Load()
+	if l == nil {
+		return nil
+	}
+	return l[op].snapshot()
+}
+
+// latency returns the p-th percentile of the latencies of op.
+func (p *Metrics) latency(op TraceOp, percentile float64) time.Duration {
+	h := p.LatencyDistribution(op)
+	if h == nil || h.Count == 0 {
+		return 0
+	}
+	return time.Duration(h.Percentile(percentile))
+}
+
+// GetLatency returns the p-th percentile of the latencies of the Gets, with p
+// between 0 and 1, e.g. 0.99 for the 99th percentile, if Config.DetailedMetrics
+// is set, or zero otherwise. It's the upper bound of the power of 2 bucket of
+// nanoseconds the percentile falls in, so it's within a factor of 2 of the
+// actual latency. The latencies tell what the hit ratio doesn't, like the
+// contention of the Get buffers or the stalls on the locks of the store.
+func (p *Metrics) GetLatency(percentile float64) time.Duration {
+	return p.latency(TraceGet, percentile)
+}
+
+// SetLatency works like GetLatency for the Sets, of all kinds.
+func (p *Metrics) SetLatency(percentile float64) time.Duration {
+	return p.latency(TraceSet, percentile)
+}
+
+// DelLatency works like GetLatency for the Dels.
+func (p *Metrics) DelLatency(percentile float64) time.Duration {
+	return p.latency(TraceDel, percentile)
+}
@@ -0,0 +1,111 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := newLatencyHistogram()
+	h.add(0)
+	h.add(100)
+	h.add(100)
+	h.add(math.MaxInt64)
+
+	data := h.snapshot()
+	require.Equal(t, int64(4), data.Count)
+	require.Equal(t, int64(1), data.CountPerBucket[0])
+	require.Equal(t, int64(2), data.CountPerBucket[7], "[64, 128)")
+	require.Equal(t, int64(1), data.CountPerBucket[latencyBuckets-1])
+	require.Equal(t, int64(0), data.Min)
+	require.Equal(t, int64(math.MaxInt64), data.Max)
+
+	h.clear()
+	require.Zero(t, h.snapshot().Count)
+}
+
+func TestMetricsLatency(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:     100,
+		MaxCost:         1000,
+		BufferItems:     64,
+		Metrics:         true,
+		DetailedMetrics: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.Zero(t, c.Metrics.GetLatency(0.99))
+	for i := 0; i < 100; i++ {
+		c.Set(i, i, 1)
+		c.Get(i)
+	}
+	c.Del(1)
+
+	require.Equal(t, int64(100), c.Metrics.LatencyDistribution(TraceGet).Count)
+	require.Equal(t, int64(100), c.Metrics.LatencyDistribution(TraceSet).Count)
+	require.Equal(t, int64(1), c.Metrics.LatencyDistribution(TraceDel).Count)
+	require.Positive(t, c.Metrics.GetLatency(0.99))
+	require.GreaterOrEqual(t, c.Metrics.GetLatency(0.99), c.Metrics.GetLatency(0.5))
+	require.Positive(t, c.Metrics.SetLatency(0.5))
+	require.Positive(t, c.Metrics.DelLatency(0.5))
+	require.Nil(t, c.Metrics.LatencyDistribution(TraceOp(-1)))
+
+	c.Metrics.Clear()
+	require.Zero(t, c.Metrics.GetLatency(0.99))
+}
+
+func TestMetricsLatencyDisabled(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     1000,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	c.Set(1, 1, 1)
+	c.Get(1)
+	require.Nil(t, c.Metrics.LatencyDistribution(TraceGet))
+	require.Zero(t, c.Metrics.GetLatency(0.99))
+
+	var nilMetrics *Metrics
+	require.Zero(t, nilMetrics.SetLatency(0.5))
+}
+
+func TestMetricsLatencyTraceSampling(t *testing.T) {
+	var traced atomic.Int64
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:     100,
+		MaxCost:         1000,
+		BufferItems:     64,
+		Metrics:         true,
+		DetailedMetrics: true,
+		TraceSampleRate: 10,
+		OnTrace: func(op TraceOp, keyHash uint64, durNs int64, hit bool) {
+			require.GreaterOrEqual(t, durNs, int64(0))
+			traced.Add(1)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 1000; i++ {
+		c.Get(i)
+	}
+	require.Equal(t, int64(1000), c.Metrics.LatencyDistribution(TraceGet).Count,
+		"all the Gets are timed")
+	require.Greater(t, traced.Load(), int64(0))
+	require.Less(t, traced.Load(), int64(1000), "only the sampled ones are traced")
+	require.Less(t, c.Metrics.GetLatency(0.5), time.Second)
+}
@@ -0,0 +1,333 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"container/list"
+	"sync/atomic"
+)
+
+const (
+	// lirsHIRRatio is the share of MaxCost reserved for resident HIR entries.
+	// The LIRS paper [1] found 1% to work well.
+	//
+	// [1]: https://dl.acm.org/doi/10.1145/511399.511340
+	lirsHIRRatio = 0.01
+	// lirsMaxNonResident bounds the number of non-resident HIR entries kept in
+	// the stack, relative to the number of resident entries.
+	lirsMaxNonResident = 2
+)
+
+type lirsStatus byte
+
+const (
+	lirsLIR lirsStatus = iota
+	lirsHIR
+	// lirsNonResident entries are HIR entries whose value has been evicted,
+	// but whose recency is still tracked in the stack.
+	lirsNonResident
+)
+
+type lirsEntry struct {
+	key    uint64
+	cost   int64
+	status lirsStatus
+	// s points to the entry in the stack, q in the queue of resident HIR
+	// entries and nr in the list of non-resident entries. Each one is nil if
+	// the entry isn't part of the corresponding list.
+	s, q, nr *list.Element
+}
+
+// lirsPolicy implements the Low Inter-reference Recency Set replacement
+// policy [1], extended to weigh entries by cost. Entries with a small reuse
+// distance (LIR) are protected in the stack, while the ones with a large
+// reuse distance (HIR) go through a small FIFO queue and are the first to be
+// evicted. lirsPolicy admits every item that fits in the cache.
+//
+// [1]: https://dl.acm.org/doi/10.1145/511399.511340
+type lirsPolicy[V any] struct {
+	policyBase
+	// NOTE: align maxCost to 64-bit boundary for use with atomic.
+	maxCost int64
+	used    int64
+	lirCost int64
+	entries map[uint64]*lirsEntry
+	// stack is ordered by recency, front is the most recently used entry. The
+	// back of the stack is always a LIR entry.
+	stack *list.List
+	// queue holds the resident HIR entries in FIFO order, the front is the
+	// next one to be evicted.
+	queue       *list.List
+	nonResident *list.List
+}
+
+func newLIRSPolicy[V any](maxCost int64) *lirsPolicy[V] {
+	p := &lirsPolicy[V]{
+		policyBase: newPolicyBase(),
+		maxCost:    maxCost,
+	}
+	p.clear()
+	go p.processItems(p.access)
+	return p
+}
+
+func (p *lirsPolicy[V]) CollectMetrics(metrics *Metrics) {
+	p.metrics = metrics
+}
+
+func (p *lirsPolicy[V]) clear() {
+	p.used = 0
+	p.lirCost = 0
+	p.entries = make(map[uint64]*lirsEntry)
+	p.stack = list.New()
+	p.queue = list.New()
+	p.nonResident = list.New()
+}
+
+func (p *lirsPolicy[V]) lirCap() int64 {
+	return int64(float64(p.MaxCost()) * (1 - lirsHIRRatio))
+}
+
+// access records a hit on each of the resident keys.
+func (p *lirsPolicy[V]) access(keys []uint64) {
+	for _, key := range keys {
+		e, ok := p.entries[key]
+		if !ok || e.status == lirsNonResident {
+			// Misses are dealt with by Add.
+			continue
+		}
+		switch {
+		case e.status == lirsLIR:
+			wasBottom := p.stack.Back() == e.s
+			p.stack.MoveToFront(e.s)
+			if wasBottom {
+				p.prune()
+			}
+		case e.s != nil:
+			// A resident HIR entry still in the stack has a reuse distance
+			// smaller than the oldest LIR entry, so it takes its place.
+			p.queue.Remove(e.q)
+			e.q = nil
+			p.stack.MoveToFront(e.s)
+			p.promote(e)
+		default:
+			e.s = p.stack.PushFront(e)
+			p.queue.MoveToBack(e.q)
+		}
+	}
+}
+
+// promote turns e, which is already at the top of the stack, into a LIR entry
+// and demotes the oldest LIR entries until the LIR set fits in its share.
+func (p *lirsPolicy[V]) promote(e *lirsEntry) {
+	e.status = lirsLIR
+	p.lirCost += e.cost
+	for p.lirCost > p.lirCap() && p.stack.Back() != e.s {
+		p.demoteBottom()
+	}
+}
+
+// demoteBottom turns the LIR entry at the bottom of the stack into a resident
+// HIR entry.
+func (p *lirsPolicy[V]) demoteBottom() {
+	e := p.stack.Remove(p.stack.Back()).(*lirsEntry)
+	e.s = nil
+	e.status = lirsHIR
+	e.q = p.queue.PushBack(e)
+	p.lirCost -= e.cost
+	p.prune()
+}
+
+// prune removes the HIR entries from the bottom of the stack, so that the
+// stack always ends with a LIR entry.
+func (p *lirsPolicy[V]) prune() {
+	for b := p.stack.Back(); b != nil; b = p.stack.Back() {
+		e := b.Value.(*lirsEntry)
+		if e.status == lirsLIR {
+			return
+		}
+		p.stack.Remove(b)
+		e.s = nil
+		if e.status == lirsNonResident {
+			p.nonResident.Remove(e.nr)
+			delete(p.entries, e.key)
+		}
+	}
+}
+
+// evictOne removes the oldest resident HIR entry, demoting a LIR entry first
+// if there are none.
+func (p *lirsPolicy[V]) evictOne() *Item[V] {
+	if p.queue.Len() == 0 {
+		p.demoteBottom()
+	}
+	e := p.queue.Remove(p.queue.Front()).(*lirsEntry)
+	e.q = nil
+	p.used -= e.cost
+	p.metrics.trackEvict(e.key, e.cost)
+	victim := &Item[V]{Key: e.key, Cost: e.cost}
+	if e.s == nil {
+		delete(p.entries, e.key)
+		return victim
+	}
+	// Keep track of its recency, so that it can become a LIR entry if it's
+	// requested again soon.
+	e.status = lirsNonResident
+	e.nr = p.nonResident.PushBack(e)
+	maxNonResident := lirsMaxNonResident * (len(p.entries) - p.nonResident.Len())
+	for p.nonResident.Len() > maxNonResident {
+		old := p.nonResident.Remove(p.nonResident.Front()).(*lirsEntry)
+		p.stack.Remove(old.s)
+		delete(p.entries, old.key)
+	}
+	return victim
+}
+
+func (p *lirsPolicy[V]) Add(key uint64, cost int64) ([]*Item[V], bool) {
+	p.Lock()
+	defer p.Unlock()
+	return p.add(key, cost)
+}
+
+func (p *lirsPolicy[V]) AddBatch(pairs []policyPair) []addResult[V] {
+	p.Lock()
+	defer p.Unlock()
+	return addBatch(pairs, p.add)
+}
+
+// add is Add, with the lock held.
+func (p *lirsPolicy[V]) add(key uint64, cost int64) ([]*Item[V], bool) {
+	// Cannot add an item bigger than entire cache.
+	if cost > p.MaxCost() {
+		return nil, false
+	}
+	// No need to go any further if the item is already in the cache.
+	if p.updateIfHas(key, cost) {
+		return nil, false
+	}
+
+	var victims []*Item[V]
+	for p.used+cost > p.MaxCost() {
+		victims = append(victims, p.evictOne())
+	}
+
+	p.used += cost
+	p.metrics.trackAdd(key, cost)
+	if e, ok := p.entries[key]; ok {
+		// The entry is non-resident, but still in the stack: it's been reused
+		// recently enough to become a LIR entry.
+		p.nonResident.Remove(e.nr)
+		e.nr = nil
+		e.cost = cost
+		p.stack.MoveToFront(e.s)
+		p.promote(e)
+		return victims, true
+	}
+
+	e := &lirsEntry{key: key, cost: cost}
+	p.entries[key] = e
+	e.s = p.stack.PushFront(e)
+	if p.lirCost+cost <= p.lirCap() {
+		// Until the LIR set is full, every new entry is a LIR entry.
+		e.status = lirsLIR
+		p.lirCost += cost
+	} else {
+		e.status = lirsHIR
+		e.q = p.queue.PushBack(e)
+	}
+	return victims, true
+}
+
+func (p *lirsPolicy[V]) AddIfRoom(key uint64, cost int64) bool {
+	p.Lock()
+	if e, ok := p.entries[key]; (ok && e.status != lirsNonResident) ||
+		p.used+cost > p.MaxCost() {
+		p.Unlock()
+		return false
+	}
+	p.Unlock()
+	_, added := p.Add(key, cost)
+	return added
+}
+
+func (p *lirsPolicy[V]) updateIfHas(key uint64, cost int64) bool {
+	e, ok := p.entries[key]
+	if !ok || e.status == lirsNonResident {
+		return false
+	}
+	p.metrics.trackUpdate(key, e.cost, cost)
+	p.used += cost - e.cost
+	if e.status == lirsLIR {
+		p.lirCost += cost - e.cost
+	}
+	e.cost = cost
+	return true
+}
+
+func (p *lirsPolicy[V]) Has(key uint64) bool {
+	p.Lock()
+	defer p.Unlock()
+	e, ok := p.entries[key]
+	return ok && e.status != lirsNonResident
+}
+
+func (p *lirsPolicy[V]) Del(key uint64) {
+	p.Lock()
+	defer p.Unlock()
+	e, ok := p.entries[key]
+	if !ok || e.status == lirsNonResident {
+		return
+	}
+	p.used -= e.cost
+	p.metrics.trackEvict(key, e.cost)
+	if e.q != nil {
+		p.queue.Remove(e.q)
+	}
+	delete(p.entries, key)
+	if e.s == nil {
+		return
+	}
+	p.stack.Remove(e.s)
+	if e.status == lirsLIR {
+		p.lirCost -= e.cost
+		p.prune()
+	}
+}
+
+func (p *lirsPolicy[V]) Cap() int64 {
+	p.Lock()
+	defer p.Unlock()
+	return p.MaxCost() - p.used
+}
+
+func (p *lirsPolicy[V]) Update(key uint64, cost int64) {
+	p.Lock()
+	p.updateIfHas(key, cost)
+	p.Unlock()
+}
+
+func (p *lirsPolicy[V]) Cost(key uint64) int64 {
+	p.Lock()
+	defer p.Unlock()
+	if e, ok := p.entries[key]; ok && e.status != lirsNonResident {
+		return e.cost
+	}
+	return -1
+}
+
+func (p *lirsPolicy[V]) Clear() {
+	p.Lock()
+	p.clear()
+	p.Unlock()
+}
+
+func (p *lirsPolicy[V]) MaxCost() int64 {
+	return atomic.LoadInt64(&p.maxCost)
+}
+
+func (p *lirsPolicy[V]) UpdateMaxCost(maxCost int64) {
+	atomic.StoreInt64(&p.maxCost, maxCost)
+}
@@ -0,0 +1,194 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLIRSPolicyAdd(t *testing.T) {
+	p := newLIRSPolicy[int](100)
+	defer p.Close()
+	p.CollectMetrics(newMetrics())
+
+	victims, added := p.Add(1, 101)
+	require.Nil(t, victims)
+	require.False(t, added)
+
+	for i := uint64(1); i <= 10; i++ {
+		victims, added = p.Add(i, 10)
+		require.Nil(t, victims)
+		require.True(t, added)
+	}
+	// Updating an existing key doesn't evict anything.
+	victims, added = p.Add(1, 10)
+	require.Nil(t, victims)
+	require.False(t, added)
+
+	victims, added = p.Add(11, 10)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	require.False(t, p.Has(victims[0].Key))
+	require.True(t, p.Has(11))
+	require.Equal(t, int64(0), p.Cap())
+	require.Equal(t, uint64(1), p.metrics.KeysEvicted())
+}
+
+func TestLIRSPolicyAddIfRoom(t *testing.T) {
+	p := newLIRSPolicy[int](100)
+	defer p.Close()
+
+	require.True(t, p.AddIfRoom(1, 60))
+	require.False(t, p.AddIfRoom(1, 10))
+	require.False(t, p.AddIfRoom(2, 50))
+	require.True(t, p.AddIfRoom(2, 40))
+	require.Equal(t, int64(0), p.Cap())
+}
+
+func TestLIRSPolicyHIRPromotion(t *testing.T) {
+	p := newLIRSPolicy[int](10)
+	defer p.Close()
+
+	// Key 1 to 9 fill the LIR set, 10 is a resident HIR entry.
+	for i := uint64(1); i <= 10; i++ {
+		p.Add(i, 1)
+	}
+	e := p.entries[10]
+	require.Equal(t, lirsHIR, e.status)
+
+	// Accessing 10 again while it's still in the stack turns it into a LIR
+	// entry, and demotes the oldest LIR entry.
+	p.itemsCh <- []uint64{10}
+	time.Sleep(wait)
+	p.Lock()
+	require.Equal(t, lirsLIR, e.status)
+	require.Equal(t, lirsHIR, p.entries[1].status)
+	p.Unlock()
+
+	// The demoted entry is the next one to go.
+	victims, _ := p.Add(11, 1)
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(1), victims[0].Key)
+}
+
+func TestLIRSPolicyNonResident(t *testing.T) {
+	p := newLIRSPolicy[int](10)
+	defer p.Close()
+
+	for i := uint64(1); i <= 10; i++ {
+		p.Add(i, 1)
+	}
+	// Each new key evicts the previous HIR entry, which stays in the stack
+	// as a non-resident entry.
+	p.Add(11, 1)
+	require.False(t, p.Has(10))
+	require.Equal(t, lirsNonResident, p.entries[10].status)
+	require.Equal(t, int64(-1), p.Cost(10))
+
+	// Adding it back makes it a LIR entry straight away.
+	p.Add(10, 1)
+	require.True(t, p.Has(10))
+	require.Equal(t, lirsLIR, p.entries[10].status)
+	require.Equal(t, lirsNonResident, p.entries[11].status)
+}
+
+func TestLIRSPolicyDel(t *testing.T) {
+	p := newLIRSPolicy[int](100)
+	defer p.Close()
+
+	p.Add(1, 1)
+	p.Add(2, 2)
+	p.Del(1)
+	p.Del(3)
+	require.False(t, p.Has(1))
+	require.True(t, p.Has(2))
+	require.Equal(t, int64(98), p.Cap())
+}
+
+func TestLIRSPolicyUpdate(t *testing.T) {
+	p := newLIRSPolicy[int](100)
+	defer p.Close()
+
+	p.Add(1, 1)
+	p.Update(1, 2)
+	require.Equal(t, int64(2), p.Cost(1))
+	require.Equal(t, int64(2), p.lirCost)
+	require.Equal(t, int64(98), p.Cap())
+}
+
+func TestLIRSPolicyClear(t *testing.T) {
+	p := newLIRSPolicy[int](100)
+	defer p.Close()
+
+	p.Add(1, 1)
+	p.Add(2, 2)
+	p.Clear()
+	require.False(t, p.Has(1))
+	require.False(t, p.Has(2))
+	require.Equal(t, int64(100), p.Cap())
+	require.Equal(t, 0, p.stack.Len())
+}
+
+func TestLIRSPolicyLoop(t *testing.T) {
+	// LRU gets no hits at all on a loop slightly bigger than the cache, while
+	// LIRS keeps most of the loop resident.
+	p := newLIRSPolicy[int](100)
+	defer p.Close()
+
+	var hits, total int
+	for round := 0; round < 20; round++ {
+		for i := uint64(0); i < 120; i++ {
+			total++
+			if p.Has(i) {
+				hits++
+				p.Lock()
+				p.access([]uint64{i})
+				p.Unlock()
+				continue
+			}
+			p.Add(i, 1)
+		}
+	}
+	require.Greater(t, float64(hits)/float64(total), 0.7)
+}
+
+func TestCacheLIRSPolicy(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		Metrics:            true,
+		IgnoreInternalCost: true,
+		Policy:             PolicyLIRS,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 20; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	require.Equal(t, uint64(20), c.Metrics.KeysAdded())
+	require.Equal(t, uint64(10), c.Metrics.KeysEvicted())
+	require.Equal(t, uint64(10), c.Metrics.CostAdded()-c.Metrics.CostEvicted())
+
+	val, ok := c.Get(19)
+	require.True(t, ok)
+	require.Equal(t, 19, val)
+}
+
+func TestCacheUnknownPolicy(t *testing.T) {
+	_, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Policy:      "mru",
+	})
+	require.EqualError(t, err, `unknown Policy: "mru"`)
+}
@@ -0,0 +1,215 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package livecfg applies configuration changes to running caches. The changes
+// are SuperFlag strings (see z.SuperFlag), e.g. "max-cost=1073741824;
+// ttl-ticker-duration-in-sec=30;", coming from a file or a channel. They're
+// named like the fields of ristretto.Config, in kebab case.
+package livecfg
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+// Cache is implemented by *ristretto.Cache and *ristretto.PartitionedCache.
+type Cache interface {
+	UpdateMaxCost(maxCost int64)
+	UpdateTtlTickerDuration(secs int64)
+}
+
+// Logf is used to report what has been applied.
+type Logf func(format string, args ...any)
+
+// restartOptions are the options of ristretto.Config that can only be set when
+// creating a cache.
+var restartOptions = map[string]bool{
+	"num-counters":         true,
+	"buffer-items":         true,
+	"metrics":              true,
+	"ignore-internal-cost": true,
+	"thrash-threshold":     true,
+	"trace-sample-rate":    true,
+	"ghost-list-size":      true,
+	"retry-admit-window":   true,
+	"sample-hot-gets":      true,
+	"replicate-hot-keys":   true,
+	"ordered-callbacks":    true,
+	"recalculate-costs":    true,
+	"on-evict-rate-limit":  true,
+	"name":                 true,
+	"track-idle-time":      true,
+	"max-idle-time":        true,
+	"default-ttl":          true,
+	"max-ttl":              true,
+	"policy":               true,
+	"scramble-keys":        true,
+	"key-hash-seed":        true,
+	"spill-limit":          true,
+	"keep-values":          true,
+	"mmap-store-path":      true,
+	"sliding-ttl":          true,
+	"max-buffer-items":     true,
+	"ttl-audit-interval":   true,
+	"detailed-metrics":     true,
+	"top-keys":             true,
+}
+
+// Result is what Apply did with each option.
+type Result struct {
+	// Applied holds the options applied to the cache, as "name=value".
+	Applied []string
+	// Restart holds the names of the valid options that can't be changed
+	// without creating a new cache.
+	Restart []string
+	// Unknown holds the names of the options that aren't options of
+	// ristretto.Config.
+	Unknown []string
+}
+
+// Apply applies the supported options of flag to c: max-cost and
+// ttl-ticker-duration-in-sec. If the flag is malformed or any of their values
+// is invalid, nothing is applied and an error is returned.
+func Apply(c Cache, flag string) (*Result, error) {
+	sf, err := z.ParseSuperFlag(flag)
+	if err != nil {
+		return nil, err
+	}
+	var updates []func()
+	r := &Result{}
+	for _, key := range sf.Keys() {
+		val := sf.GetString(key)
+		switch {
+		case key == "max-cost":
+			maxCost, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || maxCost <= 0 {
+				return nil, fmt.Errorf("livecfg: invalid max-cost: %q", val)
+			}
+			updates = append(updates, func() { c.UpdateMaxCost(maxCost) })
+		case key == "ttl-ticker-duration-in-sec":
+			secs, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || secs <= 0 {
+				return nil, fmt.Errorf("livecfg: invalid ttl-ticker-duration-in-sec: %q", val)
+			}
+			updates = append(updates, func() { c.UpdateTtlTickerDuration(secs) })
+		case restartOptions[key]:
+			r.Restart = append(r.Restart, key)
+			continue
+		default:
+			r.Unknown = append(r.Unknown, key)
+			continue
+		}
+		r.Applied = append(r.Applied, key+"="+val)
+	}
+	for _, update := range updates {
+		update()
+	}
+	return r, nil
+}
+
+// Watcher applies the changes it receives to a cache until it's closed.
+type Watcher struct {
+	c       Cache
+	logf    Logf
+	done    chan struct{}
+	stopped sync.WaitGroup
+	once    sync.Once
+}
+
+func newWatcher(c Cache, logf Logf) *Watcher {
+	if logf == nil {
+		logf = log.Printf
+	}
+	w := &Watcher{c: c, logf: logf, done: make(chan struct{})}
+	w.stopped.Add(1)
+	return w
+}
+
+// Watch applies every flag received on updates to c, until updates is closed
+// or the returned Watcher is. Applied changes, ignored options and errors are
+// logged with logf, or with log.Printf if logf is nil.
+func Watch(c Cache, updates <-chan string, logf Logf) *Watcher {
+	w := newWatcher(c, logf)
+	go func() {
+		defer w.stopped.Done()
+		for {
+			select {
+			case flag, ok := <-updates:
+				if !ok {
+					return
+				}
+				w.apply(flag)
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// WatchFile reads the flag in the file at path every interval, and applies it
+// to c every time it changes, starting right away. Applied changes, ignored
+// options and errors are logged with logf, or with log.Printf if logf is nil.
+func WatchFile(c Cache, path string, interval time.Duration, logf Logf) *Watcher {
+	w := newWatcher(c, logf)
+	var last []byte
+	check := func() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			w.logf("livecfg: reading %s: %v", path, err)
+			return
+		}
+		if last != nil && bytes.Equal(data, last) {
+			return
+		}
+		last = data
+		w.apply(string(data))
+	}
+	check()
+	go func() {
+		defer w.stopped.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				check()
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+func (w *Watcher) apply(flag string) {
+	r, err := Apply(w.c, flag)
+	if err != nil {
+		w.logf("livecfg: not applied: %v", err)
+		return
+	}
+	for _, opt := range r.Applied {
+		w.logf("livecfg: applied %s", opt)
+	}
+	for _, key := range r.Restart {
+		w.logf("livecfg: %s requires a restart, ignored", key)
+	}
+	for _, key := range r.Unknown {
+		w.logf("livecfg: unknown option %s, ignored", key)
+	}
+}
+
+// Close stops the watcher, and returns once it's stopped.
+func (w *Watcher) Close() {
+	w.once.Do(func() { close(w.done) })
+	w.stopped.Wait()
+}
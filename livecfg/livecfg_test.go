@@ -0,0 +1,129 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package livecfg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dgraph-io/ristretto/v2"
+)
+
+func newCache(t *testing.T) *ristretto.Cache[int, int] {
+	c, err := ristretto.NewCache(&ristretto.Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	t.Cleanup(c.Close)
+	return c
+}
+
+// logs collects the logged lines.
+type logs struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *logs) logf(format string, args ...any) {
+	l.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+	l.Unlock()
+}
+
+func (l *logs) get() []string {
+	l.Lock()
+	defer l.Unlock()
+	return append([]string{}, l.lines...)
+}
+
+func TestApply(t *testing.T) {
+	c := newCache(t)
+	r, err := Apply(c, "max-cost=100; ttl_ticker_duration_in_sec=1; num-counters=5; foo=bar;")
+	require.NoError(t, err)
+	require.Equal(t, []string{"max-cost=100", "ttl-ticker-duration-in-sec=1"}, r.Applied)
+	require.Equal(t, []string{"num-counters"}, r.Restart)
+	require.Equal(t, []string{"foo"}, r.Unknown)
+	require.Equal(t, int64(100), c.MaxCost())
+}
+
+func TestApplyInvalid(t *testing.T) {
+	c := newCache(t)
+	for _, flag := range []string{
+		"max-cost",
+		"max-cost=0",
+		"max-cost=200; ttl-ticker-duration-in-sec=abc",
+	} {
+		_, err := Apply(c, flag)
+		require.Error(t, err, flag)
+	}
+	// Nothing is applied if any option is invalid.
+	require.Equal(t, int64(10), c.MaxCost())
+}
+
+func TestApplyPartitioned(t *testing.T) {
+	c, err := ristretto.NewPartitionedCache(&ristretto.Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	}, 2)
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, err = Apply(c, "max-cost=100")
+	require.NoError(t, err)
+	require.Equal(t, int64(100), c.MaxCost())
+}
+
+func TestWatch(t *testing.T) {
+	c := newCache(t)
+	var l logs
+	updates := make(chan string)
+	w := Watch(c, updates, l.logf)
+	defer w.Close()
+
+	updates <- "max-cost=50; policy=lirs"
+	updates <- "max-cost=-1"
+	close(updates)
+	w.stopped.Wait()
+	require.Equal(t, int64(50), c.MaxCost())
+	require.Equal(t, []string{
+		"livecfg: applied max-cost=50",
+		"livecfg: policy requires a restart, ignored",
+		`livecfg: not applied: livecfg: invalid max-cost: "-1"`,
+	}, l.get())
+}
+
+func TestWatchFile(t *testing.T) {
+	c := newCache(t)
+	var l logs
+	path := filepath.Join(t.TempDir(), "cache.flag")
+	require.NoError(t, os.WriteFile(path, []byte("max-cost=20;"), 0o600))
+
+	w := WatchFile(c, path, 10*time.Millisecond, l.logf)
+	defer w.Close()
+	require.Equal(t, int64(20), c.MaxCost())
+
+	require.NoError(t, os.WriteFile(path, []byte("max-cost=30;"), 0o600))
+	require.Eventually(t, func() bool {
+		return c.MaxCost() == 30
+	}, time.Second, 10*time.Millisecond)
+
+	// Unchanged files aren't applied again.
+	time.Sleep(50 * time.Millisecond)
+	w.Close()
+	require.Equal(t, []string{
+		"livecfg: applied max-cost=20",
+		"livecfg: applied max-cost=30",
+	}, l.get())
+}
@@ -0,0 +1,135 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// LoadingConfig is the configuration of a LoadingCache.
+type LoadingConfig[K Key, V any] struct {
+	// Load loads the value of key and its cost, on the misses of Get and to
+	// refresh the values. It's required.
+	Load func(key K) (V, int64, error)
+
+	// RefreshAfter is the age of the values past which the Gets which hit
+	// them reload them in the background, returning them meanwhile, like
+	// Caffeine's refreshAfterWrite. This keeps the hot keys from all missing
+	// at once when they expire, and waiting for a synchronous load. It should
+	// be shorter than the TTL of the values. If zero, the values are never
+	// refreshed.
+	RefreshAfter time.Duration
+
+	// OnRefreshError is called with the errors of the reloads made in the
+	// background, which otherwise leave the values as they are.
+	OnRefreshError func(key K, err error)
+}
+
+// LoadingCache is a Cache which loads the values of its keys on demand. Its
+// Gets load the values missed, coalescing the concurrent misses for the same
+// key like GetOrCompute, and refresh the values past LoadingConfig.RefreshAfter
+// in the background.
+//
+// The ages of the values are tracked with their versions (see SetWithVersion),
+// which are the times their loads started: this also keeps a slow reload from
+// overwriting a value loaded since. The values written to the cache outside of
+// the LoadingCache, with version 0, are refreshed on their first Get.
+type LoadingCache[K Key, V any] struct {
+	cache          *Cache[K, V]
+	load           func(key K) (V, int64, error)
+	refreshAfter   time.Duration
+	onRefreshError func(key K, err error)
+	// refreshing holds the hashes of the keys being reloaded in the background,
+	// for only one reload of a key at a time.
+	refreshing sync.Map
+}
+
+// NewLoadingCache returns a LoadingCache loading the values of cache. The other
+// writes to cache, e.g. to delete the values changed elsewhere, can still be
+// made directly, see Cache.
+func NewLoadingCache[K Key, V any](cache *Cache[K, V], config LoadingConfig[K, V]) (
+	*LoadingCache[K, V], error) {
+	switch {
+	case cache == nil:
+		return nil, errors.New("Cache can't be nil")
+	case config.Load == nil:
+		return nil, errors.New("Load can't be nil")
+	case config.RefreshAfter < 0:
+		return nil, errors.New("RefreshAfter can't be negative number")
+	}
+	return &LoadingCache[K, V]{
+		cache:          cache,
+		load:           config.Load,
+		refreshAfter:   config.RefreshAfter,
+		onRefreshError: config.OnRefreshError,
+	}, nil
+}
+
+// Cache returns the cache of l.
+func (l *LoadingCache[K, V]) Cache() *Cache[K, V] {
+	return l.cache
+}
+
+// Get returns the value of key. On a miss, it loads the value, Sets it and
+// returns it, or returns the error of Load. On a hit of a value older than
+// RefreshAfter, it returns the value, and starts reloading it in the
+// background unless it's being reloaded already.
+func (l *LoadingCache[K, V]) Get(key K) (V, error) {
+	c := l.cache
+	if c == nil || c.isClosed.Load() {
+		value, _, err := l.load(key)
+		return value, err
+	}
+	value, ok := c.Get(key)
+	if !ok {
+		loadedAt := ttlNow()
+		return c.computeMiss(key, func() (V, int64, error) {
+			return l.load(key)
+		}, func(value V, cost int64) bool {
+			return c.SetWithVersion(key, value, cost, loadVersion(loadedAt))
+		})
+	}
+	if l.refreshAfter > 0 {
+		keyHash, conflictHash := c.keyToHash(key)
+		version, ok := c.storedItems.GetVersion(keyHash, conflictHash)
+		if ok && ttlNow().Sub(time.Unix(0, int64(version))) >= l.refreshAfter {
+			l.refresh(key, keyHash)
+		}
+	}
+	return value, nil
+}
+
+// Refresh reloads the value of key in the background, unless it's being
+// reloaded already, e.g. when the value is known to have changed.
+func (l *LoadingCache[K, V]) Refresh(key K) {
+	keyHash, _ := l.cache.keyToHash(key)
+	l.refresh(key, keyHash)
+}
+
+func (l *LoadingCache[K, V]) refresh(key K, keyHash uint64) {
+	if _, loading := l.refreshing.LoadOrStore(keyHash, struct{}{}); loading {
+		return
+	}
+	go func() {
+		defer l.refreshing.Delete(keyHash)
+		loadedAt := ttlNow()
+		value, cost, err := l.load(key)
+		if err != nil {
+			if l.onRefreshError != nil {
+				l.onRefreshError(key, err)
+			}
+			return
+		}
+		l.cache.SetWithVersion(key, value, cost, loadVersion(loadedAt))
+	}()
+}
+
+// loadVersion is the version of the values loaded at t.
+func loadVersion(t time.Time) uint64 {
+	return uint64(t.UnixNano())
+}
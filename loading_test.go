@@ -0,0 +1,201 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadingCache(t *testing.T) {
+	c := newCacheT(t, &Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	var loads atomic.Int64
+	// release blocks the reloads, once closed.
+	release := make(chan struct{})
+	l, err := NewLoadingCache(c, LoadingConfig[int, int]{
+		Load: func(key int) (int, int64, error) {
+			if n := loads.Add(1); n > 1 {
+				<-release
+				return key * int(n), 1, nil
+			}
+			return key, 1, nil
+		},
+		RefreshAfter: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.Equal(t, c, l.Cache())
+
+	val, err := l.Get(1)
+	require.NoError(t, err)
+	require.Equal(t, 1, val)
+	val, err = l.Get(1)
+	require.NoError(t, err)
+	require.Equal(t, 1, val)
+	require.Equal(t, int64(1), loads.Load())
+
+	// The stale value is returned while it's reloaded, once.
+	time.Sleep(60 * time.Millisecond)
+	for n := 0; n < 3; n++ {
+		val, err = l.Get(1)
+		require.NoError(t, err)
+		require.Equal(t, 1, val)
+	}
+	close(release)
+	require.Eventually(t, func() bool {
+		val, _ := l.Get(1)
+		return val == 2
+	}, time.Second, time.Millisecond)
+	require.Equal(t, int64(2), loads.Load())
+
+	// The values Set directly are refreshed on their first Get.
+	require.True(t, c.Set(2, 0, 1))
+	c.Wait()
+	val, err = l.Get(2)
+	require.NoError(t, err)
+	require.Zero(t, val)
+	require.Eventually(t, func() bool {
+		val, _ := c.Get(2)
+		return val != 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestLoadingCacheRefreshClock(t *testing.T) {
+	f := newFakeClock()
+	f.install(t)
+	c := newCacheT(t, &Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	var loads atomic.Int64
+	l, err := NewLoadingCache(c, LoadingConfig[int, int]{
+		Load: func(key int) (int, int64, error) {
+			return key * int(loads.Add(1)), 1, nil
+		},
+		RefreshAfter: time.Minute,
+	})
+	require.NoError(t, err)
+
+	val, err := l.Get(1)
+	require.NoError(t, err)
+	require.Equal(t, 1, val)
+	// The age of the values is measured like the TTLs, so a step of the wall
+	// clock doesn't make them all stale.
+	f.step(time.Hour)
+	_, err = l.Get(1)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), loads.Load())
+
+	f.advance(time.Minute)
+	_, err = l.Get(1)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		val, _ := c.Get(1)
+		return val == 2
+	}, time.Second, time.Millisecond)
+}
+
+func TestLoadingCacheMisses(t *testing.T) {
+	c := newCacheT(t, &Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	var loads atomic.Int64
+	errLoad := errors.New("load")
+	l, err := NewLoadingCache(c, LoadingConfig[int, int]{
+		Load: func(key int) (int, int64, error) {
+			loads.Add(1)
+			if key < 0 {
+				return 0, 0, errLoad
+			}
+			time.Sleep(10 * time.Millisecond)
+			return key, 1, nil
+		},
+	})
+	require.NoError(t, err)
+
+	// The concurrent misses load the value once.
+	var wg sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err := l.Get(1)
+			require.NoError(t, err)
+			require.Equal(t, 1, val)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int64(1), loads.Load())
+
+	_, err = l.Get(-1)
+	require.ErrorIs(t, err, errLoad)
+	_, ok := c.Get(-1)
+	require.False(t, ok)
+}
+
+func TestLoadingCacheRefreshError(t *testing.T) {
+	c := newCacheT(t, &Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	errLoad := errors.New("load")
+	errs := make(chan error, 1)
+	l, err := NewLoadingCache(c, LoadingConfig[int, int]{
+		Load: func(key int) (int, int64, error) {
+			return 0, 0, errLoad
+		},
+		OnRefreshError: func(key int, err error) { errs <- err },
+	})
+	require.NoError(t, err)
+
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	l.Refresh(1)
+	require.ErrorIs(t, <-errs, errLoad)
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+}
+
+func TestLoadingCacheConfig(t *testing.T) {
+	c := newCacheT(t, &Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	load := func(key int) (int, int64, error) { return key, 1, nil }
+	_, err := NewLoadingCache(nil, LoadingConfig[int, int]{Load: load})
+	require.Error(t, err)
+	_, err = NewLoadingCache(c, LoadingConfig[int, int]{})
+	require.Error(t, err)
+	_, err = NewLoadingCache(c, LoadingConfig[int, int]{Load: load, RefreshAfter: -1})
+	require.Error(t, err)
+
+	// The values are loaded without caching them once the cache is closed.
+	l, err := NewLoadingCache(c, LoadingConfig[int, int]{Load: load})
+	require.NoError(t, err)
+	c.Close()
+	val, err := l.Get(1)
+	require.NoError(t, err)
+	require.Equal(t, 1, val)
+}
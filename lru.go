@@ -0,0 +1,243 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"container/list"
+	"sync/atomic"
+)
+
+// slruProtectedRatio is the share of MaxCost given to the protected segment of
+// PolicySLRU.
+const slruProtectedRatio = 0.8
+
+type lruEntry struct {
+	key       uint64
+	cost      int64
+	protected bool
+	elem      *list.Element
+}
+
+// lruPolicy implements the LRU policy, weighing entries by cost, and its
+// segmented variant, SLRU. New items go to the front of the probation segment
+// and the items are evicted from its back. With LRU, accessing an item moves
+// it back to the front. With SLRU, it moves the item to the protected
+// segment, whose least recently used items fall back to the probation segment
+// when it uses more than its share of MaxCost. This way, an item accessed a
+// single time, e.g. by a scan, doesn't evict the items accessed repeatedly.
+type lruPolicy[V any] struct {
+	policyBase
+	// NOTE: align maxCost to 64-bit boundary for use with atomic.
+	maxCost int64
+	// protectedRatio is the share of maxCost of the protected segment, it's
+	// zero for LRU.
+	protectedRatio float64
+	used           int64
+	protectedCost  int64
+	entries        map[uint64]*lruEntry
+	// Front is the most recently used entry for both segments.
+	probation *list.List
+	protected *list.List
+}
+
+func newLRUPolicy[V any](maxCost int64) *lruPolicy[V] {
+	return newSegmentedLRUPolicy[V](maxCost, 0)
+}
+
+func newSLRUPolicy[V any](maxCost int64) *lruPolicy[V] {
+	return newSegmentedLRUPolicy[V](maxCost, slruProtectedRatio)
+}
+
+func newSegmentedLRUPolicy[V any](maxCost int64, protectedRatio float64) *lruPolicy[V] {
+	p := &lruPolicy[V]{
+		policyBase:     newPolicyBase(),
+		maxCost:        maxCost,
+		protectedRatio: protectedRatio,
+	}
+	p.clear()
+	go p.processItems(p.access)
+	return p
+}
+
+func (p *lruPolicy[V]) CollectMetrics(metrics *Metrics) {
+	p.metrics = metrics
+}
+
+func (p *lruPolicy[V]) clear() {
+	p.used = 0
+	p.protectedCost = 0
+	p.entries = make(map[uint64]*lruEntry)
+	p.probation = list.New()
+	p.protected = list.New()
+}
+
+func (p *lruPolicy[V]) access(keys []uint64) {
+	for _, key := range keys {
+		e, ok := p.entries[key]
+		switch {
+		case !ok:
+		case e.protected:
+			p.protected.MoveToFront(e.elem)
+		case p.protectedRatio == 0:
+			p.probation.MoveToFront(e.elem)
+		default:
+			p.probation.Remove(e.elem)
+			e.protected = true
+			e.elem = p.protected.PushFront(e)
+			p.protectedCost += e.cost
+			p.demote()
+		}
+	}
+}
+
+// demote moves the least recently used entries of the protected segment to
+// the probation segment, while it uses more than its share of MaxCost.
+func (p *lruPolicy[V]) demote() {
+	protectedCap := int64(float64(p.MaxCost()) * p.protectedRatio)
+	for p.protectedCost > protectedCap && p.protected.Len() > 1 {
+		e := p.protected.Remove(p.protected.Back()).(*lruEntry)
+		p.protectedCost -= e.cost
+		e.protected = false
+		e.elem = p.probation.PushFront(e)
+	}
+}
+
+// evictOne removes the least recently used entry of the probation segment,
+// or of the protected segment if the probation segment is empty.
+func (p *lruPolicy[V]) evictOne() *Item[V] {
+	segment := p.probation
+	if segment.Len() == 0 {
+		segment = p.protected
+	}
+	e := segment.Remove(segment.Back()).(*lruEntry)
+	if e.protected {
+		p.protectedCost -= e.cost
+	}
+	p.used -= e.cost
+	delete(p.entries, e.key)
+	p.metrics.trackEvict(e.key, e.cost)
+	return &Item[V]{Key: e.key, Cost: e.cost}
+}
+
+func (p *lruPolicy[V]) Add(key uint64, cost int64) ([]*Item[V], bool) {
+	p.Lock()
+	defer p.Unlock()
+	return p.add(key, cost)
+}
+
+func (p *lruPolicy[V]) AddBatch(pairs []policyPair) []addResult[V] {
+	p.Lock()
+	defer p.Unlock()
+	return addBatch(pairs, p.add)
+}
+
+// add is Add, with the lock held.
+func (p *lruPolicy[V]) add(key uint64, cost int64) ([]*Item[V], bool) {
+	// Cannot add an item bigger than entire cache.
+	if cost > p.MaxCost() {
+		return nil, false
+	}
+	// No need to go any further if the item is already in the cache.
+	if p.updateIfHas(key, cost) {
+		return nil, false
+	}
+
+	var victims []*Item[V]
+	for p.used+cost > p.MaxCost() {
+		victims = append(victims, p.evictOne())
+	}
+	e := &lruEntry{key: key, cost: cost}
+	e.elem = p.probation.PushFront(e)
+	p.used += cost
+	p.entries[key] = e
+	p.metrics.trackAdd(key, cost)
+	return victims, true
+}
+
+func (p *lruPolicy[V]) AddIfRoom(key uint64, cost int64) bool {
+	p.Lock()
+	if _, ok := p.entries[key]; ok || p.used+cost > p.MaxCost() {
+		p.Unlock()
+		return false
+	}
+	p.Unlock()
+	_, added := p.Add(key, cost)
+	return added
+}
+
+func (p *lruPolicy[V]) updateIfHas(key uint64, cost int64) bool {
+	e, ok := p.entries[key]
+	if !ok {
+		return false
+	}
+	p.metrics.trackUpdate(key, e.cost, cost)
+	p.used += cost - e.cost
+	if e.protected {
+		p.protectedCost += cost - e.cost
+	}
+	e.cost = cost
+	return true
+}
+
+func (p *lruPolicy[V]) Has(key uint64) bool {
+	p.Lock()
+	defer p.Unlock()
+	_, ok := p.entries[key]
+	return ok
+}
+
+func (p *lruPolicy[V]) Del(key uint64) {
+	p.Lock()
+	defer p.Unlock()
+	e, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	if e.protected {
+		p.protected.Remove(e.elem)
+		p.protectedCost -= e.cost
+	} else {
+		p.probation.Remove(e.elem)
+	}
+	p.used -= e.cost
+	delete(p.entries, key)
+	p.metrics.trackEvict(key, e.cost)
+}
+
+func (p *lruPolicy[V]) Cap() int64 {
+	p.Lock()
+	defer p.Unlock()
+	return p.MaxCost() - p.used
+}
+
+func (p *lruPolicy[V]) Update(key uint64, cost int64) {
+	p.Lock()
+	p.updateIfHas(key, cost)
+	p.Unlock()
+}
+
+func (p *lruPolicy[V]) Cost(key uint64) int64 {
+	p.Lock()
+	defer p.Unlock()
+	if e, ok := p.entries[key]; ok {
+		return e.cost
+	}
+	return -1
+}
+
+func (p *lruPolicy[V]) Clear() {
+	p.Lock()
+	p.clear()
+	p.Unlock()
+}
+
+func (p *lruPolicy[V]) MaxCost() int64 {
+	return atomic.LoadInt64(&p.maxCost)
+}
+
+func (p *lruPolicy[V]) UpdateMaxCost(maxCost int64) {
+	atomic.StoreInt64(&p.maxCost, maxCost)
+}
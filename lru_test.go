@@ -0,0 +1,126 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUPolicy(t *testing.T) {
+	p := newLRUPolicy[int](10)
+	defer p.Close()
+	p.CollectMetrics(newMetrics())
+
+	victims, added := p.Add(1, 11)
+	require.Nil(t, victims)
+	require.False(t, added)
+	for i := uint64(1); i <= 10; i++ {
+		victims, added = p.Add(i, 1)
+		require.Nil(t, victims)
+		require.True(t, added)
+	}
+	victims, added = p.Add(1, 1)
+	require.Nil(t, victims)
+	require.False(t, added)
+
+	// 1 and 2 were accessed, so 3 is the least recently used.
+	p.itemsCh <- []uint64{1, 2}
+	time.Sleep(wait)
+	victims, added = p.Add(11, 2)
+	require.True(t, added)
+	require.Len(t, victims, 2)
+	require.Equal(t, uint64(3), victims[0].Key)
+	require.Equal(t, uint64(4), victims[1].Key)
+	require.True(t, p.Has(1))
+	require.Equal(t, int64(0), p.Cap())
+	require.Equal(t, uint64(2), p.metrics.KeysEvicted())
+
+	require.False(t, p.AddIfRoom(12, 1))
+	p.Update(11, 1)
+	require.Equal(t, int64(1), p.Cost(11))
+	require.True(t, p.AddIfRoom(12, 1))
+	p.Del(12)
+	require.False(t, p.Has(12))
+	require.Equal(t, int64(-1), p.Cost(12))
+	p.Clear()
+	require.Equal(t, int64(10), p.Cap())
+}
+
+func TestSLRUPolicy(t *testing.T) {
+	p := newSLRUPolicy[int](10)
+	defer p.Close()
+
+	for i := uint64(1); i <= 10; i++ {
+		p.Add(i, 1)
+	}
+	p.itemsCh <- []uint64{1, 2}
+	time.Sleep(wait)
+	p.Lock()
+	require.True(t, p.entries[1].protected)
+	require.Equal(t, int64(2), p.protectedCost)
+	p.Unlock()
+
+	// A scan doesn't evict the protected items.
+	for i := uint64(11); i <= 30; i++ {
+		p.Add(i, 1)
+	}
+	require.True(t, p.Has(1))
+	require.True(t, p.Has(2))
+	require.False(t, p.Has(3))
+
+	// The protected segment is kept within its share of MaxCost, by moving
+	// its least recently used items back to the probation segment.
+	keys := make([]uint64, 0, 8)
+	for i := uint64(23); i <= 30; i++ {
+		keys = append(keys, i)
+	}
+	p.itemsCh <- keys
+	time.Sleep(wait)
+	p.Lock()
+	require.Equal(t, int64(8), p.protectedCost)
+	require.False(t, p.entries[1].protected)
+	require.False(t, p.entries[2].protected)
+	p.Unlock()
+	victims, _ := p.Add(31, 1)
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(1), victims[0].Key)
+	p.Del(30)
+	p.Lock()
+	require.Equal(t, int64(7), p.protectedCost)
+	p.Unlock()
+}
+
+func TestCacheLRUPolicy(t *testing.T) {
+	for _, policy := range []string{PolicyLRU, PolicySLRU} {
+		t.Run(policy, func(t *testing.T) {
+			c, err := NewCache(&Config[int, int]{
+				NumCounters:        100,
+				MaxCost:            10,
+				BufferItems:        64,
+				Metrics:            true,
+				IgnoreInternalCost: true,
+				Policy:             policy,
+			})
+			require.NoError(t, err)
+			defer c.Close()
+
+			for i := 0; i < 20; i++ {
+				require.True(t, c.Set(i, i, 1))
+			}
+			c.Wait()
+			require.Equal(t, uint64(20), c.Metrics.KeysAdded())
+			require.Equal(t, uint64(10), c.Metrics.KeysEvicted())
+			val, ok := c.Get(19)
+			require.True(t, ok)
+			require.Equal(t, 19, val)
+			_, ok = c.Get(9)
+			require.False(t, ok)
+		})
+	}
+}
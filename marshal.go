@@ -0,0 +1,216 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+// metricsMessage is the Metrics message of metrics.proto, as encoded by
+// Metrics.MarshalJSON.
+type metricsMessage struct {
+	Epoch                 uint64             `json:"epoch"`
+	Counters              map[string]uint64  `json:"counters"`
+	HitRatio              float64            `json:"hit_ratio"`
+	ThrashIndex           float64            `json:"thrash_index"`
+	AdmissionDenialRate   float64            `json:"admission_denial_rate"`
+	QueueDepths           queueDepthsMessage `json:"queue_depths"`
+	BufferItems           int64              `json:"buffer_items"`
+	LifeExpectancySeconds *histogramMessage  `json:"life_expectancy_seconds,omitempty"`
+	IdleTimeSeconds       *histogramMessage  `json:"idle_time_seconds,omitempty"`
+	CostDistribution      *histogramMessage  `json:"cost_distribution,omitempty"`
+}
+
+type queueDepthsMessage struct {
+	SetBuf          int64 `json:"set_buf"`
+	SetBufCap       int64 `json:"set_buf_cap"`
+	EvictionBacklog int64 `json:"eviction_backlog"`
+	CleanupBacklog  int64 `json:"cleanup_backlog"`
+	Spill           int64 `json:"spill"`
+	SpillAgeNanos   int64 `json:"spill_age_nanos"`
+}
+
+type histogramMessage struct {
+	Bounds         []float64 `json:"bounds"`
+	CountPerBucket []int64   `json:"count_per_bucket"`
+	Count          int64     `json:"count"`
+	Min            int64     `json:"min"`
+	Max            int64     `json:"max"`
+	Sum            int64     `json:"sum"`
+}
+
+func newHistogramMessage(h *z.HistogramData) *histogramMessage {
+	if h == nil {
+		return nil
+	}
+	m := &histogramMessage{
+		Bounds:         h.Bounds,
+		CountPerBucket: h.CountPerBucket,
+		Count:          h.Count,
+		Max:            h.Max,
+		Sum:            h.Sum,
+	}
+	if h.Count > 0 {
+		// Min is math.MaxInt64 until the first value.
+		m.Min = h.Min
+	}
+	return m
+}
+
+// message returns the current values of the metrics.
+func (p *Metrics) message() *metricsMessage {
+	m := &metricsMessage{
+		Epoch:                 p.Epoch(),
+		Counters:              make(map[string]uint64, doNotUse),
+		HitRatio:              p.Ratio(),
+		ThrashIndex:           p.ThrashIndex(),
+		AdmissionDenialRate:   p.AdmissionDenialRate(),
+		BufferItems:           p.BufferItems(),
+		LifeExpectancySeconds: newHistogramMessage(p.LifeExpectancySeconds()),
+		IdleTimeSeconds:       newHistogramMessage(p.IdleTimeSeconds()),
+		CostDistribution:      newHistogramMessage(p.CostDistribution()),
+	}
+	for i := 0; i < doNotUse; i++ {
+		t := metricType(i)
+		m.Counters[stringFor(t)] = p.get(t)
+	}
+	q := p.QueueDepths()
+	m.QueueDepths = queueDepthsMessage{
+		SetBuf:          int64(q.SetBuf),
+		SetBufCap:       int64(q.SetBufCap),
+		EvictionBacklog: q.EvictionBacklog,
+		CleanupBacklog:  int64(q.CleanupBacklog),
+		Spill:           int64(q.Spill),
+		SpillAgeNanos:   int64(q.SpillAge),
+	}
+	return m
+}
+
+// MarshalJSON encodes the counters, ratios, queue depths and histograms of the
+// metrics as a JSON object with the fields of the Metrics message of
+// metrics.proto, under the same names. Its fields are only ever added to, so
+// that monitoring agents can rely on them. Disabled metrics are encoded as
+// null.
+func (p *Metrics) MarshalJSON() ([]byte, error) {
+	if p == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(p.message())
+}
+
+// MarshalProto encodes the metrics as the Metrics message of metrics.proto,
+// in the protobuf wire format. The message is encoded by hand, so that the
+// module doesn't depend on a protobuf runtime, but it can be decoded by the
+// code generated from metrics.proto in any language.
+func (p *Metrics) MarshalProto() ([]byte, error) {
+	if p == nil {
+		return nil, errors.New("metrics are disabled")
+	}
+	m := p.message()
+	var b []byte
+	b = appendProtoVarint(b, 1, m.Epoch)
+	names := make([]string, 0, len(m.Counters))
+	for name := range m.Counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var entry []byte
+		entry = appendProtoBytes(entry, 1, []byte(name))
+		entry = appendProtoVarint(entry, 2, m.Counters[name])
+		b = appendProtoMessage(b, 2, entry)
+	}
+	b = appendProtoDouble(b, 3, m.HitRatio)
+	b = appendProtoDouble(b, 4, m.ThrashIndex)
+	b = appendProtoDouble(b, 5, m.AdmissionDenialRate)
+
+	var q []byte
+	q = appendProtoVarint(q, 1, uint64(m.QueueDepths.SetBuf))
+	q = appendProtoVarint(q, 2, uint64(m.QueueDepths.SetBufCap))
+	q = appendProtoVarint(q, 3, uint64(m.QueueDepths.EvictionBacklog))
+	q = appendProtoVarint(q, 4, uint64(m.QueueDepths.CleanupBacklog))
+	q = appendProtoVarint(q, 5, uint64(m.QueueDepths.Spill))
+	q = appendProtoVarint(q, 6, uint64(m.QueueDepths.SpillAgeNanos))
+	b = appendProtoMessage(b, 6, q)
+	b = appendProtoVarint(b, 7, uint64(m.BufferItems))
+	b = appendProtoHistogram(b, 8, m.LifeExpectancySeconds)
+	b = appendProtoHistogram(b, 9, m.IdleTimeSeconds)
+	b = appendProtoHistogram(b, 10, m.CostDistribution)
+	return b, nil
+}
+
+// The wire types of the protobuf encoding.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+func appendProtoTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+// appendProtoVarint appends a varint field, negative int64s are passed as
+// their two's complement, like protobuf does. Zero values are omitted, as in
+// proto3.
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendProtoTag(b, field, protoVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoDouble(b []byte, field int, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendProtoTag(b, field, protoFixed64)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	return appendProtoMessage(b, field, v)
+}
+
+// appendProtoMessage appends an embedded message, even if it's empty, so that
+// it's set.
+func appendProtoMessage(b []byte, field int, v []byte) []byte {
+	b = appendProtoTag(b, field, protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendProtoHistogram(b []byte, field int, h *histogramMessage) []byte {
+	if h == nil {
+		return b
+	}
+	// The repeated fields are packed, as in proto3.
+	var bounds, counts []byte
+	for _, bound := range h.Bounds {
+		bounds = binary.LittleEndian.AppendUint64(bounds, math.Float64bits(bound))
+	}
+	for _, count := range h.CountPerBucket {
+		counts = binary.AppendUvarint(counts, uint64(count))
+	}
+	var m []byte
+	m = appendProtoBytes(m, 1, bounds)
+	m = appendProtoBytes(m, 2, counts)
+	m = appendProtoVarint(m, 3, uint64(h.Count))
+	m = appendProtoVarint(m, 4, uint64(h.Min))
+	m = appendProtoVarint(m, 5, uint64(h.Max))
+	m = appendProtoVarint(m, 6, uint64(h.Sum))
+	return appendProtoMessage(b, field, m)
+}
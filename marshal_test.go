@@ -0,0 +1,141 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordMarshalMetrics makes c record an admission, a hit and two misses.
+func recordMarshalMetrics(t *testing.T, c *Cache[int, int]) {
+	require.True(t, c.Set(1, 1, 3))
+	c.Wait()
+	c.Get(1)
+	c.Get(2)
+	c.Get(3)
+}
+
+func TestMetricsMarshalJSON(t *testing.T) {
+	c := newCacheT(t, &Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	recordMarshalMetrics(t, c)
+
+	data, err := json.Marshal(c.Metrics)
+	require.NoError(t, err)
+	var m map[string]any
+	require.NoError(t, json.Unmarshal(data, &m))
+	for _, field := range []string{
+		"epoch", "counters", "hit_ratio", "thrash_index", "admission_denial_rate",
+		"queue_depths", "buffer_items", "life_expectancy_seconds", "cost_distribution",
+	} {
+		require.Contains(t, m, field)
+	}
+	require.NotContains(t, m, "idle_time_seconds")
+	counters := m["counters"].(map[string]any)
+	require.Len(t, counters, doNotUse)
+	require.Equal(t, float64(1), counters["hit"])
+	require.Equal(t, float64(2), counters["miss"])
+	require.Equal(t, float64(3), counters["cost-added"])
+	require.InDelta(t, 1.0/3, m["hit_ratio"], 1e-9)
+	require.Equal(t, float64(64), m["buffer_items"])
+	require.Equal(t, float64(setBufSize), m["queue_depths"].(map[string]any)["set_buf_cap"])
+	costs := m["cost_distribution"].(map[string]any)
+	require.Equal(t, float64(1), costs["count"])
+	require.Equal(t, float64(2), costs["min"], "the bound of its bucket")
+	life := m["life_expectancy_seconds"].(map[string]any)
+	require.Equal(t, float64(0), life["min"])
+
+	var nilMetrics *Metrics
+	data, err = json.Marshal(nilMetrics)
+	require.NoError(t, err)
+	require.Equal(t, "null", string(data))
+}
+
+// protoFields decodes the fields of a protobuf message, by number: varints
+// and fixed64s as uint64s, length-delimited fields as []byte.
+func protoFields(t *testing.T, b []byte) map[uint64][]any {
+	fields := make(map[uint64][]any)
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		require.Positive(t, n)
+		b = b[n:]
+		switch tag & 7 {
+		case protoVarint:
+			v, n := binary.Uvarint(b)
+			require.Positive(t, n)
+			fields[tag>>3] = append(fields[tag>>3], v)
+			b = b[n:]
+		case protoFixed64:
+			fields[tag>>3] = append(fields[tag>>3], binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case protoBytes:
+			size, n := binary.Uvarint(b)
+			require.Positive(t, n)
+			fields[tag>>3] = append(fields[tag>>3], b[n:n+int(size)])
+			b = b[n+int(size):]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+	}
+	return fields
+}
+
+func TestMetricsMarshalProto(t *testing.T) {
+	c := newCacheT(t, &Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	recordMarshalMetrics(t, c)
+
+	data, err := c.Metrics.MarshalProto()
+	require.NoError(t, err)
+	fields := protoFields(t, data)
+	require.NotContains(t, fields, uint64(1), "the zero epoch is omitted")
+
+	counters := make(map[string]uint64)
+	var names []string
+	for _, entry := range fields[2] {
+		e := protoFields(t, entry.([]byte))
+		name := string(e[1][0].([]byte))
+		names = append(names, name)
+		if v, ok := e[2]; ok {
+			counters[name] = v[0].(uint64)
+		}
+	}
+	require.Len(t, names, doNotUse)
+	require.IsIncreasing(t, names)
+	require.Equal(t, uint64(1), counters["hit"])
+	require.Equal(t, uint64(2), counters["miss"])
+	require.NotContains(t, counters, "sets-rejected")
+	require.InDelta(t, 1.0/3, math.Float64frombits(fields[3][0].(uint64)), 1e-9)
+	require.Equal(t, uint64(64), fields[7][0])
+
+	depths := protoFields(t, fields[6][0].([]byte))
+	require.Equal(t, uint64(setBufSize), depths[2][0])
+	costs := protoFields(t, fields[10][0].([]byte))
+	require.Equal(t, uint64(1), costs[3][0])
+	require.Equal(t, uint64(2), costs[4][0])
+	bounds := costs[1][0].([]byte)
+	require.Equal(t, 1.0, math.Float64frombits(binary.LittleEndian.Uint64(bounds)))
+	require.NotContains(t, fields, uint64(9))
+
+	var nilMetrics *Metrics
+	_, err = nilMetrics.MarshalProto()
+	require.Error(t, err)
+}
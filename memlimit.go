@@ -0,0 +1,99 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"math"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cgroupLimitFiles are the files holding the memory limit of the current
+// cgroup, for cgroup v2 and v1.
+var cgroupLimitFiles = []string{
+	"/sys/fs/cgroup/memory.max",
+	"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+}
+
+// MemoryLimit returns the lowest of the Go soft memory limit (set with
+// GOMEMLIMIT or debug.SetMemoryLimit) and the memory limit of the cgroup of the
+// process. It returns math.MaxInt64 if there's no limit.
+func MemoryLimit() int64 {
+	// A negative input doesn't change the limit, only reads it.
+	limit := debug.SetMemoryLimit(-1)
+	for _, path := range cgroupLimitFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		// cgroup v2 writes "max" when there's no limit.
+		n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err == nil && n > 0 && n < limit {
+			limit = n
+		}
+		break
+	}
+	return limit
+}
+
+// RecommendedMaxCost returns the share of MemoryLimit that a cache can use, to
+// be used as MaxCost when the cost of items is their size in bytes. fraction
+// must be in (0, 1]. It returns an error if there's no memory limit.
+func RecommendedMaxCost(fraction float64) (int64, error) {
+	if fraction <= 0 || fraction > 1 {
+		return 0, errors.New("fraction must be in (0, 1]")
+	}
+	limit := MemoryLimit()
+	if limit == math.MaxInt64 {
+		return 0, errors.New("no memory limit set")
+	}
+	return int64(float64(limit) * fraction), nil
+}
+
+// WatchMemoryLimit calls UpdateMaxCost with RecommendedMaxCost(fraction) right
+// away, and again every time MemoryLimit changes, checking it every interval.
+// This keeps the size of the cache in line with limits changed at runtime, e.g.
+// with debug.SetMemoryLimit or a resized container. MaxCost is left as is while
+// there's no memory limit. The returned function stops the watcher, and only
+// returns once it's stopped.
+func (c *Cache[K, V]) WatchMemoryLimit(fraction float64, interval time.Duration) (stop func()) {
+	update := func() int64 {
+		limit := MemoryLimit()
+		if maxCost, err := RecommendedMaxCost(fraction); err == nil {
+			c.UpdateMaxCost(maxCost)
+		}
+		return limit
+	}
+	last := update()
+	done, exited := make(chan struct{}), make(chan struct{})
+	ticker := time.NewTicker(interval)
+	withLabels(c.name, "memoryLimit", func() {
+		go func() {
+			defer close(exited)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if MemoryLimit() != last {
+						last = update()
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	})
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-exited
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// withCgroupLimit makes MemoryLimit read the cgroup limit from a file holding
+// contents, for the duration of the test.
+func withCgroupLimit(t *testing.T, contents string) {
+	path := filepath.Join(t.TempDir(), "memory.max")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+	prev := cgroupLimitFiles
+	cgroupLimitFiles = []string{path}
+	t.Cleanup(func() { cgroupLimitFiles = prev })
+}
+
+// withGoMemLimit sets the Go soft memory limit for the duration of the test.
+func withGoMemLimit(t *testing.T, limit int64) {
+	prev := debug.SetMemoryLimit(limit)
+	t.Cleanup(func() { debug.SetMemoryLimit(prev) })
+}
+
+func TestMemoryLimit(t *testing.T) {
+	withGoMemLimit(t, math.MaxInt64)
+	withCgroupLimit(t, "max\n")
+	require.Equal(t, int64(math.MaxInt64), MemoryLimit())
+	_, err := RecommendedMaxCost(0.5)
+	require.Error(t, err)
+
+	withCgroupLimit(t, "1073741824\n")
+	require.Equal(t, int64(1<<30), MemoryLimit())
+
+	// The lowest limit wins.
+	withGoMemLimit(t, 512<<20)
+	require.Equal(t, int64(512<<20), MemoryLimit())
+	maxCost, err := RecommendedMaxCost(0.25)
+	require.NoError(t, err)
+	require.Equal(t, int64(128<<20), maxCost)
+
+	_, err = RecommendedMaxCost(0)
+	require.Error(t, err)
+	_, err = RecommendedMaxCost(1.5)
+	require.Error(t, err)
+}
+
+func TestCacheWatchMemoryLimit(t *testing.T) {
+	withCgroupLimit(t, "max")
+	withGoMemLimit(t, 400<<20)
+
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	stop := c.WatchMemoryLimit(0.5, 10*time.Millisecond)
+	defer stop()
+	require.Equal(t, int64(200<<20), c.MaxCost())
+
+	debug.SetMemoryLimit(200 << 20)
+	require.Eventually(t, func() bool {
+		return c.MaxCost() == 100<<20
+	}, time.Second, 10*time.Millisecond)
+
+	stop()
+	stop()
+	debug.SetMemoryLimit(100 << 20)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int64(100<<20), c.MaxCost())
+}
@@ -0,0 +1,501 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+// The file of a mmapStore is made of a header, a hash index of the keys, and
+// an arena of records, the values of the keys. The index is an open addressing
+// table of slots, each holding a key hash and the offset of its record, or
+// slotEmpty or slotDeleted. The arena is append-only: a new value is appended,
+// and its slot then points to it. The records are made of their size, as
+// written by z.MmapFile.AllocateSlice, then mmapRecordHeader bytes of fixed
+// fields, then the value.
+const (
+	mmapStoreMagic   = "RSTRMMAP"
+	mmapStoreVersion = 1
+	mmapHeaderSize   = 64
+	mmapSlotSize     = 16
+	mmapRecordHeader = 40
+	// mmapMinSlotBits is the log2 of the minimum number of slots.
+	mmapMinSlotBits = 10
+	// mmapMinGarbage is the size of the overwritten records past which the
+	// arena is compacted if they outweigh the live ones.
+	mmapMinGarbage = 1 << 20
+
+	slotEmpty   = 0
+	slotDeleted = 1
+)
+
+// The offsets of the fields of the header.
+const (
+	mmapOffVersion    = 8
+	mmapOffSlotBits   = 12
+	mmapOffTail       = 16
+	mmapOffGeneration = 24
+)
+
+// mmapRecord is a record of the file of a mmapStore, with its key.
+type mmapRecord struct {
+	key        uint64
+	conflict   uint64
+	expiration time.Time
+	cost       int64
+	generation uint64
+	version    uint64
+	value      []byte
+}
+
+// size returns the size taken by r in the arena.
+func (r *mmapRecord) size() int {
+	return 4 + mmapRecordHeader + len(r.value)
+}
+
+// mmapStore is the store of Config.MmapStorePath: a shardedMap, which serves
+// the reads, mirrored to a memory-mapped file by every write, so that a cache
+// restarted after a crash of its process recovers its items from the file.
+// The mirror is not synced to disk until the store is closed, so the items
+// written since may be lost if the machine crashes.
+//
+// The writes change the shardedMap first, then the file, under mu, with the
+// state of the key in the shardedMap at that point: the concurrent writes of
+// a key can be mirrored in any order, the last one mirrors its final state.
+type mmapStore[V any] struct {
+	*shardedMap[V]
+	path string
+
+	// mu protects the following.
+	mu       sync.Mutex
+	f        *z.MmapFile
+	slotBits uint
+	// used is the number of slots not empty, live the number of keys, and
+	// liveBytes the size of their records.
+	used, live int
+	liveBytes  int
+}
+
+// openMmapStore opens the store file at path, or creates it, and returns the
+// store along with the records of the file, to be admitted by the policy,
+// which are not in the shardedMap yet.
+func openMmapStore[V any](path string) (*mmapStore[V], []mmapRecord, error) {
+	if _, ok := any(zeroValue[V]()).([]byte); !ok {
+		return nil, nil, errors.New("MmapStorePath needs []byte values")
+	}
+	var recs []mmapRecord
+	var generation uint64
+	if old, err := z.OpenMmapFile(path, os.O_RDWR, 0); err == nil {
+		recs, generation, err = readMmapStore(old.Data)
+		if cerr := old.Close(-1); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("while reading %s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+
+	// Drop the expired items, and compact the file.
+	now := ttlNow()
+	live := recs[:0]
+	for _, r := range recs {
+		if r.expiration.IsZero() || now.Before(r.expiration) {
+			live = append(live, r)
+		}
+	}
+	s := &mmapStore[V]{shardedMap: newShardedMap[V](), path: path}
+	s.generation.Store(generation)
+	if err := s.rewrite(live, generation); err != nil {
+		return nil, nil, err
+	}
+	return s, live, nil
+}
+
+// readMmapStore returns the live records of data, the content of a store
+// file, and its generation. The records which don't fit in the arena are
+// skipped, e.g. when a crash happened in the middle of their writing.
+func readMmapStore(data []byte) ([]mmapRecord, uint64, error) {
+	if len(data) < mmapHeaderSize || string(data[:len(mmapStoreMagic)]) != mmapStoreMagic {
+		return nil, 0, errors.New("not a store file")
+	}
+	if v := binary.BigEndian.Uint32(data[mmapOffVersion:]); v != mmapStoreVersion {
+		return nil, 0, fmt.Errorf("unsupported store version: %d", v)
+	}
+	slotBits := uint(binary.BigEndian.Uint32(data[mmapOffSlotBits:]))
+	tail := binary.BigEndian.Uint64(data[mmapOffTail:])
+	generation := binary.BigEndian.Uint64(data[mmapOffGeneration:])
+	arena := uint64(mmapHeaderSize + mmapSlotSize<<slotBits)
+	if slotBits > 40 || arena > uint64(len(data)) || tail < arena || tail > uint64(len(data)) {
+		return nil, 0, errors.New("corrupted store header")
+	}
+	var recs []mmapRecord
+	for n := 0; n < 1<<slotBits; n++ {
+		slot := data[mmapHeaderSize+n*mmapSlotSize:]
+		off := binary.BigEndian.Uint64(slot[8:])
+		if off == slotEmpty || off == slotDeleted {
+			continue
+		}
+		if off < arena || off+4+mmapRecordHeader > tail {
+			continue
+		}
+		size := uint64(binary.BigEndian.Uint32(data[off:]))
+		if size < mmapRecordHeader || off+4+size > tail {
+			continue
+		}
+		r := decodeMmapRecord(data[off+4 : off+4+size])
+		if r.generation < generation {
+			continue
+		}
+		r.key = binary.BigEndian.Uint64(slot)
+		recs = append(recs, r)
+	}
+	return recs, generation, nil
+}
+
+func decodeMmapRecord(b []byte) mmapRecord {
+	r := mmapRecord{
+		conflict:   binary.BigEndian.Uint64(b),
+		cost:       int64(binary.BigEndian.Uint64(b[16:])),
+		generation: binary.BigEndian.Uint64(b[24:]),
+		version:    binary.BigEndian.Uint64(b[32:]),
+		value:      append([]byte(nil), b[mmapRecordHeader:]...),
+	}
+	if exp := int64(binary.BigEndian.Uint64(b[8:])); exp != 0 {
+		r.expiration = time.Unix(0, exp)
+	}
+	return r
+}
+
+// rewrite replaces the file of s by a new one holding recs, with room for
+// twice as many keys. s.mu must be held, or s not shared yet.
+func (s *mmapStore[V]) rewrite(recs []mmapRecord, generation uint64) error {
+	slotBits := uint(max(mmapMinSlotBits, bits.Len(uint(2*len(recs)))))
+	size := mmapHeaderSize + mmapSlotSize<<slotBits
+	for n := range recs {
+		size += recs[n].size()
+	}
+	tmp := s.path + ".tmp"
+	f, err := z.OpenMmapFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, size)
+	if err != nil && !errors.Is(err, z.NewFile) {
+		return err
+	}
+	err = nil
+	copy(f.Data, mmapStoreMagic)
+	binary.BigEndian.PutUint32(f.Data[mmapOffVersion:], mmapStoreVersion)
+	binary.BigEndian.PutUint32(f.Data[mmapOffSlotBits:], uint32(slotBits))
+	binary.BigEndian.PutUint64(f.Data[mmapOffGeneration:], generation)
+	binary.BigEndian.PutUint64(f.Data[mmapOffTail:], uint64(mmapHeaderSize+mmapSlotSize<<slotBits))
+
+	old := s.f
+	s.f, s.slotBits = f, slotBits
+	s.used, s.live, s.liveBytes = 0, 0, 0
+	for n := range recs {
+		if err = s.put(&recs[n]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = z.RenameSynced(tmp, s.path)
+	}
+	if err != nil {
+		s.f = old
+		_ = f.Delete()
+		return err
+	}
+	if old != nil {
+		return old.Close(-1)
+	}
+	return nil
+}
+
+func (s *mmapStore[V]) tail() int {
+	return int(binary.BigEndian.Uint64(s.f.Data[mmapOffTail:]))
+}
+
+// slot returns the index of the slot of key if found, or else of the slot to
+// insert it in.
+func (s *mmapStore[V]) slot(key uint64) (int, bool) {
+	mask := 1<<s.slotBits - 1
+	free := -1
+	for n, probe := int((key*0x9E3779B97F4A7C15)>>(64-s.slotBits)), 0; probe <= mask; n, probe = (n+1)&mask, probe+1 {
+		slot := s.f.Data[mmapHeaderSize+n*mmapSlotSize:]
+		switch off := binary.BigEndian.Uint64(slot[8:]); {
+		case off == slotEmpty:
+			if free >= 0 {
+				return free, false
+			}
+			return n, false
+		case off == slotDeleted:
+			if free < 0 {
+				free = n
+			}
+		case binary.BigEndian.Uint64(slot) == key:
+			return n, true
+		}
+	}
+	return free, false
+}
+
+// record returns the record of the slot n, which must hold one, along with
+// its size in the arena.
+func (s *mmapStore[V]) record(n int) (mmapRecord, int) {
+	off := binary.BigEndian.Uint64(s.f.Data[mmapHeaderSize+n*mmapSlotSize+8:])
+	size := binary.BigEndian.Uint32(s.f.Data[off:])
+	return decodeMmapRecord(s.f.Data[off+4 : off+4+uint64(size)]), 4 + int(size)
+}
+
+// recordSize returns the size in the arena of the record of the slot n, which
+// must hold one.
+func (s *mmapStore[V]) recordSize(n int) int {
+	off := binary.BigEndian.Uint64(s.f.Data[mmapHeaderSize+n*mmapSlotSize+8:])
+	return 4 + int(binary.BigEndian.Uint32(s.f.Data[off:]))
+}
+
+// put appends r to the arena, and points the slot of its key to it. s.mu must
+// be held.
+func (s *mmapStore[V]) put(r *mmapRecord) error {
+	n, found := s.slot(r.key)
+	if found {
+		s.liveBytes -= s.recordSize(n)
+	} else {
+		if binary.BigEndian.Uint64(s.f.Data[mmapHeaderSize+n*mmapSlotSize+8:]) == slotEmpty {
+			s.used++
+		}
+		s.live++
+	}
+	tail := s.tail()
+	b, next, err := s.f.AllocateSlice(mmapRecordHeader+len(r.value), tail)
+	if err != nil {
+		return err
+	}
+	var exp int64
+	if !r.expiration.IsZero() {
+		exp = r.expiration.UnixNano()
+	}
+	binary.BigEndian.PutUint64(b, r.conflict)
+	binary.BigEndian.PutUint64(b[8:], uint64(exp))
+	binary.BigEndian.PutUint64(b[16:], uint64(r.cost))
+	binary.BigEndian.PutUint64(b[24:], r.generation)
+	binary.BigEndian.PutUint64(b[32:], r.version)
+	copy(b[mmapRecordHeader:], r.value)
+	// The record is complete before anything points to it.
+	binary.BigEndian.PutUint64(s.f.Data[mmapOffTail:], uint64(next))
+	slot := s.f.Data[mmapHeaderSize+n*mmapSlotSize:]
+	binary.BigEndian.PutUint64(slot, r.key)
+	binary.BigEndian.PutUint64(slot[8:], uint64(tail))
+	s.liveBytes += r.size()
+	return nil
+}
+
+// remove removes the record of key, if any. s.mu must be held.
+func (s *mmapStore[V]) remove(key uint64) {
+	n, found := s.slot(key)
+	if !found {
+		return
+	}
+	s.liveBytes -= s.recordSize(n)
+	s.live--
+	binary.BigEndian.PutUint64(s.f.Data[mmapHeaderSize+n*mmapSlotSize+8:], slotDeleted)
+}
+
+// records returns the live records of the file. s.mu must be held.
+func (s *mmapStore[V]) records() []mmapRecord {
+	recs := make([]mmapRecord, 0, s.live)
+	for n := 0; n < 1<<s.slotBits; n++ {
+		slot := s.f.Data[mmapHeaderSize+n*mmapSlotSize:]
+		if off := binary.BigEndian.Uint64(slot[8:]); off == slotEmpty || off == slotDeleted {
+			continue
+		}
+		r, _ := s.record(n)
+		r.key = binary.BigEndian.Uint64(slot)
+		recs = append(recs, r)
+	}
+	return recs
+}
+
+// mirror writes the current state of key in the shardedMap to the file: its
+// item, along with cost, or its absence. A zero cost keeps the cost of the
+// current record. If writing fails, e.g. for lack of disk space, the store
+// stops mirroring.
+func (s *mmapStore[V]) mirror(key uint64, cost int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return
+	}
+	m := s.shards[key%numShards]
+	m.RLock()
+	item, ok := m.data[key]
+	m.RUnlock()
+	if !ok {
+		s.remove(key)
+		return
+	}
+	if cost == 0 {
+		if n, found := s.slot(key); found {
+			r, _ := s.record(n)
+			cost = r.cost
+		}
+	}
+	value, _ := any(item.value).([]byte)
+	extra := item.extra()
+	err := s.put(&mmapRecord{
+		key:        key,
+		conflict:   item.conflict,
+		expiration: item.expiration,
+		cost:       cost,
+		generation: extra.generation,
+		version:    extra.version,
+		value:      value,
+	})
+	// Compact the arena once the garbage outweighs the live records, and grow
+	// the index when it's 3/4 full.
+	garbage := s.tail() - mmapHeaderSize - mmapSlotSize<<s.slotBits - s.liveBytes
+	if err == nil && (s.used > 3<<s.slotBits/4 || garbage > max(s.liveBytes, mmapMinGarbage)) {
+		err = s.rewrite(s.records(), s.generation.Load())
+	}
+	if err != nil {
+		_ = s.f.Close(-1)
+		s.f = nil
+	}
+}
+
+// forget removes the record of key without looking at the shardedMap, for the
+// records the policy didn't admit back.
+func (s *mmapStore[V]) forget(key uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f != nil {
+		s.remove(key)
+	}
+}
+
+// close syncs and closes the file. The store stops mirroring.
+func (s *mmapStore[V]) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close(-1)
+	s.f = nil
+	return err
+}
+
+func (s *mmapStore[V]) Set(i *Item[V]) {
+	if i == nil {
+		return
+	}
+	s.shardedMap.Set(i)
+	s.mirror(i.Key, i.Cost)
+}
+
+func (s *mmapStore[V]) Del(key, conflict uint64) (uint64, V, bool) {
+	c, v, ok := s.shardedMap.Del(key, conflict)
+	s.mirror(key, 0)
+	return c, v, ok
+}
+
+func (s *mmapStore[V]) Update(i *Item[V]) (V, bool) {
+	prev, ok := s.shardedMap.Update(i)
+	if ok {
+		s.mirror(i.Key, i.Cost)
+	}
+	return prev, ok
+}
+
+func (s *mmapStore[V]) Batch(ops []storeOp[V]) {
+	s.shardedMap.Batch(ops)
+	for _, op := range ops {
+		if op.item != nil && op.op != TraceGet {
+			s.mirror(op.item.Key, op.item.Cost)
+		}
+	}
+}
+
+func (s *mmapStore[V]) Cleanup(policy policy[V], onEvict func(item *Item[V])) {
+	// The expired items are deleted from the shardedMap directly.
+	s.shardedMap.Cleanup(policy, func(i *Item[V]) {
+		s.mirror(i.Key, 0)
+		if onEvict != nil {
+			onEvict(i)
+		}
+	})
+}
+
+func (s *mmapStore[V]) Audit(policy policy[V], onEvict func(item *Item[V]), shard int) (int, int) {
+	return s.shardedMap.Audit(policy, func(i *Item[V]) {
+		s.mirror(i.Key, 0)
+		if onEvict != nil {
+			onEvict(i)
+		}
+	}, shard)
+}
+
+func (s *mmapStore[V]) Invalidate() {
+	s.shardedMap.Invalidate()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f != nil {
+		binary.BigEndian.PutUint64(s.f.Data[mmapOffGeneration:], s.generation.Load())
+	}
+}
+
+func (s *mmapStore[V]) Purge(shard int) []*Item[V] {
+	items := s.shardedMap.Purge(shard)
+	for _, i := range items {
+		s.mirror(i.Key, 0)
+	}
+	return items
+}
+
+func (s *mmapStore[V]) Clear(onEvict func(item *Item[V])) {
+	s.shardedMap.Clear(onEvict)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f != nil {
+		if err := s.rewrite(nil, s.generation.Load()); err != nil {
+			_ = s.f.Close(-1)
+			s.f = nil
+		}
+	}
+}
+
+// recoverItems admits the records of the store file of c back, see
+// Config.MmapStorePath, those which don't fit are removed from the file.
+func (c *Cache[K, V]) recoverItems(s *mmapStore[V], recs []mmapRecord) {
+	generation := s.Generation()
+	for n := range recs {
+		r := &recs[n]
+		if !c.cachePolicy.AddIfRoom(r.key, r.cost) {
+			s.forget(r.key)
+			continue
+		}
+		value, _ := any(r.value).(V)
+		s.shardedMap.Set(&Item[V]{
+			Key:        r.key,
+			Conflict:   r.conflict,
+			Value:      value,
+			Expiration: r.expiration,
+			version:    r.version,
+			generation: generation,
+		})
+		c.idle.add(r.key, r.cost)
+	}
+}
@@ -0,0 +1,176 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMmapStoreRecover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	config := &Config[string, []byte]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		MmapStorePath:      path,
+	}
+	c := newCacheT(t, config)
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(fmt.Sprint(i), []byte(fmt.Sprint("value", i)), 1))
+	}
+	require.True(t, c.SetWithTTL("ttl", []byte("ttl"), 1, time.Hour))
+	require.True(t, c.SetWithTTL("expired", []byte("expired"), 1, time.Millisecond))
+	c.Wait()
+	require.True(t, c.Set("1", []byte("updated"), 2))
+	c.Del("2")
+	p := c.Pipeline()
+	p.Set("3", []byte("pipelined"), 1)
+	p.Del("4")
+	p.Exec()
+	c.Wait()
+	time.Sleep(10 * time.Millisecond)
+
+	// The cache isn't closed, as if its process crashed.
+	recovered := newCacheT(t, config)
+	for key, want := range map[string]string{
+		"0":   "value0",
+		"1":   "updated",
+		"3":   "pipelined",
+		"9":   "value9",
+		"ttl": "ttl",
+	} {
+		val, ok := recovered.Get(key)
+		require.True(t, ok, key)
+		require.Equal(t, want, string(val))
+	}
+	for _, key := range []string{"2", "4", "expired"} {
+		_, ok := recovered.Get(key)
+		require.False(t, ok, key)
+	}
+	ttl, ok := recovered.GetTTL("ttl")
+	require.True(t, ok)
+	require.InDelta(t, time.Hour, ttl, float64(time.Minute))
+	keyHash, _ := recovered.keyToHash("1")
+	require.Equal(t, int64(2), recovered.cachePolicy.Cost(keyHash))
+	c.Close()
+}
+
+func TestMmapStoreClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	config := &Config[string, []byte]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		MmapStorePath:      path,
+	}
+	c := newCacheT(t, config)
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(fmt.Sprint(i), []byte{byte(i)}, 1))
+	}
+	c.Wait()
+	c.Close()
+
+	// The items past MaxCost aren't admitted back, nor kept in the file.
+	small := *config
+	small.MaxCost = 4
+	c = newCacheT(t, &small)
+	var found int
+	for i := 0; i < 10; i++ {
+		if val, ok := c.Get(fmt.Sprint(i)); ok {
+			require.Equal(t, []byte{byte(i)}, val)
+			found++
+		}
+	}
+	require.Equal(t, 4, found)
+	c.Close()
+	c = newCacheT(t, config)
+	var count int
+	c.Range(func(_, _ uint64, _ []byte) bool {
+		count++
+		return true
+	})
+	require.Equal(t, 4, count)
+
+	// Clear and Invalidate empty the file too.
+	c.Clear()
+	require.True(t, c.Set("clear", []byte("clear"), 1))
+	c.Wait()
+	c.Invalidate()
+	require.True(t, c.Set("invalidate", []byte("invalidate"), 1))
+	c.Wait()
+	c.Close()
+	c = newCacheT(t, config)
+	_, ok := c.Get("clear")
+	require.False(t, ok)
+	val, ok := c.Get("invalidate")
+	require.True(t, ok)
+	require.Equal(t, "invalidate", string(val))
+}
+
+func TestMmapStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	config := &Config[string, []byte]{
+		NumCounters:        1000,
+		MaxCost:            10000,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		MmapStorePath:      path,
+	}
+	c := newCacheT(t, config)
+	value := make([]byte, 1<<10)
+	require.True(t, c.Set("key", value, 1))
+	c.Wait()
+	for n := 0; n < 5000; n++ {
+		value[0] = byte(n)
+		require.True(t, c.Set("key", value, 1))
+	}
+	for n := 0; n < 3000; n++ {
+		require.True(t, c.Set(fmt.Sprint(n), []byte("small"), 1))
+	}
+	c.Wait()
+	// The records overwritten are compacted away, and the index grows.
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Less(t, fi.Size(), int64(4<<20))
+
+	recovered := newCacheT(t, config)
+	val, ok := recovered.Get("key")
+	require.True(t, ok)
+	require.Equal(t, byte(4999%256), val[0])
+	for n := 0; n < 3000; n++ {
+		_, ok := recovered.Get(fmt.Sprint(n))
+		require.True(t, ok, n)
+	}
+}
+
+func TestMmapStoreErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewCache(&Config[string, string]{
+		NumCounters:   100,
+		MaxCost:       10,
+		BufferItems:   64,
+		MmapStorePath: filepath.Join(dir, "cache"),
+	})
+	require.Error(t, err)
+
+	path := filepath.Join(dir, "corrupted")
+	require.NoError(t, os.WriteFile(path, make([]byte, 128), 0o644))
+	_, err = NewCache(&Config[string, []byte]{
+		NumCounters:   100,
+		MaxCost:       10,
+		BufferItems:   64,
+		MmapStorePath: path,
+	})
+	require.Error(t, err)
+}
@@ -0,0 +1,431 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"math/bits"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2/api"
+)
+
+// PartitionedCache splits the keys between independent caches, each with its
+// own policy, buffers and goroutines, picking the cache of a key by its hash.
+// This removes the contention on the policy shared by all the goroutines of a
+// Cache, at the cost of a lower hit ratio: each partition only sees its own
+// share of the accesses, and of MaxCost. It's meant for very high throughput
+// users, e.g. with one partition per NUMA node or per group of Ps.
+//
+// PartitionedCache has the same API as Cache. Metrics are aggregated over all
+// the partitions.
+type PartitionedCache[K Key, V any] struct {
+	parts     []*Cache[K, V]
+	keyToHash func(K) (uint64, uint64)
+	// Metrics contains a running log of important statistics like hits, misses,
+	// and dropped items, for all the partitions.
+	Metrics *Metrics
+}
+
+// NewPartitionedCache returns a new PartitionedCache of the given number of
+// partitions, or of runtime.GOMAXPROCS(0) partitions if partitions is zero.
+// NumCounters and MaxCost of config are split evenly between the partitions,
+// all the other settings apply to every partition. OnEvict, OnReject, OnExit,
+// Cost and the other callbacks are shared, so they may be called concurrently.
+// Every partition keeps its items in its own file if MmapStorePath is set, at
+// MmapStorePath suffixed with the index of the partition, so they're only
+// recovered by a PartitionedCache of the same number of partitions.
+func NewPartitionedCache[K Key, V any](config *Config[K, V], partitions int) (
+	*PartitionedCache[K, V], error) {
+	switch {
+	case partitions < 0:
+		return nil, errors.New("partitions can't be negative number")
+	case partitions == 0:
+		partitions = runtime.GOMAXPROCS(0)
+	}
+	c := &PartitionedCache[K, V]{keyToHash: config.KeyToHash}
+	if c.keyToHash == nil {
+		// All the partitions share the seed of ScrambleKeys, if any.
+		c.keyToHash = defaultKeyToHash(config)
+	}
+	if config.Metrics {
+		c.Metrics = newMetrics()
+	}
+	for i := 0; i < partitions; i++ {
+		cfg := *config
+		cfg.KeyToHash = c.keyToHash
+		cfg.NumCounters = splitEvenly(config.NumCounters, partitions)
+		cfg.MaxCost = splitEvenly(config.MaxCost, partitions)
+		if config.Name != "" {
+			cfg.Name = config.Name + "/" + strconv.Itoa(i)
+		}
+		if config.MmapStorePath != "" {
+			cfg.MmapStorePath = config.MmapStorePath + "." + strconv.Itoa(i)
+		}
+		part, err := newCache(&cfg, c.Metrics)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.parts = append(c.parts, part)
+	}
+	return c, nil
+}
+
+// splitEvenly returns the share of total of one of n partitions, at least 1.
+// Invalid totals are returned as is, for NewCache to report them.
+func splitEvenly(total int64, n int) int64 {
+	if total <= 0 {
+		return total
+	}
+	return max(total/int64(n), 1)
+}
+
+// partition returns the cache holding key.
+func (c *PartitionedCache[K, V]) partition(key K) *Cache[K, V] {
+	keyHash, _ := c.keyToHash(key)
+	// Scramble the hash first: the caches pick their internal shards by the
+	// low bits of the same hash.
+	idx, _ := bits.Mul64(keyHash*0x9E3779B97F4A7C15, uint64(len(c.parts)))
+	return c.parts[idx]
+}
+
+// Partitions returns the number of partitions.
+func (c *PartitionedCache[K, V]) Partitions() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.parts)
+}
+
+// Get works like Cache.Get.
+func (c *PartitionedCache[K, V]) Get(key K) (V, bool) {
+	if c == nil {
+		return zeroValue[V](), false
+	}
+	return c.partition(key).Get(key)
+}
+
+// GetQuiet works like Cache.GetQuiet.
+func (c *PartitionedCache[K, V]) GetQuiet(key K) (V, bool) {
+	if c == nil {
+		return zeroValue[V](), false
+	}
+	return c.partition(key).GetQuiet(key)
+}
+
+// GetOrCompute works like Cache.GetOrCompute.
+func (c *PartitionedCache[K, V]) GetOrCompute(key K, compute func() (V, int64, error)) (V, error) {
+	if c == nil {
+		value, _, err := compute()
+		return value, err
+	}
+	return c.partition(key).GetOrCompute(key, compute)
+}
+
+// Compute works like Cache.Compute.
+func (c *PartitionedCache[K, V]) Compute(key K, fn func(value V, found bool) (V, int64, bool)) (V, bool) {
+	if c == nil {
+		value, _, _ := fn(zeroValue[V](), false)
+		return value, false
+	}
+	return c.partition(key).Compute(key, fn)
+}
+
+// GetWithInfo works like Cache.GetWithInfo.
+func (c *PartitionedCache[K, V]) GetWithInfo(key K) (V, ItemInfo, bool) {
+	if c == nil {
+		return zeroValue[V](), ItemInfo{}, false
+	}
+	return c.partition(key).GetWithInfo(key)
+}
+
+// GetEntry works like Cache.GetEntry, on the partition of key.
+func (c *PartitionedCache[K, V]) GetEntry(key K) (CacheEntry[V], bool) {
+	if c == nil {
+		return CacheEntry[V]{}, false
+	}
+	return c.partition(key).GetEntry(key)
+}
+
+// Set works like Cache.Set.
+func (c *PartitionedCache[K, V]) Set(key K, value V, cost int64) bool {
+	if c == nil {
+		return false
+	}
+	return c.partition(key).Set(key, value, cost)
+}
+
+// Put works like Cache.Put.
+func (c *PartitionedCache[K, V]) Put(key K, value V) bool {
+	if c == nil {
+		return false
+	}
+	return c.partition(key).Put(key, value)
+}
+
+// SetWithTTL works like Cache.SetWithTTL.
+func (c *PartitionedCache[K, V]) SetWithTTL(key K, value V, cost int64, ttl time.Duration) bool {
+	if c == nil {
+		return false
+	}
+	return c.partition(key).SetWithTTL(key, value, cost, ttl)
+}
+
+// SetWithOptions works like Cache.SetWithOptions.
+func (c *PartitionedCache[K, V]) SetWithOptions(key K, value V, cost int64, opts SetOptions) bool {
+	if c == nil {
+		return false
+	}
+	return c.partition(key).SetWithOptions(key, value, cost, opts)
+}
+
+// SetWithResult works like Cache.SetWithResult.
+func (c *PartitionedCache[K, V]) SetWithResult(key K, value V, cost int64, ttl time.Duration) SetResult {
+	if c == nil {
+		return SetDropped
+	}
+	return c.partition(key).SetWithResult(key, value, cost, ttl)
+}
+
+// SetIfAbsent works like Cache.SetIfAbsent.
+func (c *PartitionedCache[K, V]) SetIfAbsent(key K, value V, cost int64) bool {
+	if c == nil {
+		return false
+	}
+	return c.partition(key).SetIfAbsent(key, value, cost)
+}
+
+// CompareAndSwap works like Cache.CompareAndSwap.
+func (c *PartitionedCache[K, V]) CompareAndSwap(key K, old, new V, cost int64) bool {
+	if c == nil {
+		return false
+	}
+	return c.partition(key).CompareAndSwap(key, old, new, cost)
+}
+
+// SetWithVersion works like Cache.SetWithVersion.
+func (c *PartitionedCache[K, V]) SetWithVersion(key K, value V, cost int64, version uint64) bool {
+	if c == nil {
+		return false
+	}
+	return c.partition(key).SetWithVersion(key, value, cost, version)
+}
+
+// Prefetch works like Cache.Prefetch.
+func (c *PartitionedCache[K, V]) Prefetch(key K, loader func() (V, int64, error)) error {
+	if c == nil {
+		return nil
+	}
+	return c.partition(key).Prefetch(key, loader)
+}
+
+// Del works like Cache.Del.
+func (c *PartitionedCache[K, V]) Del(key K) {
+	if c == nil {
+		return
+	}
+	c.partition(key).Del(key)
+}
+
+// GetTTL works like Cache.GetTTL.
+func (c *PartitionedCache[K, V]) GetTTL(key K) (time.Duration, bool) {
+	if c == nil {
+		return 0, false
+	}
+	return c.partition(key).GetTTL(key)
+}
+
+// Scan works like Cache.Scan, going through the partitions one after the
+// other.
+func (c *PartitionedCache[K, V]) Scan(cursor uint64, count int) ([]*Item[V], uint64) {
+	if c == nil {
+		return nil, 0
+	}
+	// The cursor counts the shards of all the partitions.
+	var items []*Item[V]
+	for part := cursor / numShards; part < uint64(len(c.parts)); part++ {
+		batch, next := c.parts[part].Scan(cursor%numShards, count-len(items))
+		items = append(items, batch...)
+		if next != 0 {
+			return items, part*numShards + next
+		}
+		cursor = 0
+		if len(items) >= max(count, 1) && part+1 < uint64(len(c.parts)) {
+			return items, (part + 1) * numShards
+		}
+	}
+	return items, 0
+}
+
+// Range works like Cache.Range, going through the partitions one after the
+// other.
+func (c *PartitionedCache[K, V]) Range(fn func(key, conflict uint64, value V) bool) {
+	if c == nil {
+		return
+	}
+	more := true
+	for _, part := range c.parts {
+		part.Range(func(key, conflict uint64, value V) bool {
+			more = fn(key, conflict, value)
+			return more
+		})
+		if !more {
+			return
+		}
+	}
+}
+
+// Iterator works like Cache.Iterator, going through the partitions one after
+// the other. Iterator.Shard counts the shards of all the partitions, like the
+// cursors of Scan.
+func (c *PartitionedCache[K, V]) Iterator() *Iterator[K, V] {
+	if c == nil {
+		return &Iterator[K, V]{}
+	}
+	return &Iterator[K, V]{caches: c.parts}
+}
+
+// TopKeys works like Cache.TopKeys, over the keys of all the partitions.
+func (c *PartitionedCache[K, V]) TopKeys(n int) []KeyFrequency[K] {
+	if c == nil || n <= 0 {
+		return nil
+	}
+	var freqs []KeyFrequency[K]
+	for _, part := range c.parts {
+		freqs = append(freqs, part.TopKeys(n)...)
+	}
+	if freqs == nil {
+		return nil
+	}
+	return topFrequencies(freqs, n)
+}
+
+// Wait blocks until all the buffered writes of all the partitions have been
+// applied.
+func (c *PartitionedCache[K, V]) Wait() {
+	if c == nil {
+		return
+	}
+	for _, part := range c.parts {
+		part.Wait()
+	}
+}
+
+// CacheMetrics works like Cache.CacheMetrics, with the Metrics aggregated over
+// all the partitions.
+func (c *PartitionedCache[K, V]) CacheMetrics() api.Metrics {
+	if c == nil {
+		return (*Metrics)(nil)
+	}
+	return c.Metrics
+}
+
+// IsThrashing returns true if any of the partitions is thrashing, see
+// Cache.IsThrashing.
+func (c *PartitionedCache[K, V]) IsThrashing() bool {
+	if c == nil {
+		return false
+	}
+	for _, part := range c.parts {
+		if part.IsThrashing() {
+			return true
+		}
+	}
+	return false
+}
+
+// Clear empties all the partitions, see Cache.Clear.
+func (c *PartitionedCache[K, V]) Clear() {
+	if c == nil {
+		return
+	}
+	for _, part := range c.parts {
+		part.Clear()
+	}
+}
+
+// Invalidate invalidates all the partitions, see Cache.Invalidate.
+func (c *PartitionedCache[K, V]) Invalidate() {
+	if c == nil {
+		return
+	}
+	for _, part := range c.parts {
+		part.Invalidate()
+	}
+}
+
+// SetReadOnly makes all the partitions read-only or not, see
+// Cache.SetReadOnly.
+func (c *PartitionedCache[K, V]) SetReadOnly(readOnly bool) {
+	if c == nil {
+		return
+	}
+	for _, part := range c.parts {
+		part.SetReadOnly(readOnly)
+	}
+}
+
+// ReadOnly returns whether all the partitions are read-only, see
+// Cache.ReadOnly.
+func (c *PartitionedCache[K, V]) ReadOnly() bool {
+	if c == nil {
+		return false
+	}
+	for _, part := range c.parts {
+		if !part.ReadOnly() {
+			return false
+		}
+	}
+	return true
+}
+
+// Close stops all the partitions, see Cache.Close.
+func (c *PartitionedCache[K, V]) Close() {
+	if c == nil {
+		return
+	}
+	for _, part := range c.parts {
+		part.Close()
+	}
+}
+
+// MaxCost returns the max cost of the whole cache, which is the sum of the max
+// costs of the partitions.
+func (c *PartitionedCache[K, V]) MaxCost() int64 {
+	if c == nil {
+		return 0
+	}
+	var maxCost int64
+	for _, part := range c.parts {
+		maxCost += part.MaxCost()
+	}
+	return maxCost
+}
+
+// UpdateMaxCost updates the max cost of the whole cache, splitting it evenly
+// between the partitions.
+func (c *PartitionedCache[K, V]) UpdateMaxCost(maxCost int64) {
+	if c == nil {
+		return
+	}
+	for _, part := range c.parts {
+		part.UpdateMaxCost(splitEvenly(maxCost, len(c.parts)))
+	}
+}
+
+// UpdateTtlTickerDuration changes how often expired items are cleaned up in all
+// the partitions, see Cache.UpdateTtlTickerDuration.
+func (c *PartitionedCache[K, V]) UpdateTtlTickerDuration(secs int64) {
+	if c == nil {
+		return
+	}
+	for _, part := range c.parts {
+		part.UpdateTtlTickerDuration(secs)
+	}
+}
@@ -0,0 +1,332 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitionedCache(t *testing.T) {
+	c, err := NewPartitionedCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		TrackIdleTime:      true,
+	}, 4)
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, 4, c.Partitions())
+	require.Equal(t, int64(100), c.MaxCost())
+
+	for i := 0; i < 40; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	require.True(t, c.SetWithTTL(100, 100, 1, time.Hour))
+	require.Equal(t, SetAdmitted, c.SetWithResult(101, 101, 1, 0))
+	require.True(t, c.SetWithVersion(102, 102, 1, 1))
+	c.Wait()
+	for i := 0; i < 40; i++ {
+		val, ok := c.Get(i)
+		require.True(t, ok)
+		require.Equal(t, i, val)
+	}
+	ttl, ok := c.GetTTL(100)
+	require.True(t, ok)
+	require.Greater(t, ttl, time.Minute)
+
+	c.Del(0)
+	c.Wait()
+	_, ok = c.Get(0)
+	require.False(t, ok)
+
+	// The keys are spread over all the partitions.
+	for _, part := range c.parts {
+		require.Less(t, part.cachePolicy.Cap(), int64(25))
+	}
+
+	c.Invalidate()
+	_, ok = c.Get(1)
+	require.False(t, ok)
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	_, ok = c.Get(1)
+	require.True(t, ok)
+
+	c.SetReadOnly(true)
+	require.True(t, c.ReadOnly())
+	require.False(t, c.Set(2, 2, 1))
+	c.SetReadOnly(false)
+	require.False(t, c.ReadOnly())
+
+	c.Clear()
+	_, ok = c.Get(1)
+	require.False(t, ok)
+}
+
+func TestPartitionedCacheScan(t *testing.T) {
+	c, err := NewPartitionedCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		TrackIdleTime:      true,
+	}, 4)
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 80; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+
+	seen := make(map[int]bool)
+	var cursor uint64
+	for {
+		var items []*Item[int]
+		items, cursor = c.Scan(cursor, 7)
+		for _, item := range items {
+			require.False(t, seen[item.Value])
+			seen[item.Value] = true
+		}
+		if cursor == 0 {
+			break
+		}
+		require.GreaterOrEqual(t, len(items), 7)
+	}
+	require.Len(t, seen, 80)
+}
+
+func TestPartitionedCacheRange(t *testing.T) {
+	c, err := NewPartitionedCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		TrackIdleTime:      true,
+	}, 4)
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 80; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+
+	seen := make(map[int]bool)
+	c.Range(func(key, conflict uint64, value int) bool {
+		require.False(t, seen[value])
+		seen[value] = true
+		return true
+	})
+	require.Len(t, seen, 80)
+
+	var calls int
+	c.Range(func(key, conflict uint64, value int) bool {
+		calls++
+		return calls < 30
+	})
+	require.Equal(t, 30, calls)
+}
+
+func TestPartitionedCacheIterator(t *testing.T) {
+	c, err := NewPartitionedCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		TrackIdleTime:      true,
+	}, 4)
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 80; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+
+	seen := make(map[int]bool)
+	for it := c.Iterator(); it.Next(); {
+		require.False(t, seen[it.Item().Value])
+		seen[it.Item().Value] = true
+		require.Less(t, it.Shard(), 4*int(numShards))
+	}
+	require.Len(t, seen, 80)
+}
+
+func TestPartitionedCacheTopKeys(t *testing.T) {
+	disabled, err := NewPartitionedCache(&Config[int, int]{
+		NumCounters: 1000,
+		MaxCost:     100,
+		BufferItems: 64,
+	}, 4)
+	require.NoError(t, err)
+	defer disabled.Close()
+	require.Nil(t, disabled.TopKeys(2))
+
+	c, err := NewPartitionedCache(&Config[int, int]{
+		NumCounters: 1000,
+		MaxCost:     100,
+		BufferItems: 64,
+		TopKeys:     2,
+	}, 4)
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 40; i++ {
+		c.Get(i)
+		c.Get(100)
+		c.Get(200)
+	}
+	top := c.TopKeys(2)
+	require.Len(t, top, 2)
+	require.ElementsMatch(t, []int{100, 200}, []int{top[0].Key, top[1].Key})
+}
+
+func TestPartitionedCacheMetrics(t *testing.T) {
+	c, err := NewPartitionedCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		TrackIdleTime:      true,
+	}, 4)
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 40; i++ {
+		c.Set(i, i, 1)
+	}
+	c.Wait()
+	for i := 0; i < 50; i++ {
+		c.Get(i)
+	}
+	require.Equal(t, uint64(40), c.Metrics.KeysAdded())
+	require.Equal(t, uint64(40), c.Metrics.Hits())
+	require.Equal(t, uint64(10), c.Metrics.Misses())
+	require.Equal(t, uint64(40), c.Metrics.IdleCost(0))
+	require.Len(t, c.Metrics.idle, 4)
+	require.Equal(t, 4*setBufSize, c.Metrics.QueueDepths().SetBufCap)
+	for _, part := range c.parts {
+		require.Same(t, c.Metrics, part.Metrics)
+	}
+}
+
+func TestPartitionedCacheUpdateMaxCost(t *testing.T) {
+	c, err := NewPartitionedCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		TrackIdleTime:      true,
+	}, 4)
+	require.NoError(t, err)
+	defer c.Close()
+	c.UpdateMaxCost(200)
+	require.Equal(t, int64(200), c.MaxCost())
+	for _, part := range c.parts {
+		require.Equal(t, int64(50), part.MaxCost())
+	}
+}
+
+func TestPartitionedCacheConcurrent(t *testing.T) {
+	c, err := NewPartitionedCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		TrackIdleTime:      true,
+	}, 0)
+	require.NoError(t, err)
+	defer c.Close()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				c.Set(g*1000+i, i, 1)
+				c.Get(g*1000 + i)
+			}
+		}(g)
+	}
+	wg.Wait()
+	c.Wait()
+	require.LessOrEqual(t, c.Metrics.CostAdded()-c.Metrics.CostEvicted(), uint64(100))
+}
+
+func TestPartitionedCacheMmapStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	open := func() *PartitionedCache[string, []byte] {
+		c, err := NewPartitionedCache(&Config[string, []byte]{
+			NumCounters:        1000,
+			MaxCost:            100,
+			BufferItems:        64,
+			IgnoreInternalCost: true,
+			MmapStorePath:      path,
+		}, 4)
+		require.NoError(t, err)
+		t.Cleanup(c.Close)
+		return c
+	}
+	c := open()
+	for i := 0; i < 40; i++ {
+		require.True(t, c.Set(fmt.Sprint(i), []byte(fmt.Sprint("value", i)), 1))
+	}
+	c.Wait()
+	c.Close()
+
+	// Every partition recovers the items of its own file.
+	recovered := open()
+	for i := 0; i < 40; i++ {
+		val, ok := recovered.Get(fmt.Sprint(i))
+		require.True(t, ok, i)
+		require.Equal(t, fmt.Sprint("value", i), string(val))
+	}
+	for i := 0; i < 4; i++ {
+		require.FileExists(t, path+"."+fmt.Sprint(i))
+	}
+	require.NoFileExists(t, path)
+}
+
+func TestPartitionedCacheConfig(t *testing.T) {
+	_, err := NewPartitionedCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	}, -1)
+	require.EqualError(t, err, "partitions can't be negative number")
+
+	_, err = NewPartitionedCache(&Config[int, int]{
+		NumCounters: 100,
+		BufferItems: 64,
+	}, 2)
+	require.EqualError(t, err, "MaxCost can't be zero")
+}
+
+func TestPartitionedCacheNil(t *testing.T) {
+	var c *PartitionedCache[int, int]
+	require.False(t, c.Set(1, 1, 1))
+	require.Equal(t, SetDropped, c.SetWithResult(1, 1, 1, 0))
+	_, ok := c.Get(1)
+	require.False(t, ok)
+	c.Del(1)
+	c.Wait()
+	c.Clear()
+	c.SetReadOnly(true)
+	require.False(t, c.ReadOnly())
+	c.Close()
+	require.Zero(t, c.MaxCost())
+	require.Zero(t, c.Partitions())
+}
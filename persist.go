@@ -0,0 +1,100 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+// metricsStateVersion is the version of the format written by Metrics.Save.
+const metricsStateVersion = 1
+
+// metricsState is the saved form of Metrics. Counters are keyed by their name
+// in Metrics.String, so that adding metrics doesn't break restoring the ones
+// saved by older versions.
+type metricsState struct {
+	Version  int               `json:"version"`
+	Epoch    uint64            `json:"epoch"`
+	Counters map[string]uint64 `json:"counters"`
+}
+
+// Save writes the lifetime counters of the metrics to w, so that they can be
+// restored with Restore when the process restarts.
+func (p *Metrics) Save(w io.Writer) error {
+	if p == nil {
+		return errors.New("metrics are disabled")
+	}
+	state := metricsState{
+		Version:  metricsStateVersion,
+		Epoch:    p.epoch.Load(),
+		Counters: make(map[string]uint64, doNotUse),
+	}
+	for i := 0; i < doNotUse; i++ {
+		t := metricType(i)
+		state.Counters[stringFor(t)] = p.get(t)
+	}
+	return json.NewEncoder(w).Encode(state)
+}
+
+// Restore reads counters written by Save from r and adds them to the current
+// ones, so that long-term statistics like Ratio carry over restarts. The
+// epoch becomes the saved one plus one. Unknown counters are ignored.
+func (p *Metrics) Restore(r io.Reader) error {
+	if p == nil {
+		return errors.New("metrics are disabled")
+	}
+	var state metricsState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return fmt.Errorf("while decoding metrics: %w", err)
+	}
+	if state.Version != metricsStateVersion {
+		return fmt.Errorf("unsupported metrics version: %d", state.Version)
+	}
+	for i := 0; i < doNotUse; i++ {
+		t := metricType(i)
+		if v, ok := state.Counters[stringFor(t)]; ok {
+			p.add(t, v)
+		}
+	}
+	p.epoch.Store(state.Epoch + 1)
+	return nil
+}
+
+// SaveFile saves the metrics to the file at path, like Save. The file is
+// replaced atomically, so a crash while saving doesn't lose the previous save.
+func (p *Metrics) SaveFile(path string) error {
+	var buf bytes.Buffer
+	if err := p.Save(&buf); err != nil {
+		return err
+	}
+	return z.WriteFileAtomic(path, buf.Bytes(), 0o644)
+}
+
+// RestoreFile restores the metrics saved to the file at path by SaveFile.
+func (p *Metrics) RestoreFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return p.Restore(f)
+}
+
+// Epoch is the number of restarts the metrics went through: 0 for metrics that
+// were never restored, and one more than the saved epoch after Restore.
+func (p *Metrics) Epoch() uint64 {
+	if p == nil {
+		return 0
+	}
+	return p.epoch.Load()
+}
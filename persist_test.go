@@ -0,0 +1,84 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsSaveRestore(t *testing.T) {
+	m := newMetrics()
+	m.add(hit, 3)
+	m.add(miss, 1)
+	m.add(keyAdd, 5)
+
+	var buf bytes.Buffer
+	require.NoError(t, m.Save(&buf))
+	saved := buf.String()
+
+	// Restoring into the metrics of a new cache carries the counters over.
+	restored := newMetrics()
+	restored.add(hit, 1)
+	require.NoError(t, restored.Restore(strings.NewReader(saved)))
+	require.Equal(t, uint64(4), restored.Hits())
+	require.Equal(t, uint64(1), restored.Misses())
+	require.Equal(t, uint64(5), restored.KeysAdded())
+	require.Equal(t, 0.8, restored.Ratio())
+	require.Equal(t, uint64(1), restored.Epoch())
+
+	// Every restart bumps the epoch.
+	buf.Reset()
+	require.NoError(t, restored.Save(&buf))
+	again := newMetrics()
+	require.NoError(t, again.Restore(&buf))
+	require.Equal(t, uint64(2), again.Epoch())
+	require.Equal(t, uint64(4), again.Hits())
+
+	// Clear resets the counters, not the epoch.
+	again.Clear()
+	require.Zero(t, again.Hits())
+	require.Equal(t, uint64(2), again.Epoch())
+}
+
+func TestMetricsRestoreInvalid(t *testing.T) {
+	m := newMetrics()
+	require.Error(t, m.Restore(strings.NewReader("{")))
+	require.EqualError(t, m.Restore(strings.NewReader(`{"version": 2}`)),
+		"unsupported metrics version: 2")
+
+	// Unknown counters are ignored.
+	require.NoError(t, m.Restore(strings.NewReader(
+		`{"version": 1, "epoch": 7, "counters": {"hit": 2, "future-metric": 3}}`)))
+	require.Equal(t, uint64(2), m.Hits())
+	require.Equal(t, uint64(8), m.Epoch())
+
+	var nilMetrics *Metrics
+	require.Error(t, nilMetrics.Save(&bytes.Buffer{}))
+	require.Error(t, nilMetrics.Restore(strings.NewReader("{}")))
+}
+
+func TestMetricsSaveRestoreFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	m := newMetrics()
+	m.add(hit, 3)
+	require.NoError(t, m.SaveFile(path))
+	m.add(hit, 3)
+	require.NoError(t, m.SaveFile(path))
+
+	restored := newMetrics()
+	require.NoError(t, restored.RestoreFile(path))
+	require.Equal(t, uint64(6), restored.Hits())
+	require.Equal(t, uint64(1), restored.Epoch())
+
+	require.Error(t, restored.RestoreFile(filepath.Join(t.TempDir(), "missing")))
+	var disabled *Metrics
+	require.Error(t, disabled.SaveFile(path))
+}
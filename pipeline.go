@@ -0,0 +1,252 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+// Pipeline queues Gets, Sets and Dels to apply them all at once with Exec,
+// like the pipelining of Redis: the store is locked once per shard for all
+// the operations, and the accesses of all the Gets are passed to the policy
+// at once. This is meant for proxies and the other high throughput users that
+// handle many keys per request.
+//
+// The operations on the same key are applied in order. Like with Cache.Set,
+// the new keys are admitted asynchronously, so a Get of a new key Set earlier
+// in the same pipeline misses. A Pipeline isn't safe for concurrent use, and
+// can be reused once Exec returns.
+type Pipeline[K Key, V any] struct {
+	c   *Cache[K, V]
+	ops []storeOp[V]
+}
+
+// PipelineResult is the result of an operation of a Pipeline. For Gets, Value
+// and OK are those returned by Cache.Get, and for Sets OK is the result of
+// Cache.SetWithTTL. For Dels, OK is always true.
+type PipelineResult[V any] struct {
+	Value V
+	OK    bool
+}
+
+// Pipeline returns a new, empty Pipeline for the cache.
+func (c *Cache[K, V]) Pipeline() *Pipeline[K, V] {
+	return &Pipeline[K, V]{c: c}
+}
+
+// Len returns the number of operations queued.
+func (p *Pipeline[K, V]) Len() int {
+	return len(p.ops)
+}
+
+// Get queues a Get of key.
+func (p *Pipeline[K, V]) Get(key K) {
+	if p.c == nil {
+		return
+	}
+	keyHash, conflictHash := p.c.keyToHash(key)
+	p.ops = append(p.ops, storeOp[V]{
+		op:   TraceGet,
+		item: &Item[V]{Key: keyHash, Conflict: conflictHash},
+	})
+}
+
+// Set queues a Set of key, see Cache.Set.
+func (p *Pipeline[K, V]) Set(key K, value V, cost int64) {
+	p.SetWithTTL(key, value, cost, 0)
+}
+
+// SetWithTTL queues a Set of key expiring after ttl, see Cache.SetWithTTL.
+func (p *Pipeline[K, V]) SetWithTTL(key K, value V, cost int64, ttl time.Duration) {
+	if p.c == nil {
+		return
+	}
+	// A negative ttl makes the Set a no-op, which is left without an item,
+	// like the values rejected by Config.InspectValue.
+	i, ok := p.c.newItem(key, value, cost, ttl)
+	if ok && !p.c.inspect(value) {
+		i = nil
+	}
+	p.ops = append(p.ops, storeOp[V]{op: TraceSet, item: i})
+}
+
+// Del queues a Del of key, see Cache.Del.
+func (p *Pipeline[K, V]) Del(key K) {
+	if p.c == nil {
+		return
+	}
+	keyHash, conflictHash := p.c.keyToHash(key)
+	p.ops = append(p.ops, storeOp[V]{
+		op:   TraceDel,
+		item: &Item[V]{flag: itemDelete, Key: keyHash, Conflict: conflictHash},
+	})
+}
+
+// Exec applies the queued operations, and returns their results in the order
+// they were queued. The pipeline is empty afterwards.
+func (p *Pipeline[K, V]) Exec() []PipelineResult[V] {
+	c := p.c
+	results := make([]PipelineResult[V], len(p.ops))
+	defer func() {
+		clear(p.ops)
+		p.ops = p.ops[:0]
+	}()
+	if c == nil || c.isClosed.Load() {
+		return results
+	}
+	// The writes of a read-only cache are left without an item, like the
+	// no-op Sets.
+	if c.readOnly.Load() {
+		for j := range p.ops {
+			if op := &p.ops[j]; op.op != TraceGet && op.item != nil {
+				op.item = nil
+				c.Metrics.add(rejectReadOnly, 1)
+			}
+		}
+	}
+	// So are the writes failed by the FaultInjector, while the failed Gets
+	// miss.
+	var failed []bool
+	if faultsEnabled {
+		failed = make([]bool, len(p.ops))
+		for j := range p.ops {
+			op := &p.ops[j]
+			if op.item == nil || !c.storeFault(op.op, op.item.Key) {
+				continue
+			}
+			failed[j] = true
+			if op.op == TraceSet {
+				c.Metrics.add(dropSets, 1)
+			}
+			if op.op != TraceGet {
+				op.item = nil
+			}
+		}
+	}
+
+	// The stripes of all the keys written to are locked at once, as the
+	// shards of the store are by Batch, see Config.OrderedCallbacks.
+	var stripes uint64
+	if c.ordered != nil {
+		for _, op := range p.ops {
+			if op.op != TraceGet && op.item != nil {
+				stripes |= stripeMask(op.item.Key)
+			}
+		}
+	}
+	c.ordered.lockStripes(stripes)
+	c.storedItems.Batch(p.ops)
+	for j, fail := range failed {
+		if fail {
+			p.ops[j].value, p.ops[j].ok = zeroValue[V](), false
+		}
+	}
+	for _, op := range p.ops {
+		if op.item == nil || op.op == TraceGet || !op.ok {
+			continue
+		}
+		reason := Updated
+		if op.op == TraceDel {
+			reason = Deleted
+		}
+		c.removed(Item[V]{
+			Key:      op.item.Key,
+			Conflict: op.item.Conflict,
+			Value:    op.value,
+			Cost:     c.removalCost(op.item.Key),
+		}, reason)
+	}
+	c.ordered.unlockStripes(stripes)
+
+	var accessed []uint64
+	for j := range p.ops {
+		op, res := &p.ops[j], &results[j]
+		switch op.op {
+		case TraceGet:
+			if !op.hot || z.FastRand()%hotGetSample == 0 {
+				accessed = append(accessed, op.item.Key)
+			}
+			res.Value, res.OK = op.value, op.ok
+			if !op.ok {
+				c.Metrics.add(miss, 1)
+				continue
+			}
+			c.Metrics.add(hit, 1)
+			c.trackFetchSaved(op.item.Key, op.item.Conflict)
+			if c.sliding.Load() {
+				c.storedItems.Touch(op.item.Key, op.item.Conflict)
+			}
+			if c.recalculateCosts {
+				c.recalculateCost(op.item.Key, op.item.Conflict, op.value,
+					c.cachePolicy.Cost(op.item.Key))
+			}
+		case TraceSet:
+			res.OK = op.item != nil && c.sendItem(op.item, op.ok)
+		case TraceDel:
+			if op.item == nil {
+				continue
+			}
+			// Like in Cache.Del, the deletion goes through setBuf too, to be
+			// applied after the Sets of the key buffered before it.
+			c.send(op.item, true)
+			res.OK = true
+		}
+	}
+	c.cachePolicy.Push(accessed)
+	return results
+}
+
+// Entry is an item to Set with SetMany. A zero TTL means no expiration, like
+// for Cache.Set.
+type Entry[K Key, V any] struct {
+	Key   K
+	Value V
+	Cost  int64
+	TTL   time.Duration
+}
+
+// SetMany sets all the entries like SetWithTTL, but in a single Pipeline: the
+// store is locked once per shard for all of them. This is meant for bulk
+// loads, which would otherwise spend most of their time in the overhead of the
+// individual Sets. It returns the results of the Sets, in order. Like with
+// Set, the new entries are admitted through an internal buffer, which drops
+// them when full: large loads are best split in chunks with a Wait after each,
+// or backed by Config.SpillLimit.
+func (c *Cache[K, V]) SetMany(entries []Entry[K, V]) []bool {
+	ok := make([]bool, len(entries))
+	if c == nil || c.isClosed.Load() {
+		return ok
+	}
+	p := &Pipeline[K, V]{c: c, ops: make([]storeOp[V], 0, len(entries))}
+	for _, e := range entries {
+		p.SetWithTTL(e.Key, e.Value, e.Cost, e.TTL)
+	}
+	for n, res := range p.Exec() {
+		ok[n] = res.OK
+	}
+	return ok
+}
+
+// GetMany gets all the keys like Get, but in a single Pipeline: the store is
+// locked once per shard for all of them, and their accesses are passed to the
+// policy at once. It returns the values and whether they were found, in the
+// order of keys.
+func (c *Cache[K, V]) GetMany(keys []K) ([]V, []bool) {
+	values, ok := make([]V, len(keys)), make([]bool, len(keys))
+	if c == nil || c.isClosed.Load() {
+		return values, ok
+	}
+	p := &Pipeline[K, V]{c: c, ops: make([]storeOp[V], 0, len(keys))}
+	for _, key := range keys {
+		p.Get(key)
+	}
+	for n, res := range p.Exec() {
+		values[n], ok[n] = res.Value, res.OK
+	}
+	return values, ok
+}
@@ -0,0 +1,161 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeline(t *testing.T) {
+	var exits []int
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		OnExit:             func(v int) { exits = append(exits, v) },
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.True(t, c.Set(1, 10, 1))
+	require.True(t, c.Set(2, 20, 1))
+	c.Wait()
+
+	p := c.Pipeline()
+	p.Get(1)
+	p.Set(1, 11, 1)
+	p.Get(1)
+	p.Get(3)
+	p.Set(3, 30, 1)
+	p.Del(2)
+	p.Get(2)
+	p.SetWithTTL(4, 40, 1, -1)
+	require.Equal(t, 8, p.Len())
+	require.Equal(t, []PipelineResult[int]{
+		{Value: 10, OK: true},
+		{OK: true},
+		{Value: 11, OK: true},
+		{},
+		{OK: true},
+		{OK: true},
+		{},
+		{},
+	}, p.Exec())
+	require.Zero(t, p.Len())
+	require.Equal(t, []int{10, 20}, exits)
+	require.Equal(t, uint64(2), c.Metrics.Hits())
+	require.Equal(t, uint64(2), c.Metrics.Misses())
+
+	c.Wait()
+	for key, want := range map[int]int{1: 11, 3: 30} {
+		val, ok := c.Get(key)
+		require.True(t, ok)
+		require.Equal(t, want, val)
+	}
+	_, ok := c.Get(2)
+	require.False(t, ok)
+
+	// The accesses of the Gets reach the policy.
+	keyHash, _ := c.keyToHash(1)
+	p.Get(1)
+	p.Get(1)
+	p.Exec()
+	c.Wait()
+	require.Eventually(t, func() bool {
+		pol := c.cachePolicy.(*defaultPolicy[int])
+		pol.Lock()
+		defer pol.Unlock()
+		return pol.admit.Estimate(keyHash) >= 2
+	}, time.Second, time.Millisecond)
+}
+
+func TestPipelineShards(t *testing.T) {
+	c := newCacheT(t, &Config[int, int]{
+		NumCounters:        10000,
+		MaxCost:            1000,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	p := c.Pipeline()
+	for i := 0; i < 1000; i++ {
+		p.Set(i, i, 1)
+	}
+	for _, res := range p.Exec() {
+		require.True(t, res.OK)
+	}
+	c.Wait()
+	for i := 0; i < 1000; i++ {
+		p.Get(i)
+	}
+	results := p.Exec()
+	require.Len(t, results, 1000)
+	var hits int
+	for i, res := range results {
+		if res.OK {
+			require.Equal(t, i, res.Value)
+			hits++
+		}
+	}
+	require.Equal(t, 1000, hits)
+}
+
+func TestPipelineClosed(t *testing.T) {
+	c := newCacheT(t, &Config[int, int]{
+		NumCounters:        10000,
+		MaxCost:            1000,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	p := c.Pipeline()
+	p.Set(1, 1, 1)
+	c.Close()
+	require.Equal(t, []PipelineResult[int]{{}}, p.Exec())
+
+	var nilCache *Cache[int, int]
+	p = nilCache.Pipeline()
+	p.Get(1)
+	require.Empty(t, p.Exec())
+}
+
+func TestCacheSetManyGetMany(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	entries := make([]Entry[int, int], 50)
+	for n := range entries {
+		entries[n] = Entry[int, int]{Key: n, Value: n * 10, Cost: 1}
+	}
+	entries[49].TTL = -1
+	ok := c.SetMany(entries)
+	require.Len(t, ok, 50)
+	for n := range ok {
+		require.Equal(t, n != 49, ok[n])
+	}
+	c.Wait()
+
+	values, ok := c.GetMany([]int{1, 49, 2, 100})
+	require.Equal(t, []int{10, 0, 20, 0}, values)
+	require.Equal(t, []bool{true, false, true, false}, ok)
+	require.Equal(t, uint64(2), c.Metrics.Hits())
+	require.Equal(t, uint64(2), c.Metrics.Misses())
+
+	c.Close()
+	require.Equal(t, []bool{false}, c.SetMany(entries[:1]))
+	values, ok = c.GetMany([]int{1})
+	require.Equal(t, []int{0}, values)
+	require.Equal(t, []bool{false}, ok)
+}
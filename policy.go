@@ -6,9 +6,11 @@
 package ristretto
 
 import (
+	"fmt"
 	"math"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/dgraph-io/ristretto/v2/z"
 )
@@ -17,52 +19,160 @@ const (
 	// lfuSample is the number of items to sample when looking at eviction
 	// candidates. 5 seems to be the most optimal number [citation needed].
 	lfuSample = 5
+	// ghostBoost multiplies the hit count of incoming items found in the ghost
+	// list when comparing them with eviction candidates.
+	ghostBoost = 2
+	// hotThreshold is the estimated access frequency at which an item in the
+	// cache is considered hot, see Config.SampleHotGets. The counters of the
+	// sketch saturate at 15.
+	hotThreshold = 12
+	// hotGetSample is the sampling rate of the Gets of hot items: 1 in
+	// hotGetSample of them is recorded by the policy.
+	hotGetSample = 16
 )
 
+const (
+	// PolicyTinyLFU is the default policy: TinyLFU admission paired with
+	// Sampled LFU eviction.
+	PolicyTinyLFU = "tinylfu"
+	// PolicyLIRS is the Low Inter-reference Recency Set policy. It always
+	// admits new items and evicts based on reuse distance, which helps with
+	// looping access patterns slightly larger than the cache.
+	PolicyLIRS = "lirs"
+	// PolicyS3FIFO is the S3-FIFO policy. It always admits new items, sending
+	// them through a small FIFO queue that filters out one-hit wonders before
+	// they reach the main queue.
+	PolicyS3FIFO = "s3fifo"
+	// PolicyLRU is the Least Recently Used policy. It always admits new items
+	// and evicts the item accessed the longest ago, which suits workloads with
+	// a strong recency bias and no scans.
+	PolicyLRU = "lru"
+	// PolicySLRU is the Segmented LRU policy. It always admits new items into
+	// a probation segment, and only moves them to the protected segment once
+	// accessed again, so that scans don't evict the items accessed repeatedly.
+	PolicySLRU = "slru"
+	// PolicyARC is the Adaptive Replacement Cache policy. It always admits new
+	// items, and balances the room given to the items accessed once and to
+	// those accessed repeatedly, by tracking the keys recently evicted.
+	PolicyARC = "arc"
+	// PolicyWTinyLFU is the Window TinyLFU policy. It always admits new items
+	// into a small LRU window, and uses TinyLFU to choose which items move on
+	// from the window to the main area. The size of the window adapts to the
+	// workload, which makes it better than PolicyTinyLFU when accesses are
+	// biased towards recent items.
+	PolicyWTinyLFU = "wtinylfu"
+)
+
+// policy is the interface encapsulating eviction/admission behavior.
+type policy[V any] interface {
+	ringConsumer
+	// PushSync works like Push, but waits for room for the keys rather than
+	// dropping them.
+	PushSync([]uint64)
+	// Sync waits until the batches of keys pushed so far have been applied.
+	Sync()
+	// Add attempts to Add the key-cost pair to the Policy. It returns a slice
+	// of evicted keys and a bool denoting whether or not the key-cost pair
+	// was added. If it returns true, the key should be stored in cache.
+	Add(uint64, int64) ([]*Item[V], bool)
+	// AddBatch works like calling Add for every key-cost pair in order, but
+	// only acquires the lock of the Policy once. It returns the result of
+	// each Add.
+	AddBatch([]policyPair) []addResult[V]
+	// AddIfRoom adds the key-cost pair only if it fits without evicting
+	// anything. It returns true if the key-cost pair was added.
+	AddIfRoom(uint64, int64) bool
+	// Has returns true if the key exists in the Policy.
+	Has(uint64) bool
+	// Del deletes the key from the Policy.
+	Del(uint64)
+	// Cap returns the available capacity.
+	Cap() int64
+	// Close stops all goroutines opened by the Policy.
+	Close()
+	// Update updates the cost value for the key.
+	Update(uint64, int64)
+	// Cost returns the cost value of a key or -1 if missing.
+	Cost(uint64) int64
+	// Clear zeroes out all counters and clears hashmaps.
+	Clear()
+	// MaxCost returns the current max cost of the cache policy.
+	MaxCost() int64
+	// UpdateMaxCost updates the max cost of the cache policy.
+	UpdateMaxCost(int64)
+	// CollectMetrics sets the metrics the Policy updates.
+	CollectMetrics(*Metrics)
+}
+
 func newPolicy[V any](numCounters, maxCost int64) *defaultPolicy[V] {
 	return newDefaultPolicy[V](numCounters, maxCost)
 }
 
-type defaultPolicy[V any] struct {
+// newPolicyOfKind returns the policy identified by one of the Policy*
+// constants. An empty kind selects PolicyTinyLFU.
+func newPolicyOfKind[V any](kind string, numCounters, maxCost int64) (policy[V], error) {
+	switch kind {
+	case "", PolicyTinyLFU:
+		return newPolicy[V](numCounters, maxCost), nil
+	case PolicyLIRS:
+		return newLIRSPolicy[V](maxCost), nil
+	case PolicyS3FIFO:
+		return newS3FIFOPolicy[V](maxCost), nil
+	case PolicyLRU:
+		return newLRUPolicy[V](maxCost), nil
+	case PolicySLRU:
+		return newSLRUPolicy[V](maxCost), nil
+	case PolicyARC:
+		return newARCPolicy[V](maxCost), nil
+	case PolicyWTinyLFU:
+		return newWTinyLFUPolicy[V](numCounters, maxCost), nil
+	default:
+		return nil, fmt.Errorf("unknown Policy: %q", kind)
+	}
+}
+
+// policyBase holds what is shared by all policies: the lock protecting their
+// metadata and the goroutine applying the batches of accessed keys pushed by
+// the Get ring buffer.
+type policyBase struct {
 	sync.Mutex
-	admit    *tinyLFU
-	evict    *sampledLFU
-	itemsCh  chan []uint64
+	itemsCh chan []uint64
+	// syncCh receives the channels Sync waits on, closed once the batches
+	// in itemsCh are applied.
+	syncCh   chan chan struct{}
 	stop     chan struct{}
 	done     chan struct{}
 	isClosed bool
 	metrics  *Metrics
 }
 
-func newDefaultPolicy[V any](numCounters, maxCost int64) *defaultPolicy[V] {
-	p := &defaultPolicy[V]{
-		admit:   newTinyLFU(numCounters),
-		evict:   newSampledLFU(maxCost),
+func newPolicyBase() policyBase {
+	return policyBase{
 		itemsCh: make(chan []uint64, 3),
+		syncCh:  make(chan chan struct{}),
 		stop:    make(chan struct{}),
 		done:    make(chan struct{}),
 	}
-	go p.processItems()
-	return p
 }
 
-func (p *defaultPolicy[V]) CollectMetrics(metrics *Metrics) {
-	p.metrics = metrics
-	p.evict.metrics = metrics
-}
-
-type policyPair struct {
-	key  uint64
-	cost int64
-}
-
-func (p *defaultPolicy[V]) processItems() {
+// processItems calls onAccess, with the lock held, for every batch of keys
+// received until Close is called.
+func (p *policyBase) processItems(onAccess func(keys []uint64)) {
 	for {
 		select {
 		case items := <-p.itemsCh:
 			p.Lock()
-			p.admit.Push(items)
+			onAccess(items)
 			p.Unlock()
+		case done := <-p.syncCh:
+			// The batches pushed before Sync are in itemsCh by now.
+			for n := len(p.itemsCh); n > 0; n-- {
+				items := <-p.itemsCh
+				p.Lock()
+				onAccess(items)
+				p.Unlock()
+			}
+			close(done)
 		case <-p.stop:
 			p.done <- struct{}{}
 			return
@@ -70,7 +180,7 @@ func (p *defaultPolicy[V]) processItems() {
 	}
 }
 
-func (p *defaultPolicy[V]) Push(keys []uint64) bool {
+func (p *policyBase) Push(keys []uint64) bool {
 	if p.isClosed {
 		return false
 	}
@@ -81,23 +191,153 @@ func (p *defaultPolicy[V]) Push(keys []uint64) bool {
 
 	select {
 	case p.itemsCh <- keys:
-		p.metrics.add(keepGets, keys[0], uint64(len(keys)))
+		p.metrics.add(keepGets, uint64(len(keys)))
 		return true
 	default:
-		p.metrics.add(dropGets, keys[0], uint64(len(keys)))
+		p.metrics.add(dropGets, uint64(len(keys)))
 		return false
 	}
 }
 
+func (p *policyBase) PushSync(keys []uint64) {
+	if p.isClosed || len(keys) == 0 {
+		return
+	}
+	p.itemsCh <- keys
+	p.metrics.add(keepGets, uint64(len(keys)))
+}
+
+func (p *policyBase) Sync() {
+	if p.isClosed {
+		return
+	}
+	done := make(chan struct{})
+	p.syncCh <- done
+	<-done
+}
+
+func (p *policyBase) Close() {
+	if p.isClosed {
+		return
+	}
+
+	// Block until the p.processItems goroutine returns.
+	p.stop <- struct{}{}
+	<-p.done
+	close(p.stop)
+	close(p.done)
+	close(p.itemsCh)
+	p.isClosed = true
+}
+
+type defaultPolicy[V any] struct {
+	policyBase
+	admit *tinyLFU
+	evict *sampledLFU
+	ghost *ghostList
+	// pending holds the recently rejected keys, see Config.RetryAdmitWindow.
+	pending *pendingSet
+	// onHot is called when a key in the cache becomes hot or stops being hot,
+	// see Config.SampleHotGets. hot holds the keys currently hot.
+	onHot func(key uint64, hot bool)
+	hot   map[uint64]struct{}
+	// penalties holds the miss penalties other than 1 of the keys in the
+	// cache, and of those about to be added, see SetOptions.MissPenalty.
+	penalties map[uint64]float64
+	// admission decides which keys are admitted instead of comparing their
+	// hits with those of the victims, if set, see Config.Admission.
+	admission Admission
+}
+
+// penaltyPolicy is implemented by the policies which weigh the access
+// frequencies of the keys by their miss penalties, see SetOptions.MissPenalty.
+type penaltyPolicy interface {
+	// setPenalty sets the miss penalty of key, for its next Add. It's kept
+	// while key stays in the cache.
+	setPenalty(key uint64, penalty float64)
+}
+
+func newDefaultPolicy[V any](numCounters, maxCost int64) *defaultPolicy[V] {
+	p := &defaultPolicy[V]{
+		policyBase: newPolicyBase(),
+		admit:      newTinyLFU(numCounters),
+		evict:      newSampledLFU(maxCost),
+	}
+	go p.processItems(p.access)
+	return p
+}
+
+// access records the accesses to keys, and reports the keys in the cache whose
+// hot state changed to onHot, if set.
+func (p *defaultPolicy[V]) access(keys []uint64) {
+	p.admit.Push(keys)
+	if p.onHot == nil {
+		return
+	}
+	for _, key := range keys {
+		if _, ok := p.evict.keyCosts[key]; !ok {
+			continue
+		}
+		_, was := p.hot[key]
+		is := p.admit.Estimate(key) >= hotThreshold
+		if is == was {
+			continue
+		}
+		if is {
+			p.hot[key] = struct{}{}
+		} else {
+			delete(p.hot, key)
+		}
+		p.onHot(key, is)
+	}
+}
+
+func (p *defaultPolicy[V]) CollectMetrics(metrics *Metrics) {
+	p.metrics = metrics
+	p.evict.metrics = metrics
+}
+
+type policyPair struct {
+	key  uint64
+	cost int64
+}
+
+// addResult is the result of Policy.Add for one of the pairs of AddBatch.
+type addResult[V any] struct {
+	victims []*Item[V]
+	added   bool
+}
+
+// addBatch calls add for all the pairs, in order.
+func addBatch[V any](pairs []policyPair,
+	add func(uint64, int64) ([]*Item[V], bool)) []addResult[V] {
+	results := make([]addResult[V], len(pairs))
+	for i, pair := range pairs {
+		results[i].victims, results[i].added = add(pair.key, pair.cost)
+	}
+	return results
+}
+
 // Add decides whether the item with the given key and cost should be accepted by
 // the policy. It returns the list of victims that have been evicted and a boolean
 // indicating whether the incoming item should be accepted.
 func (p *defaultPolicy[V]) Add(key uint64, cost int64) ([]*Item[V], bool) {
 	p.Lock()
 	defer p.Unlock()
+	return p.add(key, cost)
+}
+
+func (p *defaultPolicy[V]) AddBatch(pairs []policyPair) []addResult[V] {
+	p.Lock()
+	defer p.Unlock()
+	return addBatch(pairs, p.add)
+}
 
+// add is Add, with the lock held.
+func (p *defaultPolicy[V]) add(key uint64, cost int64) ([]*Item[V], bool) {
 	// Cannot add an item bigger than entire cache.
 	if cost > p.evict.getMaxCost() {
+		delete(p.penalties, key)
 		return nil, false
 	}
 
@@ -114,12 +354,27 @@ func (p *defaultPolicy[V]) Add(key uint64, cost int64) ([]*Item[V], bool) {
 		// There's enough room in the cache to store the new item without
 		// overflowing. Do that now and stop here.
 		p.evict.add(key, cost)
-		p.metrics.add(costAdd, key, uint64(cost))
+		p.metrics.trackAdd(key, cost)
 		return nil, true
 	}
 
+	if p.admission != nil {
+		return p.admitWith(p.admission, key, cost, room)
+	}
+
 	// incHits is the hit count for the incoming item.
 	incHits := p.admit.Estimate(key)
+	if p.ghost.has(key) {
+		// The incoming item was recently evicted, which means the eviction
+		// decision was probably wrong. Boost it to make it easier to get in.
+		p.metrics.add(ghostHit, 1)
+		incHits *= ghostBoost
+	}
+	// The hit counts are compared weighted by the miss penalties.
+	incWeight := p.weigh(key, incHits)
+	// A key rejected recently is admitted regardless of the hits of the
+	// eviction candidates, see Config.RetryAdmitWindow.
+	retry := p.pending.take(key)
 	// sample is the eviction candidate pool to be filled via random sampling.
 	// TODO: perhaps we should use a min heap here. Right now our time
 	// complexity is N for finding the min. Min heap should bring it down to
@@ -135,22 +390,24 @@ func (p *defaultPolicy[V]) Add(key uint64, cost int64) ([]*Item[V], bool) {
 		sample = p.evict.fillSample(sample)
 
 		// Find minimally used item in sample.
-		minKey, minHits, minId, minCost := uint64(0), int64(math.MaxInt64), 0, int64(0)
+		minKey, minWeight, minId, minCost := uint64(0), math.Inf(1), 0, int64(0)
 		for i, pair := range sample {
 			// Look up hit count for sample key.
-			if hits := p.admit.Estimate(pair.key); hits < minHits {
-				minKey, minHits, minId, minCost = pair.key, hits, i, pair.cost
+			if weight := p.weigh(pair.key, p.admit.Estimate(pair.key)); weight < minWeight {
+				minKey, minWeight, minId, minCost = pair.key, weight, i, pair.cost
 			}
 		}
 
 		// If the incoming item isn't worth keeping in the policy, reject.
-		if incHits < minHits {
-			p.metrics.add(rejectSets, key, 1)
+		if !retry && incWeight < minWeight {
+			p.metrics.add(rejectSets, 1)
+			p.pending.add(key)
+			delete(p.penalties, key)
 			return victims, false
 		}
 
 		// Delete the victim from metadata.
-		p.evict.del(minKey)
+		p.evictVictim(minKey)
 
 		// Delete the victim from sample.
 		sample[minId] = sample[len(sample)-1]
@@ -164,10 +421,58 @@ func (p *defaultPolicy[V]) Add(key uint64, cost int64) ([]*Item[V], bool) {
 	}
 
 	p.evict.add(key, cost)
-	p.metrics.add(costAdd, key, uint64(cost))
+	p.ghost.del(key)
+	p.metrics.trackAdd(key, cost)
+	if retry {
+		p.metrics.add(retryAdmit, 1)
+	}
 	return victims, true
 }
 
+// evictVictim deletes the metadata of key, evicted to make room for another.
+func (p *defaultPolicy[V]) evictVictim(key uint64) {
+	p.evict.del(key)
+	p.ghost.add(key)
+	delete(p.hot, key)
+	delete(p.penalties, key)
+}
+
+// weigh returns hits weighted by the miss penalty of key.
+func (p *defaultPolicy[V]) weigh(key uint64, hits int64) float64 {
+	if penalty, ok := p.penalties[key]; ok {
+		return float64(hits) * penalty
+	}
+	return float64(hits)
+}
+
+func (p *defaultPolicy[V]) setPenalty(key uint64, penalty float64) {
+	p.Lock()
+	defer p.Unlock()
+	if penalty == 1 {
+		delete(p.penalties, key)
+		return
+	}
+	if p.penalties == nil {
+		p.penalties = make(map[uint64]float64)
+	}
+	p.penalties[key] = penalty
+}
+
+// AddIfRoom is a low priority variant of Add. The item is only accepted if it
+// isn't in the cache already and fits in the remaining room, i.e. no other
+// item has to be evicted to make space for it.
+func (p *defaultPolicy[V]) AddIfRoom(key uint64, cost int64) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if _, has := p.evict.keyCosts[key]; has || p.evict.roomLeft(cost) < 0 {
+		return false
+	}
+	p.evict.add(key, cost)
+	p.metrics.trackAdd(key, cost)
+	return true
+}
+
 func (p *defaultPolicy[V]) Has(key uint64) bool {
 	p.Lock()
 	_, exists := p.evict.keyCosts[key]
@@ -178,6 +483,8 @@ func (p *defaultPolicy[V]) Has(key uint64) bool {
 func (p *defaultPolicy[V]) Del(key uint64) {
 	p.Lock()
 	p.evict.del(key)
+	delete(p.hot, key)
+	delete(p.penalties, key)
 	p.Unlock()
 }
 
@@ -208,21 +515,13 @@ func (p *defaultPolicy[V]) Clear() {
 	p.Lock()
 	p.admit.clear()
 	p.evict.clear()
-	p.Unlock()
-}
-
-func (p *defaultPolicy[V]) Close() {
-	if p.isClosed {
-		return
+	p.ghost.clear()
+	p.pending.clear()
+	if p.hot != nil {
+		p.hot = make(map[uint64]struct{})
 	}
-
-	// Block until the p.processItems goroutine returns.
-	p.stop <- struct{}{}
-	<-p.done
-	close(p.stop)
-	close(p.done)
-	close(p.itemsCh)
-	p.isClosed = true
+	p.penalties = nil
+	p.Unlock()
 }
 
 func (p *defaultPolicy[V]) MaxCost() int64 {
@@ -292,8 +591,7 @@ func (p *sampledLFU) del(key uint64) {
 	}
 	p.used -= cost
 	delete(p.keyCosts, key)
-	p.metrics.add(costEvict, key, uint64(cost))
-	p.metrics.add(keyEvict, key, 1)
+	p.metrics.trackEvict(key, cost)
 }
 
 func (p *sampledLFU) add(key uint64, cost int64) {
@@ -305,14 +603,7 @@ func (p *sampledLFU) updateIfHas(key uint64, cost int64) bool {
 	if prev, found := p.keyCosts[key]; found {
 		// Update the cost of an existing key, but don't worry about evicting.
 		// Evictions will be handled the next time a new item is added.
-		p.metrics.add(keyUpdate, key, 1)
-		if prev > cost {
-			diff := prev - cost
-			p.metrics.add(costAdd, key, ^(uint64(diff) - 1))
-		} else if cost > prev {
-			diff := cost - prev
-			p.metrics.add(costAdd, key, uint64(diff))
-		}
+		p.metrics.trackUpdate(key, prev, cost)
 		p.used += cost - prev
 		p.keyCosts[key] = cost
 		return true
@@ -383,3 +674,118 @@ func (p *tinyLFU) clear() {
 	p.door.Clear()
 	p.freq.Clear()
 }
+
+// ghostList remembers the hashes of the most recently evicted keys, so that
+// the policy can tell when a victim is requested again soon after eviction.
+// ghostList is NOT thread safe.
+type ghostList struct {
+	// keys is a ring of evicted keys, next is the number of keys ever added.
+	keys []uint64
+	next uint64
+	// pos maps a key to the value of next when it was added, which tells us
+	// if its slot in the ring has been overwritten since.
+	pos map[uint64]uint64
+}
+
+func newGhostList(size int) *ghostList {
+	return &ghostList{
+		keys: make([]uint64, size),
+		pos:  make(map[uint64]uint64, size),
+	}
+}
+
+func (g *ghostList) add(key uint64) {
+	if g == nil {
+		return
+	}
+	if _, ok := g.pos[key]; ok {
+		return
+	}
+	slot := g.next % uint64(len(g.keys))
+	if g.next >= uint64(len(g.keys)) {
+		// Forget the key being overwritten, unless it was re-added later on.
+		old := g.keys[slot]
+		if pos, ok := g.pos[old]; ok && pos == g.next-uint64(len(g.keys)) {
+			delete(g.pos, old)
+		}
+	}
+	g.keys[slot] = key
+	g.pos[key] = g.next
+	g.next++
+}
+
+func (g *ghostList) has(key uint64) bool {
+	if g == nil {
+		return false
+	}
+	_, ok := g.pos[key]
+	return ok
+}
+
+func (g *ghostList) del(key uint64) {
+	if g == nil {
+		return
+	}
+	delete(g.pos, key)
+}
+
+func (g *ghostList) clear() {
+	if g == nil {
+		return
+	}
+	g.next = 0
+	g.pos = make(map[uint64]uint64, len(g.keys))
+}
+
+// pendingSet remembers the hashes of the keys rejected by the admission policy
+// for a while, so that they are admitted if they're Set again in the meantime.
+// pendingSet is NOT thread safe.
+type pendingSet struct {
+	window    time.Duration
+	deadlines map[uint64]time.Time
+	// nextSweep is when the expired keys are deleted next.
+	nextSweep time.Time
+}
+
+func newPendingSet(window time.Duration) *pendingSet {
+	return &pendingSet{
+		window:    window,
+		deadlines: make(map[uint64]time.Time),
+	}
+}
+
+func (s *pendingSet) add(key uint64) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	if now.After(s.nextSweep) {
+		for k, deadline := range s.deadlines {
+			if now.After(deadline) {
+				delete(s.deadlines, k)
+			}
+		}
+		s.nextSweep = now.Add(s.window)
+	}
+	s.deadlines[key] = now.Add(s.window)
+}
+
+// take returns true if key was rejected less than window ago, and forgets it.
+func (s *pendingSet) take(key uint64) bool {
+	if s == nil {
+		return false
+	}
+	deadline, ok := s.deadlines[key]
+	if !ok {
+		return false
+	}
+	delete(s.deadlines, key)
+	return !time.Now().After(deadline)
+}
+
+func (s *pendingSet) clear() {
+	if s == nil {
+		return
+	}
+	s.deadlines = make(map[uint64]time.Time)
+}
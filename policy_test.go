@@ -86,6 +86,219 @@ func TestPolicyAdd(t *testing.T) {
 	require.False(t, added)
 }
 
+func TestPolicyAddBatch(t *testing.T) {
+	pairs := []policyPair{{1, 5}, {2, 5}, {1, 5}, {3, 20}, {4, 5}}
+	for _, kind := range []string{
+		PolicyTinyLFU, PolicyLIRS, PolicyS3FIFO, PolicyLRU, PolicySLRU, PolicyARC,
+		PolicyWTinyLFU,
+	} {
+		t.Run(kind, func(t *testing.T) {
+			batched, err := newPolicyOfKind[int](kind, 100, 10)
+			require.NoError(t, err)
+			defer batched.Close()
+			single, err := newPolicyOfKind[int](kind, 100, 10)
+			require.NoError(t, err)
+			defer single.Close()
+
+			results := batched.AddBatch(pairs)
+			require.Len(t, results, len(pairs))
+			for i, pair := range pairs {
+				victims, added := single.Add(pair.key, pair.cost)
+				require.Equal(t, added, results[i].added, "pair %d", i)
+				require.Len(t, results[i].victims, len(victims), "pair %d", i)
+			}
+			require.Equal(t, single.Cap(), batched.Cap())
+		})
+	}
+}
+
+func TestPolicyAddIfRoom(t *testing.T) {
+	p := newDefaultPolicy[int](1000, 100)
+	require.True(t, p.AddIfRoom(1, 90))
+	require.False(t, p.AddIfRoom(1, 1))
+	require.False(t, p.AddIfRoom(2, 20))
+	require.True(t, p.AddIfRoom(2, 10))
+	require.Equal(t, int64(0), p.Cap())
+}
+
+func TestPolicyGhostList(t *testing.T) {
+	p := newDefaultPolicy[int](100, 1)
+	p.ghost = newGhostList(4)
+	p.CollectMetrics(newMetrics())
+
+	_, added := p.Add(1, 1)
+	require.True(t, added)
+	p.admit.Increment(2)
+	p.admit.Increment(2)
+	victims, added := p.Add(2, 1)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	require.True(t, p.ghost.has(1))
+
+	// Without the boost, 1 would be rejected as it is less frequent than 2.
+	p.admit.Increment(1)
+	_, added = p.Add(1, 1)
+	require.True(t, added)
+	require.False(t, p.ghost.has(1))
+	require.True(t, p.ghost.has(2))
+	require.Equal(t, uint64(1), p.metrics.GhostHits())
+}
+
+func TestPolicyPenalty(t *testing.T) {
+	p := newDefaultPolicy[int](100, 2)
+	p.CollectMetrics(newMetrics())
+
+	p.setPenalty(1, 10)
+	_, added := p.Add(1, 1)
+	require.True(t, added)
+	_, added = p.Add(2, 1)
+	require.True(t, added)
+	for n := 0; n < 5; n++ {
+		p.admit.Increment(1)
+		p.admit.Increment(3)
+	}
+	p.admit.Increment(2)
+
+	// 3 is admitted over 2, but not over 1, which weighs its 5 hits up to 50.
+	victims, added := p.Add(3, 1)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(2), victims[0].Key)
+	victims, added = p.Add(4, 1)
+	require.False(t, added)
+	require.Empty(t, victims)
+
+	// A heavier incoming key wins over the more frequent ones.
+	p.setPenalty(4, 100)
+	p.admit.Increment(4)
+	victims, added = p.Add(4, 1)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(3), victims[0].Key)
+
+	// The penalties are forgotten with their keys.
+	p.setPenalty(5, 2)
+	_, added = p.Add(5, 1)
+	require.False(t, added)
+	p.Del(1)
+	require.Equal(t, map[uint64]float64{4: 100}, p.penalties)
+	p.Clear()
+	require.Empty(t, p.penalties)
+}
+
+func TestGhostList(t *testing.T) {
+	g := newGhostList(2)
+	g.add(1)
+	g.add(2)
+	g.add(1)
+	require.True(t, g.has(1))
+	require.True(t, g.has(2))
+	g.add(3)
+	require.False(t, g.has(1))
+	require.True(t, g.has(2))
+	require.True(t, g.has(3))
+
+	// Deleted keys which are re-added survive their old slot being reused.
+	g.del(2)
+	g.add(2)
+	g.add(4)
+	require.True(t, g.has(2))
+	require.False(t, g.has(3))
+	require.True(t, g.has(4))
+
+	g.clear()
+	require.False(t, g.has(2))
+
+	g = nil
+	g.add(1)
+	require.False(t, g.has(1))
+}
+
+func TestPolicyRetryAdmit(t *testing.T) {
+	p := newDefaultPolicy[int](100, 1)
+	p.pending = newPendingSet(time.Minute)
+	p.CollectMetrics(newMetrics())
+
+	p.admit.Increment(1)
+	p.admit.Increment(1)
+	_, added := p.Add(1, 1)
+	require.True(t, added)
+	_, added = p.Add(2, 1)
+	require.False(t, added)
+
+	// The second Set of 2 is admitted, even though 1 is more frequent.
+	victims, added := p.Add(2, 1)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(1), victims[0].Key)
+	require.Equal(t, uint64(1), p.metrics.RetriesAdmitted())
+	require.Equal(t, uint64(1), p.metrics.SetsRejected())
+
+	// Markers expire after the window.
+	p.admit.Increment(2)
+	p.admit.Increment(2)
+	_, added = p.Add(3, 1)
+	require.False(t, added)
+	p.pending.deadlines[3] = time.Now().Add(-time.Second)
+	_, added = p.Add(3, 1)
+	require.False(t, added)
+}
+
+func TestPolicyHot(t *testing.T) {
+	p := newDefaultPolicy[int](100, 10)
+	defer p.Close()
+	changes := make(map[uint64]bool)
+	p.hot = make(map[uint64]struct{})
+	p.onHot = func(key uint64, hot bool) { changes[key] = hot }
+
+	p.Add(1, 1)
+	keys := make([]uint64, hotThreshold)
+	for i := range keys {
+		keys[i] = 1
+	}
+	// Keys not in the cache are never reported.
+	p.access([]uint64{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2})
+	require.Empty(t, changes)
+	p.access(keys[:hotThreshold-1])
+	require.Empty(t, changes)
+	p.access(keys[:1])
+	require.Equal(t, map[uint64]bool{1: true}, changes)
+
+	// The key cools down when the sketch is reset.
+	p.admit.reset()
+	p.access(keys[:1])
+	require.Equal(t, map[uint64]bool{1: false}, changes)
+
+	p.access(keys)
+	require.True(t, changes[1])
+	p.Del(1)
+	require.Empty(t, p.hot)
+}
+
+func TestPendingSet(t *testing.T) {
+	s := newPendingSet(time.Minute)
+	s.add(1)
+	require.True(t, s.take(1))
+	require.False(t, s.take(1))
+
+	s.deadlines[2] = time.Now().Add(-time.Second)
+	require.False(t, s.take(2))
+
+	// Expired keys are swept on add.
+	s.deadlines[3] = time.Now().Add(-time.Second)
+	s.nextSweep = time.Time{}
+	s.add(4)
+	require.NotContains(t, s.deadlines, uint64(3))
+	require.Contains(t, s.deadlines, uint64(4))
+
+	s.clear()
+	require.False(t, s.take(4))
+
+	s = nil
+	s.add(1)
+	require.False(t, s.take(1))
+}
+
 func TestPolicyHas(t *testing.T) {
 	p := newDefaultPolicy[int](100, 10)
 	p.Add(1, 1)
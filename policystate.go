@@ -0,0 +1,362 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+// The policy state is exported in the following binary format, so that other
+// tools and future versions can read it. All integers are big endian.
+//
+//	magic    [4]byte  "RSPS"
+//	version  uint16   policyStateVersion
+//	reserved uint16   zero
+//	sections, until the end of the data, each one being:
+//	  tag    uint8
+//	  length uint64   the length of the payload
+//	  payload
+//
+// The sections are:
+//
+//	sketch (tag 1):
+//	  counters   uint64   the number of counters per row, a power of 2
+//	  increments int64    the increments since the last reset
+//	  resetAt    int64    the increments between two resets
+//	  depth      uint32   the number of rows
+//	  rows, depth times:
+//	    seed     uint64
+//	    counters/2 bytes of 4-bit counters, the even counters in the low
+//	    nibbles
+//	doorkeeper (tag 2):
+//	  locs       uint64   the number of bits set per key
+//	  words      uint64   the number of words of the bitset
+//	  bitset     words times uint64
+//	costs (tag 3):
+//	  count      uint64
+//	  key uint64 and cost int64, count times
+//
+// Readers skip the sections with an unknown tag, and the bytes past the end
+// of the fields they know in a section, so new fields and sections can be
+// added without changing the version. The version is only changed by
+// incompatible changes, and readers reject the versions they don't know.
+const (
+	policyStateMagic   = "RSPS"
+	policyStateVersion = 1
+
+	policyStateSketch = 1
+	policyStateDoor   = 2
+	policyStateCosts  = 3
+)
+
+// PolicyState is the state of the TinyLFU admission policy of a Cache, see
+// Cache.ExportPolicy. It's meant to warm up a new cache with the access
+// frequencies seen by a previous one, or to be inspected by external tools.
+type PolicyState struct {
+	// Counters is the number of counters in each row of the sketch.
+	Counters uint64
+	// Increments is the number of increments since the sketch was last
+	// halved, and ResetAt the number of increments between two halvings.
+	Increments int64
+	ResetAt    int64
+	// Seeds and Rows are the seed and the 4-bit counters of every row of the
+	// sketch, two counters per byte with the even ones in the low nibbles.
+	Seeds []uint64
+	Rows  [][]byte
+	// DoorLocs is the number of bits set per key in the Door bitset.
+	DoorLocs uint64
+	Door     []uint64
+	// Costs are the costs of the keys in the cache, by key hash.
+	Costs map[uint64]int64
+}
+
+// WriteTo writes the state to w in the binary format described above.
+func (s *PolicyState) WriteTo(w io.Writer) (int64, error) {
+	buf := append([]byte(policyStateMagic), 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(buf[4:], policyStateVersion)
+
+	var sec []byte
+	sec = binary.BigEndian.AppendUint64(sec, s.Counters)
+	sec = binary.BigEndian.AppendUint64(sec, uint64(s.Increments))
+	sec = binary.BigEndian.AppendUint64(sec, uint64(s.ResetAt))
+	sec = binary.BigEndian.AppendUint32(sec, uint32(len(s.Rows)))
+	for i, row := range s.Rows {
+		sec = binary.BigEndian.AppendUint64(sec, s.Seeds[i])
+		sec = append(sec, row...)
+	}
+	buf = appendPolicySection(buf, policyStateSketch, sec)
+
+	sec = binary.BigEndian.AppendUint64(sec[:0], s.DoorLocs)
+	sec = binary.BigEndian.AppendUint64(sec, uint64(len(s.Door)))
+	for _, word := range s.Door {
+		sec = binary.BigEndian.AppendUint64(sec, word)
+	}
+	buf = appendPolicySection(buf, policyStateDoor, sec)
+
+	// The keys are sorted, so that the same state is always written the same.
+	keys := make([]uint64, 0, len(s.Costs))
+	for key := range s.Costs {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	sec = binary.BigEndian.AppendUint64(sec[:0], uint64(len(keys)))
+	for _, key := range keys {
+		sec = binary.BigEndian.AppendUint64(sec, key)
+		sec = binary.BigEndian.AppendUint64(sec, uint64(s.Costs[key]))
+	}
+	buf = appendPolicySection(buf, policyStateCosts, sec)
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+func appendPolicySection(buf []byte, tag byte, payload []byte) []byte {
+	buf = append(buf, tag)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(payload)))
+	return append(buf, payload...)
+}
+
+var errPolicyStateShort = errors.New("policy state is truncated")
+
+// ReadPolicyState reads a state written by PolicyState.WriteTo from r.
+func ReadPolicyState(r io.Reader) (*PolicyState, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8 || string(data[:4]) != policyStateMagic {
+		return nil, errors.New("not a policy state")
+	}
+	if v := binary.BigEndian.Uint16(data[4:]); v != policyStateVersion {
+		return nil, fmt.Errorf("unsupported policy state version: %d", v)
+	}
+	s := &PolicyState{Costs: make(map[uint64]int64)}
+	for data = data[8:]; len(data) > 0; {
+		if len(data) < 9 {
+			return nil, errPolicyStateShort
+		}
+		tag, n := data[0], binary.BigEndian.Uint64(data[1:])
+		data = data[9:]
+		if n > uint64(len(data)) {
+			return nil, errPolicyStateShort
+		}
+		sec := &policyStateReader{data: data[:n]}
+		data = data[n:]
+
+		switch tag {
+		case policyStateSketch:
+			s.Counters = sec.uint64()
+			s.Increments = int64(sec.uint64())
+			s.ResetAt = int64(sec.uint64())
+			depth := sec.uint32()
+			for i := uint32(0); i < depth && sec.err == nil; i++ {
+				s.Seeds = append(s.Seeds, sec.uint64())
+				s.Rows = append(s.Rows, append([]byte(nil), sec.bytes(s.Counters/2)...))
+			}
+		case policyStateDoor:
+			s.DoorLocs = sec.uint64()
+			words := sec.uint64()
+			if words > uint64(len(sec.data))/8 {
+				return nil, errPolicyStateShort
+			}
+			s.Door = make([]uint64, words)
+			for i := range s.Door {
+				s.Door[i] = sec.uint64()
+			}
+		case policyStateCosts:
+			count := sec.uint64()
+			if count > uint64(len(sec.data))/16 {
+				return nil, errPolicyStateShort
+			}
+			for i := uint64(0); i < count; i++ {
+				s.Costs[sec.uint64()] = int64(sec.uint64())
+			}
+		}
+		if sec.err != nil {
+			return nil, sec.err
+		}
+	}
+	return s, nil
+}
+
+// policyStateReader decodes the fields of a section, remembering if it ran
+// out of data.
+type policyStateReader struct {
+	data []byte
+	err  error
+}
+
+func (r *policyStateReader) bytes(n uint64) []byte {
+	if r.err != nil || n > uint64(len(r.data)) {
+		r.err = errPolicyStateShort
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *policyStateReader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *policyStateReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// Resize returns a copy of the state for a cache with a NumCounters of
+// numCounters, so that it can be imported by a cache with a different config.
+// A key is counted at the same index of a row modulo the size of the row, so
+// shrinking adds up the counters folded together, saturating at 15, and
+// growing copies them: like with the sketch itself, the estimates can only be
+// too high. The doorkeeper can't be remapped when its size changes, and is
+// cleared then, which only loses the first access to the keys since the last
+// reset. The costs are kept as is.
+func (s *PolicyState) Resize(numCounters int64) (*PolicyState, error) {
+	if numCounters <= 0 {
+		return nil, errors.New("NumCounters can't be zero")
+	}
+	if s.Counters < 2 || s.Counters&(s.Counters-1) != 0 {
+		return nil, fmt.Errorf("policy state has an invalid number of counters: %d", s.Counters)
+	}
+	width := uint64(max(next2Power(numCounters), 2))
+	r := &PolicyState{
+		Counters: width,
+		ResetAt:  numCounters,
+		Seeds:    append([]uint64(nil), s.Seeds...),
+		Costs:    make(map[uint64]int64, len(s.Costs)),
+	}
+	if s.ResetAt > 0 {
+		r.Increments = min(s.Increments*numCounters/s.ResetAt, numCounters-1)
+	}
+	for _, row := range s.Rows {
+		if uint64(len(row)) != s.Counters/2 {
+			return nil, errors.New("policy state has rows of different sizes")
+		}
+		to := make(cmRow, width/2)
+		from := cmRow(row)
+		for i := uint64(0); i < s.Counters; i++ {
+			j := i & (width - 1)
+			v := min(to.get(j)+from.get(i), 15)
+			to[j/2] = to[j/2]&^(0x0f<<((j&1)*4)) | v<<((j&1)*4)
+		}
+		// When growing, the counters beyond the old row are copies.
+		for j := s.Counters; j < width; j++ {
+			v := to.get(j & (s.Counters - 1))
+			to[j/2] |= v << ((j & 1) * 4)
+		}
+		r.Rows = append(r.Rows, to)
+	}
+	door := z.NewBloomFilter(float64(numCounters), 0.01)
+	r.DoorLocs = door.Locs()
+	r.Door = door.Bitset()
+	if len(r.Door) == len(s.Door) && r.DoorLocs == s.DoorLocs {
+		copy(r.Door, s.Door)
+	}
+	for key, cost := range s.Costs {
+		r.Costs[key] = cost
+	}
+	return r, nil
+}
+
+// state returns the current state of the policy. The caller must hold the
+// lock of the policy.
+func (p *defaultPolicy[V]) state() *PolicyState {
+	sketch := p.admit.freq
+	s := &PolicyState{
+		Counters:   sketch.mask + 1,
+		Increments: p.admit.incrs,
+		ResetAt:    p.admit.resetAt,
+		DoorLocs:   p.admit.door.Locs(),
+		Door:       append([]uint64(nil), p.admit.door.Bitset()...),
+		Costs:      make(map[uint64]int64, len(p.evict.keyCosts)),
+	}
+	for i := range sketch.rows {
+		s.Seeds = append(s.Seeds, sketch.seed[i])
+		s.Rows = append(s.Rows, append([]byte(nil), sketch.rows[i]...))
+	}
+	for key, cost := range p.evict.keyCosts {
+		s.Costs[key] = cost
+	}
+	return s
+}
+
+// restore replaces the sketch and doorkeeper of the policy by those of s. The
+// caller must hold the lock of the policy.
+func (p *defaultPolicy[V]) restore(s *PolicyState) error {
+	sketch := p.admit.freq
+	if s.Counters != sketch.mask+1 || len(s.Rows) != len(sketch.rows) {
+		return fmt.Errorf("policy state has %d rows of %d counters, want %d rows of %d",
+			len(s.Rows), s.Counters, len(sketch.rows), sketch.mask+1)
+	}
+	if len(s.Door) != len(p.admit.door.Bitset()) || s.DoorLocs != p.admit.door.Locs() {
+		return errors.New("policy state has a different doorkeeper size")
+	}
+	for i := range sketch.rows {
+		sketch.seed[i] = s.Seeds[i]
+		copy(sketch.rows[i], s.Rows[i])
+	}
+	copy(p.admit.door.Bitset(), s.Door)
+	p.admit.incrs = s.Increments
+	return nil
+}
+
+// ExportPolicy writes the state of the admission policy to w, in the format
+// read by ReadPolicyState. It's only supported by PolicyTinyLFU. The values
+// aren't exported, only the costs of their keys.
+func (c *Cache[K, V]) ExportPolicy(w io.Writer) error {
+	p, err := c.tinyLFU()
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	s := p.state()
+	p.Unlock()
+	_, err = s.WriteTo(w)
+	return err
+}
+
+// ImportPolicy reads a state written by ExportPolicy from r, and replaces the
+// access frequencies of the admission policy by the saved ones, so that the
+// cache admits the keys which were popular before. The cache must have the
+// same NumCounters as the exporting one. The saved costs aren't imported,
+// since the values of their keys aren't in the cache.
+func (c *Cache[K, V]) ImportPolicy(r io.Reader) error {
+	p, err := c.tinyLFU()
+	if err != nil {
+		return err
+	}
+	s, err := ReadPolicyState(r)
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.restore(s)
+}
+
+func (c *Cache[K, V]) tinyLFU() (*defaultPolicy[V], error) {
+	if c == nil || c.isClosed.Load() {
+		return nil, errors.New("cache is closed")
+	}
+	p, ok := c.cachePolicy.(*defaultPolicy[V])
+	if !ok {
+		return nil, errors.New("policy state is only supported by PolicyTinyLFU")
+	}
+	return p, nil
+}
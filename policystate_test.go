@@ -0,0 +1,195 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachePolicyExportImport(t *testing.T) {
+	config := &Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	}
+	c := newCacheT(t, config)
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	p := c.cachePolicy.(*defaultPolicy[int])
+	keyHash, _ := c.keyToHash(1)
+	p.Lock()
+	for i := 0; i < 5; i++ {
+		p.admit.Increment(keyHash)
+	}
+	want := p.admit.Estimate(keyHash)
+	p.Unlock()
+	require.Equal(t, int64(5), want)
+
+	var buf bytes.Buffer
+	require.NoError(t, c.ExportPolicy(&buf))
+	s, err := ReadPolicyState(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1024), s.Counters)
+	require.Len(t, s.Rows, cmDepth)
+	require.Len(t, s.Costs, 10)
+	require.Equal(t, int64(1), s.Costs[keyHash])
+
+	// Writing the state read back gives the same bytes.
+	var again bytes.Buffer
+	_, err = s.WriteTo(&again)
+	require.NoError(t, err)
+	require.Equal(t, buf.Bytes(), again.Bytes())
+
+	// The seeds are imported too, so the hashes of the keys keep their counts.
+	other := newCacheT(t, config)
+	other.keyToHash = c.keyToHash
+	require.NoError(t, other.ImportPolicy(bytes.NewReader(buf.Bytes())))
+	op := other.cachePolicy.(*defaultPolicy[int])
+	op.Lock()
+	require.Equal(t, want, op.admit.Estimate(keyHash))
+	require.Empty(t, op.evict.keyCosts)
+	op.Unlock()
+
+	small, err := NewCache(&Config[int, int]{NumCounters: 100, MaxCost: 10, BufferItems: 64})
+	require.NoError(t, err)
+	defer small.Close()
+	require.ErrorContains(t, small.ImportPolicy(bytes.NewReader(buf.Bytes())),
+		"policy state has 4 rows of 1024 counters, want 4 rows of 128")
+
+	lirs := newCacheT(t, &Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Policy:             PolicyLIRS,
+	})
+	require.EqualError(t, lirs.ExportPolicy(&buf), "policy state is only supported by PolicyTinyLFU")
+}
+
+func TestPolicyStateForwardCompatible(t *testing.T) {
+	s := &PolicyState{
+		Counters:   4,
+		Increments: 3,
+		ResetAt:    4,
+		Seeds:      []uint64{7},
+		Rows:       [][]byte{{0x21, 0x03}},
+		DoorLocs:   2,
+		Door:       []uint64{0xff},
+		Costs:      map[uint64]int64{1: 10, 2: 20},
+	}
+	var buf bytes.Buffer
+	_, err := s.WriteTo(&buf)
+	require.NoError(t, err)
+	data := buf.Bytes()
+
+	// A newer writer may add sections, and fields at the end of sections.
+	newer := append([]byte(nil), data[:8]...)
+	newer = appendPolicySection(newer, 200, []byte("future"))
+	sketch := binary.BigEndian.AppendUint64(nil, 4)
+	sketch = binary.BigEndian.AppendUint64(sketch, 3)
+	sketch = binary.BigEndian.AppendUint64(sketch, 4)
+	sketch = binary.BigEndian.AppendUint32(sketch, 1)
+	sketch = binary.BigEndian.AppendUint64(sketch, 7)
+	sketch = append(sketch, 0x21, 0x03)
+	sketch = append(sketch, "new field"...)
+	newer = appendPolicySection(newer, policyStateSketch, sketch)
+	// Skip the sketch section written by WriteTo.
+	n := binary.BigEndian.Uint64(data[9:])
+	newer = append(newer, data[8+9+n:]...)
+
+	got, err := ReadPolicyState(bytes.NewReader(newer))
+	require.NoError(t, err)
+	require.Equal(t, s, got)
+}
+
+func TestReadPolicyStateInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := (&PolicyState{Counters: 2, Seeds: []uint64{1}, Rows: [][]byte{{1}}}).WriteTo(&buf)
+	require.NoError(t, err)
+	data := buf.Bytes()
+
+	_, err = ReadPolicyState(bytes.NewReader([]byte("nope")))
+	require.EqualError(t, err, "not a policy state")
+
+	newer := append([]byte(nil), data...)
+	binary.BigEndian.PutUint16(newer[4:], policyStateVersion+1)
+	_, err = ReadPolicyState(bytes.NewReader(newer))
+	require.EqualError(t, err, "unsupported policy state version: 2")
+
+	for _, n := range []int{9, 20, len(data) - 1} {
+		_, err = ReadPolicyState(bytes.NewReader(data[:n]))
+		require.ErrorIs(t, err, errPolicyStateShort, "length %d", n)
+	}
+
+	// A section too short for its fields.
+	bad := appendPolicySection(append([]byte(nil), data[:8]...), policyStateDoor, []byte{0, 0, 0, 1})
+	_, err = ReadPolicyState(bytes.NewReader(bad))
+	require.ErrorIs(t, err, errPolicyStateShort)
+}
+
+func TestPolicyStateResize(t *testing.T) {
+	c := newCacheT(t, &Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	p := c.cachePolicy.(*defaultPolicy[int])
+	p.Lock()
+	for key := uint64(0); key < 500; key++ {
+		for i := uint64(0); i < key%8; i++ {
+			p.admit.Increment(key * 0x9E3779B97F4A7C15)
+		}
+	}
+	p.Unlock()
+	var buf bytes.Buffer
+	require.NoError(t, c.ExportPolicy(&buf))
+	s, err := ReadPolicyState(&buf)
+	require.NoError(t, err)
+
+	for _, numCounters := range []int64{100, 1000, 4000} {
+		resized, err := s.Resize(numCounters)
+		require.NoError(t, err)
+		buf.Reset()
+		_, err = resized.WriteTo(&buf)
+		require.NoError(t, err)
+
+		other, err := NewCache(&Config[int, int]{
+			NumCounters: numCounters,
+			MaxCost:     100,
+			BufferItems: 64,
+		})
+		require.NoError(t, err)
+		require.NoError(t, other.ImportPolicy(&buf))
+		op := other.cachePolicy.(*defaultPolicy[int])
+		// The estimates of the sketch can only grow, and don't change when
+		// growing it.
+		for key := uint64(0); key < 500; key++ {
+			hash := key * 0x9E3779B97F4A7C15
+			want := p.admit.freq.Estimate(hash)
+			if numCounters < 1000 {
+				require.GreaterOrEqual(t, op.admit.freq.Estimate(hash), want)
+			} else {
+				require.Equal(t, want, op.admit.freq.Estimate(hash))
+			}
+		}
+		require.Len(t, resized.Costs, len(s.Costs))
+		require.Equal(t, numCounters, resized.ResetAt)
+		other.Close()
+	}
+
+	_, err = s.Resize(0)
+	require.EqualError(t, err, "NumCounters can't be zero")
+	_, err = (&PolicyState{Counters: 3}).Resize(10)
+	require.EqualError(t, err, "policy state has an invalid number of counters: 3")
+}
@@ -0,0 +1,203 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// probePhase is how long each of the 4 phases of Probe runs.
+	probePhase = 25 * time.Millisecond
+	// probeKeys is the number of distinct keys used by Probe.
+	probeKeys = 1 << 12
+
+	// Latencies above these are reported as warnings by Probe. They are an
+	// order of magnitude above what a modern server achieves.
+	probeSlowHash   = time.Microsecond
+	probeSlowStore  = 5 * time.Microsecond
+	probeSlowPolicy = 20 * time.Microsecond
+)
+
+// ProbeReport is the outcome of Probe. Latencies are averaged over all the
+// operations of a phase.
+type ProbeReport struct {
+	// HashLatency is the time it takes to hash a key with Config.KeyToHash.
+	HashLatency time.Duration
+	// StoreSetLatency and StoreGetLatency are the times it takes to write and
+	// read an item in the internal hashmap.
+	StoreSetLatency time.Duration
+	StoreGetLatency time.Duration
+	// PolicyAddLatency is the time it takes for the policy to decide on the
+	// admission of a new item, evictions included.
+	PolicyAddLatency time.Duration
+	// Warnings describes the suspicious settings and measurements. It's empty
+	// if everything looks right.
+	Warnings []string
+}
+
+func (r *ProbeReport) String() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "hash: %s store-set: %s store-get: %s policy-add: %s",
+		r.HashLatency, r.StoreSetLatency, r.StoreGetLatency, r.PolicyAddLatency)
+	for _, w := range r.Warnings {
+		buf.WriteString("\nwarning: ")
+		buf.WriteString(w)
+	}
+	return buf.String()
+}
+
+// Probe checks config and runs a 100ms micro-benchmark of the building blocks
+// of a cache created with it: key hashing, the internal hashmap and the
+// policy. It's meant to be called at startup, so that services can detect
+// pathological configurations or slow hosts before taking traffic. Probe
+// doesn't modify config, and returns the same errors as NewCache for invalid
+// configurations.
+//
+// The probe cache only takes the settings of config which size it and pick its
+// hashing and its policy, so that it has no side effects: it doesn't write to
+// MmapStorePath, and the only user function it calls is KeyToHash, which it
+// measures. In particular, the custom Admission isn't measured.
+func Probe[K Key, V any](config *Config[K, V]) (*ProbeReport, error) {
+	if config == nil {
+		return nil, errors.New("Config can't be nil")
+	}
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	cfg := Config[K, V]{
+		NumCounters:        config.NumCounters,
+		MaxCost:            config.MaxCost,
+		BufferItems:        config.BufferItems,
+		MaxBufferItems:     config.MaxBufferItems,
+		IgnoreInternalCost: config.IgnoreInternalCost,
+		KeyToHash:          config.KeyToHash,
+		ScrambleKeys:       config.ScrambleKeys,
+		KeyHashSeed:        config.KeyHashSeed,
+		Policy:             config.Policy,
+		GhostListSize:      config.GhostListSize,
+		RetryAdmitWindow:   config.RetryAdmitWindow,
+		SampleHotGets:      config.SampleHotGets,
+		ReplicateHotKeys:   config.ReplicateHotKeys,
+	}
+	c, err := NewCache(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	r := &ProbeReport{Warnings: probeConfig(config)}
+	keys := make([]K, probeKeys)
+	for i := range keys {
+		keys[i] = probeKey[K](i)
+	}
+	hashes := make([]uint64, probeKeys)
+	conflicts := make([]uint64, probeKeys)
+
+	r.HashLatency = probeRun(func(i int) {
+		hashes[i], conflicts[i] = c.keyToHash(keys[i])
+	})
+	r.StoreSetLatency = probeRun(func(i int) {
+		c.storedItems.Set(&Item[V]{Key: hashes[i], Conflict: conflicts[i], Cost: 1})
+	})
+	r.StoreGetLatency = probeRun(func(i int) {
+		c.storedItems.Get(hashes[i], conflicts[i])
+	})
+	// Start from an empty policy, so that it has to both admit and evict.
+	c.cachePolicy.Clear()
+	cost := int64(1)
+	if !cfg.IgnoreInternalCost {
+		cost += itemSize
+	}
+	r.PolicyAddLatency = probeRun(func(i int) {
+		c.cachePolicy.Add(hashes[i], cost)
+	})
+
+	if r.HashLatency > probeSlowHash {
+		r.Warnings = append(r.Warnings, fmt.Sprintf(
+			"hashing a key takes %s, check KeyToHash or the host", r.HashLatency))
+	}
+	if r.StoreSetLatency > probeSlowStore || r.StoreGetLatency > probeSlowStore {
+		r.Warnings = append(r.Warnings, fmt.Sprintf(
+			"hashmap operations take %s (set) and %s (get), the host looks slow",
+			r.StoreSetLatency, r.StoreGetLatency))
+	}
+	if r.PolicyAddLatency > probeSlowPolicy {
+		r.Warnings = append(r.Warnings, fmt.Sprintf(
+			"policy decisions take %s, check NumCounters and Policy", r.PolicyAddLatency))
+	}
+	return r, nil
+}
+
+// probeConfig returns the warnings about the settings of a valid config.
+func probeConfig[K Key, V any](config *Config[K, V]) []string {
+	var warnings []string
+	maxItems := config.MaxCost
+	if !config.IgnoreInternalCost {
+		if config.MaxCost < itemSize {
+			warnings = append(warnings, fmt.Sprintf(
+				"MaxCost (%d) is lower than the internal cost of a single item (%d), "+
+					"nothing will be admitted unless IgnoreInternalCost is set",
+				config.MaxCost, itemSize))
+		}
+		maxItems /= itemSize
+	}
+	if config.NumCounters < maxItems {
+		warnings = append(warnings, fmt.Sprintf(
+			"NumCounters (%d) is lower than the number of items of cost 1 the cache "+
+				"can hold (%d), it should be about 10x the number of items when full",
+			config.NumCounters, maxItems))
+	}
+	if config.BufferItems != 64 {
+		warnings = append(warnings, fmt.Sprintf(
+			"BufferItems is %d, 64 works well in most cases", config.BufferItems))
+	}
+	return warnings
+}
+
+// probeRun calls f with increasing indexes, wrapping around probeKeys, for
+// probePhase and returns the average time of a call.
+func probeRun(f func(i int)) time.Duration {
+	var ops int
+	start := time.Now()
+	for time.Since(start) < probePhase {
+		// Check the time every batch of calls only, to keep its cost out of the
+		// measurement.
+		for j := 0; j < 256; j++ {
+			f(ops % probeKeys)
+			ops++
+		}
+	}
+	return time.Since(start) / time.Duration(ops)
+}
+
+// probeKey returns a distinct key for every i, for any kind of Key.
+func probeKey[K Key](i int) K {
+	var key K
+	switch any(key).(type) {
+	case string:
+		return any("probe-key-" + strconv.Itoa(i)).(K)
+	case []byte:
+		return any([]byte("probe-key-" + strconv.Itoa(i))).(K)
+	case uint64:
+		return any(uint64(i)).(K)
+	case byte:
+		return any(byte(i)).(K)
+	case int:
+		return any(i).(K)
+	case int32:
+		return any(int32(i)).(K)
+	case uint32:
+		return any(uint32(i)).(K)
+	case int64:
+		return any(int64(i)).(K)
+	}
+	return key
+}
@@ -0,0 +1,150 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbe(t *testing.T) {
+	var evicted int
+	config := &Config[string, int]{
+		NumCounters: 1e4,
+		MaxCost:     1e6,
+		BufferItems: 64,
+		OnEvict:     func(*Item[int]) { evicted++ },
+	}
+	r, err := Probe(config)
+	require.NoError(t, err)
+	require.Greater(t, r.StoreSetLatency, time.Duration(0))
+	require.Greater(t, r.StoreGetLatency, time.Duration(0))
+	require.Greater(t, r.PolicyAddLatency, time.Duration(0))
+	require.True(t, strings.HasPrefix(r.String(), "hash: "))
+	require.Zero(t, evicted)
+	// Defaults aren't applied to the given config.
+	require.Zero(t, config.TtlTickerDurationInSec)
+}
+
+// probeAdmission is an Admission counting its calls.
+type probeAdmission struct {
+	calls *atomic.Int64
+}
+
+func (a probeAdmission) Admit(uint64, int64, []Victim) bool {
+	a.calls.Add(1)
+	return true
+}
+
+func TestProbeCallbacks(t *testing.T) {
+	var calls atomic.Int64
+	call := func() { calls.Add(1) }
+	config := &Config[string, int]{
+		NumCounters:      1e4,
+		MaxCost:          1e3,
+		BufferItems:      64,
+		Metrics:          true,
+		OnEvict:          func(*Item[int]) { call() },
+		OnReject:         func(*Item[int]) { call() },
+		OnExit:           func(int) { call() },
+		OnRemoval:        func(*Item[int]) { call() },
+		ShouldUpdate:     func(int, int) bool { call(); return true },
+		Cost:             func(int) int64 { call(); return 1 },
+		TTLGroup:         func(string, int) string { call(); return "group" },
+		TTLPolicies:      map[string]TTLPolicy{"group": {Default: time.Hour}},
+		OnTrace:          func(TraceOp, uint64, int64, bool) { call() },
+		InspectValue:     func(int) bool { call(); return true },
+		Admission:        probeAdmission{&calls},
+		OrderedCallbacks: true,
+	}
+	_, err := Probe(config)
+	require.NoError(t, err)
+	require.Zero(t, calls.Load(), "Probe calls no user callback")
+}
+
+func TestProbeMmapStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	config := &Config[string, []byte]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		MmapStorePath:      path,
+	}
+	c := newCacheT(t, config)
+	require.True(t, c.Set("key", []byte("value"), 1))
+	c.Wait()
+	c.Close()
+
+	_, err := Probe(config)
+	require.NoError(t, err)
+
+	c = newCacheT(t, config)
+	var items int
+	c.Range(func(key, conflict uint64, value []byte) bool {
+		items++
+		return true
+	})
+	require.Equal(t, 1, items, "the probe doesn't write to the store file")
+}
+
+func TestProbeWarnings(t *testing.T) {
+	// Latency warnings depend on the host, only check the config ones.
+	warnings := probeConfig(&Config[uint64, int]{
+		NumCounters: 10,
+		MaxCost:     10,
+		BufferItems: 1,
+	})
+	require.Len(t, warnings, 2)
+	require.Contains(t, warnings[0], "MaxCost (10) is lower than the internal cost")
+	require.Contains(t, warnings[1], "BufferItems is 1")
+
+	warnings = probeConfig(&Config[uint64, int]{
+		NumCounters:        10,
+		MaxCost:            1e6,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.Len(t, warnings, 1)
+	require.Contains(t, warnings[0], "NumCounters (10) is lower")
+
+	r, err := Probe(&Config[uint64, int]{
+		NumCounters:        10,
+		MaxCost:            1e6,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	require.Contains(t, r.String(), "\nwarning: NumCounters (10) is lower")
+}
+
+func TestProbeInvalidConfig(t *testing.T) {
+	_, err := Probe[int, int](nil)
+	require.Error(t, err)
+	_, err = Probe(&Config[int, int]{MaxCost: 10, BufferItems: 64})
+	require.EqualError(t, err, "NumCounters can't be zero")
+	_, err = Probe(&Config[int, int]{
+		NumCounters: 100, MaxCost: 10, BufferItems: 64, DefaultTTL: -1,
+	})
+	require.EqualError(t, err, "DefaultTTL can't be negative number",
+		"the settings the probe cache doesn't take are checked too")
+}
+
+func TestProbeKey(t *testing.T) {
+	require.Equal(t, "probe-key-7", probeKey[string](7))
+	require.Equal(t, []byte("probe-key-7"), probeKey[[]byte](7))
+	require.Equal(t, uint64(7), probeKey[uint64](7))
+	require.Equal(t, byte(7), probeKey[byte](7))
+	require.Equal(t, 7, probeKey[int](7))
+	require.Equal(t, int32(7), probeKey[int32](7))
+	require.Equal(t, uint32(7), probeKey[uint32](7))
+	require.Equal(t, int64(7), probeKey[int64](7))
+}
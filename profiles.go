@@ -0,0 +1,72 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+// The average costs of the values the profiles are tuned for, in bytes, which
+// set their NumCounters.
+const (
+	smallObjectCost   = 128
+	largeBlobCost     = 64 << 10
+	scanResistantCost = 1 << 10
+	// profileCountersPerItem is the number of counters per item of the
+	// profiles, as recommended for NumCounters.
+	profileCountersPerItem = 10
+	// profileMinCounters keeps the frequency sketch of the small caches from
+	// being saturated.
+	profileMinCounters = 1 << 10
+)
+
+// profileCounters returns the NumCounters of a cache of maxCost holding values
+// costing cost on average.
+func profileCounters(maxCost, cost int64) int64 {
+	return max(profileMinCounters, profileCountersPerItem*(maxCost/cost))
+}
+
+// ProfileSmallObjects returns a Config for a cache of up to maxCost bytes of
+// many small values, of about a hundred bytes, like sessions or rows, read far
+// more often than written. The Get buffers adapt to contention, up to four
+// times their default size, and the internal cost of the items is counted, as
+// it's significant next to such values. The Config can be changed before it's
+// passed to NewCache, e.g. to set NumCounters for values of another size.
+func ProfileSmallObjects[K Key, V any](maxCost int64) *Config[K, V] {
+	return &Config[K, V]{
+		NumCounters:            profileCounters(maxCost, smallObjectCost),
+		MaxCost:                maxCost,
+		BufferItems:            64,
+		MaxBufferItems:         256,
+		TtlTickerDurationInSec: bucketDurationSecs,
+	}
+}
+
+// ProfileLargeBlobs returns a Config for a cache of up to maxCost bytes of
+// large values, of tens of kilobytes or more, like images or rendered pages.
+// Their internal cost is ignored, as it's negligible next to them, and the
+// expired items are cleaned up every second, so that their memory is given
+// back promptly. The Config can be changed before it's passed to NewCache.
+func ProfileLargeBlobs[K Key, V any](maxCost int64) *Config[K, V] {
+	return &Config[K, V]{
+		NumCounters:            profileCounters(maxCost, largeBlobCost),
+		MaxCost:                maxCost,
+		BufferItems:            64,
+		IgnoreInternalCost:     true,
+		TtlTickerDurationInSec: 1,
+	}
+}
+
+// ProfileScanResistant returns a Config for a cache of up to maxCost bytes of
+// values of about a kilobyte, whose workload mixes a hot working set with
+// scans: batch jobs, or range reads, which read many keys once. It uses
+// PolicyS3FIFO, whose small queue keeps the keys read once from evicting the
+// main one. The Config can be changed before it's passed to NewCache.
+func ProfileScanResistant[K Key, V any](maxCost int64) *Config[K, V] {
+	return &Config[K, V]{
+		NumCounters:            profileCounters(maxCost, scanResistantCost),
+		MaxCost:                maxCost,
+		BufferItems:            64,
+		TtlTickerDurationInSec: bucketDurationSecs,
+		Policy:                 PolicyS3FIFO,
+	}
+}
@@ -0,0 +1,45 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfiles(t *testing.T) {
+	for _, config := range []*Config[string, []byte]{
+		ProfileSmallObjects[string, []byte](1 << 30),
+		ProfileLargeBlobs[string, []byte](1 << 30),
+		ProfileScanResistant[string, []byte](1 << 30),
+	} {
+		require.Equal(t, int64(1<<30), config.MaxCost)
+		c, err := NewCache(config)
+		require.NoError(t, err)
+		require.True(t, c.Set("key", []byte("value"), 5))
+		c.Wait()
+		val, ok := c.Get("key")
+		require.True(t, ok)
+		require.Equal(t, []byte("value"), val)
+		c.Close()
+	}
+
+	config := ProfileSmallObjects[int, int](1 << 20)
+	require.Equal(t, int64(10*(1<<20)/smallObjectCost), config.NumCounters)
+	require.Equal(t, int64(64), config.BufferItems)
+	require.Equal(t, PolicyS3FIFO, ProfileScanResistant[int, int](1<<20).Policy)
+	// The small caches still get enough counters.
+	require.Equal(t, int64(profileMinCounters), ProfileLargeBlobs[int, int](1<<20).NumCounters)
+
+	// The profiles can be overridden.
+	config.NumCounters = 100
+	config.Metrics = true
+	c, err := NewCache(config)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NotNil(t, c.Metrics)
+}
@@ -0,0 +1,238 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+const (
+	// snapshotVersion is the version of the manifest written by SnapshotAll.
+	snapshotVersion = 1
+	// snapshotManifest and snapshotComplete are the names of the manifest and
+	// of the completion marker of a snapshot, in its directory.
+	snapshotManifest = "MANIFEST.json"
+	snapshotComplete = "COMPLETE"
+	// snapshotExt is the extension of the policy states of the caches.
+	snapshotExt = ".policy"
+)
+
+// Snapshotter is what a Registry needs from a cache, which *Cache implements.
+type Snapshotter interface {
+	SetReadOnly(readOnly bool)
+	ReadOnly() bool
+	Wait()
+	ExportPolicy(w io.Writer) error
+	ImportPolicy(r io.Reader) error
+}
+
+// Registry snapshots and restores the warm state of several caches together,
+// i.e. the access frequencies of their policies (see Cache.ExportPolicy), for
+// services with several caches which must be restored in a mutually
+// consistent state. The zero value is an empty Registry.
+type Registry struct {
+	mu     sync.Mutex
+	caches map[string]Snapshotter
+}
+
+// Register adds c to the registry under name, which names its file in the
+// snapshots, so it must be a valid file name. Registering an already used name
+// is an error.
+func (r *Registry) Register(name string, c Snapshotter) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid cache name: %q", name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.caches[name]; ok {
+		return fmt.Errorf("cache %q is already registered", name)
+	}
+	if r.caches == nil {
+		r.caches = make(map[string]Snapshotter)
+	}
+	r.caches[name] = c
+	return nil
+}
+
+// Unregister removes the cache registered under name, if any.
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.caches, name)
+}
+
+// snapshotManifestState is the manifest of a snapshot.
+type snapshotManifestState struct {
+	Version int                  `json:"version"`
+	Time    time.Time            `json:"time"`
+	Caches  []snapshotCacheState `json:"caches"`
+}
+
+// snapshotCacheState describes the file of a cache in a snapshot.
+type snapshotCacheState struct {
+	Name  string `json:"name"`
+	Size  int    `json:"size"`
+	CRC32 uint32 `json:"crc32"`
+}
+
+// SnapshotAll writes the policy states of all the registered caches to dir,
+// which is created if needed, along with a manifest, and finally a completion
+// marker: RestoreAll only reads snapshots which were completed, so a crash in
+// the middle of SnapshotAll leaves no half-written snapshot behind, even when
+// overwriting a previous one.
+//
+// The states of all the caches are taken at the same point: the caches are
+// made read-only (see Cache.SetReadOnly) and their buffered writes applied,
+// then their states are exported in memory, after which the caches are made
+// writable again, unless they were read-only already, before the files are
+// written. The writes made to them meanwhile are dropped, and counted by
+// Metrics.ReadOnlyRejections.
+func (r *Registry) SnapshotAll(dir string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("while creating %s: %w", dir, err)
+	}
+	marker := filepath.Join(dir, snapshotComplete)
+	if err := os.Remove(marker); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("while removing %s: %w", marker, err)
+	}
+
+	names := make([]string, 0, len(r.caches))
+	for name := range r.caches {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	states, err := r.export(names)
+	if err != nil {
+		return err
+	}
+
+	manifest := snapshotManifestState{Version: snapshotVersion, Time: time.Now().UTC()}
+	for i, name := range names {
+		if err := z.WriteFileAtomic(filepath.Join(dir, name+snapshotExt), states[i], 0o644); err != nil {
+			return err
+		}
+		manifest.Caches = append(manifest.Caches, snapshotCacheState{
+			Name:  name,
+			Size:  len(states[i]),
+			CRC32: crc32.ChecksumIEEE(states[i]),
+		})
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("while encoding the manifest: %w", err)
+	}
+	if err := z.WriteFileAtomic(filepath.Join(dir, snapshotManifest), data, 0o644); err != nil {
+		return err
+	}
+	// The marker holds the checksum of the manifest, so that it can't be
+	// mistaken for the marker of another snapshot.
+	return z.WriteFileAtomic(marker, binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(data)), 0o644)
+}
+
+// export returns the policy states of the caches of names, taken while all of
+// them are read-only. The caches are then left read-only or writable, as they
+// were.
+func (r *Registry) export(names []string) ([][]byte, error) {
+	readOnly := make([]bool, len(names))
+	for i, name := range names {
+		readOnly[i] = r.caches[name].ReadOnly()
+		r.caches[name].SetReadOnly(true)
+	}
+	defer func() {
+		for i, name := range names {
+			r.caches[name].SetReadOnly(readOnly[i])
+		}
+	}()
+	for _, name := range names {
+		r.caches[name].Wait()
+	}
+	states := make([][]byte, len(names))
+	for i, name := range names {
+		var buf bytes.Buffer
+		if err := r.caches[name].ExportPolicy(&buf); err != nil {
+			return nil, fmt.Errorf("while exporting cache %q: %w", name, err)
+		}
+		states[i] = buf.Bytes()
+	}
+	return states, nil
+}
+
+// RestoreAll imports the policy states of the registered caches from the
+// snapshot written by SnapshotAll to dir. All the files are read and checked
+// before any is imported, so that none is restored if the snapshot is
+// incomplete or corrupted. A cache can still reject its state, e.g. if its
+// NumCounters changed, in which case the caches before it are restored. The
+// registered caches which aren't in the snapshot, and the caches in the
+// snapshot which aren't registered, are left out.
+func (r *Registry) RestoreAll(dir string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	marker, err := os.ReadFile(filepath.Join(dir, snapshotComplete))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("snapshot in %s is incomplete", dir)
+	}
+	if err != nil {
+		return fmt.Errorf("while reading the snapshot marker: %w", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, snapshotManifest))
+	if err != nil {
+		return fmt.Errorf("while reading the snapshot manifest: %w", err)
+	}
+	if len(marker) != 4 || binary.BigEndian.Uint32(marker) != crc32.ChecksumIEEE(data) {
+		return fmt.Errorf("snapshot manifest in %s doesn't match its marker", dir)
+	}
+	var manifest snapshotManifestState
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("while decoding the snapshot manifest: %w", err)
+	}
+	if manifest.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version: %d", manifest.Version)
+	}
+
+	states := make(map[string][]byte)
+	for _, cache := range manifest.Caches {
+		if _, ok := r.caches[cache.Name]; !ok {
+			continue
+		}
+		state, err := os.ReadFile(filepath.Join(dir, cache.Name+snapshotExt))
+		if err != nil {
+			return fmt.Errorf("while reading cache %q: %w", cache.Name, err)
+		}
+		if len(state) != cache.Size || crc32.ChecksumIEEE(state) != cache.CRC32 {
+			return fmt.Errorf("snapshot of cache %q is corrupted", cache.Name)
+		}
+		if _, err := ReadPolicyState(bytes.NewReader(state)); err != nil {
+			return fmt.Errorf("while reading cache %q: %w", cache.Name, err)
+		}
+		states[cache.Name] = state
+	}
+	for _, cache := range manifest.Caches {
+		state, ok := states[cache.Name]
+		if !ok {
+			continue
+		}
+		if err := r.caches[cache.Name].ImportPolicy(bytes.NewReader(state)); err != nil {
+			return fmt.Errorf("while importing cache %q: %w", cache.Name, err)
+		}
+	}
+	return nil
+}
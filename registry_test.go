@@ -0,0 +1,107 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// accessPolicy records n accesses to key in the policy of c, and returns its
+// access frequency.
+func accessPolicy(c *Cache[int, int], key int, n int) int64 {
+	keyHash, _ := c.keyToHash(key)
+	p := c.cachePolicy.(*defaultPolicy[int])
+	p.Lock()
+	defer p.Unlock()
+	for i := 0; i < n; i++ {
+		p.admit.Increment(keyHash)
+	}
+	return p.admit.Estimate(keyHash)
+}
+
+func TestRegistrySnapshotAll(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	}
+	a, b := newCacheT(t, config), newCacheT(t, config)
+	var r Registry
+	require.NoError(t, r.Register("a", a))
+	require.NoError(t, r.Register("b", b))
+	require.EqualError(t, r.Register("a", a), `cache "a" is already registered`)
+	for _, name := range []string{"", ".", "..", "x/y"} {
+		require.Error(t, r.Register(name, a))
+	}
+
+	require.Equal(t, int64(3), accessPolicy(a, 1, 3))
+	require.Equal(t, int64(6), accessPolicy(b, 2, 6))
+	require.NoError(t, r.SnapshotAll(dir))
+	require.FileExists(t, filepath.Join(dir, "MANIFEST.json"))
+	require.FileExists(t, filepath.Join(dir, "COMPLETE"))
+	// The caches are writable again.
+	require.True(t, a.Set(1, 1, 1))
+
+	// Restore into new caches, one of them missing from the snapshot.
+	a2, b2, c2 := newCacheT(t, config), newCacheT(t, config),
+		newCacheT(t, config)
+	var r2 Registry
+	require.NoError(t, r2.Register("a", a2))
+	require.NoError(t, r2.Register("b", b2))
+	require.NoError(t, r2.Register("c", c2))
+	require.NoError(t, r2.RestoreAll(dir))
+	require.Equal(t, int64(3), accessPolicy(a2, 1, 0))
+	require.Equal(t, int64(6), accessPolicy(b2, 2, 0))
+
+	// A corrupted file fails the whole restore, before anything is imported.
+	r2.Unregister("c")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.policy"), []byte("RSPS"), 0o644))
+	a3 := newCacheT(t, config)
+	var r3 Registry
+	require.NoError(t, r3.Register("a", a3))
+	require.NoError(t, r3.Register("b", newCacheT(t, config)))
+	require.EqualError(t, r3.RestoreAll(dir), `snapshot of cache "b" is corrupted`)
+	require.Zero(t, accessPolicy(a3, 1, 0))
+
+	// So does an incomplete snapshot.
+	require.NoError(t, os.Remove(filepath.Join(dir, "COMPLETE")))
+	require.EqualError(t, r3.RestoreAll(dir), "snapshot in "+dir+" is incomplete")
+
+	// Only TinyLFU policies can be snapshotted.
+	var r4 Registry
+	require.NoError(t, r4.Register("s3", newCacheT(t, &Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Policy:             PolicyS3FIFO,
+	})))
+	require.Error(t, r4.SnapshotAll(t.TempDir()))
+}
+
+func TestRegistrySnapshotAllReadOnly(t *testing.T) {
+	config := &Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	}
+	writable, readOnly := newCacheT(t, config), newCacheT(t, config)
+	readOnly.SetReadOnly(true)
+	var r Registry
+	require.NoError(t, r.Register("writable", writable))
+	require.NoError(t, r.Register("read-only", readOnly))
+	require.NoError(t, r.SnapshotAll(t.TempDir()))
+	require.False(t, writable.ReadOnly())
+	require.True(t, readOnly.ReadOnly(), "a read-only cache stays read-only")
+	require.False(t, readOnly.Set(1, 1, 1))
+}
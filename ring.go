@@ -6,7 +6,9 @@
 package ristretto
 
 import (
+	"runtime"
 	"sync"
+	"sync/atomic"
 )
 
 // ringConsumer is the user-defined object responsible for receiving and
@@ -15,29 +17,43 @@ type ringConsumer interface {
 	Push([]uint64) bool
 }
 
-// ringStripe is a singular ring buffer that is not concurrent safe.
+// ringStripe is a singular ring buffer. It's only used by one goroutine at a
+// time, but its lock lets ringBuffer.Flush drain it meanwhile.
 type ringStripe struct {
-	cons ringConsumer
-	data []uint64
-	capa int
+	mu    sync.Mutex
+	cons  ringConsumer
+	sizer *ringSizer
+	data  []uint64
+	capa  int
 }
 
-func newRingStripe(cons ringConsumer, capa int64) *ringStripe {
+func newRingStripe(cons ringConsumer, sizer *ringSizer, capa int64) *ringStripe {
+	if sizer != nil {
+		capa = sizer.size.Load()
+	}
 	return &ringStripe{
-		cons: cons,
-		data: make([]uint64, 0, capa),
-		capa: int(capa),
+		cons:  cons,
+		sizer: sizer,
+		data:  make([]uint64, 0, capa),
+		capa:  int(capa),
 	}
 }
 
 // Push appends an item in the ring buffer and drains (copies items and
 // sends to Consumer) if full.
 func (s *ringStripe) Push(item uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.data = append(s.data, item)
 	// Decide if the ring buffer should be drained.
 	if len(s.data) >= s.capa {
 		// Send elements to consumer and create a new ring stripe.
-		if s.cons.Push(s.data) {
+		kept := s.cons.Push(s.data)
+		if s.sizer != nil {
+			s.sizer.record(!kept)
+			s.capa = int(s.sizer.size.Load())
+		}
+		if kept || cap(s.data) != s.capa {
 			s.data = make([]uint64, 0, s.capa)
 		} else {
 			s.data = s.data[:0]
@@ -45,6 +61,23 @@ func (s *ringStripe) Push(item uint64) {
 	}
 }
 
+// flush passes the items of s to push, and empties it.
+func (s *ringStripe) flush(push func([]uint64)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.data) == 0 {
+		return
+	}
+	push(s.data)
+	s.data = make([]uint64, 0, s.capa)
+}
+
+// ringHandle is what the pool of a ringBuffer holds, rather than the stripes
+// themselves, so that the stripes can be tracked until the pool drops them.
+type ringHandle struct {
+	*ringStripe
+}
+
 // ringBuffer stores multiple buffers (stripes) and distributes Pushed items
 // between them to lower contention.
 //
@@ -52,6 +85,14 @@ func (s *ringStripe) Push(item uint64) {
 // (section III part A).
 type ringBuffer struct {
 	pool *sync.Pool
+	capa int64
+	// sizer adapts the capacity of the stripes, it's nil if it's fixed.
+	sizer *ringSizer
+
+	// stripes holds the stripes of the handles in the pool, or in use, for
+	// Flush.
+	mu      sync.Mutex
+	stripes map[*ringStripe]struct{}
 }
 
 // newRingBuffer returns a striped ring buffer. The Consumer in ringConfig will
@@ -63,18 +104,135 @@ func newRingBuffer(cons ringConsumer, capa int64) *ringBuffer {
 	// percentage of elements lost. The performance primarily comes from
 	// low-level runtime functions used in the standard library that aren't
 	// available to us (such as runtime_procPin()).
-	return &ringBuffer{
-		pool: &sync.Pool{
-			New: func() interface{} { return newRingStripe(cons, capa) },
+	return newRingBufferSizer(cons, capa, nil)
+}
+
+// newAdaptiveRingBuffer returns a striped ring buffer whose stripes hold from
+// minCapa to maxCapa items, see ringSizer.
+func newAdaptiveRingBuffer(cons ringConsumer, minCapa, maxCapa int64) *ringBuffer {
+	return newRingBufferSizer(cons, minCapa, newRingSizer(minCapa, maxCapa))
+}
+
+func newRingBufferSizer(cons ringConsumer, capa int64, sizer *ringSizer) *ringBuffer {
+	b := &ringBuffer{
+		capa:    capa,
+		sizer:   sizer,
+		stripes: make(map[*ringStripe]struct{}),
+	}
+	b.pool = &sync.Pool{
+		New: func() interface{} {
+			h := &ringHandle{newRingStripe(cons, sizer, capa)}
+			b.mu.Lock()
+			b.stripes[h.ringStripe] = struct{}{}
+			b.mu.Unlock()
+			// Once the pool drops the handle, its stripe is forgotten, along
+			// with its items, as before Flush.
+			runtime.SetFinalizer(h, func(h *ringHandle) {
+				b.mu.Lock()
+				delete(b.stripes, h.ringStripe)
+				b.mu.Unlock()
+			})
+			return h
 		},
 	}
+	return b
 }
 
 // Push adds an element to one of the internal stripes and possibly drains if
 // the stripe becomes full.
 func (b *ringBuffer) Push(item uint64) {
 	// Reuse or create a new stripe.
-	stripe := b.pool.Get().(*ringStripe)
-	stripe.Push(item)
-	b.pool.Put(stripe)
+	h := b.pool.Get().(*ringHandle)
+	h.Push(item)
+	b.pool.Put(h)
+}
+
+// Flush passes the items of all the stripes which aren't full yet to push,
+// rather than to the consumer, which may drop them, and empties them.
+func (b *ringBuffer) Flush(push func([]uint64)) {
+	b.mu.Lock()
+	stripes := make([]*ringStripe, 0, len(b.stripes))
+	for s := range b.stripes {
+		stripes = append(stripes, s)
+	}
+	b.mu.Unlock()
+	for _, s := range stripes {
+		s.flush(push)
+	}
+}
+
+// Capacity returns the current number of items the stripes hold before being
+// drained.
+func (b *ringBuffer) Capacity() int64 {
+	if b.sizer == nil {
+		return b.capa
+	}
+	return b.sizer.size.Load()
+}
+
+const (
+	// ringSizerWindow is the number of drains after which a ringSizer decides
+	// whether to resize the stripes.
+	ringSizerWindow = 64
+	// ringGrowDropRate is the rate of dropped drains over a window above which
+	// the stripes are grown.
+	ringGrowDropRate = 0.01
+	// ringShrinkWindows is the number of consecutive windows without drops
+	// after which the stripes are shrunk.
+	ringShrinkWindows = 16
+)
+
+// ringSizer adapts the capacity of the stripes of a ringBuffer to the rate of
+// their drains dropped by the consumer. The drops mean the consumer is pushed
+// more batches than it keeps up with, so the stripes are doubled, for fewer
+// larger batches. Once no batch is dropped for ringShrinkWindows windows, the
+// stripes are halved, so the accesses reach the consumer sooner. The stripes
+// pick up the new capacity as they drain.
+type ringSizer struct {
+	minCapa, maxCapa int64
+	size             atomic.Int64
+	drains, drops    atomic.Int64
+
+	mu    sync.Mutex
+	quiet int // windows without drops in a row
+}
+
+func newRingSizer(minCapa, maxCapa int64) *ringSizer {
+	s := &ringSizer{minCapa: minCapa, maxCapa: maxCapa}
+	s.size.Store(minCapa)
+	return s
+}
+
+// record records a drain of a stripe, and resizes the stripes if it ends a
+// window.
+func (s *ringSizer) record(dropped bool) {
+	if dropped {
+		s.drops.Add(1)
+	}
+	if s.drains.Add(1) < ringSizerWindow {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Another drain may have ended the window already.
+	drains := s.drains.Load()
+	if drains < ringSizerWindow {
+		return
+	}
+	s.drains.Store(0)
+	drops := s.drops.Swap(0)
+	size := s.size.Load()
+	switch {
+	case float64(drops) > ringGrowDropRate*float64(drains):
+		s.quiet = 0
+		s.size.Store(min(s.maxCapa, 2*size))
+	case drops == 0:
+		s.quiet++
+		if s.quiet >= ringShrinkWindows {
+			s.quiet = 0
+			s.size.Store(max(s.minCapa, size/2))
+		}
+	default:
+		s.quiet = 0
+	}
 }
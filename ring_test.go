@@ -73,3 +73,71 @@ func TestRingConsumer(t *testing.T) {
 	require.NotEqual(t, 0, l)
 	require.True(t, l <= 100)
 }
+
+func TestRingFlush(t *testing.T) {
+	drains := 0
+	r := newRingBuffer(&testConsumer{
+		push: func(items []uint64) {
+			drains++
+		},
+		save: true,
+	}, 64)
+	for i := 0; i < 10; i++ {
+		r.Push(uint64(i))
+	}
+	require.Zero(t, drains)
+	var flushed []uint64
+	push := func(items []uint64) { flushed = append(flushed, items...) }
+	r.Flush(push)
+	require.ElementsMatch(t, []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, flushed)
+	flushed = nil
+	r.Flush(push)
+	require.Empty(t, flushed)
+}
+
+func TestRingAdaptive(t *testing.T) {
+	cons := &testConsumer{push: func([]uint64) {}}
+	r := newAdaptiveRingBuffer(cons, 2, 16)
+	require.Equal(t, int64(2), r.Capacity())
+	s := newRingStripe(cons, r.sizer, 2)
+
+	// The stripes grow while their drains are dropped, up to the maximum.
+	for i := 0; i < 2*ringSizerWindow*16; i++ {
+		s.Push(uint64(i))
+	}
+	require.Equal(t, int64(16), r.Capacity())
+	require.Equal(t, 16, s.capa)
+
+	// They shrink back once the drains are kept, down to the minimum.
+	cons.save = true
+	for i := 0; i < 16*ringSizerWindow*ringShrinkWindows*4; i++ {
+		s.Push(uint64(i))
+	}
+	require.Equal(t, int64(2), r.Capacity())
+	require.Equal(t, int64(4), newRingBuffer(cons, 4).Capacity())
+}
+
+func TestCacheMaxBufferItems(t *testing.T) {
+	_, err := NewCache(&Config[int, int]{
+		NumCounters:    100,
+		MaxCost:        10,
+		BufferItems:    64,
+		MaxBufferItems: -1,
+	})
+	require.Error(t, err)
+
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:    100,
+		MaxCost:        10,
+		BufferItems:    1,
+		MaxBufferItems: 256,
+		Metrics:        true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, int64(1), c.Metrics.BufferItems())
+	c.getBuf.sizer.size.Store(8)
+	require.Equal(t, int64(8), c.Metrics.BufferItems())
+	var nilMetrics *Metrics
+	require.Zero(t, nilMetrics.BufferItems())
+}
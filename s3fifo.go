@@ -0,0 +1,264 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"container/list"
+	"sync/atomic"
+)
+
+const (
+	// s3SmallRatio is the share of MaxCost given to the small FIFO queue, as
+	// recommended by the S3-FIFO paper [1].
+	//
+	// [1]: https://dl.acm.org/doi/10.1145/3600006.3613147
+	s3SmallRatio = 0.1
+	// s3MaxFreq caps the access counter of each entry, two bits are enough.
+	s3MaxFreq = 3
+)
+
+type s3Entry struct {
+	key  uint64
+	cost int64
+	freq uint8
+	main bool
+	elem *list.Element
+}
+
+// s3FIFOPolicy implements the S3-FIFO policy [1], extended to weigh entries by
+// cost. New items go to a small FIFO queue, most of them are evicted from
+// there after a single access (one-hit wonders). Items accessed while in the
+// small queue move to the main FIFO queue, which is evicted with a second
+// chance scheme. The keys evicted from the small queue are remembered in a
+// ghost queue, so that they go straight to the main queue if they come back.
+// Accesses only bump a small counter and never reorder the queues.
+//
+// [1]: https://dl.acm.org/doi/10.1145/3600006.3613147
+type s3FIFOPolicy[V any] struct {
+	policyBase
+	// NOTE: align maxCost to 64-bit boundary for use with atomic.
+	maxCost   int64
+	smallCost int64
+	mainCost  int64
+	entries   map[uint64]*s3Entry
+	// Front is the oldest entry for all the queues.
+	small *list.List
+	main  *list.List
+	ghost *list.List
+	// ghostKeys indexes the ghost queue, it's bounded by the number of
+	// entries in the main queue.
+	ghostKeys map[uint64]*list.Element
+}
+
+func newS3FIFOPolicy[V any](maxCost int64) *s3FIFOPolicy[V] {
+	p := &s3FIFOPolicy[V]{
+		policyBase: newPolicyBase(),
+		maxCost:    maxCost,
+	}
+	p.clear()
+	go p.processItems(p.access)
+	return p
+}
+
+func (p *s3FIFOPolicy[V]) CollectMetrics(metrics *Metrics) {
+	p.metrics = metrics
+}
+
+func (p *s3FIFOPolicy[V]) clear() {
+	p.smallCost = 0
+	p.mainCost = 0
+	p.entries = make(map[uint64]*s3Entry)
+	p.small = list.New()
+	p.main = list.New()
+	p.ghost = list.New()
+	p.ghostKeys = make(map[uint64]*list.Element)
+}
+
+func (p *s3FIFOPolicy[V]) access(keys []uint64) {
+	for _, key := range keys {
+		if e, ok := p.entries[key]; ok && e.freq < s3MaxFreq {
+			e.freq++
+		}
+	}
+}
+
+// evictOne removes a single entry from the cache, from the small queue if it
+// uses more than its share, or from the main queue otherwise.
+func (p *s3FIFOPolicy[V]) evictOne() *Item[V] {
+	smallCap := int64(float64(p.MaxCost()) * s3SmallRatio)
+	for {
+		if p.small.Len() > 0 && (p.smallCost > smallCap || p.main.Len() == 0) {
+			e := p.small.Remove(p.small.Front()).(*s3Entry)
+			p.smallCost -= e.cost
+			if e.freq > 0 {
+				// Accessed at least once after being added, promote it.
+				e.freq = 0
+				e.main = true
+				e.elem = p.main.PushBack(e)
+				p.mainCost += e.cost
+				continue
+			}
+			p.addGhost(e.key)
+			return p.evicted(e)
+		}
+		e := p.main.Remove(p.main.Front()).(*s3Entry)
+		if e.freq > 0 {
+			// Second chance.
+			e.freq--
+			e.elem = p.main.PushBack(e)
+			continue
+		}
+		p.mainCost -= e.cost
+		return p.evicted(e)
+	}
+}
+
+func (p *s3FIFOPolicy[V]) evicted(e *s3Entry) *Item[V] {
+	delete(p.entries, e.key)
+	p.metrics.trackEvict(e.key, e.cost)
+	return &Item[V]{Key: e.key, Cost: e.cost}
+}
+
+func (p *s3FIFOPolicy[V]) addGhost(key uint64) {
+	if _, ok := p.ghostKeys[key]; ok {
+		return
+	}
+	p.ghostKeys[key] = p.ghost.PushBack(key)
+	for p.ghost.Len() > p.main.Len()+1 {
+		delete(p.ghostKeys, p.ghost.Remove(p.ghost.Front()).(uint64))
+	}
+}
+
+func (p *s3FIFOPolicy[V]) Add(key uint64, cost int64) ([]*Item[V], bool) {
+	p.Lock()
+	defer p.Unlock()
+	return p.add(key, cost)
+}
+
+func (p *s3FIFOPolicy[V]) AddBatch(pairs []policyPair) []addResult[V] {
+	p.Lock()
+	defer p.Unlock()
+	return addBatch(pairs, p.add)
+}
+
+// add is Add, with the lock held.
+func (p *s3FIFOPolicy[V]) add(key uint64, cost int64) ([]*Item[V], bool) {
+	// Cannot add an item bigger than entire cache.
+	if cost > p.MaxCost() {
+		return nil, false
+	}
+	// No need to go any further if the item is already in the cache.
+	if p.updateIfHas(key, cost) {
+		return nil, false
+	}
+
+	var victims []*Item[V]
+	for p.smallCost+p.mainCost+cost > p.MaxCost() {
+		victims = append(victims, p.evictOne())
+	}
+
+	e := &s3Entry{key: key, cost: cost}
+	if elem, ok := p.ghostKeys[key]; ok {
+		p.ghost.Remove(elem)
+		delete(p.ghostKeys, key)
+		p.metrics.add(ghostHit, 1)
+		e.main = true
+		e.elem = p.main.PushBack(e)
+		p.mainCost += cost
+	} else {
+		e.elem = p.small.PushBack(e)
+		p.smallCost += cost
+	}
+	p.entries[key] = e
+	p.metrics.trackAdd(key, cost)
+	return victims, true
+}
+
+func (p *s3FIFOPolicy[V]) AddIfRoom(key uint64, cost int64) bool {
+	p.Lock()
+	if _, ok := p.entries[key]; ok || p.smallCost+p.mainCost+cost > p.MaxCost() {
+		p.Unlock()
+		return false
+	}
+	p.Unlock()
+	_, added := p.Add(key, cost)
+	return added
+}
+
+func (p *s3FIFOPolicy[V]) updateIfHas(key uint64, cost int64) bool {
+	e, ok := p.entries[key]
+	if !ok {
+		return false
+	}
+	p.metrics.trackUpdate(key, e.cost, cost)
+	if e.main {
+		p.mainCost += cost - e.cost
+	} else {
+		p.smallCost += cost - e.cost
+	}
+	e.cost = cost
+	return true
+}
+
+func (p *s3FIFOPolicy[V]) Has(key uint64) bool {
+	p.Lock()
+	defer p.Unlock()
+	_, ok := p.entries[key]
+	return ok
+}
+
+func (p *s3FIFOPolicy[V]) Del(key uint64) {
+	p.Lock()
+	defer p.Unlock()
+	e, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	if e.main {
+		p.main.Remove(e.elem)
+		p.mainCost -= e.cost
+	} else {
+		p.small.Remove(e.elem)
+		p.smallCost -= e.cost
+	}
+	delete(p.entries, key)
+	p.metrics.trackEvict(key, e.cost)
+}
+
+func (p *s3FIFOPolicy[V]) Cap() int64 {
+	p.Lock()
+	defer p.Unlock()
+	return p.MaxCost() - p.smallCost - p.mainCost
+}
+
+func (p *s3FIFOPolicy[V]) Update(key uint64, cost int64) {
+	p.Lock()
+	p.updateIfHas(key, cost)
+	p.Unlock()
+}
+
+func (p *s3FIFOPolicy[V]) Cost(key uint64) int64 {
+	p.Lock()
+	defer p.Unlock()
+	if e, ok := p.entries[key]; ok {
+		return e.cost
+	}
+	return -1
+}
+
+func (p *s3FIFOPolicy[V]) Clear() {
+	p.Lock()
+	p.clear()
+	p.Unlock()
+}
+
+func (p *s3FIFOPolicy[V]) MaxCost() int64 {
+	return atomic.LoadInt64(&p.maxCost)
+}
+
+func (p *s3FIFOPolicy[V]) UpdateMaxCost(maxCost int64) {
+	atomic.StoreInt64(&p.maxCost, maxCost)
+}
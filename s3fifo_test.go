@@ -0,0 +1,157 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3FIFOPolicyAdd(t *testing.T) {
+	p := newS3FIFOPolicy[int](100)
+	defer p.Close()
+	p.CollectMetrics(newMetrics())
+
+	victims, added := p.Add(1, 101)
+	require.Nil(t, victims)
+	require.False(t, added)
+
+	for i := uint64(1); i <= 10; i++ {
+		victims, added = p.Add(i, 10)
+		require.Nil(t, victims)
+		require.True(t, added)
+	}
+	// Updating an existing key doesn't evict anything.
+	victims, added = p.Add(1, 10)
+	require.Nil(t, victims)
+	require.False(t, added)
+
+	// Nothing was accessed, so the oldest entry goes first.
+	victims, added = p.Add(11, 10)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(1), victims[0].Key)
+	require.True(t, p.Has(11))
+	require.Equal(t, int64(0), p.Cap())
+	require.Equal(t, uint64(1), p.metrics.KeysEvicted())
+}
+
+func TestS3FIFOPolicyPromotion(t *testing.T) {
+	p := newS3FIFOPolicy[int](10)
+	defer p.Close()
+
+	for i := uint64(1); i <= 10; i++ {
+		p.Add(i, 1)
+	}
+	p.itemsCh <- []uint64{1, 2}
+	time.Sleep(wait)
+
+	// 1 and 2 were accessed in the small queue, they move to the main queue
+	// instead of being evicted.
+	victims, _ := p.Add(11, 1)
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(3), victims[0].Key)
+	p.Lock()
+	require.True(t, p.entries[1].main)
+	require.True(t, p.entries[2].main)
+	require.Equal(t, int64(2), p.mainCost)
+	p.Unlock()
+}
+
+func TestS3FIFOPolicyGhost(t *testing.T) {
+	p := newS3FIFOPolicy[int](10)
+	defer p.Close()
+	p.CollectMetrics(newMetrics())
+
+	for i := uint64(1); i <= 10; i++ {
+		p.Add(i, 1)
+	}
+	p.itemsCh <- []uint64{2}
+	time.Sleep(wait)
+	// Evicts 1 into the ghost queue and promotes 2.
+	p.Add(11, 1)
+	require.False(t, p.Has(1))
+
+	p.Add(1, 1)
+	require.True(t, p.Has(1))
+	p.Lock()
+	require.True(t, p.entries[1].main)
+	p.Unlock()
+	require.Equal(t, uint64(1), p.metrics.GhostHits())
+}
+
+func TestS3FIFOPolicyAddIfRoom(t *testing.T) {
+	p := newS3FIFOPolicy[int](100)
+	defer p.Close()
+
+	require.True(t, p.AddIfRoom(1, 60))
+	require.False(t, p.AddIfRoom(1, 10))
+	require.False(t, p.AddIfRoom(2, 50))
+	require.True(t, p.AddIfRoom(2, 40))
+	require.Equal(t, int64(0), p.Cap())
+}
+
+func TestS3FIFOPolicyDel(t *testing.T) {
+	p := newS3FIFOPolicy[int](100)
+	defer p.Close()
+
+	p.Add(1, 1)
+	p.Add(2, 2)
+	p.Del(1)
+	p.Del(3)
+	require.False(t, p.Has(1))
+	require.True(t, p.Has(2))
+	require.Equal(t, int64(98), p.Cap())
+}
+
+func TestS3FIFOPolicyUpdate(t *testing.T) {
+	p := newS3FIFOPolicy[int](100)
+	defer p.Close()
+
+	p.Add(1, 1)
+	p.Update(1, 2)
+	require.Equal(t, int64(2), p.Cost(1))
+	require.Equal(t, int64(-1), p.Cost(2))
+	require.Equal(t, int64(98), p.Cap())
+}
+
+func TestS3FIFOPolicyClear(t *testing.T) {
+	p := newS3FIFOPolicy[int](100)
+	defer p.Close()
+
+	p.Add(1, 1)
+	p.Add(2, 2)
+	p.Clear()
+	require.False(t, p.Has(1))
+	require.False(t, p.Has(2))
+	require.Equal(t, int64(100), p.Cap())
+}
+
+func TestCacheS3FIFOPolicy(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		Metrics:            true,
+		IgnoreInternalCost: true,
+		Policy:             PolicyS3FIFO,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 20; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	require.Equal(t, uint64(20), c.Metrics.KeysAdded())
+	require.Equal(t, uint64(10), c.Metrics.KeysEvicted())
+
+	val, ok := c.Get(19)
+	require.True(t, ok)
+	require.Equal(t, 19, val)
+}
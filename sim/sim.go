@@ -135,6 +135,54 @@ func ParseARC(line string, err error) ([]uint64, error) {
 	return nil, ErrDone
 }
 
+// Event is a key of a timed trace, along with the time it was accessed at,
+// relative to the first event of the trace.
+type Event struct {
+	Key  uint64
+	Time time.Duration
+}
+
+// TimedSimulator returns the events of a timed trace, in order.
+type TimedSimulator func() (Event, error)
+
+// NewTimedReader creates a TimedSimulator from a trace file with one event per
+// line, each one being a timestamp in seconds followed by a key, e.g.
+// "1700000000.25 42". ErrDone is returned when every line has been read.
+func NewTimedReader(file io.Reader) TimedSimulator {
+	b := bufio.NewReader(file)
+	var first float64
+	started := false
+	return func() (Event, error) {
+		ts, key, err := ParseTimed(b.ReadString('\n'))
+		if err != nil {
+			return Event{}, err
+		}
+		if !started {
+			first, started = ts, true
+		}
+		return Event{Key: key, Time: time.Duration((ts - first) * float64(time.Second))}, nil
+	}
+}
+
+// ParseTimed takes a single line of input from a timed trace file, and returns
+// its timestamp in seconds and its key.
+func ParseTimed(line string, err error) (float64, uint64, error) {
+	if line = strings.TrimSpace(line); line == "" {
+		return 0, 0, ErrDone
+	}
+	// example: "1700000000.25 42\n"
+	cols := strings.Fields(line)
+	if len(cols) != 2 {
+		return 0, 0, ErrBadLine
+	}
+	ts, err := strconv.ParseFloat(cols[0], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	key, err := strconv.ParseUint(cols[1], 10, 64)
+	return ts, key, err
+}
+
 // Collection evaluates the Simulator size times and saves each item to the
 // returned slice.
 func Collection(simulator Simulator, size uint64) []uint64 {
@@ -9,7 +9,9 @@ import (
 	"bytes"
 	"compress/gzip"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestZipfian(t *testing.T) {
@@ -86,6 +88,32 @@ func TestParseARC(t *testing.T) {
 	}
 }
 
+func TestTimedReader(t *testing.T) {
+	s := NewTimedReader(strings.NewReader("100.5 7\n101 8\r\n160.5 7"))
+	want := []Event{
+		{Key: 7, Time: 0},
+		{Key: 8, Time: 500 * time.Millisecond},
+		{Key: 7, Time: time.Minute},
+	}
+	for _, w := range want {
+		e, err := s()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e != w {
+			t.Fatalf("got %+v, want %+v", e, w)
+		}
+	}
+	if _, err := s(); err != ErrDone {
+		t.Fatalf("got %v, want ErrDone", err)
+	}
+
+	s = NewTimedReader(strings.NewReader("1 2 3\n"))
+	if _, err := s(); err != ErrBadLine {
+		t.Fatalf("got %v, want ErrBadLine", err)
+	}
+}
+
 func TestCollection(t *testing.T) {
 	s := NewUniform(100)
 	c := Collection(s, 100)
@@ -0,0 +1,156 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+// spillQueue holds the items which found setBuf full, in order, until
+// processItems makes room for them in setBuf, see Config.SpillLimit.
+//
+// Once an item is spilled, the items sent after it are spilled too, until the
+// queue is empty again, so that the items of a key still reach processItems in
+// the order they were sent. The queue is only pumped by processItems, after it
+// took items from setBuf: an item is only spilled if setBuf is full, so
+// processItems always has a batch to process and a pump to do after it.
+//
+// A nil *spillQueue is valid, and makes send use setBuf only.
+type spillQueue[V any] struct {
+	// mu protects items.
+	mu    sync.Mutex
+	items []spilledItem[V]
+	limit int
+	// depth and oldest are the number of items and the time the first one was
+	// spilled, if any, so that QueueDepths doesn't need mu.
+	depth  atomic.Int64
+	oldest atomic.Int64
+}
+
+type spilledItem[V any] struct {
+	item *Item[V]
+	at   int64
+}
+
+func newSpillQueue[V any](limit int) *spillQueue[V] {
+	return &spillQueue[V]{limit: limit}
+}
+
+// send sends i to setBuf, or spills it if setBuf is full or other items are
+// spilled already. If force is false, send returns false instead of spilling i
+// past the limit. Otherwise i is always sent or spilled. spilled is true if i
+// was spilled.
+func (q *spillQueue[V]) send(setBuf chan *Item[V], i *Item[V], force bool) (ok, spilled bool) {
+	if q == nil {
+		if force {
+			setBuf <- i
+			return true, false
+		}
+		select {
+		case setBuf <- i:
+			return true, false
+		default:
+			return false, false
+		}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		select {
+		case setBuf <- i:
+			return true, false
+		default:
+		}
+	}
+	if !force && len(q.items) >= q.limit {
+		return false, false
+	}
+	now := z.NanoTime()
+	if len(q.items) == 0 {
+		q.oldest.Store(now)
+	}
+	q.items = append(q.items, spilledItem[V]{item: i, at: now})
+	q.depth.Store(int64(len(q.items)))
+	return true, true
+}
+
+// pump moves the spilled items to setBuf, in order, while setBuf has room.
+func (q *spillQueue[V]) pump(setBuf chan *Item[V]) {
+	if q == nil || q.depth.Load() == 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+loop:
+	for ; n < len(q.items); n++ {
+		select {
+		case setBuf <- q.items[n].item:
+		default:
+			break loop
+		}
+	}
+	q.pop(n)
+}
+
+// drain removes and returns all the spilled items.
+func (q *spillQueue[V]) drain() []*Item[V] {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := make([]*Item[V], len(q.items))
+	for n, s := range q.items {
+		items[n] = s.item
+	}
+	q.pop(len(q.items))
+	return items
+}
+
+// pop removes the n first items. q.mu must be held.
+func (q *spillQueue[V]) pop(n int) {
+	clear(q.items[:n])
+	q.items = q.items[n:]
+	if len(q.items) == 0 {
+		// Let the backing array go, it can be large after a burst.
+		q.items = nil
+		q.oldest.Store(0)
+	} else {
+		q.oldest.Store(q.items[0].at)
+	}
+	q.depth.Store(int64(len(q.items)))
+}
+
+// stats returns the number of spilled items and how long ago the oldest one
+// was spilled.
+func (q *spillQueue[V]) stats() (int, time.Duration) {
+	if q == nil {
+		return 0, 0
+	}
+	depth := int(q.depth.Load())
+	oldest := q.oldest.Load()
+	if depth == 0 || oldest == 0 {
+		return 0, 0
+	}
+	return depth, time.Duration(z.NanoTime() - oldest)
+}
+
+// send sends i to setBuf, spilling it if needed and Config.SpillLimit is set.
+// If block is true, send waits for room in setBuf unless i can be spilled, and
+// i can be spilled past the limit: it's meant for Dels and Waits, which can't
+// be dropped. Otherwise send returns false if i was dropped.
+func (c *Cache[K, V]) send(i *Item[V], block bool) bool {
+	ok, spilled := c.spill.send(c.setBuf, i, block)
+	if spilled {
+		c.Metrics.add(spillSets, 1)
+	}
+	return ok
+}
@@ -0,0 +1,151 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpillQueue(t *testing.T) {
+	setBuf := make(chan *Item[int], 2)
+	item := func(key uint64) *Item[int] { return &Item[int]{Key: key} }
+
+	var nilQueue *spillQueue[int]
+	ok, spilled := nilQueue.send(setBuf, item(1), false)
+	require.True(t, ok)
+	require.False(t, spilled)
+	nilQueue.pump(setBuf)
+	require.Empty(t, nilQueue.drain())
+	depth, age := nilQueue.stats()
+	require.Zero(t, depth)
+	require.Zero(t, age)
+	<-setBuf
+
+	q := newSpillQueue[int](2)
+	for key := uint64(1); key <= 4; key++ {
+		ok, spilled := q.send(setBuf, item(key), false)
+		require.True(t, ok)
+		require.Equal(t, key > 2, spilled)
+	}
+	ok, spilled = q.send(setBuf, item(5), false)
+	require.False(t, ok)
+	require.False(t, spilled)
+	// Forced items are spilled past the limit.
+	ok, spilled = q.send(setBuf, item(6), true)
+	require.True(t, ok)
+	require.True(t, spilled)
+	depth, _ = q.stats()
+	require.Equal(t, 3, depth)
+
+	// Once room is made in setBuf, the items still go after the spilled ones.
+	require.Equal(t, uint64(1), (<-setBuf).Key)
+	ok, spilled = q.send(setBuf, item(7), true)
+	require.True(t, ok)
+	require.True(t, spilled)
+	q.pump(setBuf)
+	require.Equal(t, uint64(2), (<-setBuf).Key)
+	require.Equal(t, uint64(3), (<-setBuf).Key)
+	depth, _ = q.stats()
+	require.Equal(t, 3, depth)
+
+	drained := q.drain()
+	require.Len(t, drained, 3)
+	for n, key := range []uint64{4, 6, 7} {
+		require.Equal(t, key, drained[n].Key)
+	}
+	depth, age = q.stats()
+	require.Zero(t, depth)
+	require.Zero(t, age)
+	ok, spilled = q.send(setBuf, item(8), false)
+	require.True(t, ok)
+	require.False(t, spilled)
+}
+
+// pauseProcessing stops the processItems goroutine of c, until the returned
+// func restarts it.
+func pauseProcessing[K Key, V any](c *Cache[K, V]) func() {
+	c.stop <- struct{}{}
+	<-c.done
+	return func() { go c.processItems() }
+}
+
+func TestCacheSpillLimit(t *testing.T) {
+	_, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		SpillLimit:  -1,
+	})
+	require.Error(t, err)
+
+	const spillLimit = 10
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            1 << 20,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		SpillLimit:         spillLimit,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	resume := pauseProcessing(c)
+	for key := 0; key < setBufSize+spillLimit; key++ {
+		require.True(t, c.Set(key, key, 1))
+	}
+	require.False(t, c.Set(setBufSize+spillLimit, 0, 1))
+	// Dels are spilled past the limit rather than blocking.
+	c.Del(0)
+	depths := c.Metrics.QueueDepths()
+	require.Equal(t, setBufSize, depths.SetBuf)
+	require.Equal(t, spillLimit+1, depths.Spill)
+	require.Positive(t, depths.SpillAge)
+	require.Equal(t, uint64(spillLimit+1), c.Metrics.SetsSpilled())
+	require.Equal(t, uint64(1), c.Metrics.SetsDropped())
+	resume()
+
+	c.Wait()
+	require.Equal(t, QueueDepths{SetBufCap: setBufSize}, c.Metrics.QueueDepths())
+	_, ok := c.Get(0)
+	require.False(t, ok)
+	for key := 1; key < setBufSize+spillLimit; key++ {
+		val, ok := c.Get(key)
+		require.True(t, ok, "key %d", key)
+		require.Equal(t, key, val)
+	}
+	_, ok = c.Get(setBufSize + spillLimit)
+	require.False(t, ok)
+}
+
+func TestCacheSpillClear(t *testing.T) {
+	var evicted []int
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            1 << 20,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		SpillLimit:         1,
+		OnEvict:            func(item *Item[int]) { evicted = append(evicted, item.Value) },
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	resume := pauseProcessing(c)
+	for key := 0; key <= setBufSize; key++ {
+		require.True(t, c.Set(key, key, 1))
+	}
+	resume()
+	c.Clear()
+	// The spilled item is evicted, wherever processItems had the time to get
+	// it to.
+	require.Len(t, evicted, setBufSize+1)
+	require.Contains(t, evicted, setBufSize)
+	depth, _ := c.spill.stats()
+	require.Zero(t, depth)
+}
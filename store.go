@@ -7,6 +7,7 @@ package ristretto
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,6 +19,78 @@ type storeItem[V any] struct {
 	conflict   uint64
 	value      V
 	expiration time.Time
+	// extras holds the optional fields of the item, nil if they're all zero,
+	// so that they don't grow the items which don't use them.
+	extras *itemExtras
+}
+
+// itemExtras are the fields of a storeItem which most items don't use. They
+// aren't changed once set, so that the copies of an item can share them.
+type itemExtras struct {
+	// slide is the TTL the expiration is extended by on access, if the item
+	// is sliding, see Config.SlidingTTL.
+	slide   time.Duration
+	version uint64
+	// fetchCost is the time it takes to fetch the value again, if set, see
+	// SetOptions.FetchCost.
+	fetchCost time.Duration
+	// metadata is the metadata of the value, if set, see SetOptions.Metadata.
+	metadata *itemMetadata
+	// generation is the generation of the store when the item was Set, see
+	// store.Invalidate.
+	generation uint64
+	// hot is set for the keys reported as hot by the policy, see
+	// Config.SampleHotGets.
+	hot bool
+}
+
+// newStoreItem returns the storeItem of i, with the given fetch cost and hot.
+func newStoreItem[V any](i *Item[V], fetchCost time.Duration, hot bool) storeItem[V] {
+	item := storeItem[V]{
+		key:        i.Key,
+		conflict:   i.Conflict,
+		value:      i.Value,
+		expiration: i.Expiration,
+	}
+	item.setExtras(itemExtras{
+		slide:      i.slide,
+		version:    i.version,
+		fetchCost:  fetchCost,
+		metadata:   i.metadata,
+		generation: i.generation,
+		hot:        hot,
+	})
+	return item
+}
+
+// extra returns the optional fields of the item, zero if it has none.
+func (s *storeItem[V]) extra() itemExtras {
+	if s.extras == nil {
+		return itemExtras{}
+	}
+	return *s.extras
+}
+
+// setExtras replaces the optional fields of the item by e.
+func (s *storeItem[V]) setExtras(e itemExtras) {
+	if e == (itemExtras{}) {
+		s.extras = nil
+		return
+	}
+	s.extras = &e
+}
+
+// storeOp is an operation of a Pipeline, applied by store.Batch. Only the Key
+// and Conflict of item are used by Gets and Dels, and Sets update the item if
+// it exists, like store.Update. value, ok and hot are the results of Gets,
+// like those of store.GetHot. For Sets, value and ok are the results of
+// store.Update, and for Dels value is the deleted value, and ok whether it was
+// found.
+type storeOp[V any] struct {
+	op      TraceOp
+	item    *Item[V]
+	value   V
+	ok, hot bool
 }
 
 // store is the interface fulfilled by all hash map implementations in this
@@ -29,19 +102,64 @@ type storeItem[V any] struct {
 type store[V any] interface {
 	// Get returns the value associated with the key parameter.
 	Get(uint64, uint64) (V, bool)
+	// GetHot works like Get, and also returns whether the key is hot.
+	GetHot(uint64, uint64) (V, bool, bool)
+	// SetHot marks the key as hot or not, if it's present.
+	SetHot(uint64, bool)
 	// Expiration returns the expiration time for this key.
 	Expiration(uint64) time.Time
+	// GetExpiration works like Get, but returns the expiration of the item
+	// rather than its value.
+	GetExpiration(uint64, uint64) (time.Time, bool)
+	// GetVersion works like Get, but returns the version of the item rather
+	// than its value, see SetWithVersion.
+	GetVersion(uint64, uint64) (uint64, bool)
+	// GetFetchCost works like Get, but returns the fetch cost of the item
+	// rather than its value, see SetOptions.FetchCost.
+	GetFetchCost(uint64, uint64) (time.Duration, bool)
+	// GetMetadata works like Get, and also returns the metadata of the item,
+	// read along with its value, see SetOptions.Metadata.
+	GetMetadata(uint64, uint64) (V, *itemMetadata, bool)
+	// Touch extends the expiration of the key by its sliding TTL, if it's
+	// present and sliding, see Config.SlidingTTL.
+	Touch(uint64, uint64)
 	// Set adds the key-value pair to the Map or updates the value if it's
 	// already present. The key-value pair is passed as a pointer to an
 	// item object.
 	Set(*Item[V])
-	// Del deletes the key-value pair from the Map.
-	Del(uint64, uint64) (uint64, V)
+	// Del deletes the key-value pair from the Map, and returns its conflict
+	// hash and value, and whether it was found.
+	Del(uint64, uint64) (uint64, V, bool)
 	// Update attempts to update the key with a new value and returns true if
 	// successful.
 	Update(*Item[V]) (V, bool)
 	// Cleanup removes items that have an expired TTL.
-	Cleanup(policy *defaultPolicy[V], onEvict func(item *Item[V]))
+	Cleanup(policy policy[V], onEvict func(item *Item[V]))
+	// Invalidate makes all the items stored so far unreachable, by moving the
+	// store to a new generation.
+	Invalidate()
+	// Generation returns the current generation, to be set on new items.
+	Generation() uint64
+	// Purge deletes the items of the shard with the given index that were
+	// stored before the current generation, and returns them.
+	Purge(shard int) []*Item[V]
+	// Items returns the items of the shard with the given index that haven't
+	// expired or been invalidated, without their cost.
+	Items(shard int) []*Item[V]
+	// Batch applies the operations of a Pipeline in one pass per shard, locking
+	// every shard once. The operations on the same shard are applied in order,
+	// and those without an item are skipped.
+	Batch(ops []storeOp[V])
+	// Audit checks the keys of a sample of the expiration buckets against the
+	// items of the store, and the items of the shard with the given index
+	// against the buckets already cleaned up, see Config.TTLAuditInterval. It
+	// removes the keys from the buckets whose items are gone or expire in
+	// another bucket, and evicts the expired items which no bucket left to
+	// clean up holds, like Cleanup. It returns the numbers of both.
+	Audit(policy policy[V], onEvict func(item *Item[V]), shard int) (int, int)
+	// CleanupBacklog returns the number of expired items that are waiting
+	// for Cleanup.
+	CleanupBacklog() int
 	// Clear clears all contents of the store.
 	Clear(onEvict func(item *Item[V]))
 	SetShouldUpdateFn(f updateFn[V])
@@ -55,17 +173,22 @@ func newStore[V any]() store[V] {
 const numShards uint64 = 256
 
 type shardedMap[V any] struct {
-	shards    []*lockedMap[V]
-	expiryMap *expirationMap[V]
+	shards     []*lockedMap[V]
+	expiryMap  *expirationMap[V]
+	generation *atomic.Uint64
+	// replicas is set if Config.ReplicateHotKeys is, see replicateHot.
+	replicas *hotReplicas[V]
 }
 
 func newShardedMap[V any]() *shardedMap[V] {
 	sm := &shardedMap[V]{
-		shards:    make([]*lockedMap[V], int(numShards)),
-		expiryMap: newExpirationMap[V](),
+		shards:     make([]*lockedMap[V], int(numShards)),
+		expiryMap:  newExpirationMap[V](),
+		generation: new(atomic.Uint64),
 	}
 	for i := range sm.shards {
 		sm.shards[i] = newLockedMap[V](sm.expiryMap)
+		sm.shards[i].generation = sm.generation
 	}
 	return sm
 }
@@ -80,10 +203,38 @@ func (sm *shardedMap[V]) Get(key, conflict uint64) (V, bool) {
 	return sm.shards[key%numShards].get(key, conflict)
 }
 
+func (sm *shardedMap[V]) GetHot(key, conflict uint64) (V, bool, bool) {
+	return sm.shards[key%numShards].getHot(key, conflict)
+}
+
+func (sm *shardedMap[V]) SetHot(key uint64, hot bool) {
+	sm.shards[key%numShards].setHot(key, hot)
+}
+
 func (sm *shardedMap[V]) Expiration(key uint64) time.Time {
 	return sm.shards[key%numShards].Expiration(key)
 }
 
+func (sm *shardedMap[V]) GetExpiration(key, conflict uint64) (time.Time, bool) {
+	return sm.shards[key%numShards].getExpiration(key, conflict)
+}
+
+func (sm *shardedMap[V]) GetVersion(key, conflict uint64) (uint64, bool) {
+	return sm.shards[key%numShards].getVersion(key, conflict)
+}
+
+func (sm *shardedMap[V]) GetFetchCost(key, conflict uint64) (time.Duration, bool) {
+	return sm.shards[key%numShards].getFetchCost(key, conflict)
+}
+
+func (sm *shardedMap[V]) GetMetadata(key, conflict uint64) (V, *itemMetadata, bool) {
+	return sm.shards[key%numShards].getMetadata(key, conflict)
+}
+
+func (sm *shardedMap[V]) Touch(key, conflict uint64) {
+	sm.shards[key%numShards].touch(key, conflict)
+}
+
 func (sm *shardedMap[V]) Set(i *Item[V]) {
 	if i == nil {
 		// If item is nil make this Set a no-op.
@@ -93,7 +244,7 @@ func (sm *shardedMap[V]) Set(i *Item[V]) {
 	sm.shards[i.Key%numShards].Set(i)
 }
 
-func (sm *shardedMap[V]) Del(key, conflict uint64) (uint64, V) {
+func (sm *shardedMap[V]) Del(key, conflict uint64) (uint64, V, bool) {
 	return sm.shards[key%numShards].Del(key, conflict)
 }
 
@@ -101,10 +252,76 @@ func (sm *shardedMap[V]) Update(newItem *Item[V]) (V, bool) {
 	return sm.shards[newItem.Key%numShards].Update(newItem)
 }
 
-func (sm *shardedMap[V]) Cleanup(policy *defaultPolicy[V], onEvict func(item *Item[V])) {
+func (sm *shardedMap[V]) Cleanup(policy policy[V], onEvict func(item *Item[V])) {
 	sm.expiryMap.cleanup(sm, policy, onEvict)
 }
 
+func (sm *shardedMap[V]) Invalidate() {
+	sm.generation.Add(1)
+}
+
+func (sm *shardedMap[V]) Generation() uint64 {
+	return sm.generation.Load()
+}
+
+func (sm *shardedMap[V]) Purge(shard int) []*Item[V] {
+	return sm.shards[shard].purge()
+}
+
+func (sm *shardedMap[V]) Items(shard int) []*Item[V] {
+	return sm.shards[shard].items()
+}
+
+func (sm *shardedMap[V]) Batch(ops []storeOp[V]) {
+	// Group the operations by shard, keeping their order in every shard.
+	var counts [numShards + 1]int
+	for i := range ops {
+		if ops[i].item != nil {
+			counts[ops[i].item.Key%numShards+1]++
+		}
+	}
+	for i := 1; i <= int(numShards); i++ {
+		counts[i] += counts[i-1]
+	}
+	order := make([]int, len(ops))
+	next := counts
+	for i := range ops {
+		if ops[i].item == nil {
+			continue
+		}
+		shard := ops[i].item.Key % numShards
+		order[next[shard]] = i
+		next[shard]++
+	}
+	for shard := range sm.shards {
+		if lo, hi := counts[shard], counts[shard+1]; lo < hi {
+			sm.shards[shard].batch(ops, order[lo:hi])
+		}
+	}
+}
+
+func (sm *shardedMap[V]) Audit(policy policy[V], onEvict func(item *Item[V]), shard int) (int, int) {
+	var orphans, expired int
+	for _, e := range sm.expiryMap.sample(ttlAuditBuckets) {
+		if sm.shards[e.key%numShards].unindex(e) {
+			orphans++
+		}
+	}
+	for _, i := range sm.shards[shard].delUnindexed(sm.expiryMap.lastCleaned()) {
+		i.Cost = policy.Cost(i.Key)
+		policy.Del(i.Key)
+		if onEvict != nil {
+			onEvict(i)
+		}
+		expired++
+	}
+	return orphans, expired
+}
+
+func (sm *shardedMap[V]) CleanupBacklog() int {
+	return sm.expiryMap.backlog()
+}
+
 func (sm *shardedMap[V]) Clear(onEvict func(item *Item[V])) {
 	for i := uint64(0); i < numShards; i++ {
 		sm.shards[i].Clear(onEvict)
@@ -117,12 +334,18 @@ type lockedMap[V any] struct {
 	data         map[uint64]storeItem[V]
 	em           *expirationMap[V]
 	shouldUpdate updateFn[V]
+	// generation is the current generation of the store.
+	generation *atomic.Uint64
+	// replicas is shared by the shards of the store, and nil unless the
+	// items of the hot keys are replicated, see Config.ReplicateHotKeys.
+	replicas *hotReplicas[V]
 }
 
 func newLockedMap[V any](em *expirationMap[V]) *lockedMap[V] {
 	return &lockedMap[V]{
-		data: make(map[uint64]storeItem[V]),
-		em:   em,
+		data:       make(map[uint64]storeItem[V]),
+		em:         em,
+		generation: new(atomic.Uint64),
 		shouldUpdate: func(cur, prev V) bool {
 			return true
 		},
@@ -134,21 +357,51 @@ func (m *lockedMap[V]) setShouldUpdateFn(f updateFn[V]) {
 }
 
 func (m *lockedMap[V]) get(key, conflict uint64) (V, bool) {
+	value, ok, _ := m.getHot(key, conflict)
+	return value, ok
+}
+
+func (m *lockedMap[V]) getHot(key, conflict uint64) (V, bool, bool) {
+	if item, ok := m.replicas.get(key); ok {
+		return m.check(item, ok, conflict)
+	}
 	m.RLock()
 	item, ok := m.data[key]
 	m.RUnlock()
+	return m.check(item, ok, conflict)
+}
+
+// check returns the value of item, which was found if ok, if it matches
+// conflict and hasn't expired or been invalidated.
+func (m *lockedMap[V]) check(item storeItem[V], ok bool, conflict uint64) (V, bool, bool) {
 	if !ok {
-		return zeroValue[V](), false
+		return zeroValue[V](), false, false
 	}
 	if conflict != 0 && (conflict != item.conflict) {
-		return zeroValue[V](), false
+		return zeroValue[V](), false, false
 	}
 
-	// Handle expired items.
-	if !item.expiration.IsZero() && time.Now().After(item.expiration) {
-		return zeroValue[V](), false
+	// Handle expired and invalidated items.
+	if !item.expiration.IsZero() && ttlNow().After(item.expiration) {
+		return zeroValue[V](), false, false
+	}
+	extra := item.extra()
+	if extra.generation < m.generation.Load() {
+		return zeroValue[V](), false, false
+	}
+	return item.value, true, extra.hot
+}
+
+func (m *lockedMap[V]) setHot(key uint64, hot bool) {
+	m.Lock()
+	defer m.Unlock()
+	if item, ok := m.data[key]; ok {
+		extra := item.extra()
+		extra.hot = hot
+		item.setExtras(extra)
+		m.data[key] = item
+		m.replicas.set(item)
 	}
-	return item.value, true
 }
 
 func (m *lockedMap[V]) Expiration(key uint64) time.Time {
@@ -157,6 +410,72 @@ func (m *lockedMap[V]) Expiration(key uint64) time.Time {
 	return m.data[key].expiration
 }
 
+func (m *lockedMap[V]) getExpiration(key, conflict uint64) (time.Time, bool) {
+	m.RLock()
+	item, ok := m.data[key]
+	m.RUnlock()
+	_, ok, _ = m.check(item, ok, conflict)
+	return item.expiration, ok
+}
+
+func (m *lockedMap[V]) getVersion(key, conflict uint64) (uint64, bool) {
+	m.RLock()
+	item, ok := m.data[key]
+	m.RUnlock()
+	_, ok, _ = m.check(item, ok, conflict)
+	return item.extra().version, ok
+}
+
+func (m *lockedMap[V]) getFetchCost(key, conflict uint64) (time.Duration, bool) {
+	m.RLock()
+	item, ok := m.data[key]
+	m.RUnlock()
+	_, ok, _ = m.check(item, ok, conflict)
+	return item.extra().fetchCost, ok
+}
+
+func (m *lockedMap[V]) getMetadata(key, conflict uint64) (V, *itemMetadata, bool) {
+	m.RLock()
+	item, ok := m.data[key]
+	m.RUnlock()
+	value, ok, _ := m.check(item, ok, conflict)
+	if !ok {
+		return value, nil, false
+	}
+	return value, item.extra().metadata, true
+}
+
+// slideGranularity is the fraction of the sliding TTL of an item below which
+// the extensions of its expiration are skipped, see Config.SlidingTTL.
+const slideGranularity = 64
+
+func (m *lockedMap[V]) touch(key, conflict uint64) {
+	m.RLock()
+	item, ok := m.data[key]
+	m.RUnlock()
+	slide := item.extra().slide
+	if !ok || slide == 0 {
+		return
+	}
+	expiration := ttlNow().Add(slide)
+	if expiration.Sub(item.expiration) < slide/slideGranularity {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	item, ok = m.data[key]
+	// The item can't be extended once it expired, nor if it changed since.
+	if _, ok, _ = m.check(item, ok, conflict); !ok || item.extra().slide == 0 ||
+		!expiration.After(item.expiration) {
+		return
+	}
+	m.em.update(key, item.conflict, item.expiration, expiration)
+	item.expiration = expiration
+	m.data[key] = item
+	m.replicas.set(item)
+}
+
 func (m *lockedMap[V]) Set(i *Item[V]) {
 	if i == nil {
 		// If the item is nil make this Set a no-op.
@@ -166,6 +485,9 @@ func (m *lockedMap[V]) Set(i *Item[V]) {
 	m.Lock()
 	defer m.Unlock()
 	item, ok := m.data[i.Key]
+	if m.rejects(i, item, ok) {
+		return
+	}
 
 	if ok {
 		// The item existed already. We need to check the conflict key and reject the
@@ -176,6 +498,9 @@ func (m *lockedMap[V]) Set(i *Item[V]) {
 		if m.shouldUpdate != nil && !m.shouldUpdate(i.Value, item.value) {
 			return
 		}
+		if i.isStale(item.extra().version) {
+			return
+		}
 		m.em.update(i.Key, i.Conflict, item.expiration, i.Expiration)
 	} else {
 		// The value is not in the map already. There's no need to return anything.
@@ -183,23 +508,40 @@ func (m *lockedMap[V]) Set(i *Item[V]) {
 		m.em.add(i.Key, i.Conflict, i.Expiration)
 	}
 
-	m.data[i.Key] = storeItem[V]{
-		key:        i.Key,
-		conflict:   i.Conflict,
-		value:      i.Value,
-		expiration: i.Expiration,
+	m.data[i.Key] = newStoreItem(i, i.fetchCost, false)
+	if item.extra().hot {
+		// The new item isn't hot, before the policy reports it again.
+		m.replicas.del(i.Key)
+	}
+}
+
+// rejects returns true, and marks i as stale, if the cond of i is false for
+// item, which was found if ok, see Item.cond.
+func (m *lockedMap[V]) rejects(i *Item[V], item storeItem[V], ok bool) bool {
+	if i.cond == nil {
+		return false
+	}
+	value, found, _ := m.check(item, ok, i.Conflict)
+	if !i.cond(value, found) {
+		i.stale = true
 	}
+	return i.stale
 }
 
-func (m *lockedMap[V]) Del(key, conflict uint64) (uint64, V) {
+func (m *lockedMap[V]) Del(key, conflict uint64) (uint64, V, bool) {
 	m.Lock()
 	defer m.Unlock()
+	return m.del(key, conflict)
+}
+
+// del works like Del, with the lock held.
+func (m *lockedMap[V]) del(key, conflict uint64) (uint64, V, bool) {
 	item, ok := m.data[key]
 	if !ok {
-		return 0, zeroValue[V]()
+		return 0, zeroValue[V](), false
 	}
 	if conflict != 0 && (conflict != item.conflict) {
-		return 0, zeroValue[V]()
+		return 0, zeroValue[V](), false
 	}
 
 	if !item.expiration.IsZero() {
@@ -207,13 +549,78 @@ func (m *lockedMap[V]) Del(key, conflict uint64) (uint64, V) {
 	}
 
 	delete(m.data, key)
-	return item.conflict, item.value
+	if item.extra().hot {
+		m.replicas.del(key)
+	}
+	return item.conflict, item.value, true
+}
+
+// unindex removes the key of e from its bucket, unless the store holds it with
+// an expiration in that bucket, and reports whether it did.
+func (m *lockedMap[V]) unindex(e bucketEntry) bool {
+	// The lock of the shard keeps the key from being indexed meanwhile.
+	m.RLock()
+	defer m.RUnlock()
+	item, ok := m.data[e.key]
+	if ok && item.conflict == e.conflict && !item.expiration.IsZero() &&
+		storageBucket(item.expiration) == e.bucket {
+		return false
+	}
+	return m.em.delIf(e.bucket, e.key, e.conflict)
+}
+
+// delUnindexed deletes the expired items whose buckets are numbered cleaned at
+// most, so have been cleaned up already without them, and returns them.
+func (m *lockedMap[V]) delUnindexed(cleaned int64) []*Item[V] {
+	unindexed := func(item storeItem[V], now time.Time) bool {
+		return !item.expiration.IsZero() && now.After(item.expiration) &&
+			storageBucket(item.expiration) <= cleaned
+	}
+	now := ttlNow()
+	var keys []uint64
+	m.RLock()
+	for key, item := range m.data {
+		if unindexed(item, now) {
+			keys = append(keys, key)
+		}
+	}
+	m.RUnlock()
+	if len(keys) == 0 {
+		return nil
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	items := make([]*Item[V], 0, len(keys))
+	for _, key := range keys {
+		// The item may have been Set again since.
+		item, ok := m.data[key]
+		if !ok || !unindexed(item, now) {
+			continue
+		}
+		m.del(key, item.conflict)
+		items = append(items, &Item[V]{
+			Key:        key,
+			Conflict:   item.conflict,
+			Value:      item.value,
+			Expiration: item.expiration,
+		})
+	}
+	return items
 }
 
 func (m *lockedMap[V]) Update(newItem *Item[V]) (V, bool) {
 	m.Lock()
 	defer m.Unlock()
+	return m.update(newItem)
+}
+
+// update works like Update, with the lock held.
+func (m *lockedMap[V]) update(newItem *Item[V]) (V, bool) {
 	item, ok := m.data[newItem.Key]
+	if m.rejects(newItem, item, ok) {
+		return item.value, false
+	}
 	if !ok {
 		return zeroValue[V](), false
 	}
@@ -223,29 +630,121 @@ func (m *lockedMap[V]) Update(newItem *Item[V]) (V, bool) {
 	if m.shouldUpdate != nil && !m.shouldUpdate(newItem.Value, item.value) {
 		return item.value, false
 	}
+	extra := item.extra()
+	if newItem.isStale(extra.version) {
+		return item.value, false
+	}
 
 	m.em.update(newItem.Key, newItem.Conflict, item.expiration, newItem.Expiration)
-	m.data[newItem.Key] = storeItem[V]{
-		key:        newItem.Key,
-		conflict:   newItem.Conflict,
-		value:      newItem.Value,
-		expiration: newItem.Expiration,
+	// Like the miss penalty, the fetch cost is kept if the new value has none.
+	fetchCost := newItem.fetchCost
+	if fetchCost == 0 {
+		fetchCost = extra.fetchCost
+	}
+	m.data[newItem.Key] = newStoreItem(newItem, fetchCost, extra.hot)
+	if extra.hot {
+		m.replicas.set(m.data[newItem.Key])
 	}
 
 	return item.value, true
 }
 
-func (m *lockedMap[V]) Clear(onEvict func(item *Item[V])) {
+// batch applies the operations of ops at the given indexes, in order. Only
+// the read lock is taken if they're all Gets.
+func (m *lockedMap[V]) batch(ops []storeOp[V], indexes []int) {
+	readOnly := true
+	for _, i := range indexes {
+		readOnly = readOnly && ops[i].op == TraceGet
+	}
+	if readOnly {
+		m.RLock()
+		defer m.RUnlock()
+	} else {
+		m.Lock()
+		defer m.Unlock()
+	}
+	for _, i := range indexes {
+		op := &ops[i]
+		switch op.op {
+		case TraceGet:
+			item, ok := m.data[op.item.Key]
+			op.value, op.ok, op.hot = m.check(item, ok, op.item.Conflict)
+		case TraceSet:
+			op.value, op.ok = m.update(op.item)
+		case TraceDel:
+			_, op.value, op.ok = m.del(op.item.Key, op.item.Conflict)
+		}
+	}
+}
+
+func (m *lockedMap[V]) items() []*Item[V] {
+	m.RLock()
+	defer m.RUnlock()
+	items := make([]*Item[V], 0, len(m.data))
+	now := ttlNow()
+	generation := m.generation.Load()
+	for key, item := range m.data {
+		if !item.expiration.IsZero() && now.After(item.expiration) {
+			continue
+		}
+		if item.extra().generation < generation {
+			continue
+		}
+		items = append(items, &Item[V]{
+			Key:        key,
+			Conflict:   item.conflict,
+			Value:      item.value,
+			Expiration: item.expiration,
+		})
+	}
+	return items
+}
+
+func (m *lockedMap[V]) purge() []*Item[V] {
 	m.Lock()
 	defer m.Unlock()
+	var purged []*Item[V]
+	generation := m.generation.Load()
+	for key, item := range m.data {
+		if item.extra().generation >= generation {
+			continue
+		}
+		if !item.expiration.IsZero() {
+			m.em.del(key, item.expiration)
+		}
+		delete(m.data, key)
+		if item.extra().hot {
+			m.replicas.del(key)
+		}
+		purged = append(purged, &Item[V]{
+			Key:        key,
+			Conflict:   item.conflict,
+			Value:      item.value,
+			Expiration: item.expiration,
+		})
+	}
+	return purged
+}
+
+func (m *lockedMap[V]) Clear(onEvict func(item *Item[V])) {
+	m.Lock()
+	data := m.data
+	m.data = make(map[uint64]storeItem[V])
+	for key, si := range data {
+		if si.extra().hot {
+			m.replicas.del(key)
+		}
+	}
+	m.Unlock()
+	// onEvict is called without the lock, which it may need to take through
+	// the cache, see Config.OrderedCallbacks.
 	i := &Item[V]{}
 	if onEvict != nil {
-		for _, si := range m.data {
+		for _, si := range data {
 			i.Key = si.key
 			i.Conflict = si.conflict
 			i.Value = si.value
 			onEvict(i)
 		}
 	}
-	m.data = make(map[uint64]storeItem[V])
 }
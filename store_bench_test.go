@@ -0,0 +1,104 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+// benchStore is what BenchmarkStores needs from the store implementations.
+type benchStore interface {
+	Get(key, conflict uint64) (int, bool)
+	Set(i *Item[int])
+	Del(key, conflict uint64) (uint64, int, bool)
+}
+
+// benchStores are the implementations compared by BenchmarkStores. A new
+// store is evaluated against the others by adding it here.
+var benchStores = []struct {
+	name string
+	new  func() benchStore
+}{
+	{"shardedMap", func() benchStore { return newShardedMap[int]() }},
+	{"lockedMap", func() benchStore { return singleLockedMap{newLockedMap[int](nil)} }},
+	{"syncMap", func() benchStore { return &syncMapStore{} }},
+}
+
+// singleLockedMap is a store of a single shard, the baseline for sharding.
+type singleLockedMap struct {
+	*lockedMap[int]
+}
+
+func (m singleLockedMap) Get(key, conflict uint64) (int, bool) {
+	return m.get(key, conflict)
+}
+
+// syncMapStore is a store on a sync.Map, the baseline for lock-free stores.
+type syncMapStore struct {
+	m sync.Map
+}
+
+func (s *syncMapStore) Get(key, conflict uint64) (int, bool) {
+	v, ok := s.m.Load(key)
+	if !ok {
+		return 0, false
+	}
+	i := v.(*Item[int])
+	if conflict != 0 && conflict != i.Conflict {
+		return 0, false
+	}
+	return i.Value, true
+}
+
+func (s *syncMapStore) Set(i *Item[int]) {
+	s.m.Store(i.Key, i)
+}
+
+func (s *syncMapStore) Del(key, conflict uint64) (uint64, int, bool) {
+	v, ok := s.m.LoadAndDelete(key)
+	if !ok {
+		return 0, 0, false
+	}
+	i := v.(*Item[int])
+	return i.Conflict, i.Value, true
+}
+
+// BenchmarkStores compares the store implementations over mixes of reads and
+// writes, e.g. for 4 and 16 cores, in a machine-readable output:
+//
+//	go test -run '^$' -bench 'Stores/.*/reads=90' -cpu 4,16 -json
+func BenchmarkStores(b *testing.B) {
+	const numKeys = 1 << 14
+	keys := make([][2]uint64, numKeys)
+	for n := range keys {
+		keys[n][0], keys[n][1] = z.KeyToHash(n)
+	}
+	for _, impl := range benchStores {
+		for _, reads := range []int{100, 90, 50, 10} {
+			b.Run(fmt.Sprintf("%s/reads=%d", impl.name, reads), func(b *testing.B) {
+				s := impl.new()
+				for _, k := range keys {
+					s.Set(&Item[int]{Key: k[0], Conflict: k[1], Value: 1})
+				}
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for n := int(z.FastRand()); pb.Next(); n++ {
+						k := keys[n%numKeys]
+						if int(z.FastRand()%100) < reads {
+							s.Get(k[0], k[1])
+						} else {
+							s.Set(&Item[int]{Key: k[0], Conflict: k[1], Value: n})
+						}
+					}
+				})
+			})
+		}
+	}
+}
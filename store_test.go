@@ -146,6 +146,140 @@ func TestStoreUpdate(t *testing.T) {
 	require.Empty(t, val)
 }
 
+func TestStoreVersion(t *testing.T) {
+	s := newStore[int]()
+	key, conflict := z.KeyToHash(1)
+	s.Set(&Item[int]{Key: key, Conflict: conflict, Value: 1, version: 5, versioned: true})
+
+	old := &Item[int]{Key: key, Conflict: conflict, Value: 2, version: 4, versioned: true}
+	_, ok := s.Update(old)
+	require.False(t, ok)
+	require.True(t, old.stale)
+	s.Set(&Item[int]{Key: key, Conflict: conflict, Value: 2, version: 4, versioned: true})
+	val, _ := s.Get(key, conflict)
+	require.Equal(t, 1, val)
+
+	_, ok = s.Update(&Item[int]{Key: key, Conflict: conflict, Value: 3, version: 5, versioned: true})
+	require.True(t, ok)
+	val, _ = s.Get(key, conflict)
+	require.Equal(t, 3, val)
+
+	// Unversioned writes always go through, and reset the version.
+	_, ok = s.Update(&Item[int]{Key: key, Conflict: conflict, Value: 4})
+	require.True(t, ok)
+	_, ok = s.Update(&Item[int]{Key: key, Conflict: conflict, Value: 5, version: 1, versioned: true})
+	require.True(t, ok)
+	val, _ = s.Get(key, conflict)
+	require.Equal(t, 5, val)
+}
+
+func TestStoreHot(t *testing.T) {
+	s := newStore[int]()
+	key, conflict := z.KeyToHash(1)
+	s.SetHot(key, true)
+	_, ok, hot := s.GetHot(key, conflict)
+	require.False(t, ok)
+	require.False(t, hot)
+
+	s.Set(&Item[int]{Key: key, Conflict: conflict, Value: 1})
+	s.SetHot(key, true)
+	val, ok, hot := s.GetHot(key, conflict)
+	require.True(t, ok)
+	require.True(t, hot)
+	require.Equal(t, 1, val)
+
+	// Updates keep the flag.
+	_, ok = s.Update(&Item[int]{Key: key, Conflict: conflict, Value: 2})
+	require.True(t, ok)
+	_, _, hot = s.GetHot(key, conflict)
+	require.True(t, hot)
+
+	s.SetHot(key, false)
+	_, _, hot = s.GetHot(key, conflict)
+	require.False(t, hot)
+}
+
+func TestStoreItemExtras(t *testing.T) {
+	s := newShardedMap[int]()
+	key, conflict := z.KeyToHash(1)
+	extras := func() *itemExtras {
+		m := s.shards[key%numShards]
+		m.RLock()
+		defer m.RUnlock()
+		return m.data[key].extras
+	}
+	s.Set(&Item[int]{Key: key, Conflict: conflict, Value: 1})
+	require.Nil(t, extras(), "the items without optional fields don't allocate them")
+
+	s.SetHot(key, true)
+	require.Equal(t, &itemExtras{hot: true}, extras())
+	_, ok := s.Update(&Item[int]{Key: key, Conflict: conflict, Value: 2, version: 3, versioned: true})
+	require.True(t, ok)
+	require.Equal(t, &itemExtras{version: 3, hot: true}, extras())
+	s.SetHot(key, false)
+	require.Equal(t, &itemExtras{version: 3}, extras())
+	_, ok = s.Update(&Item[int]{Key: key, Conflict: conflict, Value: 3})
+	require.True(t, ok)
+	require.Nil(t, extras())
+}
+
+func TestStoreBatch(t *testing.T) {
+	s := newStore[int]()
+	key, conflict := z.KeyToHash(1)
+	// other is missing, and in the same shard as key.
+	other := key + numShards
+	s.Set(&Item[int]{Key: key, Conflict: conflict, Value: 1})
+
+	ops := []storeOp[int]{
+		{op: TraceGet, item: &Item[int]{Key: key, Conflict: conflict}},
+		{op: TraceSet, item: &Item[int]{Key: key, Conflict: conflict, Value: 2}},
+		{op: TraceGet, item: &Item[int]{Key: key, Conflict: conflict}},
+		{op: TraceSet, item: nil},
+		{op: TraceGet, item: &Item[int]{Key: other}},
+		{op: TraceDel, item: &Item[int]{Key: key, Conflict: conflict}},
+		{op: TraceGet, item: &Item[int]{Key: key, Conflict: conflict}},
+	}
+	s.Batch(ops)
+	require.True(t, ops[0].ok)
+	require.Equal(t, 1, ops[0].value)
+	// The Set updated the value, and returned the previous one.
+	require.True(t, ops[1].ok)
+	require.Equal(t, 1, ops[1].value)
+	require.True(t, ops[2].ok)
+	require.Equal(t, 2, ops[2].value)
+	require.False(t, ops[4].ok)
+	require.Equal(t, 2, ops[5].value)
+	require.False(t, ops[6].ok)
+	_, ok := s.Get(key, conflict)
+	require.False(t, ok)
+}
+
+func TestStoreInvalidate(t *testing.T) {
+	s := newStore[int]()
+	key, conflict := z.KeyToHash(1)
+	s.Set(&Item[int]{Key: key, Conflict: conflict, Value: 1, Expiration: time.Now().Add(time.Hour)})
+	s.Invalidate()
+	require.Equal(t, uint64(1), s.Generation())
+	_, ok := s.Get(key, conflict)
+	require.False(t, ok)
+
+	key2, conflict2 := z.KeyToHash(2)
+	s.Set(&Item[int]{Key: key2, Conflict: conflict2, Value: 2, generation: s.Generation()})
+
+	var purged []*Item[int]
+	for shard := 0; shard < int(numShards); shard++ {
+		purged = append(purged, s.Purge(shard)...)
+	}
+	require.Len(t, purged, 1)
+	require.Equal(t, key, purged[0].Key)
+	require.Equal(t, 1, purged[0].Value)
+	require.Zero(t, s.Expiration(key))
+
+	val, ok := s.Get(key2, conflict2)
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+}
+
 func TestStoreCollision(t *testing.T) {
 	s := newShardedMap[int]()
 	s.shards[1].Lock()
@@ -198,8 +332,15 @@ func TestStoreExpiration(t *testing.T) {
 
 	ttl := s.Expiration(key)
 	require.Equal(t, expiration, ttl)
+	ttl, ok = s.GetExpiration(key, conflict)
+	require.True(t, ok)
+	require.Equal(t, expiration, ttl)
+	_, ok = s.GetExpiration(key, conflict+1)
+	require.False(t, ok)
 
 	s.Del(key, conflict)
+	_, ok = s.GetExpiration(key, conflict)
+	require.False(t, ok)
 
 	_, ok = s.Get(key, conflict)
 	require.False(t, ok)
@@ -211,6 +352,36 @@ func TestStoreExpiration(t *testing.T) {
 	require.True(t, ttl.IsZero())
 }
 
+func TestStoreTouch(t *testing.T) {
+	s := newShardedMap[int]()
+	expiration := time.Now().Add(time.Minute)
+	s.Set(&Item[int]{Key: 1, Conflict: 1, Value: 1, Expiration: expiration, slide: time.Hour})
+	s.Set(&Item[int]{Key: 2, Conflict: 2, Value: 2, Expiration: expiration})
+
+	// Only the sliding item is extended, by its TTL.
+	s.Touch(1, 2)
+	require.Equal(t, expiration, s.Expiration(1))
+	s.Touch(1, 1)
+	s.Touch(2, 2)
+	s.Touch(3, 3)
+	extended := s.Expiration(1)
+	require.InDelta(t, time.Hour, time.Until(extended), float64(time.Minute))
+	require.Equal(t, expiration, s.Expiration(2))
+	require.Equal(t, uint64(1), s.expiryMap.buckets[storageBucket(extended)][1])
+	require.NotContains(t, s.expiryMap.buckets[storageBucket(expiration)], uint64(1))
+
+	// The extensions shorter than the granularity are skipped.
+	s.Touch(1, 1)
+	require.Equal(t, extended, s.Expiration(1))
+
+	// Expired items aren't revived.
+	s.Set(&Item[int]{Key: 1, Conflict: 1, Value: 1, Expiration: time.Now().Add(-time.Second),
+		slide: time.Hour})
+	s.Touch(1, 1)
+	_, ok := s.Get(1, 1)
+	require.False(t, ok)
+}
+
 func BenchmarkStoreGet(b *testing.B) {
 	s := newStore[int]()
 	key, conflict := z.KeyToHash(1)
@@ -118,14 +118,14 @@ func (c *Clairvoyant) Metrics() *Metrics {
 	heap.Init(data)
 	for _, key := range c.access {
 		if _, has := look[key]; has {
-			stat.add(hit, 0, 1)
+			stat.add(hit, 1)
 			continue
 		}
 		if uint64(data.Len()) >= c.capacity {
 			victim := heap.Pop(data)
 			delete(look, victim.(*clairvoyantItem).key)
 		}
-		stat.add(miss, 0, 1)
+		stat.add(miss, 1)
 		look[key] = struct{}{}
 		heap.Push(data, &clairvoyantItem{key, c.hits[key]})
 	}
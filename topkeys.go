@@ -0,0 +1,150 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+// topKeysStripes is the number of stripes of topKeys, each with its own lock,
+// so that the Gets don't all contend on a single one.
+const topKeysStripes = 8
+
+// KeyFrequency is a key returned by Cache.TopKeys, with its approximate number
+// of Gets.
+type KeyFrequency[K Key] struct {
+	Key     K
+	KeyHash uint64
+	// Count is the number of Gets of Key, hits and misses, since it's tracked
+	// or the cache was last cleared. It overestimates it by up to Error.
+	Count uint64
+	// Error is the number of Gets of the keys Key replaced in the tracking,
+	// which Count may include.
+	Error uint64
+}
+
+// topKeys tracks the keys read the most, with the space-saving algorithm: it
+// counts the Gets of up to capacity keys per stripe, and a Get of another key
+// replaces the key of the lowest count, taking over its count. The keys whose
+// Count is higher than the lowest one are guaranteed to be there. All the
+// methods are no-ops on a nil *topKeys.
+type topKeys[K Key] struct {
+	stripes [topKeysStripes]topKeysStripe[K]
+}
+
+type topKeysStripe[K Key] struct {
+	sync.Mutex
+	capacity int
+	// freqs is a min-heap of the keys by Count, and index the positions of the
+	// keys in it, by hash.
+	freqs []KeyFrequency[K]
+	index map[uint64]int
+}
+
+// newTopKeys returns a topKeys tracking up to capacity keys per stripe, so
+// that the capacity keys read the most are tracked however the stripes spread
+// them.
+func newTopKeys[K Key](capacity int) *topKeys[K] {
+	t := &topKeys[K]{}
+	for i := range t.stripes {
+		t.stripes[i].capacity = capacity
+		t.stripes[i].index = make(map[uint64]int, capacity)
+	}
+	return t
+}
+
+// add records a Get of key.
+func (t *topKeys[K]) add(key K, keyHash uint64) {
+	if t == nil {
+		return
+	}
+	s := &t.stripes[keyHash%topKeysStripes]
+	s.Lock()
+	defer s.Unlock()
+	if i, ok := s.index[keyHash]; ok {
+		s.freqs[i].Count++
+		heap.Fix(s, i)
+		return
+	}
+	if len(s.freqs) < s.capacity {
+		heap.Push(s, KeyFrequency[K]{Key: key, KeyHash: keyHash, Count: 1})
+		return
+	}
+	lowest := &s.freqs[0]
+	delete(s.index, lowest.KeyHash)
+	*lowest = KeyFrequency[K]{Key: key, KeyHash: keyHash, Count: lowest.Count + 1, Error: lowest.Count}
+	s.index[keyHash] = 0
+	heap.Fix(s, 0)
+}
+
+// top returns up to n of the keys read the most, by decreasing Count.
+func (t *topKeys[K]) top(n int) []KeyFrequency[K] {
+	if t == nil || n <= 0 {
+		return nil
+	}
+	var freqs []KeyFrequency[K]
+	for i := range t.stripes {
+		s := &t.stripes[i]
+		s.Lock()
+		freqs = append(freqs, s.freqs...)
+		s.Unlock()
+	}
+	return topFrequencies(freqs, n)
+}
+
+func (t *topKeys[K]) clear() {
+	if t == nil {
+		return
+	}
+	for i := range t.stripes {
+		s := &t.stripes[i]
+		s.Lock()
+		s.freqs = nil
+		s.index = make(map[uint64]int, s.capacity)
+		s.Unlock()
+	}
+}
+
+// topFrequencies sorts freqs by decreasing Count and returns the first n.
+func topFrequencies[K Key](freqs []KeyFrequency[K], n int) []KeyFrequency[K] {
+	sort.Slice(freqs, func(i, j int) bool {
+		if freqs[i].Count != freqs[j].Count {
+			return freqs[i].Count > freqs[j].Count
+		}
+		return freqs[i].KeyHash < freqs[j].KeyHash
+	})
+	if len(freqs) > n {
+		freqs = freqs[:n]
+	}
+	return freqs
+}
+
+// The methods of heap.Interface, which keep index up to date.
+
+func (s *topKeysStripe[K]) Len() int { return len(s.freqs) }
+
+func (s *topKeysStripe[K]) Less(i, j int) bool { return s.freqs[i].Count < s.freqs[j].Count }
+
+func (s *topKeysStripe[K]) Swap(i, j int) {
+	s.freqs[i], s.freqs[j] = s.freqs[j], s.freqs[i]
+	s.index[s.freqs[i].KeyHash] = i
+	s.index[s.freqs[j].KeyHash] = j
+}
+
+func (s *topKeysStripe[K]) Push(x any) {
+	f := x.(KeyFrequency[K])
+	s.index[f.KeyHash] = len(s.freqs)
+	s.freqs = append(s.freqs, f)
+}
+
+func (s *topKeysStripe[K]) Pop() any {
+	f := s.freqs[len(s.freqs)-1]
+	s.freqs = s.freqs[:len(s.freqs)-1]
+	delete(s.index, f.KeyHash)
+	return f
+}
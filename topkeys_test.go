@@ -0,0 +1,94 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopKeysSpaceSaving(t *testing.T) {
+	top := newTopKeys[string](2)
+	// All the keys go to the same stripe, to exercise the replacements.
+	top.add("a", 0)
+	top.add("a", 0)
+	top.add("a", 0)
+	top.add("b", topKeysStripes)
+	top.add("c", 2*topKeysStripes)
+
+	require.Equal(t, []KeyFrequency[string]{
+		{Key: "a", KeyHash: 0, Count: 3},
+		{Key: "c", KeyHash: 2 * topKeysStripes, Count: 2, Error: 1},
+	}, top.top(10))
+	require.Len(t, top.top(1), 1)
+	require.Nil(t, top.top(0))
+
+	top.clear()
+	require.Empty(t, top.top(10))
+
+	var nilTop *topKeys[string]
+	nilTop.add("a", 0)
+	require.Nil(t, nilTop.top(1))
+}
+
+func TestCacheTopKeys(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 1000,
+		MaxCost:     100,
+		BufferItems: 64,
+		TopKeys:     3,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 1000; i++ {
+		c.Get(i)
+		c.Get(1)
+		if i%2 == 0 {
+			c.Get(2)
+		}
+		if i%4 == 0 {
+			c.Get(3)
+		}
+	}
+	c.GetQuiet(3)
+
+	top := c.TopKeys(3)
+	require.Len(t, top, 3)
+	for i, key := range []int{1, 2, 3} {
+		require.Equal(t, key, top[i].Key)
+		keyHash, _ := z.KeyToHash(key)
+		require.Equal(t, keyHash, top[i].KeyHash)
+		require.GreaterOrEqual(t, top[i].Count, uint64(1000/(1<<i)))
+		require.LessOrEqual(t, top[i].Count-top[i].Error, uint64(1000/(1<<i)+1))
+	}
+
+	c.Clear()
+	require.Empty(t, c.TopKeys(3))
+}
+
+func TestCacheTopKeysDisabled(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	c.Get(1)
+	require.Nil(t, c.TopKeys(1))
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		TopKeys:     -1,
+	})
+	require.Error(t, err)
+}
@@ -0,0 +1,65 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+// TraceOp identifies the cache operation passed to Config.OnTrace.
+type TraceOp int
+
+const (
+	TraceGet TraceOp = iota
+	TraceSet
+	TraceDel
+)
+
+func (op TraceOp) String() string {
+	switch op {
+	case TraceGet:
+		return "get"
+	case TraceSet:
+		return "set"
+	case TraceDel:
+		return "del"
+	default:
+		return "unidentified"
+	}
+}
+
+// traceStart returns the start time of an operation if it has been sampled for
+// tracing, or zero otherwise. It costs a single nil check when tracing is off.
+// If Config.DetailedMetrics is set, it returns the start time of the other
+// operations too, negated, for traceEnd to only record their latency.
+func (c *Cache[K, V]) traceStart() int64 {
+	if c.onTrace == nil || (c.traceRate > 1 && z.FastRand()%c.traceRate != 0) {
+		if c.detailedMetrics {
+			return -z.NanoTime()
+		}
+		return 0
+	}
+	return z.NanoTime()
+}
+
+// traceEnd records the latency of an operation timed by traceStart if
+// Config.DetailedMetrics is set, and calls onTrace if it has been sampled.
+func (c *Cache[K, V]) traceEnd(op TraceOp, keyHash uint64, start int64, hit bool) {
+	if start == 0 {
+		return
+	}
+	traced := start > 0
+	if !traced {
+		start = -start
+	}
+	dur := z.NanoTime() - start
+	if c.detailedMetrics {
+		c.Metrics.trackLatency(op, dur)
+	}
+	if traced {
+		c.onTrace(op, keyHash, dur, hit)
+	}
+}
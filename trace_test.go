@@ -0,0 +1,87 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/ristretto/v2/z"
+	"github.com/stretchr/testify/require"
+)
+
+type traceRecord struct {
+	op      TraceOp
+	keyHash uint64
+	hit     bool
+}
+
+func TestCacheOnTrace(t *testing.T) {
+	var mu sync.Mutex
+	var records []traceRecord
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     1000,
+		BufferItems: 64,
+		OnTrace: func(op TraceOp, keyHash uint64, durNs int64, hit bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			require.GreaterOrEqual(t, durNs, int64(0))
+			records = append(records, traceRecord{op, keyHash, hit})
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	key, _ := z.KeyToHash(1)
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	c.Get(1)
+	c.Del(1)
+	c.Get(1)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []traceRecord{
+		{TraceSet, key, true},
+		{TraceGet, key, true},
+		{TraceDel, key, false},
+		{TraceGet, key, false},
+	}, records)
+}
+
+func TestCacheOnTraceSampling(t *testing.T) {
+	var mu sync.Mutex
+	traced := 0
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:     100,
+		MaxCost:         1000,
+		BufferItems:     64,
+		TraceSampleRate: 10,
+		OnTrace: func(op TraceOp, keyHash uint64, durNs int64, hit bool) {
+			mu.Lock()
+			traced++
+			mu.Unlock()
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 1000; i++ {
+		c.Get(i)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	require.Greater(t, traced, 0)
+	require.Less(t, traced, 1000)
+}
+
+func TestTraceOpString(t *testing.T) {
+	require.Equal(t, "get", TraceGet.String())
+	require.Equal(t, "set", TraceSet.String())
+	require.Equal(t, "del", TraceDel.String())
+	require.Equal(t, "unidentified", TraceOp(-1).String())
+}
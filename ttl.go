@@ -25,9 +25,19 @@ func cleanupBucket(t time.Time) int64 {
 	return storageBucket(t) - 1
 }
 
+// ttlAuditBuckets is the number of expiration buckets checked by every audit,
+// see Config.TTLAuditInterval.
+const ttlAuditBuckets = 8
+
 // bucket type is a map of key to conflict.
 type bucket map[uint64]uint64
 
+// bucketEntry is a key of a bucket, see expirationMap.sample.
+type bucketEntry struct {
+	bucket        int64
+	key, conflict uint64
+}
+
 // expirationMap is a map of bucket number to the corresponding bucket.
 type expirationMap[V any] struct {
 	sync.RWMutex
@@ -38,7 +48,7 @@ type expirationMap[V any] struct {
 func newExpirationMap[V any]() *expirationMap[V] {
 	return &expirationMap[V]{
 		buckets:              make(map[int64]bucket),
-		lastCleanedBucketNum: cleanupBucket(time.Now()),
+		lastCleanedBucketNum: cleanupBucket(ttlNow()),
 	}
 }
 
@@ -110,13 +120,13 @@ func (m *expirationMap[_]) del(key uint64, expiration time.Time) {
 // cleanup removes all the items in the bucket that was just completed. It deletes
 // those items from the store, and calls the onEvict function on those items.
 // This function is meant to be called periodically.
-func (m *expirationMap[V]) cleanup(store store[V], policy *defaultPolicy[V], onEvict func(item *Item[V])) int {
+func (m *expirationMap[V]) cleanup(store store[V], policy policy[V], onEvict func(item *Item[V])) int {
 	if m == nil {
 		return 0
 	}
 
 	m.Lock()
-	now := time.Now()
+	now := ttlNow()
 	currentBucketNum := cleanupBucket(now)
 	// Clean up all buckets up to and including currentBucketNum, starting from
 	// (but not including) the last one that was cleaned up
@@ -141,9 +151,10 @@ func (m *expirationMap[V]) cleanup(store store[V], policy *defaultPolicy[V], onE
 
 			cost := policy.Cost(key)
 			policy.Del(key)
-			_, value := store.Del(key, conflict)
+			_, value, found := store.Del(key, conflict)
 
-			if onEvict != nil {
+			// The keys deleted since they were set to expire already left.
+			if onEvict != nil && found {
 				onEvict(&Item[V]{Key: key,
 					Conflict:   conflict,
 					Value:      value,
@@ -159,6 +170,71 @@ func (m *expirationMap[V]) cleanup(store store[V], policy *defaultPolicy[V], onE
 	return cleanedBucketsCount
 }
 
+// sample returns the keys of up to n buckets, picked in the random order the
+// map iterates in.
+func (m *expirationMap[_]) sample(n int) []bucketEntry {
+	if m == nil {
+		return nil
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+	var entries []bucketEntry
+	for bucketNum, b := range m.buckets {
+		if n == 0 {
+			break
+		}
+		n--
+		for key, conflict := range b {
+			entries = append(entries, bucketEntry{bucket: bucketNum, key: key, conflict: conflict})
+		}
+	}
+	return entries
+}
+
+// delIf deletes key from the bucket bucketNum if it's there with conflict, and
+// reports whether it was.
+func (m *expirationMap[_]) delIf(bucketNum int64, key, conflict uint64) bool {
+	m.Lock()
+	defer m.Unlock()
+	b, ok := m.buckets[bucketNum]
+	if !ok {
+		return false
+	}
+	if c, ok := b[key]; !ok || c != conflict {
+		return false
+	}
+	delete(b, key)
+	if len(b) == 0 {
+		delete(m.buckets, bucketNum)
+	}
+	return true
+}
+
+// lastCleaned returns the number of the last bucket cleaned up.
+func (m *expirationMap[_]) lastCleaned() int64 {
+	m.RLock()
+	defer m.RUnlock()
+	return m.lastCleanedBucketNum
+}
+
+// backlog returns the number of items in the buckets that cleanup would clean
+// up now.
+func (m *expirationMap[V]) backlog() int {
+	if m == nil {
+		return 0
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+	var n int
+	currentBucketNum := cleanupBucket(ttlNow())
+	for bucketNum := m.lastCleanedBucketNum + 1; bucketNum <= currentBucketNum; bucketNum++ {
+		n += len(m.buckets[bucketNum])
+	}
+	return n
+}
+
 // clear clears the expirationMap, the caller is responsible for properly
 // evicting the referenced items
 func (m *expirationMap[V]) clear() {
@@ -168,6 +244,6 @@ func (m *expirationMap[V]) clear() {
 
 	m.Lock()
 	m.buckets = make(map[int64]bucket)
-	m.lastCleanedBucketNum = cleanupBucket(time.Now())
+	m.lastCleanedBucketNum = cleanupBucket(ttlNow())
 	m.Unlock()
 }
@@ -80,3 +80,88 @@ func TestExpirationMapCleanup(t *testing.T) {
 		)
 	})
 }
+
+func TestExpirationMapBacklog(t *testing.T) {
+	em := newExpirationMap[int]()
+	var nilMap *expirationMap[int]
+	require.Zero(t, nilMap.backlog())
+
+	now := time.Now()
+	em.add(1, 1, now.Add(-time.Minute))
+	em.add(2, 2, now.Add(-time.Minute))
+	em.add(3, 3, now.Add(time.Hour))
+	require.Zero(t, em.backlog())
+
+	// Pretend the buckets of the last two minutes haven't been cleaned up.
+	em.lastCleanedBucketNum = cleanupBucket(now.Add(-2 * time.Minute))
+	require.Equal(t, 2, em.backlog())
+
+	em.cleanup(newShardedMap[int](), newDefaultPolicy[int](100, 10), nil)
+	require.Zero(t, em.backlog())
+}
+
+func TestShardedMapAudit(t *testing.T) {
+	s := newShardedMap[int]()
+	p := newDefaultPolicy[int](100, 10)
+	defer p.Close()
+
+	now := time.Now()
+	// Consistent items aren't repaired.
+	s.Set(&Item[int]{Key: 1, Conflict: 1, Value: 1, Expiration: now.Add(time.Hour)})
+	s.Set(&Item[int]{Key: 2, Conflict: 2, Value: 2})
+	// An orphan, and a stale key of an item expiring in another bucket.
+	s.expiryMap.add(3, 3, now.Add(time.Hour))
+	s.expiryMap.add(1, 1, now.Add(2*time.Hour))
+	// An expired item whose bucket was cleaned up without it.
+	s.shards[4].data[4] = storeItem[int]{key: 4, conflict: 4, value: 4,
+		expiration: now.Add(-time.Hour)}
+
+	var evicted []uint64
+	orphans, expired := s.Audit(p, func(i *Item[int]) {
+		require.Equal(t, 4, i.Value)
+		evicted = append(evicted, i.Key)
+	}, 4)
+	require.Equal(t, 2, orphans)
+	require.Equal(t, 1, expired)
+	require.Equal(t, []uint64{4}, evicted)
+	_, ok := s.Get(1, 1)
+	require.True(t, ok)
+	_, _, ok = s.Del(4, 4)
+	require.False(t, ok)
+	require.Len(t, s.expiryMap.buckets, 1)
+
+	orphans, expired = s.Audit(p, nil, 4)
+	require.Zero(t, orphans)
+	require.Zero(t, expired)
+}
+
+func TestCacheTTLAudit(t *testing.T) {
+	_, err := NewCache(&Config[int, int]{
+		NumCounters:      100,
+		MaxCost:          10,
+		BufferItems:      64,
+		TTLAuditInterval: -1,
+	})
+	require.Error(t, err)
+
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		TTLAuditInterval:   time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	s := c.storedItems.(*shardedMap[int])
+	s.expiryMap.add(3, 3, time.Now().Add(time.Hour))
+	s.shards[0].Lock()
+	s.shards[0].data[256] = storeItem[int]{key: 256, value: 256,
+		expiration: time.Now().Add(-time.Hour)}
+	s.shards[0].Unlock()
+	require.Eventually(t, func() bool {
+		return c.Metrics.TTLOrphansRepaired() == 1 && c.Metrics.TTLExpiredRepaired() == 1
+	}, time.Second, time.Millisecond)
+}
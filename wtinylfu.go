@@ -0,0 +1,331 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"container/list"
+	"math"
+	"sync/atomic"
+)
+
+const (
+	// wtlfuInitialWindow is the initial share of MaxCost given to the window
+	// of PolicyWTinyLFU, and wtlfuMinWindow and wtlfuMaxWindow the bounds the
+	// hill climber keeps it within.
+	wtlfuInitialWindow = 0.01
+	wtlfuMinWindow     = 0.01
+	wtlfuMaxWindow     = 0.8
+	// wtlfuInitialStep is the share of MaxCost the window is first moved by,
+	// the step then decays by wtlfuStepDecay on every climb, and is restarted
+	// when the hit ratio changes by more than wtlfuRestartThreshold, e.g. when
+	// the workload changes.
+	wtlfuInitialStep      = 0.0625
+	wtlfuStepDecay        = 0.98
+	wtlfuRestartThreshold = 0.05
+	// wtlfuMinSample is the minimum number of accesses between two climbs.
+	// There are at least ten times as many as the items in the cache.
+	wtlfuMinSample = 1000
+)
+
+// wtlfuSegment identifies the segments of wTinyLFUPolicy.
+type wtlfuSegment int
+
+const (
+	wtlfuWindow wtlfuSegment = iota
+	wtlfuProbation
+	wtlfuProtected
+)
+
+type wtlfuEntry struct {
+	key     uint64
+	cost    int64
+	segment wtlfuSegment
+	elem    *list.Element
+}
+
+// wTinyLFUPolicy implements the W-TinyLFU policy [1], with the adaptive window
+// of Caffeine [2], weighing entries by cost. New items are always admitted
+// into a small LRU window, which they leave for the probation segment of the
+// main SLRU area. When the cache is full, the item last moved out of the
+// window competes with the least recently used item of the probation segment,
+// and the one with the lower access frequency, as estimated by TinyLFU, is
+// evicted. Items accessed while in the probation segment move to the protected
+// segment.
+//
+// The window absorbs bursts of new keys, which the frequency filter of the
+// main area would reject, so the best size of the window depends on how
+// recency-biased the workload is. A hill climber samples the hit ratio and
+// keeps moving the window in the same direction while it improves, and turns
+// back once it drops.
+//
+// [1]: https://arxiv.org/abs/1512.00727
+// [2]: https://github.com/ben-manes/caffeine/wiki/Efficiency
+type wTinyLFUPolicy[V any] struct {
+	policyBase
+	// NOTE: align maxCost to 64-bit boundary for use with atomic.
+	maxCost int64
+	admit   *tinyLFU
+	entries map[uint64]*wtlfuEntry
+	// Front is the most recently used entry for all the segments.
+	segments [3]*list.List
+	costs    [3]int64
+
+	// window is the share of maxCost of the window, adapted by climb.
+	window float64
+	// step is the share of maxCost the window moves by on the next climb, in
+	// the direction of its sign.
+	step float64
+	// hits and misses are the accesses since the last climb, and hitRatio
+	// the hit ratio before it.
+	hits, misses int64
+	hitRatio     float64
+}
+
+func newWTinyLFUPolicy[V any](numCounters, maxCost int64) *wTinyLFUPolicy[V] {
+	p := &wTinyLFUPolicy[V]{
+		policyBase: newPolicyBase(),
+		maxCost:    maxCost,
+		admit:      newTinyLFU(numCounters),
+	}
+	p.clear()
+	go p.processItems(p.access)
+	return p
+}
+
+func (p *wTinyLFUPolicy[V]) CollectMetrics(metrics *Metrics) {
+	p.metrics = metrics
+}
+
+func (p *wTinyLFUPolicy[V]) clear() {
+	p.entries = make(map[uint64]*wtlfuEntry)
+	for i := range p.segments {
+		p.segments[i] = list.New()
+		p.costs[i] = 0
+	}
+	p.window = wtlfuInitialWindow
+	p.step = wtlfuInitialStep
+	p.hits, p.misses, p.hitRatio = 0, 0, 0
+}
+
+func (p *wTinyLFUPolicy[V]) used() int64 {
+	return p.costs[wtlfuWindow] + p.costs[wtlfuProbation] + p.costs[wtlfuProtected]
+}
+
+func (p *wTinyLFUPolicy[V]) access(keys []uint64) {
+	for _, key := range keys {
+		p.admit.Increment(key)
+		e, ok := p.entries[key]
+		if !ok {
+			p.misses++
+			continue
+		}
+		p.hits++
+		switch e.segment {
+		case wtlfuProbation:
+			p.move(e, wtlfuProtected)
+			p.demote()
+		default:
+			p.segments[e.segment].MoveToFront(e.elem)
+		}
+	}
+	if p.hits+p.misses >= max(wtlfuMinSample, 10*int64(len(p.entries))) {
+		p.climb()
+	}
+}
+
+// climb moves the window by the current step, reversing it if the hit ratio
+// dropped since the last climb.
+func (p *wTinyLFUPolicy[V]) climb() {
+	hitRatio := float64(p.hits) / float64(p.hits+p.misses)
+	change := hitRatio - p.hitRatio
+	p.hits, p.misses, p.hitRatio = 0, 0, hitRatio
+	if change < 0 {
+		p.step = -p.step
+	}
+	p.window = min(wtlfuMaxWindow, max(wtlfuMinWindow, p.window+p.step))
+	if math.Abs(change) >= wtlfuRestartThreshold {
+		p.step = math.Copysign(wtlfuInitialStep, p.step)
+	} else {
+		p.step *= wtlfuStepDecay
+	}
+	p.shrinkWindow()
+}
+
+// move moves e to the front of to.
+func (p *wTinyLFUPolicy[V]) move(e *wtlfuEntry, to wtlfuSegment) {
+	p.remove(e)
+	e.segment = to
+	e.elem = p.segments[to].PushFront(e)
+	p.costs[to] += e.cost
+}
+
+func (p *wTinyLFUPolicy[V]) remove(e *wtlfuEntry) {
+	p.segments[e.segment].Remove(e.elem)
+	p.costs[e.segment] -= e.cost
+}
+
+func (p *wTinyLFUPolicy[V]) back(segment wtlfuSegment) *wtlfuEntry {
+	return p.segments[segment].Back().Value.(*wtlfuEntry)
+}
+
+// shrinkWindow moves the least recently used entries of the window to the
+// probation segment, while the window uses more than its share of MaxCost. The
+// most recent entry always stays, so that a new key is never evicted by its
+// own Add.
+func (p *wTinyLFUPolicy[V]) shrinkWindow() {
+	windowCap := int64(float64(p.MaxCost()) * p.window)
+	for p.costs[wtlfuWindow] > windowCap && p.segments[wtlfuWindow].Len() > 1 {
+		p.move(p.back(wtlfuWindow), wtlfuProbation)
+	}
+}
+
+// demote moves the least recently used entries of the protected segment to
+// the probation segment, while it uses more than its share of the main area.
+func (p *wTinyLFUPolicy[V]) demote() {
+	mainCost := float64(p.MaxCost()) * (1 - p.window)
+	protectedCap := int64(mainCost * slruProtectedRatio)
+	for p.costs[wtlfuProtected] > protectedCap && p.segments[wtlfuProtected].Len() > 1 {
+		p.move(p.back(wtlfuProtected), wtlfuProbation)
+	}
+}
+
+// evictOne evicts the entry of probation segment, the least recently used one
+// or the one last moved from the window, with the lowest access frequency.
+// It evicts from the protected segment if the probation segment is empty, and
+// from the window if both are.
+func (p *wTinyLFUPolicy[V]) evictOne() *Item[V] {
+	var e *wtlfuEntry
+	switch probation := p.segments[wtlfuProbation]; {
+	case probation.Len() > 0:
+		victim := p.back(wtlfuProbation)
+		candidate := probation.Front().Value.(*wtlfuEntry)
+		e = victim
+		if candidate != victim && p.admit.Estimate(candidate.key) <= p.admit.Estimate(victim.key) {
+			e = candidate
+		}
+	case p.segments[wtlfuProtected].Len() > 0:
+		e = p.back(wtlfuProtected)
+	default:
+		e = p.back(wtlfuWindow)
+	}
+	p.remove(e)
+	delete(p.entries, e.key)
+	p.metrics.trackEvict(e.key, e.cost)
+	return &Item[V]{Key: e.key, Cost: e.cost}
+}
+
+func (p *wTinyLFUPolicy[V]) Add(key uint64, cost int64) ([]*Item[V], bool) {
+	p.Lock()
+	defer p.Unlock()
+	return p.add(key, cost)
+}
+
+func (p *wTinyLFUPolicy[V]) AddBatch(pairs []policyPair) []addResult[V] {
+	p.Lock()
+	defer p.Unlock()
+	return addBatch(pairs, p.add)
+}
+
+// add is Add, with the lock held.
+func (p *wTinyLFUPolicy[V]) add(key uint64, cost int64) ([]*Item[V], bool) {
+	// Cannot add an item bigger than entire cache.
+	if cost > p.MaxCost() {
+		return nil, false
+	}
+	// No need to go any further if the item is already in the cache.
+	if p.updateIfHas(key, cost) {
+		return nil, false
+	}
+
+	e := &wtlfuEntry{key: key, cost: cost, segment: wtlfuWindow}
+	e.elem = p.segments[wtlfuWindow].PushFront(e)
+	p.costs[wtlfuWindow] += cost
+	p.entries[key] = e
+	p.shrinkWindow()
+	var victims []*Item[V]
+	for p.used() > p.MaxCost() {
+		victims = append(victims, p.evictOne())
+	}
+	p.metrics.trackAdd(key, cost)
+	return victims, true
+}
+
+func (p *wTinyLFUPolicy[V]) AddIfRoom(key uint64, cost int64) bool {
+	p.Lock()
+	if _, ok := p.entries[key]; ok || p.used()+cost > p.MaxCost() {
+		p.Unlock()
+		return false
+	}
+	p.Unlock()
+	_, added := p.Add(key, cost)
+	return added
+}
+
+func (p *wTinyLFUPolicy[V]) updateIfHas(key uint64, cost int64) bool {
+	e, ok := p.entries[key]
+	if !ok {
+		return false
+	}
+	p.metrics.trackUpdate(key, e.cost, cost)
+	p.costs[e.segment] += cost - e.cost
+	e.cost = cost
+	return true
+}
+
+func (p *wTinyLFUPolicy[V]) Has(key uint64) bool {
+	p.Lock()
+	defer p.Unlock()
+	_, ok := p.entries[key]
+	return ok
+}
+
+func (p *wTinyLFUPolicy[V]) Del(key uint64) {
+	p.Lock()
+	defer p.Unlock()
+	e, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	p.remove(e)
+	delete(p.entries, key)
+	p.metrics.trackEvict(key, e.cost)
+}
+
+func (p *wTinyLFUPolicy[V]) Cap() int64 {
+	p.Lock()
+	defer p.Unlock()
+	return p.MaxCost() - p.used()
+}
+
+func (p *wTinyLFUPolicy[V]) Update(key uint64, cost int64) {
+	p.Lock()
+	p.updateIfHas(key, cost)
+	p.Unlock()
+}
+
+func (p *wTinyLFUPolicy[V]) Cost(key uint64) int64 {
+	p.Lock()
+	defer p.Unlock()
+	if e, ok := p.entries[key]; ok {
+		return e.cost
+	}
+	return -1
+}
+
+func (p *wTinyLFUPolicy[V]) Clear() {
+	p.Lock()
+	p.clear()
+	p.admit.clear()
+	p.Unlock()
+}
+
+func (p *wTinyLFUPolicy[V]) MaxCost() int64 {
+	return atomic.LoadInt64(&p.maxCost)
+}
+
+func (p *wTinyLFUPolicy[V]) UpdateMaxCost(maxCost int64) {
+	atomic.StoreInt64(&p.maxCost, maxCost)
+}
@@ -0,0 +1,147 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWTinyLFUPolicyAdd(t *testing.T) {
+	p := newWTinyLFUPolicy[int](1000, 100)
+	defer p.Close()
+	p.CollectMetrics(newMetrics())
+
+	victims, added := p.Add(1, 101)
+	require.Nil(t, victims)
+	require.False(t, added)
+	for i := uint64(1); i <= 10; i++ {
+		victims, added = p.Add(i, 10)
+		require.Nil(t, victims)
+		require.True(t, added)
+	}
+	victims, added = p.Add(1, 10)
+	require.Nil(t, victims)
+	require.False(t, added)
+
+	// Only the last key fits in the window, the others moved on to the
+	// probation segment.
+	p.Lock()
+	require.Equal(t, 1, p.segments[wtlfuWindow].Len())
+	require.Equal(t, wtlfuWindow, p.entries[10].segment)
+	require.Equal(t, wtlfuProbation, p.entries[1].segment)
+	p.Unlock()
+
+	// 1 is more frequent than 10, the candidate leaving the window, so 10 is
+	// evicted instead of 1, the least recently used.
+	for n := 0; n < 3; n++ {
+		p.admit.Increment(1)
+	}
+	victims, added = p.Add(11, 10)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(10), victims[0].Key)
+	// A candidate more frequent than the least recently used item evicts it.
+	for n := 0; n < 5; n++ {
+		p.admit.Increment(11)
+	}
+	victims, _ = p.Add(12, 10)
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(1), victims[0].Key)
+	require.Equal(t, int64(0), p.Cap())
+	require.Equal(t, uint64(2), p.metrics.KeysEvicted())
+
+	require.False(t, p.AddIfRoom(13, 10))
+	p.Del(12)
+	require.False(t, p.Has(12))
+	require.Equal(t, int64(-1), p.Cost(12))
+	require.True(t, p.AddIfRoom(13, 10))
+	p.Update(13, 5)
+	require.Equal(t, int64(5), p.Cost(13))
+	p.Clear()
+	require.Equal(t, int64(100), p.Cap())
+	require.Zero(t, p.admit.Estimate(1))
+}
+
+func TestWTinyLFUPolicyProtected(t *testing.T) {
+	p := newWTinyLFUPolicy[int](1000, 100)
+	defer p.Close()
+
+	for i := uint64(1); i <= 10; i++ {
+		p.Add(i, 10)
+	}
+	p.itemsCh <- []uint64{1, 2}
+	time.Sleep(wait)
+	p.Lock()
+	require.Equal(t, wtlfuProtected, p.entries[1].segment)
+	require.Equal(t, int64(2), p.hits)
+	p.Unlock()
+
+	// A scan goes through the window and probation segments only.
+	for i := uint64(11); i <= 50; i++ {
+		p.Add(i, 10)
+	}
+	require.True(t, p.Has(1))
+	require.True(t, p.Has(2))
+}
+
+func TestWTinyLFUPolicyClimb(t *testing.T) {
+	p := newWTinyLFUPolicy[int](1000, 1000)
+	defer p.Close()
+	for i := uint64(1); i <= 100; i++ {
+		p.Add(i, 10)
+	}
+
+	// The window grows while the hit ratio improves.
+	p.Lock()
+	defer p.Unlock()
+	p.hits, p.misses = 50, 50
+	p.climb()
+	require.InDelta(t, wtlfuInitialWindow+wtlfuInitialStep, p.window, 1e-9)
+	require.InDelta(t, wtlfuInitialStep, p.step, 1e-9)
+	require.LessOrEqual(t, p.costs[wtlfuWindow], int64(float64(1000)*p.window))
+	p.hits, p.misses = 51, 49
+	p.climb()
+	require.InDelta(t, wtlfuInitialStep*wtlfuStepDecay, p.step, 1e-9)
+
+	// It turns back once the hit ratio drops, and stays within its bounds.
+	window := p.window
+	p.hits, p.misses = 50, 50
+	p.climb()
+	require.Less(t, p.window, window)
+	require.Negative(t, p.step)
+	for n := 0; n < 100; n++ {
+		p.hits, p.misses = 0, 100
+		p.climb()
+		require.GreaterOrEqual(t, p.window, wtlfuMinWindow)
+		require.LessOrEqual(t, p.window, wtlfuMaxWindow)
+	}
+}
+
+func TestCacheWTinyLFUPolicy(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		Metrics:            true,
+		IgnoreInternalCost: true,
+		Policy:             PolicyWTinyLFU,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 20; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	require.Equal(t, uint64(20), c.Metrics.KeysAdded())
+	require.Equal(t, uint64(10), c.Metrics.KeysEvicted())
+	val, ok := c.Get(19)
+	require.True(t, ok)
+	require.Equal(t, 19, val)
+}
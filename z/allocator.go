@@ -16,8 +16,6 @@ import (
 	"sync/atomic"
 	"time"
 	"unsafe"
-
-	"github.com/dustin/go-humanize"
 )
 
 // Allocator amortizes the cost of small allocations by allocating memory in
@@ -92,7 +90,7 @@ func Allocators() string {
 
 	var buf bytes.Buffer
 	for tag, sz := range tags {
-		fmt.Fprintf(&buf, "Tag: %s Num: %d Size: %s . ", tag, num[tag], humanize.IBytes(sz))
+		fmt.Fprintf(&buf, "Tag: %s Num: %d Size: %s . ", tag, num[tag], iBytes(sz))
 	}
 	allocsMu.Unlock()
 	return buf.String()
@@ -297,6 +295,66 @@ func (a *Allocator) Allocate(sz int) []byte {
 	}
 }
 
+// Realloc resizes b, which must have been returned by the allocator, to
+// newSize bytes. If b is the latest allocation and there's room left in its
+// buffer, it's resized in place. Otherwise, a new slice is allocated and the
+// contents of b are copied over. Bytes beyond len(b) aren't zeroed out.
+func (a *Allocator) Realloc(b []byte, newSize int) []byte {
+	if a == nil {
+		out := make([]byte, newSize)
+		copy(out, b)
+		return out
+	}
+	if out, ok := a.resizeLast(b, newSize); ok {
+		return out
+	}
+	if newSize <= len(b) {
+		// Shrinking doesn't need to move the data.
+		return b[:newSize]
+	}
+	out := a.Allocate(newSize)
+	copy(out, b)
+	return out
+}
+
+// TrimTail shrinks b, which must have been returned by the allocator, to n
+// bytes. If b is the latest allocation, the bytes after n are returned to the
+// allocator and will be used by the next allocations. This is useful for
+// builders that reserve more than they end up using.
+func (a *Allocator) TrimTail(b []byte, n int) []byte {
+	if n > len(b) {
+		panic(fmt.Sprintf("TrimTail can't grow a slice of %d bytes to %d", len(b), n))
+	}
+	if a != nil {
+		if out, ok := a.resizeLast(b, n); ok {
+			return out
+		}
+	}
+	return b[:n]
+}
+
+// resizeLast resizes b in place if it's the latest allocation, and fits in its
+// buffer once resized.
+func (a *Allocator) resizeLast(b []byte, newSize int) ([]byte, bool) {
+	if len(b) == 0 {
+		return nil, false
+	}
+	pos := atomic.LoadUint64(&a.compIdx)
+	bufIdx, posIdx := parse(pos)
+	buf := a.buffers[bufIdx]
+	start := posIdx - len(b)
+	if start < 0 || start+newSize > len(buf) ||
+		uintptr(unsafe.Pointer(&b[0])) != uintptr(unsafe.Pointer(&buf[0]))+uintptr(start) {
+		return nil, false
+	}
+	// The CAS fails if there's been an allocation since we loaded pos.
+	newPos := uint64(bufIdx)<<32 | uint64(start+newSize)
+	if !atomic.CompareAndSwapUint64(&a.compIdx, pos, newPos) {
+		return nil, false
+	}
+	return buf[start : start+newSize], true
+}
+
 type AllocatorPool struct {
 	numGets int64
 	allocCh chan *Allocator
@@ -83,6 +83,66 @@ func TestAllocateTrim(t *testing.T) {
 	require.LessOrEqual(t, int(a.Allocated()), N)
 }
 
+func TestAllocatorRealloc(t *testing.T) {
+	a := NewAllocator(1024, "test")
+	defer a.Release()
+
+	b := a.Allocate(16)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	// b is the latest allocation, so it grows in place.
+	grown := a.Realloc(b, 32)
+	require.Len(t, grown, 32)
+	require.Equal(t, unsafe.Pointer(&b[0]), unsafe.Pointer(&grown[0]))
+	require.Equal(t, b, grown[:16])
+	require.Equal(t, 32, a.Size())
+
+	// Once something else is allocated, it has to be copied.
+	other := a.Allocate(8)
+	moved := a.Realloc(grown, 64)
+	require.Len(t, moved, 64)
+	require.NotEqual(t, unsafe.Pointer(&grown[0]), unsafe.Pointer(&moved[0]))
+	require.Equal(t, grown, moved[:32])
+	require.Equal(t, 32+8+64, a.Size())
+
+	// Shrinking never copies.
+	shrunk := a.Realloc(other, 4)
+	require.Equal(t, unsafe.Pointer(&other[0]), unsafe.Pointer(&shrunk[0]))
+	require.Len(t, shrunk, 4)
+
+	// Growing past the end of the current buffer moves to the next one.
+	big := a.Realloc(moved, 4096)
+	require.Len(t, big, 4096)
+	require.Equal(t, moved, big[:64])
+
+	var nilAlloc *Allocator
+	require.Equal(t, []byte{1, 2, 0}, nilAlloc.Realloc([]byte{1, 2}, 3))
+}
+
+func TestAllocatorTrimTail(t *testing.T) {
+	a := NewAllocator(1024, "test")
+	defer a.Release()
+
+	b := a.Allocate(100)
+	b = a.TrimTail(b, 10)
+	require.Len(t, b, 10)
+	require.Equal(t, 10, a.Size())
+
+	// The trimmed space is used by the next allocation.
+	next := a.Allocate(10)
+	require.Equal(t, uintptr(unsafe.Pointer(&b[0]))+10, uintptr(unsafe.Pointer(&next[0])))
+
+	// b isn't the latest allocation anymore, only its length changes.
+	b = a.TrimTail(b, 5)
+	require.Len(t, b, 5)
+	require.Equal(t, 20, a.Size())
+	require.Panics(t, func() { a.TrimTail(b, 6) })
+
+	var nilAlloc *Allocator
+	require.Len(t, nilAlloc.TrimTail(make([]byte, 4), 2), 2)
+}
+
 func TestPowTwo(t *testing.T) {
 	require.Equal(t, 2, log2(4))
 	require.Equal(t, 2, log2(7))
@@ -138,6 +138,16 @@ func (bl *Bloom) TotalSize() int {
 	return len(bl.bitset)*8 + 5*8
 }
 
+// Locs returns the number of bits set per hash added to the filter.
+func (bl *Bloom) Locs() uint64 {
+	return bl.setLocs
+}
+
+// Bitset returns the bits of the filter. Changing them changes the filter.
+func (bl *Bloom) Bitset() []uint64 {
+	return bl.bitset
+}
+
 // Size makes Bloom filter with as bitset of size sz.
 func (bl *Bloom) Size(sz uint64) {
 	bl.bitset = make([]uint64, sz>>6)
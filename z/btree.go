@@ -423,6 +423,37 @@ func (t *Tree) IterateKV(f func(key, val uint64) (newVal uint64)) {
 	})
 }
 
+// Seek calls fn for the keys greater than or equal to k, and their values, in
+// ascending order of keys, until fn returns false. The tree must not be
+// modified by fn.
+func (t *Tree) Seek(k uint64, fn func(key, val uint64) bool) {
+	root := t.node(1)
+	t.seek(root, k, fn)
+}
+
+func (t *Tree) seek(n node, k uint64, fn func(key, val uint64) bool) bool {
+	if n.isLeaf() {
+		for i := n.search(k); i < n.numKeys(); i++ {
+			// A zero value here means that this is a bogus entry.
+			if val := n.val(i); val != 0 && !fn(n.key(i), val) {
+				return false
+			}
+		}
+		return true
+	}
+	// The children before the one of k only hold smaller keys.
+	for i := n.search(k); i < n.numKeys(); i++ {
+		childID := n.val(i)
+		if childID == 0 {
+			continue
+		}
+		if !t.seek(t.node(childID), k, fn) {
+			return false
+		}
+	}
+	return true
+}
+
 func (t *Tree) print(n node, parentID uint64) {
 	n.print(parentID)
 	if n.isLeaf() {
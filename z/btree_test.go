@@ -208,6 +208,47 @@ func TestTreeIterateKV(t *testing.T) {
 	require.Equal(t, n, count)
 }
 
+func TestTreeSeek(t *testing.T) {
+	bt := NewTree("TestTreeSeek")
+	defer func() { require.NoError(t, bt.Close()) }()
+
+	// Enough random keys to have internal nodes.
+	keys := make(map[uint64]bool)
+	for len(keys) < 50000 {
+		k := uint64(rand.Int63n(math.MaxInt64-1)) + 1
+		keys[k] = true
+		bt.Set(k, k/2+1)
+	}
+	sorted := make([]uint64, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	for _, i := range []int{0, 1, 1000, len(sorted) - 1} {
+		var got []uint64
+		bt.Seek(sorted[i], func(k, v uint64) bool {
+			require.Equal(t, k/2+1, v)
+			got = append(got, k)
+			return true
+		})
+		require.Equal(t, sorted[i:], got)
+	}
+
+	// Seeking between keys starts at the next one, and fn can stop early.
+	var got []uint64
+	bt.Seek(sorted[10]+1, func(k, v uint64) bool {
+		got = append(got, k)
+		return len(got) < 3
+	})
+	require.Equal(t, sorted[11:14], got)
+
+	bt.Seek(sorted[len(sorted)-1]+1, func(k, v uint64) bool {
+		t.Fatalf("unexpected key %d", k)
+		return false
+	})
+}
+
 func TestOccupancyRatio(t *testing.T) {
 	// atmax 4 keys per node
 	setPageSize(16 * 5)
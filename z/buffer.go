@@ -6,14 +6,16 @@
 package z
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"runtime/debug"
 	"sort"
 	"sync/atomic"
-
-	"github.com/pkg/errors"
+	"time"
 )
 
 const (
@@ -42,6 +44,33 @@ type Buffer struct {
 	autoMmapDir   string     // directory for autoMmap to create a tempfile in
 	persistent    bool       // when enabled, Release will not delete the underlying mmap file
 	tag           string     // used for jemalloc stats
+	align         int        // when > 1, the data of every slice is aligned to this many bytes
+	varint        bool       // when enabled, slice lengths are encoded as uvarints
+	recordSz      int        // when > 0, all slices have this size and no header is written
+	stats         BufferStats
+	onRelease     func(tag string, stats BufferStats) // optional, called by Release
+}
+
+// BufferStats holds the counters of the work done by a Buffer since it was
+// created, see Buffer.Stats.
+type BufferStats struct {
+	// BytesWritten is the number of bytes allocated or written, including the
+	// headers and padding of the slices. It isn't decreased by Reset.
+	BytesWritten uint64
+	// Grows is the number of times the buffer was reallocated or its file
+	// was extended.
+	Grows uint64
+	// MmapRemaps is the number of those grows that remapped a file, including
+	// the switch to a file by WithAutoMmap.
+	MmapRemaps uint64
+	// Sorts and SortTime are the number of SortSlice or SortSliceBetween
+	// calls, and the total time spent in them.
+	Sorts    uint64
+	SortTime time.Duration
+	// Iterations is the number of SliceIterate or SliceIterateReverse calls,
+	// and SlicesIterated the number of slices passed to their callbacks.
+	Iterations     uint64
+	SlicesIterated uint64
 }
 
 func NewBuffer(capacity int, tag string) *Buffer {
@@ -132,6 +161,95 @@ func (b *Buffer) WithMaxSize(size int) *Buffer {
 	return b
 }
 
+// WithStatsCallback makes Release call fn with the tag and final stats of the
+// buffer, so that its I/O and CPU usage can be attributed to its user.
+func (b *Buffer) WithStatsCallback(fn func(tag string, stats BufferStats)) *Buffer {
+	b.onRelease = fn
+	return b
+}
+
+// Stats returns the counters of the work done by the buffer so far.
+func (b *Buffer) Stats() BufferStats {
+	return b.stats
+}
+
+// WithAlignment makes SliceAllocate return slices starting at an offset that is
+// a multiple of n, which must be a power of 2. This is required to cast the
+// slices to structs, or to use SIMD loads on them. Every slice is padded to a
+// multiple of n bytes, so the alignment is kept by SortSlice. The padding is
+// accounted for in the offsets returned by Slice. WithAlignment can only be
+// called on an empty buffer.
+func (b *Buffer) WithAlignment(n int) *Buffer {
+	if n <= 0 || n&(n-1) != 0 {
+		panic(fmt.Sprintf("z.Buffer alignment must be a power of 2, got: %d", n))
+	}
+	if !b.IsEmpty() || b.bufType == UseInvalid {
+		panic("can only set the alignment of an empty buffer")
+	}
+	if b.varint {
+		panic("can't align the slices of a buffer with varint headers")
+	}
+	b.align = n
+	b.alignStart()
+	return b
+}
+
+// alignStart moves the start of the buffer, so that the data of the first slice
+// is aligned. The existing padding is kept as is.
+func (b *Buffer) alignStart() {
+	if b.align <= 1 {
+		return
+	}
+	hdr := b.headerSize(0)
+	start := alignUp(int(b.padding)+hdr, b.align) - hdr
+	b.Grow(start - int(b.offset))
+	b.padding = uint64(start)
+	b.offset = uint64(start)
+}
+
+// WithVarintHeader makes SliceAllocate encode the length of the slices as
+// uvarints instead of 8 bytes, which saves 7 bytes per slice shorter than 128
+// bytes. Slice, SliceIterate and SortSlice decode the headers accordingly.
+// WithVarintHeader can only be called on an empty buffer, and can't be combined
+// with WithAlignment.
+func (b *Buffer) WithVarintHeader() *Buffer {
+	if !b.IsEmpty() || b.bufType == UseInvalid {
+		panic("can only set the header encoding of an empty buffer")
+	}
+	if b.align > 1 {
+		panic("can't use varint headers in an aligned buffer")
+	}
+	if b.recordSz > 0 {
+		panic("can't use varint headers in a buffer with fixed size records")
+	}
+	b.varint = true
+	return b
+}
+
+// WithFixedRecordSize makes the buffer store slices of n bytes only, without
+// any header: SliceAllocate panics if asked for a different size, and Slice,
+// SliceIterate and SortSlice use a fixed stride. This halves the memory used by
+// large arrays of small uniform records. WithFixedRecordSize can only be called
+// on an empty buffer, and can't be combined with WithVarintHeader.
+func (b *Buffer) WithFixedRecordSize(n int) *Buffer {
+	if n <= 0 {
+		panic(fmt.Sprintf("z.Buffer record size must be positive, got: %d", n))
+	}
+	if !b.IsEmpty() || b.bufType == UseInvalid {
+		panic("can only set the record size of an empty buffer")
+	}
+	if b.varint {
+		panic("can't use fixed size records in a buffer with varint headers")
+	}
+	b.recordSz = n
+	b.alignStart()
+	return b
+}
+
+func alignUp(n, align int) int {
+	return (n + align - 1) &^ (align - 1)
+}
+
 func (b *Buffer) IsEmpty() bool {
 	return int(b.offset) == b.StartOffset()
 }
@@ -182,6 +300,7 @@ func (b *Buffer) Grow(n int) {
 		growBy = n
 	}
 	b.curSz += growBy
+	b.stats.Grows++
 
 	switch b.bufType {
 	case UseCalloc:
@@ -200,6 +319,7 @@ func (b *Buffer) Grow(n int) {
 			Free(b.buf)
 			b.mmapFile = mmapFile
 			b.buf = mmapFile.Data
+			b.stats.MmapRemaps++
 			break
 		}
 
@@ -212,11 +332,12 @@ func (b *Buffer) Grow(n int) {
 	case UseMmap:
 		// Truncate and remap the underlying file.
 		if err := b.mmapFile.Truncate(int64(b.curSz)); err != nil {
-			err = errors.Wrapf(err,
-				"while trying to truncate file: %s to size: %d", b.mmapFile.Fd.Name(), b.curSz)
+			err = fmt.Errorf("while trying to truncate file: %s to size: %d: %w",
+				b.mmapFile.Fd.Name(), b.curSz, err)
 			panic(err)
 		}
 		b.buf = b.mmapFile.Data
+		b.stats.MmapRemaps++
 
 	default:
 		panic("can only use Grow on UseCalloc and UseMmap buffers")
@@ -230,6 +351,7 @@ func (b *Buffer) Allocate(n int) []byte {
 	b.Grow(n)
 	off := b.offset
 	b.offset += uint64(n)
+	b.stats.BytesWritten += uint64(n)
 	return b.buf[off:int(b.offset)]
 }
 
@@ -238,38 +360,121 @@ func (b *Buffer) Allocate(n int) []byte {
 func (b *Buffer) AllocateOffset(n int) int {
 	b.Grow(n)
 	b.offset += uint64(n)
+	b.stats.BytesWritten += uint64(n)
 	return int(b.offset) - n
 }
 
 func (b *Buffer) writeLen(sz int) {
+	switch {
+	case b.recordSz > 0:
+		return
+	case b.varint:
+		buf := b.Allocate(b.headerSize(sz))
+		binary.PutUvarint(buf, uint64(sz))
+		return
+	}
 	buf := b.Allocate(8)
 	binary.BigEndian.PutUint64(buf, uint64(sz))
 }
 
+// readLen returns the length of the slice starting at buf, and the size of
+// its header.
+func (b *Buffer) readLen(buf []byte) (int, int) {
+	switch {
+	case b.recordSz > 0:
+		return b.recordSz, 0
+	case b.varint:
+		sz, n := binary.Uvarint(buf)
+		return int(sz), n
+	}
+	return int(binary.BigEndian.Uint64(buf)), 8
+}
+
+// headerSize returns the number of bytes needed to encode the length sz.
+func (b *Buffer) headerSize(sz int) int {
+	switch {
+	case b.recordSz > 0:
+		return 0
+	case b.varint:
+		n := 1
+		for v := uint64(sz); v >= 0x80; v >>= 7 {
+			n++
+		}
+		return n
+	}
+	return 8
+}
+
 // SliceAllocate would encode the size provided into the buffer, followed by a call to Allocate,
 // hence returning the slice of size sz. This can be used to allocate a lot of small buffers into
 // this big buffer.
-// Note that SliceAllocate should NOT be mixed with normal calls to Write.
+// Note that SliceAllocate should NOT be mixed with normal calls to Write. To copy
+// an existing slice into the buffer, use WriteSlice, which also returns its
+// offset.
 func (b *Buffer) SliceAllocate(sz int) []byte {
-	b.Grow(8 + sz)
+	if b.recordSz > 0 && sz != b.recordSz {
+		panic(fmt.Sprintf("z.Buffer can only allocate records of size %d, got: %d", b.recordSz, sz))
+	}
+	total := b.recordSize(sz)
+	b.Grow(total)
 	b.writeLen(sz)
-	return b.Allocate(sz)
+	slice := b.Allocate(sz)
+	if pad := total - b.headerSize(sz) - sz; pad > 0 {
+		ZeroOut(b.buf, int(b.offset), int(b.offset)+pad)
+		b.offset += uint64(pad)
+		b.stats.BytesWritten += uint64(pad)
+	}
+	return slice
+}
+
+// recordSize returns the number of bytes used by a slice of size sz, including
+// its header and padding.
+func (b *Buffer) recordSize(sz int) int {
+	n := b.headerSize(sz) + sz
+	if b.align > 1 {
+		return alignUp(n, b.align)
+	}
+	return n
 }
 
 func (b *Buffer) StartOffset() int {
 	return int(b.padding)
 }
 
-func (b *Buffer) WriteSlice(slice []byte) {
+// WriteSlice writes slice along with its header, like SliceAllocate does, and
+// returns the offset of the record, for ReadSliceAt.
+func (b *Buffer) WriteSlice(slice []byte) int {
+	offset := int(b.offset)
 	dst := b.SliceAllocate(len(slice))
 	assert(len(slice) == copy(dst, slice))
+	return offset
+}
+
+// ReadSliceAt returns the slice written by WriteSlice (or SliceAllocate) at
+// offset, or nil if offset is past the end of the buffer. The returned slice
+// points into the buffer.
+func (b *Buffer) ReadSliceAt(offset int) []byte {
+	if offset < 0 {
+		return nil
+	}
+	slice, _ := b.Slice(offset)
+	return slice
 }
 
+// ErrStopIteration can be returned by the callbacks of SliceIterate and
+// SliceIterateReverse to stop the iteration early, without an error.
+var ErrStopIteration = errors.New("stop iteration")
+
+// SliceIterate calls f for every non-empty slice written with WriteSlice (or
+// SliceAllocate), in the order they were written, until f returns an error.
+// That error is returned, unless it's ErrStopIteration, which only stops the
+// iteration. The slices point into the buffer.
 func (b *Buffer) SliceIterate(f func(slice []byte) error) error {
 	if b.IsEmpty() {
 		return nil
 	}
 
+	b.stats.Iterations++
 	next := b.StartOffset()
 	var slice []byte
 	for next >= 0 {
@@ -277,14 +482,48 @@ func (b *Buffer) SliceIterate(f func(slice []byte) error) error {
 		if len(slice) == 0 {
 			continue
 		}
+		b.stats.SlicesIterated++
 		if err := f(slice); err != nil {
-			return err
+			return stopIteration(err)
 		}
 	}
 
 	return nil
 }
 
+// SliceIterateReverse works like SliceIterate, but goes through the slices
+// from the last written one to the first one. The records don't point to
+// their previous ones, so it first collects the offsets of all the slices,
+// like SliceOffsets.
+func (b *Buffer) SliceIterateReverse(f func(slice []byte) error) error {
+	if b.IsEmpty() {
+		return nil
+	}
+
+	b.stats.Iterations++
+	offsets := b.SliceOffsets()
+	for i := len(offsets) - 1; i >= 0; i-- {
+		slice, _ := b.Slice(offsets[i])
+		if len(slice) == 0 {
+			continue
+		}
+		b.stats.SlicesIterated++
+		if err := f(slice); err != nil {
+			return stopIteration(err)
+		}
+	}
+
+	return nil
+}
+
+// stopIteration returns err, or nil if it's ErrStopIteration.
+func stopIteration(err error) error {
+	if errors.Is(err, ErrStopIteration) {
+		return nil
+	}
+	return err
+}
+
 const (
 	UseCalloc BufferType = iota
 	UseMmap
@@ -330,14 +569,14 @@ func (s *sortHelper) sortSmall(start, end int) {
 	})
 	// Now we iterate over the s.small offsets and copy over the slices. The result is now in order.
 	for _, off := range s.small {
-		_, _ = s.tmp.Write(rawSlice(s.b.buf[off:]))
+		_, _ = s.tmp.Write(s.b.rawSlice(s.b.buf[off:]))
 	}
 	assert(end-start == copy(s.b.buf[start:end], s.tmp.Bytes()))
 }
 
 func assert(b bool) {
 	if !b {
-		log.Fatalf("%+v", errors.Errorf("Assertion failure"))
+		log.Fatalf("Assertion failure\n%s", debug.Stack())
 	}
 }
 func check(err error) {
@@ -379,11 +618,10 @@ func (s *sortHelper) merge(left, right []byte, start, end int) {
 			assert(len(left) == copy(s.b.buf[start:end], left))
 			return
 		}
-		ls = rawSlice(left)
-		rs = rawSlice(right)
+		ls = s.b.rawSlice(left)
+		rs = s.b.rawSlice(right)
 
-		// We skip the first 4 bytes in the rawSlice, because that stores the length.
-		if s.less(ls[8:], rs[8:]) {
+		if s.less(s.b.sliceData(ls), s.b.sliceData(rs)) {
 			copyLeft()
 		} else {
 			copyRight()
@@ -422,6 +660,10 @@ func (b *Buffer) SortSliceBetween(start, end int, less LessFunc) {
 	if start == 0 {
 		panic("start can never be zero")
 	}
+	defer func(begin time.Time) {
+		b.stats.Sorts++
+		b.stats.SortTime += time.Since(begin)
+	}(time.Now())
 
 	var offsets []int
 	next, count := start, 0
@@ -455,9 +697,17 @@ func (b *Buffer) SortSliceBetween(start, end int, less LessFunc) {
 	s.sort(0, len(offsets)-1)
 }
 
-func rawSlice(buf []byte) []byte {
-	sz := binary.BigEndian.Uint64(buf)
-	return buf[:8+int(sz)]
+// rawSlice returns the slice at the start of buf, including its header and
+// padding.
+func (b *Buffer) rawSlice(buf []byte) []byte {
+	sz, _ := b.readLen(buf)
+	return buf[:b.recordSize(sz)]
+}
+
+// sliceData returns the data of a slice returned by rawSlice.
+func (b *Buffer) sliceData(raw []byte) []byte {
+	sz, n := b.readLen(raw)
+	return raw[n : n+sz]
 }
 
 // Slice would return the slice written at offset.
@@ -466,16 +716,71 @@ func (b *Buffer) Slice(offset int) ([]byte, int) {
 		return nil, -1
 	}
 
-	sz := binary.BigEndian.Uint64(b.buf[offset:])
-	start := offset + 8
-	next := start + int(sz)
-	res := b.buf[start:next]
+	sz, n := b.readLen(b.buf[offset:])
+	start := offset + n
+	res := b.buf[start : start+sz]
+	next := offset + b.recordSize(sz)
 	if next >= int(b.offset) {
 		next = -1
 	}
 	return res, next
 }
 
+// Partition is a range of consecutive records of a Buffer whose slices share
+// the same prefix, see PartitionBy.
+type Partition struct {
+	// Prefix is the prefix of the slices of the partition. It points into the
+	// buffer.
+	Prefix []byte
+	// Start is the offset of the first record of the partition, and End the
+	// offset right after its last one: the records of the partition are read
+	// with Slice, from Start, until the next offset is End or -1. The range
+	// can also be passed to SortSliceBetween.
+	Start, End int
+}
+
+// PartitionBy splits the slices of b into partitions of consecutive slices
+// with the same first prefixLen bytes (or the same bytes, for the shorter
+// slices), in order. On a buffer sorted with SortSlice, every prefix has a
+// single partition, so the partitions can be handed out to different
+// goroutines, which read their records with Slice without going through the
+// whole buffer again. Empty slices belong to the partition of the slice
+// before them, or to the first partition. It panics if prefixLen isn't
+// positive.
+func (b *Buffer) PartitionBy(prefixLen int) []Partition {
+	if prefixLen <= 0 {
+		panic("prefixLen must be positive")
+	}
+	if b.IsEmpty() {
+		return nil
+	}
+	b.stats.Iterations++
+	var parts []Partition
+	for offset := b.StartOffset(); offset >= 0; {
+		slice, next := b.Slice(offset)
+		end := next
+		if end < 0 {
+			end = int(b.offset)
+		}
+		b.stats.SlicesIterated++
+		prefix := slice[:min(len(slice), prefixLen)]
+		switch {
+		case len(parts) == 0:
+			parts = append(parts, Partition{Prefix: prefix, Start: offset})
+		case len(slice) > 0 && !bytes.Equal(prefix, parts[len(parts)-1].Prefix):
+			if len(parts[len(parts)-1].Prefix) == 0 {
+				// The partition only holds empty slices so far.
+				parts[len(parts)-1].Prefix = prefix
+				break
+			}
+			parts = append(parts, Partition{Prefix: prefix, Start: offset})
+		}
+		parts[len(parts)-1].End = end
+		offset = next
+	}
+	return parts
+}
+
 // SliceOffsets is an expensive function. Use sparingly.
 func (b *Buffer) SliceOffsets() []int {
 	next := b.StartOffset()
@@ -500,6 +805,7 @@ func (b *Buffer) Write(p []byte) (n int, err error) {
 	b.Grow(n)
 	assert(n == copy(b.buf[b.offset:], p))
 	b.offset += uint64(n)
+	b.stats.BytesWritten += uint64(n)
 	return n, nil
 }
 
@@ -514,6 +820,9 @@ func (b *Buffer) Release() error {
 	if b == nil {
 		return nil
 	}
+	if b.onRelease != nil {
+		b.onRelease(b.tag, b.stats)
+	}
 	switch b.bufType {
 	case UseCalloc:
 		Free(b.buf)
@@ -523,11 +832,11 @@ func (b *Buffer) Release() error {
 		}
 		path := b.mmapFile.Fd.Name()
 		if err := b.mmapFile.Close(-1); err != nil {
-			return errors.Wrapf(err, "while closing file: %s", path)
+			return fmt.Errorf("while closing file: %s: %w", path, err)
 		}
 		if !b.persistent {
 			if err := os.Remove(path); err != nil {
-				return errors.Wrapf(err, "while deleting file %s", path)
+				return fmt.Errorf("while deleting file %s: %w", path, err)
 			}
 		}
 	}
@@ -10,9 +10,11 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"math"
 	"math/rand"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -255,6 +257,226 @@ func TestBufferPadding(t *testing.T) {
 	}
 }
 
+func TestBufferAlignment(t *testing.T) {
+	for _, align := range []int{1, 8, 16, 64} {
+		bufs := newTestBuffers(t, 32)
+		for _, buf := range bufs {
+			name := fmt.Sprintf("Using buffer type: %s align: %d", buf.bufType, align)
+			t.Run(name, func(t *testing.T) {
+				buf.WithAlignment(align)
+				require.True(t, buf.IsEmpty())
+
+				const N = 1000
+				exp := make([][]byte, 0, N)
+				for i := 0; i < N; i++ {
+					data := make([]byte, 1+rand.Intn(40))
+					rand.Read(data)
+					slice := buf.SliceAllocate(len(data))
+					require.Equal(t, len(data), copy(slice, data))
+					exp = append(exp, data)
+				}
+
+				check := func() {
+					var i int
+					next := buf.StartOffset()
+					for next >= 0 {
+						var slice []byte
+						off := next
+						slice, next = buf.Slice(next)
+						// The data starts right after the 8 bytes header.
+						require.Zero(t, (off+8)%align)
+						require.Equal(t, exp[i], slice)
+						i++
+					}
+					require.Equal(t, N, i)
+				}
+				check()
+
+				buf.SortSlice(func(a, b []byte) bool {
+					return bytes.Compare(a, b) < 0
+				})
+				sort.Slice(exp, func(i, j int) bool {
+					return bytes.Compare(exp[i], exp[j]) < 0
+				})
+				check()
+			})
+		}
+	}
+}
+
+func TestBufferAlignmentInvalid(t *testing.T) {
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	require.Panics(t, func() { buf.WithAlignment(0) })
+	require.Panics(t, func() { buf.WithAlignment(24) })
+	buf.SliceAllocate(4)
+	require.Panics(t, func() { buf.WithAlignment(16) })
+}
+
+func TestBufferVarintHeader(t *testing.T) {
+	bufs := newTestBuffers(t, 32)
+	for _, buf := range bufs {
+		name := fmt.Sprintf("Using buffer type: %s", buf.bufType)
+		t.Run(name, func(t *testing.T) {
+			buf.WithVarintHeader()
+
+			const N = 1000
+			exp := make([][]byte, 0, N)
+			var total int
+			for i := 0; i < N; i++ {
+				// Mostly small slices, with a few needing a longer header.
+				sz := 1 + rand.Intn(16)
+				if i%100 == 0 {
+					sz = 200 + rand.Intn(20000)
+				}
+				data := make([]byte, sz)
+				rand.Read(data)
+				buf.WriteSlice(data)
+				exp = append(exp, data)
+				total += buf.headerSize(sz) + sz
+			}
+			require.Equal(t, total, buf.LenNoPadding())
+
+			check := func() {
+				var i int
+				require.NoError(t, buf.SliceIterate(func(slice []byte) error {
+					require.Equal(t, exp[i], slice)
+					i++
+					return nil
+				}))
+				require.Equal(t, N, i)
+			}
+			check()
+
+			buf.SortSlice(func(a, b []byte) bool {
+				return bytes.Compare(a, b) < 0
+			})
+			sort.Slice(exp, func(i, j int) bool {
+				return bytes.Compare(exp[i], exp[j]) < 0
+			})
+			check()
+		})
+	}
+}
+
+func TestBufferVarintHeaderInvalid(t *testing.T) {
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	buf.WithAlignment(16)
+	require.Panics(t, func() { buf.WithVarintHeader() })
+
+	vbuf := NewBuffer(64, "test").WithVarintHeader()
+	defer func() { require.NoError(t, vbuf.Release()) }()
+	require.Panics(t, func() { vbuf.WithAlignment(16) })
+	vbuf.SliceAllocate(4)
+	require.Panics(t, func() { vbuf.WithVarintHeader() })
+}
+
+func TestBufferHeaderSize(t *testing.T) {
+	buf := &Buffer{}
+	require.Equal(t, 8, buf.headerSize(1))
+	buf.varint = true
+	require.Equal(t, 1, buf.headerSize(0))
+	require.Equal(t, 1, buf.headerSize(127))
+	require.Equal(t, 2, buf.headerSize(128))
+	require.Equal(t, 5, buf.headerSize(math.MaxInt32))
+	buf = &Buffer{recordSz: 16}
+	require.Equal(t, 0, buf.headerSize(16))
+}
+
+func TestBufferFixedRecordSize(t *testing.T) {
+	for _, align := range []int{1, 32} {
+		bufs := newTestBuffers(t, 32)
+		for _, buf := range bufs {
+			name := fmt.Sprintf("Using buffer type: %s align: %d", buf.bufType, align)
+			t.Run(name, func(t *testing.T) {
+				buf.WithAlignment(align).WithFixedRecordSize(16)
+
+				const N = 10000
+				for i := 0; i < N; i++ {
+					slice := buf.SliceAllocate(16)
+					binary.BigEndian.PutUint64(slice, uint64(rand.Int63()))
+					binary.BigEndian.PutUint64(slice[8:], uint64(i))
+				}
+				stride := alignUp(16, align)
+				require.Equal(t, N*stride, buf.LenNoPadding())
+
+				buf.SortSlice(func(a, b []byte) bool {
+					return binary.BigEndian.Uint64(a) < binary.BigEndian.Uint64(b)
+				})
+				var last uint64
+				seen := make(map[uint64]bool)
+				next := buf.StartOffset()
+				for next >= 0 {
+					off := next
+					var slice []byte
+					slice, next = buf.Slice(next)
+					require.Zero(t, off%align)
+					require.Len(t, slice, 16)
+					v := binary.BigEndian.Uint64(slice)
+					require.GreaterOrEqual(t, v, last)
+					last = v
+					seen[binary.BigEndian.Uint64(slice[8:])] = true
+				}
+				require.Len(t, seen, N)
+			})
+		}
+	}
+}
+
+func TestBufferFixedRecordSizeInvalid(t *testing.T) {
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	require.Panics(t, func() { buf.WithFixedRecordSize(0) })
+	buf.WithFixedRecordSize(8)
+	require.Panics(t, func() { buf.WithVarintHeader() })
+	require.Panics(t, func() { buf.SliceAllocate(4) })
+	buf.SliceAllocate(8)
+	require.Panics(t, func() { buf.WithFixedRecordSize(8) })
+}
+
+func TestBufferPartitionBy(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		require.Nil(t, buf.PartitionBy(2))
+		for _, s := range []string{"bb2", "", "aa1", "c", "bb1", "aa2", "aa3", "d"} {
+			buf.WriteSlice([]byte(s))
+		}
+		buf.SortSlice(func(a, b []byte) bool { return bytes.Compare(a, b) < 0 })
+
+		var prefixes []string
+		var got [][]string
+		for _, part := range buf.PartitionBy(2) {
+			prefixes = append(prefixes, string(part.Prefix))
+			var slices []string
+			for offset := part.Start; offset >= 0 && offset != part.End; {
+				var slice []byte
+				slice, offset = buf.Slice(offset)
+				slices = append(slices, string(slice))
+			}
+			got = append(got, slices)
+		}
+		require.Equal(t, []string{"aa", "bb", "c", "d"}, prefixes)
+		require.Equal(t, [][]string{
+			{"", "aa1", "aa2", "aa3"},
+			{"bb1", "bb2"},
+			{"c"},
+			{"d"},
+		}, got)
+
+		parts := buf.PartitionBy(1)
+		require.Len(t, parts, 4)
+		require.Equal(t, buf.StartOffset(), parts[0].Start)
+		for i := 1; i < len(parts); i++ {
+			require.Equal(t, parts[i-1].End, parts[i].Start)
+		}
+		require.Equal(t, buf.LenNoPadding()+buf.StartOffset(), parts[3].End)
+		require.Panics(t, func() { buf.PartitionBy(0) })
+	}
+}
+
 func newTestBuffers(t *testing.T, capacity int) []*Buffer {
 	var bufs []*Buffer
 
@@ -288,3 +510,115 @@ func TestSmallBuffer(t *testing.T) {
 		})
 	})
 }
+
+func TestBufferWriteReadSlice(t *testing.T) {
+	for name, newBuf := range map[string]func() *Buffer{
+		"default":   func() *Buffer { return NewBuffer(16, "test") },
+		"aligned":   func() *Buffer { return NewBuffer(16, "test").WithAlignment(8) },
+		"varint":    func() *Buffer { return NewBuffer(16, "test").WithVarintHeader() },
+		"fixedsize": func() *Buffer { return NewBuffer(16, "test").WithFixedRecordSize(3) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			buf := newBuf()
+			defer func() { require.NoError(t, buf.Release()) }()
+
+			slices := [][]byte{[]byte("abc"), []byte("def"), []byte("ghi")}
+			var offsets []int
+			for _, s := range slices {
+				offsets = append(offsets, buf.WriteSlice(s))
+			}
+			require.Equal(t, buf.SliceOffsets(), offsets)
+			for i, off := range offsets {
+				require.Equal(t, slices[i], buf.ReadSliceAt(off))
+			}
+			require.Nil(t, buf.ReadSliceAt(buf.LenWithPadding()))
+			require.Nil(t, buf.ReadSliceAt(-1))
+		})
+	}
+}
+
+func TestBufferSliceIterateStop(t *testing.T) {
+	buf := NewBuffer(16, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	for _, s := range []string{"a", "b", "c", "d"} {
+		buf.WriteSlice([]byte(s))
+	}
+
+	collect := func(iterate func(func([]byte) error) error, stopAt string) ([]string, error) {
+		var got []string
+		err := iterate(func(slice []byte) error {
+			got = append(got, string(slice))
+			if string(slice) == stopAt {
+				return ErrStopIteration
+			}
+			return nil
+		})
+		return got, err
+	}
+
+	got, err := collect(buf.SliceIterate, "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c", "d"}, got)
+	got, err = collect(buf.SliceIterate, "b")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, got)
+
+	got, err = collect(buf.SliceIterateReverse, "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"d", "c", "b", "a"}, got)
+	got, err = collect(buf.SliceIterateReverse, "c")
+	require.NoError(t, err)
+	require.Equal(t, []string{"d", "c"}, got)
+
+	// Other errors are returned as is.
+	errFail := fmt.Errorf("fail")
+	require.Equal(t, errFail, buf.SliceIterateReverse(func([]byte) error { return errFail }))
+
+	empty := NewBuffer(16, "test")
+	defer func() { require.NoError(t, empty.Release()) }()
+	require.NoError(t, empty.SliceIterateReverse(func([]byte) error {
+		t.Fatal("no slices expected")
+		return nil
+	}))
+}
+
+func TestBufferStats(t *testing.T) {
+	var released BufferStats
+	buf := NewBuffer(64, "test").WithStatsCallback(func(tag string, stats BufferStats) {
+		require.Equal(t, "test", tag)
+		released = stats
+	})
+	for i := 0; i < 10; i++ {
+		buf.WriteSlice([]byte(fmt.Sprintf("slice-%02d", 9-i)))
+	}
+	buf.SortSlice(func(l, r []byte) bool {
+		return bytes.Compare(l, r) < 0
+	})
+	require.NoError(t, buf.SliceIterate(func([]byte) error { return nil }))
+
+	stats := buf.Stats()
+	require.Equal(t, uint64(10*(8+8)), stats.BytesWritten)
+	require.Greater(t, stats.Grows, uint64(0))
+	require.Zero(t, stats.MmapRemaps)
+	require.Equal(t, uint64(1), stats.Sorts)
+	require.Greater(t, stats.SortTime, time.Duration(0))
+	require.Equal(t, uint64(1), stats.Iterations)
+	require.Equal(t, uint64(10), stats.SlicesIterated)
+
+	// Reset doesn't clear the stats.
+	buf.Reset()
+	require.Equal(t, stats, buf.Stats())
+	require.NoError(t, buf.Release())
+	require.Equal(t, stats, released)
+}
+
+func TestBufferStatsMmap(t *testing.T) {
+	buf := NewBuffer(64, "test").WithAutoMmap(128, "")
+	defer func() { require.NoError(t, buf.Release()) }()
+	buf.Allocate(100)
+	require.Equal(t, uint64(1), buf.Stats().MmapRemaps)
+	buf.Allocate(1000)
+	require.Equal(t, uint64(2), buf.Stats().MmapRemaps)
+	require.Equal(t, uint64(2), buf.Stats().Grows)
+	require.Equal(t, uint64(1100), buf.Stats().BytesWritten)
+}
@@ -19,8 +19,6 @@ import (
 	"sync"
 	"sync/atomic"
 	"unsafe"
-
-	"github.com/dustin/go-humanize"
 )
 
 // The go:linkname directives provides backdoor access to private functions in
@@ -125,7 +123,7 @@ func Leaks() string {
 	var buf bytes.Buffer
 	fmt.Fprintf(&buf, "Allocations:\n")
 	for f, sz := range m {
-		fmt.Fprintf(&buf, "%s at file: %s\n", humanize.IBytes(uint64(sz)), f)
+		fmt.Fprintf(&buf, "%s at file: %s\n", iBytes(uint64(sz)), f)
 	}
 	return buf.String()
 }
@@ -0,0 +1,335 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package z
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Codec is the compression format of the frames written by a
+// CompressedWriter.
+type Codec byte
+
+const (
+	// CodecGzip compresses every frame as a gzip member.
+	CodecGzip Codec = iota + 1
+	// CodecFlate compresses every frame as a raw DEFLATE stream, which is
+	// gzip without its header and checksum.
+	CodecFlate
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecGzip:
+		return "gzip"
+	case CodecFlate:
+		return "flate"
+	}
+	return fmt.Sprintf("Codec(%d)", byte(c))
+}
+
+// DefaultFrameSize is the number of uncompressed bytes in every frame written
+// by a CompressedWriter, unless changed with WithFrameSize.
+const DefaultFrameSize = 64 << 10
+
+// compressedTrailerSize is the size of the trailer ending a compressed stream:
+// the length of its index, as a big endian uint64, followed by its codec.
+const compressedTrailerSize = 9
+
+// ErrCorruptStream is returned by NewCompressedReader for data that doesn't
+// end with the index of a stream written by a CompressedWriter.
+var ErrCorruptStream = errors.New("corrupt compressed stream")
+
+// CompressedFrame is the location of a frame of a compressed stream, see
+// CompressedWriter.
+type CompressedFrame struct {
+	// Offset and Size are the range of the compressed frame, from the start of
+	// the stream.
+	Offset, Size int
+	// RawOffset and RawSize are the range of the data of the frame, once
+	// decompressed, from the start of the data written to the stream.
+	RawOffset, RawSize int
+}
+
+// CompressedWriter compresses the data written to it into a Buffer, see
+// Buffer.CompressedWriter.
+type CompressedWriter struct {
+	b         *Buffer
+	codec     Codec
+	frameSize int
+	start     int // offset of the stream in b
+	comp      io.WriteCloser
+	frames    []CompressedFrame
+	raw       int // bytes written to the current frame
+	rawTotal  int
+	closed    bool
+}
+
+// CompressedWriter returns a writer compressing the data written to it with
+// codec, into frames of DefaultFrameSize uncompressed bytes. Every frame is a
+// complete stream of codec, so it can be decompressed without the ones before
+// it, and Close writes the index of the frames after them, so that they can be
+// found with NewCompressedReader.
+//
+// The stream starts at the end of b. Nothing else must be written to b until
+// the writer is closed.
+func (b *Buffer) CompressedWriter(codec Codec) *CompressedWriter {
+	switch codec {
+	case CodecGzip, CodecFlate:
+	default:
+		panic(fmt.Sprintf("z.Buffer can't compress with %s", codec))
+	}
+	return &CompressedWriter{
+		b:         b,
+		codec:     codec,
+		frameSize: DefaultFrameSize,
+		start:     int(b.offset),
+	}
+}
+
+// WithFrameSize sets the number of uncompressed bytes in every frame. Smaller
+// frames are read back with less work, while larger ones compress better. It
+// must be called before the first Write, and panics if size isn't positive.
+func (w *CompressedWriter) WithFrameSize(size int) *CompressedWriter {
+	if size <= 0 {
+		panic("frame size must be positive")
+	}
+	if len(w.frames) > 0 {
+		panic("WithFrameSize must be called before Write")
+	}
+	w.frameSize = size
+	return w
+}
+
+// Write compresses p into the buffer, ending the current frame whenever it
+// holds the frame size of data.
+func (w *CompressedWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to a closed CompressedWriter")
+	}
+	var written int
+	for len(p) > 0 {
+		if w.comp == nil {
+			if err := w.startFrame(); err != nil {
+				return written, err
+			}
+		}
+		n := min(len(p), w.frameSize-w.raw)
+		if _, err := w.comp.Write(p[:n]); err != nil {
+			return written, err
+		}
+		w.raw += n
+		written += n
+		p = p[n:]
+		if w.raw == w.frameSize {
+			if err := w.Flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *CompressedWriter) startFrame() error {
+	w.frames = append(w.frames, CompressedFrame{
+		Offset:    int(w.b.offset) - w.start,
+		RawOffset: w.rawTotal,
+	})
+	switch w.codec {
+	case CodecGzip:
+		w.comp = gzip.NewWriter(w.b)
+	case CodecFlate:
+		comp, err := flate.NewWriter(w.b, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		w.comp = comp
+	}
+	return nil
+}
+
+// Flush ends the current frame before the frame size of data is written to
+// it, so that all the data written so far can be read back. Frames are best
+// ended at the boundaries of the records they hold, so that reading a record
+// decompresses a single frame.
+func (w *CompressedWriter) Flush() error {
+	if w.comp == nil {
+		return nil
+	}
+	if err := w.comp.Close(); err != nil {
+		return err
+	}
+	frame := &w.frames[len(w.frames)-1]
+	frame.Size = int(w.b.offset) - w.start - frame.Offset
+	frame.RawSize = w.raw
+	w.rawTotal += w.raw
+	w.comp = nil
+	w.raw = 0
+	return nil
+}
+
+// Close ends the current frame and writes the index of the frames after them.
+// It doesn't release the buffer.
+func (w *CompressedWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	w.closed = true
+	var index []byte
+	for _, frame := range w.frames {
+		index = binary.AppendUvarint(index, uint64(frame.Size))
+		index = binary.AppendUvarint(index, uint64(frame.RawSize))
+	}
+	trailer := w.b.Allocate(len(index) + compressedTrailerSize)
+	n := copy(trailer, index)
+	binary.BigEndian.PutUint64(trailer[n:], uint64(len(index)))
+	trailer[n+8] = byte(w.codec)
+	return nil
+}
+
+// Frames returns the frames ended so far.
+func (w *CompressedWriter) Frames() []CompressedFrame {
+	n := len(w.frames)
+	if w.comp != nil {
+		n--
+	}
+	return w.frames[:n:n]
+}
+
+// Bytes returns the stream written so far, which is passed to
+// NewCompressedReader once the writer is closed. It points into the buffer,
+// so it's only valid until the buffer is written to again.
+func (w *CompressedWriter) Bytes() []byte {
+	return w.b.buf[w.start:w.b.offset]
+}
+
+// CompressedReader reads back the frames of a stream written by a
+// CompressedWriter.
+type CompressedReader struct {
+	data   []byte
+	codec  Codec
+	frames []CompressedFrame
+}
+
+// NewCompressedReader returns a reader of the stream data, written by a
+// CompressedWriter and closed. It only reads the index of the stream, the
+// frames are decompressed by Frame and ReadAt.
+func NewCompressedReader(data []byte) (*CompressedReader, error) {
+	if len(data) < compressedTrailerSize {
+		return nil, ErrCorruptStream
+	}
+	trailer := data[len(data)-compressedTrailerSize:]
+	codec := Codec(trailer[8])
+	if codec != CodecGzip && codec != CodecFlate {
+		return nil, ErrCorruptStream
+	}
+	indexSize := binary.BigEndian.Uint64(trailer)
+	if indexSize > uint64(len(data)-compressedTrailerSize) {
+		return nil, ErrCorruptStream
+	}
+	end := len(data) - compressedTrailerSize - int(indexSize)
+	index := data[end : len(data)-compressedTrailerSize]
+	r := &CompressedReader{data: data[:end], codec: codec}
+	var offset, rawOffset int
+	for len(index) > 0 {
+		size, n := binary.Uvarint(index)
+		if n <= 0 {
+			return nil, ErrCorruptStream
+		}
+		rawSize, m := binary.Uvarint(index[n:])
+		if m <= 0 || size > uint64(end-offset) {
+			return nil, ErrCorruptStream
+		}
+		index = index[n+m:]
+		r.frames = append(r.frames, CompressedFrame{
+			Offset:    offset,
+			Size:      int(size),
+			RawOffset: rawOffset,
+			RawSize:   int(rawSize),
+		})
+		offset += int(size)
+		rawOffset += int(rawSize)
+	}
+	if offset != end {
+		return nil, ErrCorruptStream
+	}
+	return r, nil
+}
+
+// Codec returns the codec of the frames.
+func (r *CompressedReader) Codec() Codec {
+	return r.codec
+}
+
+// Frames returns the frames of the stream, in order.
+func (r *CompressedReader) Frames() []CompressedFrame {
+	return r.frames
+}
+
+// Size returns the number of bytes written to the stream, before compression.
+func (r *CompressedReader) Size() int {
+	if len(r.frames) == 0 {
+		return 0
+	}
+	last := r.frames[len(r.frames)-1]
+	return last.RawOffset + last.RawSize
+}
+
+// Frame returns the data of the i-th frame, decompressed.
+func (r *CompressedReader) Frame(i int) ([]byte, error) {
+	frame := r.frames[i]
+	src := bytes.NewReader(r.data[frame.Offset : frame.Offset+frame.Size])
+	var dec io.ReadCloser
+	switch r.codec {
+	case CodecGzip:
+		zr, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		dec = zr
+	case CodecFlate:
+		dec = flate.NewReader(src)
+	}
+	defer dec.Close()
+	out := make([]byte, frame.RawSize)
+	if _, err := io.ReadFull(dec, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ReadAt reads the data written to the stream at offset off, before
+// compression, decompressing only the frames holding it.
+func (r *CompressedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	i := sort.Search(len(r.frames), func(i int) bool {
+		return r.frames[i].RawOffset+r.frames[i].RawSize > int(off)
+	})
+	var n int
+	for ; n < len(p) && i < len(r.frames); i++ {
+		data, err := r.Frame(i)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[int(off)+n-r.frames[i].RawOffset:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,110 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package z
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferCompressedWriter(t *testing.T) {
+	for _, codec := range []Codec{CodecGzip, CodecFlate} {
+		t.Run(codec.String(), func(t *testing.T) {
+			b := NewBuffer(64, "test")
+			defer func() { require.NoError(t, b.Release()) }()
+			b.WriteSlice([]byte("before"))
+
+			var data []byte
+			for i := 0; i < 1000; i++ {
+				data = append(data, fmt.Sprintf("record %d;", i)...)
+			}
+			w := b.CompressedWriter(codec).WithFrameSize(1000)
+			n, err := w.Write(data[:1500])
+			require.NoError(t, err)
+			require.Equal(t, 1500, n)
+			require.Len(t, w.Frames(), 1)
+			require.NoError(t, w.Flush())
+			require.Len(t, w.Frames(), 2)
+			require.Equal(t, 500, w.Frames()[1].RawSize)
+			_, err = w.Write(data[1500:])
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			_, err = w.Write(data)
+			require.Error(t, err)
+			stream := w.Bytes()
+			require.Less(t, len(stream), len(data))
+
+			r, err := NewCompressedReader(stream)
+			require.NoError(t, err)
+			require.Equal(t, codec, r.Codec())
+			require.Equal(t, len(data), r.Size())
+			frames := r.Frames()
+			require.Equal(t, w.Frames(), frames)
+			require.Len(t, frames, 2+(len(data)-1500+999)/1000)
+
+			// Every frame is decoded on its own.
+			var all []byte
+			for i, frame := range frames {
+				got, err := r.Frame(i)
+				require.NoError(t, err)
+				require.Equal(t, data[frame.RawOffset:frame.RawOffset+frame.RawSize], got)
+				all = append(all, got...)
+			}
+			require.Equal(t, data, all)
+			if codec == CodecGzip {
+				zr, err := gzip.NewReader(bytes.NewReader(stream[frames[1].Offset:]))
+				require.NoError(t, err)
+				zr.Multistream(false)
+				got, err := io.ReadAll(zr)
+				require.NoError(t, err)
+				require.Equal(t, data[1000:1500], got)
+			}
+
+			p := make([]byte, 700)
+			n, err = r.ReadAt(p, 900)
+			require.NoError(t, err)
+			require.Equal(t, 700, n)
+			require.Equal(t, data[900:1600], p)
+			n, err = r.ReadAt(p, int64(len(data)-100))
+			require.Equal(t, io.EOF, err)
+			require.Equal(t, 100, n)
+
+			// The data before the stream is untouched.
+			require.Equal(t, []byte("before"), b.ReadSliceAt(b.StartOffset()))
+		})
+	}
+}
+
+func TestCompressedReaderErrors(t *testing.T) {
+	b := NewBuffer(64, "test")
+	defer func() { require.NoError(t, b.Release()) }()
+	w := b.CompressedWriter(CodecGzip)
+	require.NoError(t, w.Close())
+	r, err := NewCompressedReader(w.Bytes())
+	require.NoError(t, err)
+	require.Empty(t, r.Frames())
+	require.Zero(t, r.Size())
+
+	_, err = w.Write([]byte("data"))
+	require.Error(t, err)
+	for _, data := range [][]byte{
+		nil,
+		[]byte("short"),
+		{0, 0, 0, 0, 0, 0, 0, 0, 9},
+		{0, 0, 0, 0, 0, 0, 0, 100, byte(CodecGzip)},
+		{5, 0, 0, 0, 0, 0, 0, 0, 0, 2, byte(CodecGzip)},
+	} {
+		_, err := NewCompressedReader(data)
+		require.ErrorIs(t, err, ErrCorruptStream, "%v", data)
+	}
+	require.Panics(t, func() { b.CompressedWriter(Codec(0)) })
+	require.Panics(t, func() { b.CompressedWriter(CodecGzip).WithFrameSize(0) })
+}
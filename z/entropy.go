@@ -0,0 +1,52 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package z
+
+import "math"
+
+const (
+	// entropyChunks and entropyChunkSize bound the number of bytes read by
+	// Entropy to 4 KiB.
+	entropyChunks    = 64
+	entropyChunkSize = 64
+)
+
+// Entropy estimates the Shannon entropy of b, in bits per byte: from 0 for
+// constant data to 8 for uniformly random data. Compressed and encrypted data
+// is close to 8, usually above 7.5, while text and most uncompressed formats
+// are well below, which makes Entropy a cheap way to tell them apart, e.g. in
+// ristretto's Config.InspectValue. Buffers longer than 4 KiB are estimated from
+// 64 chunks of 64 bytes spread evenly over b, so the cost of Entropy is
+// bounded whatever the size of b. It returns 0 for an empty b.
+func Entropy(b []byte) float64 {
+	var counts [256]int
+	n := len(b)
+	if n <= entropyChunks*entropyChunkSize {
+		for _, c := range b {
+			counts[c]++
+		}
+	} else {
+		stride := n / entropyChunks
+		for i := 0; i < entropyChunks; i++ {
+			for _, c := range b[i*stride : i*stride+entropyChunkSize] {
+				counts[c]++
+			}
+		}
+		n = entropyChunks * entropyChunkSize
+	}
+	if n == 0 {
+		return 0
+	}
+	var entropy float64
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / float64(n)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
@@ -0,0 +1,59 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package z
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntropy(t *testing.T) {
+	require.Zero(t, Entropy(nil))
+	require.Zero(t, Entropy(bytes.Repeat([]byte{'a'}, 100)))
+	require.InDelta(t, 1, Entropy([]byte("abababab")), 1e-9)
+	require.InDelta(t, 8, Entropy(bytes.Repeat(seq(256), 4)), 1e-9)
+
+	random := make([]byte, 1<<20)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+	require.Greater(t, Entropy(random), 7.9)
+	require.Greater(t, Entropy(random[:4096]), 7.9)
+
+	text := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 1000))
+	require.Less(t, Entropy(text), 5.0)
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err = w.Write(random[:64<<10])
+	require.NoError(t, err)
+	_, err = w.Write(text)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Greater(t, Entropy(buf.Bytes()), 7.5)
+}
+
+func seq(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+func BenchmarkEntropy(b *testing.B) {
+	buf := make([]byte, 1<<20)
+	_, err := rand.Read(buf)
+	require.NoError(b, err)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Entropy(buf)
+	}
+}
@@ -7,12 +7,11 @@ package z
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-
-	"github.com/pkg/errors"
 )
 
 // MmapFile represents an mmapd file and includes both the buffer to the data
@@ -28,7 +27,7 @@ func OpenMmapFileUsing(fd *os.File, sz int, writable bool) (*MmapFile, error) {
 	filename := fd.Name()
 	fi, err := fd.Stat()
 	if err != nil {
-		return nil, errors.Wrapf(err, "cannot stat file: %s", filename)
+		return nil, fmt.Errorf("cannot stat file: %s: %w", filename, err)
 	}
 
 	var rerr error
@@ -36,7 +35,7 @@ func OpenMmapFileUsing(fd *os.File, sz int, writable bool) (*MmapFile, error) {
 	if sz > 0 && fileSize == 0 {
 		// If file is empty, truncate it to sz.
 		if err := fd.Truncate(int64(sz)); err != nil {
-			return nil, errors.Wrapf(err, "error while truncation")
+			return nil, fmt.Errorf("error while truncation: %w", err)
 		}
 		fileSize = int64(sz)
 		rerr = NewFile
@@ -45,7 +44,7 @@ func OpenMmapFileUsing(fd *os.File, sz int, writable bool) (*MmapFile, error) {
 	// fmt.Printf("Mmaping file: %s with writable: %v filesize: %d\n", fd.Name(), writable, fileSize)
 	buf, err := Mmap(fd, writable, fileSize) // Mmap up to file size.
 	if err != nil {
-		return nil, errors.Wrapf(err, "while mmapping %s with size: %d", fd.Name(), fileSize)
+		return nil, fmt.Errorf("while mmapping %s with size: %d: %w", fd.Name(), fileSize, err)
 	}
 
 	if fileSize == 0 {
@@ -68,7 +67,7 @@ func OpenMmapFile(filename string, flag int, maxSz int) (*MmapFile, error) {
 	// fmt.Printf("opening file %s with flag: %v\n", filename, flag)
 	fd, err := os.OpenFile(filename, flag, 0666)
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to open: %s", filename)
+		return nil, fmt.Errorf("unable to open: %s: %w", filename, err)
 	}
 	writable := true
 	if flag == os.O_RDONLY {
@@ -193,16 +192,91 @@ func (m *MmapFile) Close(maxSz int64) error {
 	return m.Fd.Close()
 }
 
+// SyncDir fsyncs the directory dir, which makes the creation, renaming and
+// deletion of the files in it durable.
 func SyncDir(dir string) error {
 	df, err := os.Open(dir)
 	if err != nil {
-		return errors.Wrapf(err, "while opening %s", dir)
+		return fmt.Errorf("while opening %s: %w", dir, err)
 	}
 	if err := df.Sync(); err != nil {
-		return errors.Wrapf(err, "while syncing %s", dir)
+		return fmt.Errorf("while syncing %s: %w", dir, err)
 	}
 	if err := df.Close(); err != nil {
-		return errors.Wrapf(err, "while closing %s", dir)
+		return fmt.Errorf("while closing %s: %w", dir, err)
+	}
+	return nil
+}
+
+// CreateSyncedFile creates the file at filename, failing if it exists, and
+// syncs its directory so that the file survives a crash. If sync is true, the
+// file is opened with O_DSYNC, so that every write is durable once it returns.
+func CreateSyncedFile(filename string, sync bool) (*os.File, error) {
+	flags := os.O_RDWR | os.O_CREATE | os.O_EXCL
+	if sync {
+		flags |= datasyncFileFlag
+	}
+	f, err := os.OpenFile(filename, flags, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("while creating %s: %w", filename, err)
+	}
+	if err := SyncDir(filepath.Dir(filename)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// RenameSynced renames oldpath to newpath, replacing newpath if it exists, and
+// syncs the directories involved so that the rename survives a crash.
+func RenameSynced(oldpath, newpath string) error {
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return fmt.Errorf("while renaming %s to %s: %w", oldpath, newpath, err)
+	}
+	oldDir, newDir := filepath.Dir(oldpath), filepath.Dir(newpath)
+	if err := SyncDir(newDir); err != nil {
+		return err
+	}
+	if oldDir != newDir {
+		return SyncDir(oldDir)
 	}
 	return nil
 }
+
+// WriteFileAtomic writes data to the file at filename, so that after a crash
+// the file holds either its previous content or data, never a mix of both.
+// data is written to a temporary file in the same directory, synced, then
+// renamed over filename.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, base+".tmp")
+	if err != nil {
+		return fmt.Errorf("while creating a temporary file for %s: %w", filename, err)
+	}
+	tmp := f.Name()
+	err = func() error {
+		if _, err := f.Write(data); err != nil {
+			return fmt.Errorf("while writing %s: %w", tmp, err)
+		}
+		if err := f.Chmod(perm); err != nil {
+			return fmt.Errorf("while setting the permissions of %s: %w", tmp, err)
+		}
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("while syncing %s: %w", tmp, err)
+		}
+		return nil
+	}()
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("while closing %s: %w", tmp, cerr)
+	}
+	if err == nil {
+		err = RenameSynced(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -10,6 +10,10 @@ package z
 
 import "fmt"
 
+// datasyncFileFlag is only supported on Linux, other systems rely on explicit
+// syncs.
+const datasyncFileFlag = 0x0
+
 // Truncate would truncate the mmapped file to the given size. On Linux, we truncate
 // the underlying file and then call mremap, but on other systems, we unmap first,
 // then truncate, then re-map.
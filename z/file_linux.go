@@ -7,8 +7,12 @@ package z
 
 import (
 	"fmt"
+	"syscall"
 )
 
+// datasyncFileFlag makes the writes to a file durable once they return.
+const datasyncFileFlag = syscall.O_DSYNC
+
 // Truncate would truncate the mmapped file to the given size. On Linux, we truncate
 // the underlying file and then call mremap, but on other systems, we unmap first,
 // then truncate, then re-map.
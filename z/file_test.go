@@ -0,0 +1,63 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package z
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateSyncedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	for _, sync := range []bool{false, true} {
+		f, err := CreateSyncedFile(path, sync)
+		require.NoError(t, err)
+		_, err = f.Write([]byte("abc"))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		// Existing files aren't overwritten.
+		_, err = CreateSyncedFile(path, sync)
+		require.ErrorIs(t, err, os.ErrExist)
+		require.NoError(t, os.Remove(path))
+	}
+}
+
+func TestRenameSynced(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0o700))
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "sub", "dst")
+	require.NoError(t, os.WriteFile(src, []byte("abc"), 0o600))
+
+	require.NoError(t, RenameSynced(src, dst))
+	data, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, "abc", string(data))
+	require.Error(t, RenameSynced(src, dst))
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	require.NoError(t, WriteFileAtomic(path, []byte("abc"), 0o640))
+	require.NoError(t, WriteFileAtomic(path, []byte("de"), 0o640))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "de", string(data))
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o640), fi.Mode().Perm())
+
+	// No temporary file is left behind, even on failures.
+	require.Error(t, WriteFileAtomic(filepath.Join(dir, "missing", "file"), nil, 0o600))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
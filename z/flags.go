@@ -6,6 +6,7 @@
 package z
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -15,8 +16,6 @@ import (
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/pkg/errors"
 )
 
 // SuperFlagHelp makes it really easy to generate command line `--help` output for a SuperFlag. For
@@ -119,6 +118,12 @@ func NewSuperFlag(flag string) *SuperFlag {
 	return sf
 }
 
+// ParseSuperFlag works like NewSuperFlag, but returns an error instead of
+// exiting if flag is malformed.
+func ParseSuperFlag(flag string) (*SuperFlag, error) {
+	return newSuperFlagImpl(flag)
+}
+
 func newSuperFlagImpl(flag string) (*SuperFlag, error) {
 	m, err := parseFlag(flag)
 	if err != nil {
@@ -177,6 +182,19 @@ func (sf *SuperFlag) mergeAndCheckDefaultImpl(flag string) (*SuperFlag, error) {
 	return sf, nil
 }
 
+// Keys returns the sorted names of the options set in the flag.
+func (sf *SuperFlag) Keys() []string {
+	if sf == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(sf.m))
+	for k := range sf.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (sf *SuperFlag) Has(opt string) bool {
 	val := sf.GetString(opt)
 	return val != ""
@@ -209,9 +227,9 @@ func (sf *SuperFlag) GetBool(opt string) bool {
 	}
 	b, err := strconv.ParseBool(val)
 	if err != nil {
-		err = errors.Wrapf(err,
-			"Unable to parse %s as bool for key: %s. Options: %s\n",
-			val, opt, sf)
+		err = fmt.Errorf(
+			"Unable to parse %s as bool for key: %s. Options: %s: %w",
+			val, opt, sf, err)
 		log.Fatalf("%+v", err)
 	}
 	return b
@@ -224,9 +242,9 @@ func (sf *SuperFlag) GetFloat64(opt string) float64 {
 	}
 	f, err := strconv.ParseFloat(val, 64)
 	if err != nil {
-		err = errors.Wrapf(err,
-			"Unable to parse %s as float64 for key: %s. Options: %s\n",
-			val, opt, sf)
+		err = fmt.Errorf(
+			"Unable to parse %s as float64 for key: %s. Options: %s: %w",
+			val, opt, sf, err)
 		log.Fatalf("%+v", err)
 	}
 	return f
@@ -239,9 +257,9 @@ func (sf *SuperFlag) GetInt64(opt string) int64 {
 	}
 	i, err := strconv.ParseInt(val, 0, 64)
 	if err != nil {
-		err = errors.Wrapf(err,
-			"Unable to parse %s as int64 for key: %s. Options: %s\n",
-			val, opt, sf)
+		err = fmt.Errorf(
+			"Unable to parse %s as int64 for key: %s. Options: %s: %w",
+			val, opt, sf, err)
 		log.Fatalf("%+v", err)
 	}
 	return i
@@ -254,9 +272,9 @@ func (sf *SuperFlag) GetUint64(opt string) uint64 {
 	}
 	u, err := strconv.ParseUint(val, 0, 64)
 	if err != nil {
-		err = errors.Wrapf(err,
-			"Unable to parse %s as uint64 for key: %s. Options: %s\n",
-			val, opt, sf)
+		err = fmt.Errorf(
+			"Unable to parse %s as uint64 for key: %s. Options: %s: %w",
+			val, opt, sf, err)
 		log.Fatalf("%+v", err)
 	}
 	return u
@@ -269,9 +287,9 @@ func (sf *SuperFlag) GetUint32(opt string) uint32 {
 	}
 	u, err := strconv.ParseUint(val, 0, 32)
 	if err != nil {
-		err = errors.Wrapf(err,
-			"Unable to parse %s as uint32 for key: %s. Options: %s\n",
-			val, opt, sf)
+		err = fmt.Errorf(
+			"Unable to parse %s as uint32 for key: %s. Options: %s: %w",
+			val, opt, sf, err)
 		log.Fatalf("%+v", err)
 	}
 	return uint32(u)
@@ -293,6 +311,88 @@ func (sf *SuperFlag) GetPath(opt string) string {
 	return path
 }
 
+// RegisterFlags registers the command line flag name in fs, setting the
+// options of sf, which holds their defaults. The flag can be given several
+// times, each overriding the options it sets, and is rejected if it sets
+// options not in sf. Before the command line is parsed, the options are set
+// from the environment variable named after the flag, upper-cased with dashes
+// replaced by underscores (e.g. CACHE_OPTS for cache-opts), if it's set. The
+// help output of fs shows all the defaults, sorted, including those set from
+// the environment. To set the options from a config file, pass its line for
+// the flag to fs.Set.
+//
+// It exits if the environment variable is malformed, like NewSuperFlag.
+func (sf *SuperFlag) RegisterFlags(fs *flag.FlagSet, name, usage string) {
+	v := sf.FlagValue()
+	env := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+	if val, ok := os.LookupEnv(env); ok {
+		if err := v.Set(val); err != nil {
+			log.Fatalf("superflag: invalid %s: %v", env, err)
+		}
+	}
+	fs.Var(v, name, usage)
+}
+
+// FlagValue returns sf as a flag.Value, which is also a pflag.Value, for
+// registering it with other flag packages than the standard one, e.g.
+// pflag.FlagSet.Var. Its options are limited to those of sf.
+func (sf *SuperFlag) FlagValue() *SuperFlagValue {
+	if sf.m == nil {
+		sf.m = make(map[string]string)
+	}
+	return &SuperFlagValue{sf: sf, valid: sf.Keys()}
+}
+
+// SuperFlagValue is a flag.Value setting the options of a SuperFlag, see
+// SuperFlag.FlagValue.
+type SuperFlagValue struct {
+	sf *SuperFlag
+	// valid holds the names of the options Set accepts, all if it's empty.
+	valid []string
+}
+
+// String returns the options, sorted by name.
+func (v *SuperFlagValue) String() string {
+	if v == nil || v.sf == nil {
+		return ""
+	}
+	kvs := make([]string, 0, len(v.sf.m))
+	for _, k := range v.sf.Keys() {
+		kvs = append(kvs, fmt.Sprintf("%s=%s", k, v.sf.m[k]))
+	}
+	return strings.Join(kvs, "; ")
+}
+
+// Set sets the options in flag, leaving the others as they are.
+func (v *SuperFlagValue) Set(flag string) error {
+	src, err := parseFlag(flag)
+	if err != nil {
+		return err
+	}
+	if len(v.valid) > 0 {
+		for k := range src {
+			if i := sort.SearchStrings(v.valid, k); i == len(v.valid) || v.valid[i] != k {
+				return fmt.Errorf("superflag: found invalid option: %s.\nvalid options: %s",
+					k, strings.Join(v.valid, ", "))
+			}
+		}
+	}
+	for k, val := range src {
+		v.sf.m[k] = val
+	}
+	return nil
+}
+
+// Type returns the name of the type of the flag, for pflag.
+func (v *SuperFlagValue) Type() string {
+	return "superflag"
+}
+
+// Get returns the SuperFlag, for flag.Getter.
+func (v *SuperFlagValue) Get() any {
+	return v.sf
+}
+
 // expandPath expands the paths containing ~ to /home/user. It also computes the absolute path
 // from the relative paths. For example: ~/abc/../cef will be transformed to /home/user/cef.
 func expandPath(path string) (string, error) {
@@ -302,7 +402,7 @@ func expandPath(path string) (string, error) {
 	if path[0] == '~' && (len(path) == 1 || os.IsPathSeparator(path[1])) {
 		usr, err := user.Current()
 		if err != nil {
-			return "", errors.Wrap(err, "Failed to get the home directory of the user")
+			return "", fmt.Errorf("Failed to get the home directory of the user: %w", err)
 		}
 		path = filepath.Join(usr.HomeDir, path[1:])
 	}
@@ -310,7 +410,7 @@ func expandPath(path string) (string, error) {
 	var err error
 	path, err = filepath.Abs(path)
 	if err != nil {
-		return "", errors.Wrap(err, "Failed to generate absolute path")
+		return "", fmt.Errorf("Failed to generate absolute path: %w", err)
 	}
 	return path, nil
 }
@@ -6,7 +6,9 @@
 package z
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -47,6 +49,52 @@ func TestFlagDefault(t *testing.T) {
 	require.Equal(t, int64(4), f.GetInt64("two"))
 }
 
+func TestParseSuperFlag(t *testing.T) {
+	_, err := ParseSuperFlag("key-without-value")
+	require.Error(t, err)
+
+	sf, err := ParseSuperFlag("Max_Cost=10; ttl=1s;")
+	require.NoError(t, err)
+	require.Equal(t, []string{"max-cost", "ttl"}, sf.Keys())
+
+	sf = nil
+	require.Empty(t, sf.Keys())
+}
+
+func TestSuperFlagRegisterFlags(t *testing.T) {
+	t.Setenv("CACHE_OPTS", "ttl=1m")
+	sf := NewSuperFlag("max-cost=10; ttl=1s; name=;")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	sf.RegisterFlags(fs, "cache-opts", "The options of the cache.")
+	require.Equal(t, time.Minute, sf.GetDuration("ttl"))
+
+	f := fs.Lookup("cache-opts")
+	require.Equal(t, "max-cost=10; name=; ttl=1m", f.DefValue)
+	require.Equal(t, "The options of the cache.", f.Usage)
+	require.NoError(t, fs.Parse([]string{"--cache-opts=max-cost=20", "--cache-opts", "Name=c"}))
+	require.Equal(t, int64(20), sf.GetInt64("max-cost"))
+	require.Equal(t, "c", sf.GetString("name"))
+	require.Equal(t, time.Minute, sf.GetDuration("ttl"))
+	require.Same(t, sf, f.Value.(flag.Getter).Get())
+
+	require.Error(t, fs.Parse([]string{"--cache-opts=size=1"}))
+	require.Error(t, fs.Parse([]string{"--cache-opts=ttl"}))
+	require.NoError(t, fs.Set("cache-opts", "ttl=2s"))
+	require.Equal(t, 2*time.Second, sf.GetDuration("ttl"))
+
+	// FlagValue is a pflag.Value too, and accepts any option without defaults.
+	v := NewSuperFlag("").FlagValue()
+	var _ interface {
+		flag.Value
+		Type() string
+	} = v
+	require.Equal(t, "superflag", v.Type())
+	require.NoError(t, v.Set("a=1; b=2"))
+	require.Equal(t, "a=1; b=2", v.String())
+	require.Empty(t, (*SuperFlagValue)(nil).String())
+}
+
 func TestGetPath(t *testing.T) {
 	usr, err := user.Current()
 	require.NoError(t, err)
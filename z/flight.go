@@ -0,0 +1,113 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package z
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Flight deduplicates concurrent calls for the same key, like the singleflight
+// package of golang.org/x/sync, but keyed by a uint64 hash (see KeyToHash).
+// The successful results can also be shared with the calls made up to a TTL
+// after they were computed. The zero value is ready to use, with no TTL.
+type Flight[V any] struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	calls map[uint64]*flightCall[V]
+	// nextSweep is when the expired results are removed next, see finish.
+	nextSweep int64
+}
+
+type flightCall[V any] struct {
+	done chan struct{}
+	val  V
+	err  error
+	// expires is when the result stops being shared, once done is closed.
+	expires int64
+}
+
+// NewFlight returns a Flight sharing the successful results of the calls for
+// ttl after they return.
+func NewFlight[V any](ttl time.Duration) *Flight[V] {
+	return &Flight[V]{ttl: ttl}
+}
+
+// Do calls fn and returns its results, unless there's a call for key in
+// flight already, or one that succeeded less than the TTL ago. Then it waits
+// for that call to return, and returns its results instead, with shared set.
+// If fn panics, the panic is propagated to the caller of Do, and the calls
+// waiting for it return an error.
+func (f *Flight[V]) Do(key uint64, fn func() (V, error)) (v V, err error, shared bool) {
+	f.mu.Lock()
+	if f.calls == nil {
+		f.calls = make(map[uint64]*flightCall[V])
+	}
+	if c, ok := f.calls[key]; ok {
+		select {
+		case <-c.done:
+			if NanoTime() < c.expires {
+				f.mu.Unlock()
+				return c.val, c.err, true
+			}
+		default:
+			f.mu.Unlock()
+			<-c.done
+			return c.val, c.err, true
+		}
+	}
+	c := &flightCall[V]{done: make(chan struct{})}
+	f.calls[key] = c
+	f.mu.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			c.err = fmt.Errorf("z: Flight call panicked: %v", r)
+			f.finish(key, c)
+			panic(r)
+		}
+	}()
+	c.val, c.err = fn()
+	f.finish(key, c)
+	return c.val, c.err, false
+}
+
+// finish makes the results of c available to the waiting calls, and removes
+// c now if its results aren't to be shared.
+func (f *Flight[V]) finish(key uint64, c *flightCall[V]) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := NanoTime()
+	if c.err == nil && f.ttl > 0 {
+		c.expires = now + int64(f.ttl)
+	} else if f.calls[key] == c {
+		delete(f.calls, key)
+	}
+	close(c.done)
+
+	if f.ttl <= 0 || now < f.nextSweep {
+		return
+	}
+	for k, call := range f.calls {
+		select {
+		case <-call.done:
+			if now >= call.expires {
+				delete(f.calls, k)
+			}
+		default:
+		}
+	}
+	f.nextSweep = now + int64(f.ttl)
+}
+
+// Forget makes the next call to Do for key call its function, even if a call
+// for key is in flight or its results are still shared.
+func (f *Flight[V]) Forget(key uint64) {
+	f.mu.Lock()
+	delete(f.calls, key)
+	f.mu.Unlock()
+}
@@ -0,0 +1,113 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package z
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlightDedup(t *testing.T) {
+	var f Flight[int]
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func() (int, error) {
+		calls.Add(1)
+		<-release
+		return 42, nil
+	}
+
+	var wg sync.WaitGroup
+	var sharedCount atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err, shared := f.Do(1, fn)
+			require.NoError(t, err)
+			require.Equal(t, 42, v)
+			if shared {
+				sharedCount.Add(1)
+			}
+		}()
+	}
+	require.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), calls.Load())
+	require.Equal(t, int32(9), sharedCount.Load())
+
+	// Without a TTL, the result isn't kept.
+	_, _, shared := f.Do(1, fn)
+	require.False(t, shared)
+	require.Equal(t, int32(2), calls.Load())
+	require.Empty(t, f.calls)
+}
+
+func TestFlightTTL(t *testing.T) {
+	f := NewFlight[int](time.Hour)
+	var calls int
+	fn := func() (int, error) {
+		calls++
+		return calls, nil
+	}
+	v, _, shared := f.Do(1, fn)
+	require.False(t, shared)
+	require.Equal(t, 1, v)
+	v, _, shared = f.Do(1, fn)
+	require.True(t, shared)
+	require.Equal(t, 1, v)
+	v, _, _ = f.Do(2, fn)
+	require.Equal(t, 2, v)
+
+	f.Forget(1)
+	v, _, shared = f.Do(1, fn)
+	require.False(t, shared)
+	require.Equal(t, 3, v)
+
+	// Expired results are computed again.
+	f.calls[1].expires = NanoTime() - 1
+	v, _, shared = f.Do(1, fn)
+	require.False(t, shared)
+	require.Equal(t, 4, v)
+
+	// Errors aren't kept.
+	errFail := errors.New("fail")
+	_, err, _ := f.Do(3, func() (int, error) { return 0, errFail })
+	require.ErrorIs(t, err, errFail)
+	v, err, shared = f.Do(3, fn)
+	require.NoError(t, err)
+	require.False(t, shared)
+	require.Equal(t, 5, v)
+}
+
+func TestFlightPanic(t *testing.T) {
+	var f Flight[int]
+	started := make(chan struct{})
+	errc := make(chan error)
+	go func() {
+		<-started
+		_, err, _ := f.Do(1, func() (int, error) { return 1, nil })
+		errc <- err
+	}()
+	require.Panics(t, func() {
+		f.Do(1, func() (int, error) {
+			close(started)
+			time.Sleep(50 * time.Millisecond)
+			panic("boom")
+		})
+	})
+	require.Error(t, <-errc)
+	v, err, _ := f.Do(1, func() (int, error) { return 1, nil })
+	require.NoError(t, err)
+	require.Equal(t, 1, v)
+}
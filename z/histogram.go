@@ -9,8 +9,6 @@ import (
 	"fmt"
 	"math"
 	"strings"
-
-	"github.com/dustin/go-humanize"
 )
 
 // Creates bounds for an histogram. The bounds are powers of two of the form
@@ -136,7 +134,7 @@ func (histogram *HistogramData) String() string {
 			page := float64(count*100) / float64(histogram.Count)
 			cum += page
 			b.WriteString(fmt.Sprintf("[%s, %s) %d %.2f%% %.2f%%\n",
-				humanize.IBytes(lowerBound), "infinity", count, page, cum))
+				iBytes(lowerBound), "infinity", count, page, cum))
 			continue
 		}
 
@@ -192,3 +190,18 @@ func (histogram *HistogramData) Clear() {
 	histogram.Max = 0
 	histogram.Min = math.MaxInt64
 }
+
+// iBytes formats n bytes with binary units, e.g. "1.5 KiB", like IBytes of
+// github.com/dustin/go-humanize, which z doesn't depend on.
+func iBytes(n uint64) string {
+	if n < 10 {
+		return fmt.Sprintf("%d B", n)
+	}
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	e := math.Floor(math.Log(float64(n)) / math.Log(1024))
+	val := math.Floor(float64(n)/math.Pow(1024, e)*10+0.5) / 10
+	if val < 10 {
+		return fmt.Sprintf("%.1f %s", val, units[int(e)])
+	}
+	return fmt.Sprintf("%.0f %s", val, units[int(e)])
+}
@@ -9,6 +9,7 @@ import (
 	"math"
 	"testing"
 
+	"github.com/dustin/go-humanize"
 	"github.com/stretchr/testify/require"
 )
 
@@ -83,3 +84,10 @@ func TestPercentile100(t *testing.T) {
 	}
 	require.Equal(t, h.Percentile(1.0), 514.0)
 }
+
+func TestIBytes(t *testing.T) {
+	for _, n := range []uint64{0, 9, 10, 1023, 1024, 1536, 10 << 10, 1<<20 - 1, 5 << 30,
+		math.MaxUint64} {
+		require.Equal(t, humanize.IBytes(n), iBytes(n), "n: %d", n)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package z
+
+import (
+	"context"
+	"math/bits"
+)
+
+// DefaultKeyedMutexStripes is the number of stripes of a KeyedMutex made by
+// NewKeyedMutex(0).
+const DefaultKeyedMutexStripes = 256
+
+// KeyedMutex locks keys by their uint64 hash (see KeyToHash), e.g. to make a
+// read-modify-write of a cache entry atomic with respect to the others of the
+// same key. The keys are spread over a fixed number of stripes, each with a
+// single lock, so that it takes no memory per key: two keys of the same
+// stripe also exclude each other. Holding the lock of a key while locking
+// another one can deadlock.
+type KeyedMutex struct {
+	// stripes are semaphores of capacity 1, so that Lock can be canceled.
+	stripes []chan struct{}
+	mask    uint64
+}
+
+// NewKeyedMutex returns a KeyedMutex with stripes stripes, rounded up to a
+// power of two, or DefaultKeyedMutexStripes if stripes isn't positive.
+func NewKeyedMutex(stripes int) *KeyedMutex {
+	if stripes <= 0 {
+		stripes = DefaultKeyedMutexStripes
+	}
+	n := 1 << bits.Len(uint(stripes-1))
+	m := &KeyedMutex{
+		stripes: make([]chan struct{}, n),
+		mask:    uint64(n - 1),
+	}
+	for i := range m.stripes {
+		m.stripes[i] = make(chan struct{}, 1)
+	}
+	return m
+}
+
+func (m *KeyedMutex) stripe(key uint64) chan struct{} {
+	return m.stripes[key&m.mask]
+}
+
+// Lock locks key, waiting until it's available.
+func (m *KeyedMutex) Lock(key uint64) {
+	m.stripe(key) <- struct{}{}
+}
+
+// LockContext locks key like Lock, unless ctx is done first, in which case
+// it returns the error of ctx and key isn't locked.
+func (m *KeyedMutex) LockContext(ctx context.Context, key uint64) error {
+	select {
+	case m.stripe(key) <- struct{}{}:
+		return nil
+	default:
+	}
+	select {
+	case m.stripe(key) <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// TryLock locks key if it's available, and reports whether it did.
+func (m *KeyedMutex) TryLock(key uint64) bool {
+	select {
+	case m.stripe(key) <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Unlock unlocks key. It panics if key isn't locked.
+func (m *KeyedMutex) Unlock(key uint64) {
+	select {
+	case <-m.stripe(key):
+	default:
+		panic("z: Unlock of unlocked KeyedMutex key")
+	}
+}
+
+// Stripes returns the number of stripes of m.
+func (m *KeyedMutex) Stripes() int {
+	return len(m.stripes)
+}
@@ -0,0 +1,69 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package z
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	require.Equal(t, DefaultKeyedMutexStripes, NewKeyedMutex(0).Stripes())
+	m := NewKeyedMutex(3)
+	require.Equal(t, 4, m.Stripes())
+
+	m.Lock(1)
+	require.False(t, m.TryLock(1))
+	require.False(t, m.TryLock(5), "5 shares the stripe of 1")
+	require.True(t, m.TryLock(2))
+	m.Unlock(2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, m.LockContext(ctx, 1), context.DeadlineExceeded)
+
+	locked := make(chan struct{})
+	go func() {
+		require.NoError(t, m.LockContext(context.Background(), 1))
+		close(locked)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-locked:
+		t.Fatal("key locked twice")
+	default:
+	}
+	m.Unlock(1)
+	<-locked
+	m.Unlock(1)
+	require.Panics(t, func() { m.Unlock(1) })
+}
+
+func TestKeyedMutexExclusion(t *testing.T) {
+	m := NewKeyedMutex(0)
+	counts := make([]int, 8)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 1000; n++ {
+				key := uint64(n % len(counts))
+				m.Lock(key)
+				counts[key]++
+				m.Unlock(key)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, count := range counts {
+		require.Equal(t, 1000, count)
+	}
+}
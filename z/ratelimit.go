@@ -0,0 +1,81 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package z
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimiter is a token bucket: it allows rate events per second on average,
+// with bursts of up to burst events. It's lock-free and doesn't need a
+// goroutine to refill the bucket, so it's cheap enough to be checked on hot
+// paths. A nil *RateLimiter allows everything.
+type RateLimiter struct {
+	// interval is the time it takes to get a new token, in nanoseconds.
+	interval int64
+	// capacity is the time it takes to fill the bucket, in nanoseconds.
+	capacity int64
+	// tat is the time up to which the tokens have been taken: tokens accrue
+	// from then on, up to capacity.
+	tat atomic.Int64
+	now func() int64
+}
+
+// NewRateLimiter returns a RateLimiter allowing rate events per second, in
+// bursts of up to burst events. It panics if rate isn't positive or burst is
+// lower than 1.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 || burst < 1 {
+		panic("RateLimiter needs a positive rate and a burst of at least 1")
+	}
+	interval := int64(math.Max(1, float64(time.Second)/rate))
+	r := &RateLimiter{
+		interval: interval,
+		capacity: interval * int64(burst),
+		now:      NanoTime,
+	}
+	r.tat.Store(math.MinInt64 / 2)
+	return r
+}
+
+// Allow takes a token, and returns false if there's none left.
+func (r *RateLimiter) Allow() bool {
+	return r.AllowN(1)
+}
+
+// AllowN takes n tokens at once, and returns false, without taking any, if
+// there are fewer than n left.
+func (r *RateLimiter) AllowN(n int) bool {
+	if r == nil {
+		return true
+	}
+	now := r.now()
+	cost := r.interval * int64(n)
+	for {
+		tat := r.tat.Load()
+		// A bucket that has been full for a while doesn't get any fuller.
+		start := max(tat, now-r.capacity)
+		next := start + cost
+		if next > now {
+			return false
+		}
+		if r.tat.CompareAndSwap(tat, next) {
+			return true
+		}
+	}
+}
+
+// Tokens returns the number of tokens left.
+func (r *RateLimiter) Tokens() int {
+	if r == nil {
+		return math.MaxInt
+	}
+	now := r.now()
+	start := max(r.tat.Load(), now-r.capacity)
+	return int((now - start) / r.interval)
+}
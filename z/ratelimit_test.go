@@ -0,0 +1,78 @@
+/*
+ * SPDX-FileCopyrightText: © Hypermode Inc. <hello@hypermode.com>
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package z
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock makes r use a clock that only moves with the returned function.
+func fakeClock(r *RateLimiter) (advance func(d time.Duration)) {
+	var now atomic.Int64
+	now.Store(int64(time.Hour))
+	r.now = now.Load
+	return func(d time.Duration) { now.Add(int64(d)) }
+}
+
+func TestRateLimiter(t *testing.T) {
+	r := NewRateLimiter(10, 5)
+	advance := fakeClock(r)
+
+	require.Equal(t, 5, r.Tokens())
+	for i := 0; i < 5; i++ {
+		require.True(t, r.Allow())
+	}
+	require.False(t, r.Allow())
+	require.Equal(t, 0, r.Tokens())
+
+	advance(100 * time.Millisecond)
+	require.True(t, r.Allow())
+	require.False(t, r.Allow())
+
+	// The bucket doesn't hold more than burst tokens.
+	advance(time.Hour)
+	require.Equal(t, 5, r.Tokens())
+	require.False(t, r.AllowN(6))
+	require.True(t, r.AllowN(3))
+	require.Equal(t, 2, r.Tokens())
+}
+
+func TestRateLimiterConcurrent(t *testing.T) {
+	r := NewRateLimiter(1, 100)
+	fakeClock(r)
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if r.Allow() {
+					allowed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int64(100), allowed.Load())
+}
+
+func TestRateLimiterNil(t *testing.T) {
+	var r *RateLimiter
+	require.True(t, r.Allow())
+	require.True(t, r.AllowN(1000))
+}
+
+func TestRateLimiterInvalid(t *testing.T) {
+	require.Panics(t, func() { NewRateLimiter(0, 1) })
+	require.Panics(t, func() { NewRateLimiter(1, 0) })
+}
@@ -61,6 +61,18 @@ func MemHashString(str string) uint64 {
 	return uint64(memhash(ss.str, 0, uintptr(ss.len)))
 }
 
+// MemHashSeed is MemHash with the given seed.
+func MemHashSeed(data []byte, seed uint64) uint64 {
+	ss := (*stringStruct)(unsafe.Pointer(&data))
+	return uint64(memhash(ss.str, uintptr(seed), uintptr(ss.len)))
+}
+
+// MemHashStringSeed is MemHashString with the given seed.
+func MemHashStringSeed(str string, seed uint64) uint64 {
+	ss := (*stringStruct)(unsafe.Pointer(&str))
+	return uint64(memhash(ss.str, uintptr(seed), uintptr(ss.len)))
+}
+
 // FastRand is a fast thread local random function.
 //
 //go:linkname FastRand runtime.fastrand
@@ -47,6 +47,53 @@ func KeyToHash[K Key](key K) (uint64, uint64) {
 	}
 }
 
+// SeededKeyToHash returns a KeyToHash that mixes seed into the hashes, so that
+// keys colliding with one seed, or falling into the same shard of a cache,
+// don't with another one. Unlike with KeyToHash, integer keys aren't their own
+// hash. The hashes of a given key only stay the same for a given seed.
+func SeededKeyToHash[K Key](seed uint64) func(K) (uint64, uint64) {
+	return func(key K) (uint64, uint64) {
+		keyAsAny := any(key)
+		switch k := keyAsAny.(type) {
+		case uint64:
+			return mix64(k ^ seed), 0
+		case string:
+			var d xxhash.Digest
+			d.ResetWithSeed(seed)
+			_, _ = d.WriteString(k)
+			return MemHashStringSeed(k, seed), d.Sum64()
+		case []byte:
+			var d xxhash.Digest
+			d.ResetWithSeed(seed)
+			_, _ = d.Write(k)
+			return MemHashSeed(k, seed), d.Sum64()
+		case byte:
+			return mix64(uint64(k) ^ seed), 0
+		case int:
+			return mix64(uint64(k) ^ seed), 0
+		case int32:
+			return mix64(uint64(k) ^ seed), 0
+		case uint32:
+			return mix64(uint64(k) ^ seed), 0
+		case int64:
+			return mix64(uint64(k) ^ seed), 0
+		default:
+			panic("Key type not supported")
+		}
+	}
+}
+
+// mix64 is the finalizer of SplitMix64. It's a bijection, so distinct integer
+// keys keep distinct hashes.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
 var (
 	dummyCloserChan <-chan struct{}
 	tmpDir          string
@@ -43,6 +43,31 @@ func TestKeyToHash(t *testing.T) {
 	verifyHashProduct(t, 3, 0, key, conflict)
 }
 
+func TestSeededKeyToHash(t *testing.T) {
+	h1, h2 := SeededKeyToHash[string](1), SeededKeyToHash[string](2)
+	key1, conflict1 := h1("foo")
+	key, conflict := h1("foo")
+	verifyHashProduct(t, key1, conflict1, key, conflict)
+	key, conflict = h2("foo")
+	require.NotEqual(t, key1, key)
+	require.NotEqual(t, conflict1, conflict)
+
+	b1 := SeededKeyToHash[[]byte](1)
+	key, conflict = b1([]byte("foo"))
+	verifyHashProduct(t, key1, conflict1, key, conflict)
+
+	i1, i2 := SeededKeyToHash[int](1), SeededKeyToHash[int](2)
+	key1, conflict1 = i1(1)
+	require.NotEqual(t, uint64(1), key1)
+	require.Zero(t, conflict1)
+	key, _ = i2(1)
+	require.NotEqual(t, key1, key)
+	key, _ = i1(2)
+	require.NotEqual(t, key1, key)
+
+	require.Zero(t, testing.AllocsPerRun(100, func() { h1("foo") }))
+}
+
 func TestMulipleSignals(t *testing.T) {
 	closer := NewCloser(0)
 	require.NotPanics(t, func() { closer.Signal() })